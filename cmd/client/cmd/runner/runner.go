@@ -7,18 +7,23 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
 
 	clientpkg "github.com/lcensies/ssnproj/pkg/client"
+	"github.com/lcensies/ssnproj/pkg/protocol"
 	"go.uber.org/zap"
 )
 
 // RunClient starts the client and connects to the server
-func RunClient(ctx context.Context, host string, port string, serverPubKey *rsa.PublicKey, logger *zap.Logger) error {
+func RunClient(ctx context.Context, host string, port string, serverPubKey *rsa.PublicKey, logger *zap.Logger, opts ...clientpkg.ClientOption) error {
 	var client *clientpkg.Client
 	var err error
 
-	client, err = clientpkg.NewClient(ctx, host, port, serverPubKey, logger)
+	client, err = clientpkg.NewClient(ctx, host, port, serverPubKey, logger, opts...)
 	if err != nil {
 		return fmt.Errorf("failed to create client: %w", err)
 	}
@@ -33,11 +38,21 @@ func RunClient(ctx context.Context, host string, port string, serverPubKey *rsa.
 
 	logger.Info("Handshake completed successfully")
 
-	// Start interactive CLI
-	return runInteractiveCLI(ctx, client, logger)
+	// Record the server build in the log so bug reports include both versions
+	if _, err := client.ServerVersion(ctx); err != nil {
+		logger.Warn("Failed to query server version", zap.Error(err))
+	}
+
+	// Cache the server's limits so oversized uploads are refused before sending
+	if _, err := client.ServerInfo(ctx); err != nil {
+		logger.Warn("Failed to query server limits", zap.Error(err))
+	}
+
+	// Start interactive CLI, which reconnects if the server restarts mid-session
+	return runInteractiveCLI(ctx, clientpkg.NewReconnectingClient(client), logger)
 }
 
-func runInteractiveCLI(ctx context.Context, client *clientpkg.Client, logger *zap.Logger) error {
+func runInteractiveCLI(ctx context.Context, client *clientpkg.ReconnectingClient, logger *zap.Logger) error {
 	reader := bufio.NewReader(os.Stdin)
 
 	printHelp()
@@ -58,7 +73,7 @@ func runInteractiveCLI(ctx context.Context, client *clientpkg.Client, logger *za
 	}
 }
 
-func processCommand(ctx context.Context, client *clientpkg.Client, logger *zap.Logger, reader *bufio.Reader) error {
+func processCommand(ctx context.Context, client *clientpkg.ReconnectingClient, logger *zap.Logger, reader *bufio.Reader) error {
 	fmt.Print("\n> ")
 	input, err := reader.ReadString('\n')
 	if err != nil {
@@ -81,9 +96,21 @@ func processCommand(ctx context.Context, client *clientpkg.Client, logger *zap.L
 	case "download", "dl":
 		handleDownload(ctx, client, logger, parts)
 	case "list", "ls":
-		handleList(ctx, client, logger)
+		handleList(ctx, client, logger, parts)
+	case "mkdir":
+		handleMkdir(ctx, client, logger, parts)
 	case "delete", "del", "rm":
 		handleDelete(ctx, client, logger, parts, reader)
+	case "rename", "mv":
+		handleRename(ctx, client, logger, parts)
+	case "copy", "cp":
+		handleCopy(ctx, client, logger, parts)
+	case "restore":
+		handleRestore(ctx, client, logger, parts)
+	case "empty-trash":
+		handleEmptyTrash(ctx, client, logger, reader)
+	case "usage", "du":
+		handleUsage(ctx, client, logger)
 	case "exit", "quit", "q":
 		fmt.Println("Goodbye!")
 		return fmt.Errorf("exit")
@@ -94,21 +121,58 @@ func processCommand(ctx context.Context, client *clientpkg.Client, logger *zap.L
 	return nil
 }
 
-func handleUpload(ctx context.Context, client *clientpkg.Client, logger *zap.Logger, parts []string) {
+func handleUpload(ctx context.Context, client *clientpkg.ReconnectingClient, logger *zap.Logger, parts []string) {
 	if len(parts) < 2 {
-		fmt.Println("Usage: upload <filename>")
+		fmt.Println("Usage: upload <filename> [remote_path] | upload <file1> <file2> ...")
+		return
+	}
+	// Two names are a file and its remote path unless the second is a local file too
+	if len(parts) > 3 || (len(parts) == 3 && isLocalFile(parts[2])) {
+		handleUploadBatch(ctx, client, logger, parts[1:])
 		return
 	}
 	filename := parts[1]
-	if err := client.UploadFile(ctx, filename); err != nil {
+	remoteName := filepath.Base(filename)
+	if len(parts) >= 3 {
+		remoteName = parts[2]
+	}
+	progress := &progressLine{}
+	stats, err := client.UploadFileWithStats(ctx, filename, remoteName, progress.update)
+	progress.end()
+	if err != nil {
 		fmt.Printf("Error uploading file: %v\n", err)
 		logger.Error("upload failed", zap.Error(err))
 	} else {
-		fmt.Printf("✓ File '%s' uploaded successfully\n", filename)
+		fmt.Printf("✓ File '%s' %s\n", filename, formatTransfer("uploaded", stats))
 	}
 }
 
-func handleDownload(ctx context.Context, client *clientpkg.Client, logger *zap.Logger, parts []string) {
+// isLocalFile reports whether path names an existing regular file
+func isLocalFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// handleUploadBatch uploads several files over the session, reporting each one
+func handleUploadBatch(ctx context.Context, client *clientpkg.ReconnectingClient, logger *zap.Logger, filenames []string) {
+	results, err := client.UploadFiles(ctx, filenames)
+	var failed int
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			fmt.Printf("✗ %s: %v\n", result.Filename, result.Err)
+			logger.Error("upload failed", zap.String("filename", result.Filename), zap.Error(result.Err))
+		} else {
+			fmt.Printf("✓ %s\n", result.Filename)
+		}
+	}
+	if err != nil {
+		fmt.Printf("Batch upload interrupted: %v\n", err)
+	}
+	fmt.Printf("Uploaded %d of %d files\n", len(results)-failed, len(results))
+}
+
+func handleDownload(ctx context.Context, client *clientpkg.ReconnectingClient, logger *zap.Logger, parts []string) {
 	if len(parts) < 2 {
 		fmt.Println("Usage: download <filename> [output_path]")
 		return
@@ -122,16 +186,56 @@ func handleDownload(ctx context.Context, client *clientpkg.Client, logger *zap.L
 		outputPath = filepath.Base(filename)
 	}
 
-	if err := client.DownloadFile(ctx, filename, outputPath); err != nil {
+	progress := &progressLine{}
+	stats, err := client.DownloadFileWithStats(ctx, filename, outputPath, progress.update)
+	progress.end()
+	if err != nil {
 		fmt.Printf("Error downloading file: %v\n", err)
 		logger.Error("download failed", zap.Error(err))
 	} else {
-		fmt.Printf("✓ File downloaded to '%s'\n", outputPath)
+		fmt.Printf("✓ File downloaded to '%s': %s\n", outputPath, formatTransfer("received", stats))
 	}
 }
 
-func handleList(ctx context.Context, client *clientpkg.Client, logger *zap.Logger) {
-	fileList, err := client.ListFiles(ctx)
+// progressLine keeps a transfer's progress on a single, rewritten terminal line
+type progressLine struct {
+	printed bool
+}
+
+// update is a clientpkg.ProgressFunc printing a live percentage, or the byte count
+// while the total is unknown
+func (p *progressLine) update(transferred, total uint64) {
+	if total == 0 && transferred == 0 {
+		return
+	}
+	if total == 0 {
+		fmt.Printf("\r  %d bytes", transferred)
+	} else {
+		fmt.Printf("\r  %3d%% (%d of %d bytes)", transferred*100/total, transferred, total)
+	}
+	p.printed = true
+}
+
+// end moves past the progress line, if one was printed
+func (p *progressLine) end() {
+	if p.printed {
+		fmt.Println()
+	}
+}
+
+func handleList(ctx context.Context, client *clientpkg.ReconnectingClient, logger *zap.Logger, parts []string) {
+	// ls [-R] [directory]
+	var dir string
+	var recursive bool
+	for _, arg := range parts[1:] {
+		if arg == "-R" || arg == "-r" {
+			recursive = true
+		} else {
+			dir = arg
+		}
+	}
+
+	files, err := client.ListDir(ctx, dir, recursive)
 	if err != nil {
 		fmt.Printf("Error listing files: %v\n", err)
 		logger.Error("list failed", zap.Error(err))
@@ -139,22 +243,59 @@ func handleList(ctx context.Context, client *clientpkg.Client, logger *zap.Logge
 	}
 	fmt.Println("\nFiles on server:")
 	fmt.Println("================")
-	if fileList == "" {
+	if len(files) == 0 {
 		fmt.Println("(no files)")
+		return
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "SIZE\tMODIFIED\tNAME")
+	for _, file := range files {
+		size := strconv.FormatInt(file.Size, 10)
+		name := file.Name
+		// Names with newlines or other control characters would break the table
+		if strings.ContainsFunc(name, unicode.IsControl) {
+			name = strconv.Quote(name)
+		}
+		if file.IsDir {
+			size = "<dir>"
+			name += "/"
+		}
+		modified := time.Unix(file.ModTime, 0).Format("2006-01-02 15:04")
+		fmt.Fprintf(table, "%s\t%s\t%s\n", size, modified, name)
+	}
+	table.Flush()
+}
+
+func handleMkdir(ctx context.Context, client *clientpkg.ReconnectingClient, logger *zap.Logger, parts []string) {
+	if len(parts) < 2 {
+		fmt.Println("Usage: mkdir <path>")
+		return
+	}
+	path := parts[1]
+
+	if err := client.MakeDir(ctx, path); err != nil {
+		fmt.Printf("Error creating directory: %v\n", err)
+		logger.Error("mkdir failed", zap.Error(err))
 	} else {
-		fmt.Println(fileList)
+		fmt.Printf("✓ Directory '%s' created\n", path)
 	}
 }
 
-func handleDelete(ctx context.Context, client *clientpkg.Client, logger *zap.Logger, parts []string, reader *bufio.Reader) {
+func handleDelete(ctx context.Context, client *clientpkg.ReconnectingClient, logger *zap.Logger, parts []string, reader *bufio.Reader) {
 	if len(parts) < 2 {
-		fmt.Println("Usage: delete <filename>")
+		fmt.Println("Usage: delete <filename|pattern>")
 		return
 	}
 	filename := parts[1]
+	pattern := protocol.IsGlobPattern(filename)
 
 	// Confirm deletion
-	fmt.Printf("Are you sure you want to delete '%s'? (y/n): ", filename)
+	if pattern {
+		fmt.Printf("Are you sure you want to delete all files matching '%s'? (y/n): ", filename)
+	} else {
+		fmt.Printf("Are you sure you want to delete '%s'? (y/n): ", filename)
+	}
 	confirm, _ := reader.ReadString('\n')
 	confirm = strings.TrimSpace(strings.ToLower(confirm))
 
@@ -163,6 +304,17 @@ func handleDelete(ctx context.Context, client *clientpkg.Client, logger *zap.Log
 		return
 	}
 
+	if pattern {
+		deleted, err := client.DeleteFiles(ctx, filename)
+		if err != nil {
+			fmt.Printf("Error deleting files: %v\n", err)
+			logger.Error("delete failed", zap.Error(err))
+		} else {
+			fmt.Printf("✓ Deleted %d files matching '%s'\n", deleted, filename)
+		}
+		return
+	}
+
 	if err := client.DeleteFile(ctx, filename); err != nil {
 		fmt.Printf("Error deleting file: %v\n", err)
 		logger.Error("delete failed", zap.Error(err))
@@ -171,19 +323,125 @@ func handleDelete(ctx context.Context, client *clientpkg.Client, logger *zap.Log
 	}
 }
 
+func handleRename(ctx context.Context, client *clientpkg.ReconnectingClient, logger *zap.Logger, parts []string) {
+	if len(parts) < 3 {
+		fmt.Println("Usage: rename <filename> <new_filename>")
+		return
+	}
+	oldName, newName := parts[1], parts[2]
+
+	if err := client.RenameFile(ctx, oldName, newName); err != nil {
+		fmt.Printf("Error renaming file: %v\n", err)
+		logger.Error("rename failed", zap.Error(err))
+	} else {
+		fmt.Printf("✓ File '%s' renamed to '%s'\n", oldName, newName)
+	}
+}
+
+func handleCopy(ctx context.Context, client *clientpkg.ReconnectingClient, logger *zap.Logger, parts []string) {
+	if len(parts) < 3 {
+		fmt.Println("Usage: copy <filename> <new_filename>")
+		return
+	}
+	src, dst := parts[1], parts[2]
+
+	if err := client.CopyFile(ctx, src, dst); err != nil {
+		fmt.Printf("Error copying file: %v\n", err)
+		logger.Error("copy failed", zap.Error(err))
+	} else {
+		fmt.Printf("✓ File '%s' copied to '%s'\n", src, dst)
+	}
+}
+
+func handleRestore(ctx context.Context, client *clientpkg.ReconnectingClient, logger *zap.Logger, parts []string) {
+	if len(parts) < 2 {
+		fmt.Println("Usage: restore <filename>")
+		return
+	}
+	filename := parts[1]
+
+	if err := client.RestoreFile(ctx, filename); err != nil {
+		fmt.Printf("Error restoring file: %v\n", err)
+		logger.Error("restore failed", zap.Error(err))
+	} else {
+		fmt.Printf("✓ File '%s' restored from the trash\n", filename)
+	}
+}
+
+func handleEmptyTrash(ctx context.Context, client *clientpkg.ReconnectingClient, logger *zap.Logger, reader *bufio.Reader) {
+	fmt.Print("Are you sure you want to permanently delete everything in the trash? (y/n): ")
+	confirm, _ := reader.ReadString('\n')
+	confirm = strings.TrimSpace(strings.ToLower(confirm))
+
+	if confirm != "y" && confirm != "yes" {
+		fmt.Println("Empty trash cancelled")
+		return
+	}
+
+	purged, err := client.EmptyTrash(ctx)
+	if err != nil {
+		fmt.Printf("Error emptying trash: %v\n", err)
+		logger.Error("empty trash failed", zap.Error(err))
+	} else {
+		fmt.Printf("✓ Purged %d files from the trash\n", purged)
+	}
+}
+
+func handleUsage(ctx context.Context, client *clientpkg.ReconnectingClient, logger *zap.Logger) {
+	used, quota, err := client.Usage(ctx)
+	if err != nil {
+		fmt.Printf("Error getting usage: %v\n", err)
+		logger.Error("usage failed", zap.Error(err))
+		return
+	}
+	if quota > 0 {
+		fmt.Printf("%s / %s used\n", formatBytes(used), formatBytes(quota))
+	} else {
+		fmt.Printf("%s used (no quota)\n", formatBytes(used))
+	}
+}
+
+// formatBytes renders a size with a decimal unit, e.g. "12.3 MB"
+func formatBytes(size int64) string {
+	const unit = 1000
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size) / unit
+	suffixes := []string{"KB", "MB", "GB", "TB"}
+	i := 0
+	for value >= unit && i < len(suffixes)-1 {
+		value /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", value, suffixes[i])
+}
+
+// formatTransfer describes a finished transfer, e.g. "uploaded 10.0 MB in 1.2s (8.3 MB/s)"
+func formatTransfer(verb string, stats clientpkg.TransferStats) string {
+	return fmt.Sprintf("%s %s in %.1fs (%.1f MB/s)", verb, formatBytes(int64(stats.Bytes)), stats.Duration.Seconds(), stats.ThroughputMBps)
+}
+
 func printHelp() {
 	fmt.Println("\n╔══════════════════════════════════════════════════════════════╗")
 	fmt.Println("║          Secure File Transfer Client - Commands             ║")
 	fmt.Println("╚══════════════════════════════════════════════════════════════╝")
 	fmt.Println()
-	fmt.Println("  upload <filename>              Upload a file to the server")
+	fmt.Println("  upload <filename> [remote]     Upload a file to the server")
+	fmt.Println("  upload <file1> <file2> ...     Upload several files, reporting each")
 	fmt.Println("  download <filename> [output]   Download a file from the server")
-	fmt.Println("  list                           List all files on the server")
-	fmt.Println("  delete <filename>              Delete a file from the server")
+	fmt.Println("  list [-R] [dir|pattern]        List files on the server, e.g. ls logs/*.log")
+	fmt.Println("  mkdir <path>                   Create a directory on the server")
+	fmt.Println("  delete <filename|pattern>      Delete files from the server, e.g. rm *.tmp")
+	fmt.Println("  rename <filename> <new_name>   Rename a file on the server")
+	fmt.Println("  copy <filename> <new_name>     Copy a file on the server")
+	fmt.Println("  restore <filename>             Bring a deleted file back from the trash")
+	fmt.Println("  empty-trash                    Permanently delete the files in the trash")
+	fmt.Println("  usage                          Show storage used and the quota")
 	fmt.Println("  help                           Show this help message")
 	fmt.Println("  exit                           Disconnect and exit")
 	fmt.Println()
 	fmt.Println("Aliases:")
-	fmt.Println("  up = upload  |  dl = download  |  ls = list  |  rm/del = delete")
+	fmt.Println("  up = upload  |  dl = download  |  ls = list  |  rm/del = delete  |  mv = rename  |  cp = copy  |  du = usage")
 	fmt.Println()
 }
@@ -11,6 +11,8 @@ import (
 
 	"github.com/joho/godotenv"
 	runner "github.com/lcensies/ssnproj/cmd/client/cmd/runner"
+	clientpkg "github.com/lcensies/ssnproj/pkg/client"
+	"github.com/lcensies/ssnproj/pkg/protocol"
 	"go.uber.org/zap"
 )
 
@@ -20,6 +22,10 @@ var (
 	host            string
 	port            string
 	debug           bool
+	namespace       string
+	identityDir     string
+	downloadStreams int
+	adaptiveChunks  bool
 	serverPubKeyPem string
 )
 
@@ -34,6 +40,10 @@ func init() {
 	flag.StringVar(&host, "host", "localhost", "host to connect to")
 	flag.StringVar(&port, "port", "8080", "port to connect to")
 	flag.BoolVar(&debug, "debug", false, "enable debug logging")
+	flag.StringVar(&namespace, "namespace", "", "share a server directory with other clients using this namespace and identity (requires -identity)")
+	flag.StringVar(&identityDir, "identity", os.Getenv("CLIENT_IDENTITY_DIR"), "directory holding a long-lived client key; keeps uploaded files available across reconnects")
+	flag.IntVar(&downloadStreams, "streams", 1, "number of parallel connections used for each download")
+	flag.BoolVar(&adaptiveChunks, "adaptive-chunks", false, "adapt the download chunk size to the throughput observed")
 	flag.Parse()
 
 	logger, err = zap.NewProduction()
@@ -55,8 +65,26 @@ func main() {
 		logger.Error("failed to parse server public key", zap.Error(err))
 		return
 	}
-	logger.Info("Starting the client...")
-	if err := runner.RunClient(ctx, host, port, rsaPubKey, logger); err != nil {
+	logger.Info("Starting the client...", zap.String("version", protocol.Version))
+	var opts []clientpkg.ClientOption
+	if namespace != "" {
+		opts = append(opts, clientpkg.WithNamespace(namespace))
+	}
+	if downloadStreams > 1 {
+		opts = append(opts, clientpkg.WithDownloadStreams(downloadStreams))
+	}
+	if adaptiveChunks {
+		opts = append(opts, clientpkg.WithAdaptiveChunkSize())
+	}
+	if identityDir != "" {
+		identity, err := clientpkg.LoadOrCreateClientIdentity(identityDir)
+		if err != nil {
+			logger.Error("failed to load client identity", zap.Error(err))
+			return
+		}
+		opts = append(opts, clientpkg.WithIdentity(identity))
+	}
+	if err := runner.RunClient(ctx, host, port, rsaPubKey, logger, opts...); err != nil {
 		logger.Error("error running client", zap.Error(err))
 		return
 	}
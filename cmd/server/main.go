@@ -1,64 +1,62 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/lcensies/ssnproj/pkg/server"
 	"go.uber.org/zap"
 )
 
-const (
-	// Default values
-	defaultHost         = "localhost"
-	defaultPort         = "8080"
-	defaultConfigFolder = "configs/server"
-	defaultRootDir      = "data"
-)
+// shutdownTimeout bounds how long connected sessions may take to finish on shutdown
+const shutdownTimeout = 30 * time.Second
 
-// Config holds the server configuration
-type Config struct {
-	Host         string
-	Port         string
-	ConfigFolder string
-	RootDir      string
-	LogLevel     string
+// flagSettings maps command-line flags to the configuration settings they set
+var flagSettings = map[string]string{
+	"host":      "host",
+	"port":      "port",
+	"config":    "config_folder",
+	"root-dir":  "root_dir",
+	"log-level": "log_level",
 }
 
-// loadConfig loads configuration from environment variables and command-line flags
-func loadConfig() *Config {
-	config := &Config{}
+// loadConfig resolves the configuration from, in increasing precedence, the defaults,
+// the configuration file, environment variables and command-line flags
+func loadConfig() (*server.ServerConfig, error) {
+	defaults := server.DefaultServerConfig()
 
 	// Define command-line flags
-	host := flag.String("host", getEnvOrDefault("SERVER_HOST", defaultHost), "Server host address")
-	port := flag.String("port", getEnvOrDefault("SERVER_PORT", defaultPort), "Server port")
-	configFolder := flag.String("config", getEnvOrDefault("SERVER_CONFIG_FOLDER", defaultConfigFolder), "Configuration folder path")
-	rootDir := flag.String("root-dir", getEnvOrDefault("SERVER_ROOT_DIR", defaultRootDir), "Root directory for file operations")
-	logLevel := flag.String("log-level", getEnvOrDefault("SERVER_LOG_LEVEL", "info"), "Log level (debug, info, warn, error)")
+	configFile := flag.String("config-file", os.Getenv("SERVER_CONFIG_FILE"), "Configuration file (YAML or JSON)")
+	flag.String("host", defaults.Host, "Server host address")
+	flag.String("port", defaults.Port, "Server port")
+	flag.String("config", defaults.ConfigFolder, "Configuration folder path")
+	flag.String("root-dir", *defaults.RootDir, "Root directory for file operations, or :memory: to keep files in memory")
+	flag.String("log-level", defaults.LogLevel, "Log level (debug, info, warn, error)")
 
 	// Parse command-line flags
 	flag.Parse()
 
-	// Set configuration values
-	config.Host = *host
-	config.Port = *port
-	config.ConfigFolder = *configFolder
-	config.RootDir = *rootDir
-	config.LogLevel = *logLevel
-
-	return config
-}
-
-// getEnvOrDefault returns the value of an environment variable or a default value
-func getEnvOrDefault(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+	config, err := server.LoadServerConfig(*configFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.ApplyEnv(os.LookupEnv); err != nil {
+		return nil, err
 	}
-	return defaultValue
+
+	// Only flags given on the command line override the other layers
+	flag.Visit(func(f *flag.Flag) {
+		if name, ok := flagSettings[f.Name]; ok && err == nil {
+			err = config.Set(name, f.Value.String())
+		}
+	})
+	return config, err
 }
 
 // createLogger creates a logger based on the log level
@@ -85,7 +83,7 @@ func createLogger(logLevel string) (*zap.Logger, error) {
 }
 
 // validateConfig validates the configuration
-func validateConfig(config *Config) error {
+func validateConfig(config *server.ServerConfig) error {
 	if config.Host == "" {
 		return fmt.Errorf("host cannot be empty")
 	}
@@ -95,19 +93,19 @@ func validateConfig(config *Config) error {
 	if config.ConfigFolder == "" {
 		return fmt.Errorf("config folder cannot be empty")
 	}
-	if config.RootDir == "" {
+	if config.RootDir == nil || *config.RootDir == "" {
 		return fmt.Errorf("root directory cannot be empty")
 	}
 	return nil
 }
 
 // printConfig prints the current configuration
-func printConfig(config *Config, logger *zap.Logger) {
+func printConfig(config *server.ServerConfig, logger *zap.Logger) {
 	logger.Info("Server configuration",
 		zap.String("host", config.Host),
 		zap.String("port", config.Port),
 		zap.String("config_folder", config.ConfigFolder),
-		zap.String("root_dir", config.RootDir),
+		zap.String("root_dir", *config.RootDir),
 		zap.String("log_level", config.LogLevel),
 	)
 }
@@ -120,6 +118,10 @@ func printUsage() {
 	fmt.Println("  go run cmd/server/main.go [flags]")
 	fmt.Println("")
 	fmt.Println("Flags:")
+	fmt.Println("  -config-file string")
+	fmt.Println("        Configuration file (YAML or JSON); flags and environment variables override it")
+	fmt.Println("        Environment variable: SERVER_CONFIG_FILE")
+	fmt.Println("")
 	fmt.Println("  -host string")
 	fmt.Println("        Server host address (default: localhost)")
 	fmt.Println("        Environment variable: SERVER_HOST")
@@ -149,6 +151,7 @@ func printUsage() {
 	fmt.Println("  SERVER_CONFIG_FOLDER - Configuration folder path")
 	fmt.Println("  SERVER_ROOT_DIR     - Root directory for file operations")
 	fmt.Println("  SERVER_LOG_LEVEL    - Log level")
+	fmt.Println("  SERVER_<SETTING>    - Any configuration file setting, e.g. SERVER_IDLE_TIMEOUT")
 	fmt.Println("")
 	fmt.Println("Examples:")
 	fmt.Println("  # Run with default settings")
@@ -162,6 +165,9 @@ func printUsage() {
 	fmt.Println("")
 	fmt.Println("  # Run with custom config and data directories")
 	fmt.Println("  go run cmd/server/main.go -config /etc/ssnproj -root-dir /var/lib/ssnproj")
+	fmt.Println("")
+	fmt.Println("  # Run from a configuration file, overriding its port")
+	fmt.Println("  go run cmd/server/main.go -config-file server.yaml -port 9000")
 }
 
 func main() {
@@ -172,7 +178,10 @@ func main() {
 	}
 
 	// Load configuration
-	config := loadConfig()
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
 
 	// Create logger
 	logger, err := createLogger(config.LogLevel)
@@ -189,17 +198,9 @@ func main() {
 	// Print configuration
 	printConfig(config, logger)
 
-	// Create server configuration
-	serverConfig := &server.ServerConfig{
-		Host:         config.Host,
-		Port:         config.Port,
-		ConfigFolder: config.ConfigFolder,
-		RootDir:      &config.RootDir,
-		Logger:       logger,
-	}
-
 	// Create server
-	srv, err := server.NewServer(serverConfig)
+	config.Logger = logger
+	srv, err := server.NewServer(config)
 	if err != nil {
 		logger.Fatal("Failed to create server", zap.Error(err))
 	}
@@ -209,17 +210,26 @@ func main() {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	// Start server in a goroutine
+	runErr := make(chan error, 1)
 	go func() {
 		logger.Info("Starting server",
 			zap.String("address", fmt.Sprintf("%s:%s", config.Host, config.Port)))
-		srv.Run()
+		runErr <- srv.Run()
 	}()
 
-	// Wait for shutdown signal
-	sig := <-sigChan
-	logger.Info("Received shutdown signal", zap.String("signal", sig.String()))
+	// Wait for shutdown signal, or for the server to fail on its own
+	select {
+	case sig := <-sigChan:
+		logger.Info("Received shutdown signal", zap.String("signal", sig.String()))
+	case err := <-runErr:
+		logger.Fatal("Server stopped", zap.Error(err))
+	}
 	logger.Info("Shutting down server...")
 
-	// Here you could add cleanup logic if needed
-	// For now, the server will stop when the main goroutine exits
+	// Let connected sessions, e.g. uploads in progress, finish before exiting
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warn("Shutdown did not complete cleanly", zap.Error(err))
+	}
 }
@@ -5,9 +5,16 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"errors"
+	"fmt"
 	"io"
 )
 
+// Errors returned by Decrypt for ciphertexts too short to be valid
+var (
+	ErrCiphertextTooShort = errors.New("ciphertext too short")
+	ErrMissingAuthTag     = errors.New("ciphertext missing authentication tag")
+)
+
 // Encrypt encrypts data using AES-GCM
 func Encrypt(plaintext []byte, key []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
@@ -45,7 +52,12 @@ func Decrypt(ciphertext []byte, key []byte) ([]byte, error) {
 
 	nonceSize := aesGCM.NonceSize()
 	if len(ciphertext) < nonceSize {
-		return nil, errors.New("ciphertext too short")
+		return nil, ErrCiphertextTooShort
+	}
+
+	// Every sealed message carries a full tag after the nonce, even for empty plaintext
+	if len(ciphertext) < nonceSize+aesGCM.Overhead() {
+		return nil, ErrMissingAuthTag
 	}
 
 	// Extract nonce and ciphertext
@@ -60,7 +72,15 @@ func Decrypt(ciphertext []byte, key []byte) ([]byte, error) {
 
 // GenerateKey generates a random AES-256 key
 func GenerateKey() ([]byte, error) {
-	key := make([]byte, 32) // 256 bits
+	return GenerateKeyBits(256)
+}
+
+// GenerateKeyBits generates a random AES key of 128, 192 or 256 bits
+func GenerateKeyBits(bits int) ([]byte, error) {
+	if bits != 128 && bits != 192 && bits != 256 {
+		return nil, fmt.Errorf("invalid AES key size: %d bits", bits)
+	}
+	key := make([]byte, bits/8)
 	if _, err := io.ReadFull(rand.Reader, key); err != nil {
 		return nil, err
 	}
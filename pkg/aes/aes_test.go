@@ -57,7 +57,25 @@ func TestDecryptInvalidCiphertext(t *testing.T) {
 	// Too short ciphertext
 	shortCiphertext := []byte("short")
 	_, err = Decrypt(shortCiphertext, key)
-	assert.Error(t, err, "Should fail with short ciphertext")
+	assert.ErrorIs(t, err, ErrCiphertextTooShort, "Should fail with short ciphertext")
+}
+
+func TestDecryptTruncatedTag(t *testing.T) {
+	key, err := GenerateKey()
+	assert.NoError(t, err)
+
+	ciphertext, err := Encrypt([]byte("payload"), key)
+	assert.NoError(t, err)
+
+	// A nonce with no tag at all
+	_, err = Decrypt(ciphertext[:12], key)
+	assert.ErrorIs(t, err, ErrMissingAuthTag)
+
+	// Even an empty plaintext seals to nonce + 16-byte tag; anything shorter is truncated
+	sealedEmpty, err := Encrypt(nil, key)
+	assert.NoError(t, err)
+	_, err = Decrypt(sealedEmpty[:len(sealedEmpty)-1], key)
+	assert.ErrorIs(t, err, ErrMissingAuthTag)
 }
 
 func TestEncryptEmptyData(t *testing.T) {
@@ -0,0 +1,86 @@
+package entity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+)
+
+// abortTimeout bounds the wait for the server to answer CommandAbort
+const abortTimeout = 10 * time.Second
+
+// errAborting stops the chunk loop once the download's context has ended, see
+// receiveFileChunks
+var errAborting = errors.New("aborting download")
+
+// downloadAbort sends CommandAbort when a download's context ends
+type downloadAbort struct {
+	stopSend func() bool
+	sent     chan struct{}
+	// err is the failure to send the abort, set before sent is closed
+	err error
+	// received is the first message read after the context ended, not yet looked at
+	received *protocol.Message
+}
+
+// abortOnCancel sends CommandAbort as soon as ctx ends, from a goroutine of its own, so
+// the server stops the download the caller is receiving. The caller holds the exchange.
+func (c *Client) abortOnCancel(ctx context.Context) *downloadAbort {
+	abort := &downloadAbort{sent: make(chan struct{})}
+	abort.stopSend = context.AfterFunc(ctx, func() {
+		defer close(abort.sent)
+		abort.err = c.sendAbort()
+	})
+	return abort
+}
+
+// stop keeps the abort from being sent and reports whether it was, waiting for the send
+// to finish if so
+func (abort *downloadAbort) stop() bool {
+	if abort.stopSend() {
+		return false
+	}
+	<-abort.sent
+	return true
+}
+
+func (c *Client) sendAbort() error {
+	cmdPayload, err := protocol.SerializeCommand(protocol.CommandAbort, "", nil)
+	if err != nil {
+		return fmt.Errorf(errSerializeCommand, err)
+	}
+	return c.SendSecureMessage(protocol.NewMessage(protocol.MessageTypeCommand, cmdPayload))
+}
+
+// awaitAbort reads past the chunks and responses the server sent before it saw the
+// abort, up to the abort's own response. A connection that fails meanwhile is closed,
+// since it is out of step with the server.
+func (c *Client) awaitAbort(ctx context.Context, abort *downloadAbort) error {
+	if abort.err != nil {
+		c.conn.Close()
+		return fmt.Errorf("failed to send abort: %w", abort.err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), abortTimeout)
+	defer cancel()
+	message := abort.received
+	for {
+		if message == nil {
+			var err error
+			if message, err = c.ReceiveSecureMessage(ctx); err != nil {
+				c.conn.Close()
+				return fmt.Errorf("failed to receive abort response: %w", err)
+			}
+		}
+		if message.Type == protocol.MessageTypeResponse {
+			respMsg, err := protocol.DeserializeResponse(message.Payload)
+			if err == nil && respMsg.Message == protocol.AbortMessage {
+				return nil
+			}
+		}
+		message = nil
+	}
+}
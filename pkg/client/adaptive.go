@@ -0,0 +1,77 @@
+package entity
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+)
+
+const (
+	// adaptiveChunkStep is how much the adaptive chunk size grows after a download
+	// that kept up its throughput
+	adaptiveChunkStep = protocol.SmallChunkSize
+	// adaptiveThroughputDrop is the fraction of the previous download's throughput
+	// below which the adaptive chunk size is halved
+	adaptiveThroughputDrop = 0.75
+	// adaptiveQueueingDelay is how far the round trip may rise above the shortest one
+	// seen before the link counts as congested
+	adaptiveQueueingDelay = 100 * time.Millisecond
+)
+
+// chunkController picks the chunk size for download requests, AIMD style: every
+// download that keeps up throughput grows it by adaptiveChunkStep, and one whose
+// throughput falls, whose round trip swells or whose connection is lost halves it.
+// It stays within the protocol's chunk size bounds.
+type chunkController struct {
+	mu         sync.Mutex
+	size       uint32
+	throughput float64
+	minRTT     time.Duration
+}
+
+func newChunkController() *chunkController {
+	return &chunkController{size: protocol.SmallChunkSize}
+}
+
+// current returns the chunk size to request next
+func (cc *chunkController) current() uint32 {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.size
+}
+
+// observe adjusts the chunk size after a completed download and returns the new one.
+// A download of a single chunk says nothing about chunk sizes and is ignored.
+func (cc *chunkController) observe(stats TransferStats) uint32 {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if stats.Chunks < 2 || stats.Duration <= 0 {
+		return cc.size
+	}
+
+	throughput := float64(stats.Bytes) / stats.Duration.Seconds()
+	congested := throughput < cc.throughput*adaptiveThroughputDrop
+	if stats.RTT > 0 {
+		if cc.minRTT == 0 || stats.RTT < cc.minRTT {
+			cc.minRTT = stats.RTT
+		}
+		congested = congested || stats.RTT-cc.minRTT > adaptiveQueueingDelay
+	}
+	cc.throughput = throughput
+
+	if congested {
+		cc.size = max(cc.size/2, protocol.SmallChunkSize)
+	} else {
+		cc.size = min(cc.size+adaptiveChunkStep, protocol.MaxChunkSize)
+	}
+	return cc.size
+}
+
+// backOff halves the chunk size after a download lost its connection
+func (cc *chunkController) backOff() uint32 {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.size = max(cc.size/2, protocol.SmallChunkSize)
+	return cc.size
+}
@@ -0,0 +1,44 @@
+package entity
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunkController(t *testing.T) {
+	steady := TransferStats{Bytes: 1e6, Duration: time.Second, Chunks: 10, RTT: 10 * time.Millisecond}
+
+	cc := newChunkController()
+	assert.Equal(t, uint32(protocol.SmallChunkSize), cc.current())
+
+	// Steady throughput grows the size additively, up to the maximum
+	assert.Equal(t, uint32(2*protocol.SmallChunkSize), cc.observe(steady))
+	assert.Equal(t, uint32(3*protocol.SmallChunkSize), cc.observe(steady))
+	for i := 0; i < 10; i++ {
+		cc.observe(steady)
+	}
+	assert.Equal(t, uint32(protocol.MaxChunkSize), cc.current())
+
+	// A throughput drop halves it
+	slow := steady
+	slow.Duration = 2 * time.Second
+	assert.Equal(t, uint32(protocol.MaxChunkSize/2), cc.observe(slow))
+
+	// So does a round trip swollen by queueing, even at the same throughput
+	queued := slow
+	queued.RTT = steady.RTT + 2*adaptiveQueueingDelay
+	assert.Equal(t, uint32(protocol.MaxChunkSize/4), cc.observe(queued))
+
+	// A single chunk says nothing about chunk sizes
+	single := steady
+	single.Chunks = 1
+	assert.Equal(t, uint32(protocol.MaxChunkSize/4), cc.observe(single))
+
+	// A lost connection halves it, never below the minimum
+	assert.Equal(t, uint32(protocol.MaxChunkSize/8), cc.backOff())
+	assert.Equal(t, uint32(protocol.SmallChunkSize), cc.backOff())
+	assert.Equal(t, uint32(protocol.SmallChunkSize), cc.backOff())
+}
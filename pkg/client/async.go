@@ -0,0 +1,191 @@
+package entity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// UploadAsync uploads a file under its base name without waiting for the server's
+// acknowledgement. The file is streamed in chunks like UploadFile; the call returns
+// once the last chunk is sent. The returned channel receives exactly one value: nil on
+// success or the upload error. Acknowledgements are collected in order by a background
+// receiver, so several uploads can be in flight at once. Synchronous operations wait
+// for outstanding uploads to drain before using the connection.
+func (c *Client) UploadAsync(ctx context.Context, filename string) <-chan error {
+	result := make(chan error, 1)
+
+	if err := ctx.Err(); err != nil {
+		result <- err
+		return result
+	}
+
+	remoteName := filepath.Base(filename)
+	c.logger.Info("Uploading file asynchronously", zap.String("filename", remoteName))
+
+	file, size, modTime, err := openUploadFile(filename)
+	if err != nil {
+		result <- err
+		return result
+	}
+	defer file.Close()
+
+	if err := c.checkUploadLimits(remoteName, max(size, 0)); err != nil {
+		result <- err
+		return result
+	}
+	cmdPayload, err := c.uploadCommand(remoteName, size, modTime, true)
+	if err != nil {
+		result <- err
+		return result
+	}
+
+	// exchangeMu keeps other frames off the connection until the last chunk is sent.
+	// Responses are matched to waiters in the order the commands hit the wire.
+	c.exchangeMu.Lock()
+	defer c.exchangeMu.Unlock()
+
+	// The server answers once it is ready for chunks, after acknowledging the uploads
+	// before this one
+	ready := make(chan error, 1)
+	c.asyncMu.Lock()
+	msg := protocol.NewMessage(protocol.MessageTypeCommand, cmdPayload)
+	if err := c.SendSecureMessage(msg); err != nil {
+		c.asyncMu.Unlock()
+		result <- fmt.Errorf("failed to send upload command: %w", err)
+		return result
+	}
+	c.queueAsync(func(response *protocol.Message, err error) {
+		if err == nil {
+			err = c.checkReadyResponse(response)
+		}
+		ready <- err
+	})
+	c.asyncMu.Unlock()
+
+	if err := <-ready; err != nil {
+		result <- err
+		return result
+	}
+
+	var sendErr error
+	if size >= 0 {
+		sendErr = c.sendFileChunks(ctx, remoteName, file, uint64(size), nil, nil)
+	} else {
+		sendErr = c.sendStreamChunks(ctx, remoteName, file, nil, nil)
+	}
+	if errors.Is(sendErr, errSendFailed) {
+		result <- sendErr
+		return result
+	}
+
+	// The server reports the outcome after the last chunk, even when the stream was cut short
+	c.asyncMu.Lock()
+	c.queueAsync(func(response *protocol.Message, err error) {
+		switch {
+		case err != nil:
+			result <- err
+		case sendErr != nil:
+			result <- sendErr
+		default:
+			result <- c.checkUploadResponse(response)
+		}
+	})
+	c.asyncMu.Unlock()
+
+	return result
+}
+
+// asyncWaiter takes the next response read by the background receiver, or the error
+// that ended the stream
+type asyncWaiter func(response *protocol.Message, err error)
+
+// queueAsync adds waiter for the next unclaimed response, starting the background
+// receiver if it is not running. The caller holds asyncMu.
+func (c *Client) queueAsync(waiter asyncWaiter) {
+	c.asyncPending = append(c.asyncPending, waiter)
+	if c.asyncIdle == nil {
+		c.asyncIdle = make(chan struct{})
+		go c.receiveAsyncAcks()
+	}
+}
+
+// checkReadyResponse checks the server's answer to a chunked upload command
+func (c *Client) checkReadyResponse(response *protocol.Message) error {
+	if response.Type != protocol.MessageTypeResponse {
+		return fmt.Errorf(errUnexpectedResponse, response.Type)
+	}
+	respMsg, err := protocol.DeserializeResponse(response.Payload)
+	if err != nil {
+		return fmt.Errorf(errDeserializeResponse, err)
+	}
+	if !respMsg.Success {
+		return responseError("upload", respMsg)
+	}
+	return nil
+}
+
+// receiveAsyncAcks delivers responses to the pending waiters until none are left
+func (c *Client) receiveAsyncAcks() {
+	for {
+		c.asyncMu.Lock()
+		if len(c.asyncPending) == 0 {
+			close(c.asyncIdle)
+			c.asyncIdle = nil
+			c.asyncMu.Unlock()
+			return
+		}
+		c.asyncMu.Unlock()
+
+		// Acknowledgements outlive the callers' contexts; DefaultReadTimeout bounds each one
+		response, err := c.ReceiveSecureMessage(context.Background())
+		if err != nil {
+			// The stream is unusable, fail everything still waiting
+			c.failAsyncPending(fmt.Errorf(errReceiveResponse, err))
+			continue
+		}
+
+		c.asyncMu.Lock()
+		waiter := c.asyncPending[0]
+		c.asyncPending = c.asyncPending[1:]
+		c.asyncMu.Unlock()
+
+		waiter(response, nil)
+	}
+}
+
+// failAsyncPending hands err to all pending waiters
+func (c *Client) failAsyncPending(err error) {
+	c.asyncMu.Lock()
+	pending := c.asyncPending
+	c.asyncPending = nil
+	c.asyncMu.Unlock()
+
+	for _, waiter := range pending {
+		waiter(nil, err)
+	}
+}
+
+// waitForAsync blocks until all asynchronous uploads have been acknowledged
+func (c *Client) waitForAsync() {
+	c.asyncMu.Lock()
+	idle := c.asyncIdle
+	c.asyncMu.Unlock()
+
+	if idle != nil {
+		<-idle
+	}
+}
+
+// lockExchange waits for asynchronous uploads to drain and takes exclusive use of the
+// connection for one request/response exchange. Call the returned function to release it.
+// New asynchronous uploads also need exchangeMu, so none can start while it is held.
+func (c *Client) lockExchange() func() {
+	c.exchangeMu.Lock()
+	c.waitForAsync()
+	return c.exchangeMu.Unlock
+}
@@ -0,0 +1,42 @@
+package entity
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+// UploadResult reports the outcome of one file of UploadFiles
+type UploadResult struct {
+	Filename string
+	// Err is nil when the file was uploaded
+	Err error
+}
+
+// UploadFiles uploads each file under its base name over the current session, like
+// UploadFile, and reports every file's outcome in order. A failed file does not stop
+// the others. The returned error is only set when ctx ends the batch early, in which
+// case the files not attempted carry the context's error.
+func (c *Client) UploadFiles(ctx context.Context, filenames []string) ([]UploadResult, error) {
+	results := make([]UploadResult, len(filenames))
+	var failed int
+	for i, filename := range filenames {
+		results[i].Filename = filename
+		if err := ctx.Err(); err != nil {
+			for j := i; j < len(filenames); j++ {
+				results[j] = UploadResult{Filename: filenames[j], Err: err}
+			}
+			return results, err
+		}
+		if err := c.UploadFile(ctx, filename); err != nil {
+			c.logger.Warn("Upload in batch failed", zap.String("filename", filename), zap.Error(err))
+			results[i].Err = err
+			failed++
+		}
+	}
+
+	c.logger.Info("Batch upload finished",
+		zap.Int("files", len(filenames)),
+		zap.Int("failed", failed))
+	return results, nil
+}
@@ -1,14 +1,27 @@
 package entity
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	aesutil "github.com/lcensies/ssnproj/pkg/aes"
@@ -23,7 +36,7 @@ const (
 	// This prevents memory exhaustion attacks
 	MaxPayloadSize = (4 * 1024 * 1024 * 1024) - 1
 
-	// DefaultReadTimeout is the default timeout for read operations
+	// DefaultReadTimeout bounds each read when the operation's context has no deadline
 	DefaultReadTimeout = 30 * time.Second
 )
 
@@ -41,58 +54,165 @@ type Client struct {
 	logger       *zap.Logger
 	serverPubKey *rsa.PublicKey
 	aesKey       []byte
+	compression  bool
+	namespace    string
+	dialer       net.Dialer
+	// addr is the server's host:port, for reconnecting
+	addr string
+
+	// maxDownloadBytes limits DownloadBytes, see WithMaxDownloadBytes
+	maxDownloadBytes int64
+	// maxDownloadSize limits the other downloads, see WithMaxDownloadSize
+	maxDownloadSize int64
+	// downloadStreams is the number of connections DownloadFile uses, see WithDownloadStreams
+	downloadStreams int
+	// sessionKeyBits is the AES session key size, 256 when zero
+	sessionKeyBits int
+	// skipDownloadVerification turns off whole-file checksum checks, see WithDownloadVerification
+	skipDownloadVerification bool
+	// identity is the long-lived key pair sent in the handshake, see WithIdentity
+	identity *rsautil.RSAKeyPair
+	// preferredChunkSize is asked of the server for downloads, see SetPreferredChunkSize
+	preferredChunkSize uint32
+	// chunkControl adapts the download chunk size, see WithAdaptiveChunkSize
+	chunkControl *chunkController
+	// protocolVersion is the wire revision agreed in the handshake
+	protocolVersion uint16
+	// tlsConfig replaces the RSA/AES handshake with TLS, see WithTLS
+	tlsConfig *tls.Config
+	// serverInfo caches the limits returned by ServerInfo for local pre-validation
+	serverInfo atomic.Pointer[ServerInfo]
+	// retry governs reconnecting after connection failures, see WithRetryPolicy
+	retry RetryPolicy
+	// keepAliveInterval paces heartbeat pings on an idle connection, see WithKeepAliveInterval
+	keepAliveInterval time.Duration
+	// stopKeepAlive ends the heartbeat started after the handshake
+	stopKeepAlive context.CancelFunc
+	// lastActive is when the connection last carried a message, in Unix nanoseconds
+	lastActive atomic.Int64
+
+	// exchangeMu serializes whole request/response exchanges so a Client can be
+	// shared between goroutines without interleaving frames on the connection
+	exchangeMu sync.Mutex
+
+	// Asynchronous upload state, see UploadAsync
+	asyncMu      sync.Mutex
+	asyncPending []asyncWaiter
+	asyncIdle    chan struct{}
 }
 
 // NewClient creates a new client
-func NewClient(ctx context.Context, host string, port string, serverPubKey *rsa.PublicKey, logger *zap.Logger) (*Client, error) {
-	var dialer net.Dialer
-	conn, err := dialer.DialContext(ctx, "tcp", fmt.Sprintf("%s:%s", host, port))
+func NewClient(ctx context.Context, host string, port string, serverPubKey *rsa.PublicKey, logger *zap.Logger, opts ...ClientOption) (*Client, error) {
+	c := &Client{
+		logger:       logger,
+		serverPubKey: serverPubKey,
+		addr:         net.JoinHostPort(host, port),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	conn, err := c.dial(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to server: %w", err)
+		return nil, err
 	}
+	c.conn = conn
 
-	return &Client{
-		conn:         conn,
-		logger:       logger,
-		serverPubKey: serverPubKey,
-	}, nil
+	return c, nil
 }
 
-// NewClientWithServerPubKey creates a new client with server's public key loaded from file
-func NewClientWithServerPubKey(ctx context.Context, host string, port string, serverPubKeyPath string, logger *zap.Logger) (*Client, error) {
-	var dialer net.Dialer
-	conn, err := dialer.DialContext(ctx, "tcp", fmt.Sprintf("%s:%s", host, port))
+// dial opens a connection to the server, over TLS when configured
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if c.tlsConfig != nil {
+		tlsDialer := &tls.Dialer{NetDialer: &c.dialer, Config: c.tlsConfig}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", c.addr)
+	} else {
+		conn, err = c.dialer.DialContext(ctx, "tcp", c.addr)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to server: %w", err)
 	}
+	return conn, nil
+}
 
+// NewClientWithServerPubKey creates a new client with server's public key loaded from file
+func NewClientWithServerPubKey(ctx context.Context, host string, port string, serverPubKeyPath string, logger *zap.Logger, opts ...ClientOption) (*Client, error) {
 	// Load server's public key from file
 	serverPubKeyBytes, err := os.ReadFile(serverPubKeyPath)
 	if err != nil {
-		conn.Close()
 		return nil, fmt.Errorf("failed to read server public key: %w", err)
 	}
 
 	serverPubKey := rsautil.BytesToPublicKey(serverPubKeyBytes)
 
-	return &Client{
-		conn:         conn,
-		logger:       logger,
-		serverPubKey: serverPubKey,
-	}, nil
+	return NewClient(ctx, host, port, serverPubKey, logger, opts...)
 }
 
-// Close closes the client connection
+// Close closes the client connection. Servers from protocol.ProtocolVersionClose on are
+// told first, so they end the session cleanly; that is skipped while another call is
+// using the connection, which Close then interrupts.
 func (c *Client) Close(ctx context.Context) error {
+	if c.stopKeepAlive != nil {
+		c.stopKeepAlive()
+	}
 	if c.conn != nil {
+		c.sendClose()
+		// The heartbeat may have closed a dead connection already
 		err := c.conn.Close()
-		if err != nil {
+		if err != nil && !errors.Is(err, net.ErrClosed) {
 			return fmt.Errorf("failed to close connection: %w", err)
 		}
 	}
 	return nil
 }
 
+// closeTimeout bounds sending CommandClose, so Close does not hang on a stalled connection
+const closeTimeout = time.Second
+
+// sendClose tells the server the session is ending. Failures are ignored: the server
+// copes with a connection that just closes.
+func (c *Client) sendClose() {
+	if c.protocolVersion < protocol.ProtocolVersionClose || !c.exchangeMu.TryLock() {
+		return
+	}
+	defer c.exchangeMu.Unlock()
+
+	cmdPayload, err := protocol.SerializeCommand(protocol.CommandClose, "", nil)
+	if err != nil {
+		return
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	if err := c.SendSecureMessage(protocol.NewMessage(protocol.MessageTypeCommand, cmdPayload)); err != nil {
+		c.logger.Debug("Failed to send close command", zap.Error(err))
+	}
+}
+
+// SetCompression enables or disables compression of responses that support it (currently file listings)
+func (c *Client) SetCompression(enabled bool) {
+	c.compression = enabled
+}
+
+// SetPreferredChunkSize asks the server to send downloads in chunks of size bytes, which
+// it bounds to its supported range (see ServerInfo). Zero restores the server's choice by
+// file size. Servers older than protocol revision 4 ignore it.
+func (c *Client) SetPreferredChunkSize(size uint32) {
+	c.preferredChunkSize = size
+}
+
+// requestedChunkSize returns the chunk size to put in download requests, zero when none
+// is set or the server cannot take one
+func (c *Client) requestedChunkSize() uint32 {
+	if c.wireVersion() < protocol.ProtocolVersionChunkSize {
+		return 0
+	}
+	if c.chunkControl != nil {
+		return c.chunkControl.current()
+	}
+	return c.preferredChunkSize
+}
+
 // SendMessage sends a protocol message
 func (c *Client) SendMessage(msg *protocol.Message) error {
 	data, err := msg.Serialize()
@@ -104,17 +224,22 @@ func (c *Client) SendMessage(msg *protocol.Message) error {
 	if err != nil {
 		return fmt.Errorf("failed to send message: %w", err)
 	}
+	c.markActive()
 
 	return nil
 }
 
-// ReceiveMessage receives a protocol message (unencrypted - used for handshake only)
-func (c *Client) ReceiveMessage() (*protocol.Message, error) {
+// ReceiveMessage receives a protocol message (unencrypted - used for handshake only).
+// The read gives up at ctx's deadline, or after DefaultReadTimeout without one, and as
+// soon as ctx is cancelled.
+func (c *Client) ReceiveMessage(ctx context.Context) (*protocol.Message, error) {
+	defer c.watchRead(ctx)()
+
 	// Read header (1 byte type + 4 bytes length)
 	header := make([]byte, 5)
 	_, err := io.ReadFull(c.conn, header)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read message header: %w", err)
+		return nil, readError(ctx, "failed to read message header", err)
 	}
 
 	// Read payload
@@ -130,18 +255,24 @@ func (c *Client) ReceiveMessage() (*protocol.Message, error) {
 	if payloadLen > 0 {
 		_, err = io.ReadFull(c.conn, payload)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read message payload: %w", err)
+			return nil, readError(ctx, "failed to read message payload", err)
 		}
 	}
 
+	c.markActive()
+
 	return &protocol.Message{
 		Type:    msgType,
 		Payload: payload,
 	}, nil
 }
 
-// SendSecureMessage sends an AES-encrypted protocol message
+// SendSecureMessage sends an AES-encrypted protocol message, or the message as is over TLS
 func (c *Client) SendSecureMessage(msg *protocol.Message) error {
+	if c.tlsConfig != nil {
+		return c.SendMessage(msg)
+	}
+
 	// Encrypt the payload with AES
 	encryptedPayload, err := aesutil.Encrypt(msg.Payload, c.aesKey)
 	if err != nil {
@@ -153,13 +284,17 @@ func (c *Client) SendSecureMessage(msg *protocol.Message) error {
 	return c.SendMessage(encryptedMsg)
 }
 
-// ReceiveSecureMessage receives and decrypts an AES-encrypted protocol message
-func (c *Client) ReceiveSecureMessage() (*protocol.Message, error) {
+// ReceiveSecureMessage receives and decrypts an AES-encrypted protocol message, giving
+// up like ReceiveMessage
+func (c *Client) ReceiveSecureMessage(ctx context.Context) (*protocol.Message, error) {
 	// Receive encrypted message
-	encryptedMsg, err := c.ReceiveMessage()
+	encryptedMsg, err := c.ReceiveMessage(ctx)
 	if err != nil {
 		return nil, err
 	}
+	if c.tlsConfig != nil {
+		return encryptedMsg, nil
+	}
 
 	// Decrypt the payload
 	decryptedPayload, err := aesutil.Decrypt(encryptedMsg.Payload, c.aesKey)
@@ -173,32 +308,92 @@ func (c *Client) ReceiveSecureMessage() (*protocol.Message, error) {
 	}, nil
 }
 
-// PerformHandshake performs RSA key exchange with the server
+// PerformHandshake performs RSA key exchange with the server. Over TLS (WithTLS) the
+// connection is already secure and no messages are exchanged. The heartbeat set by
+// WithKeepAliveInterval starts once the session is established.
 func (c *Client) PerformHandshake(ctx context.Context) error {
+	err := c.performHandshake(ctx)
+	if err == nil {
+		c.startKeepAlive()
+	}
+	return err
+}
+
+// performHandshake establishes the session for PerformHandshake
+func (c *Client) performHandshake(ctx context.Context) error {
+	c.exchangeMu.Lock()
+	defer c.exchangeMu.Unlock()
+
+	if c.tlsConfig != nil {
+		return c.startTLSSession()
+	}
+
 	c.logger.Info("Starting RSA handshake...")
 
 	// Step 1: Generate AES key
-	aesKey, err := aesutil.GenerateKey()
+	keyBits := c.sessionKeyBits
+	if keyBits == 0 {
+		keyBits = 256
+	}
+	aesKey, err := aesutil.GenerateKeyBits(keyBits)
 	if err != nil {
 		return fmt.Errorf("failed to generate AES key: %w", err)
 	}
 	c.aesKey = aesKey
 	c.logger.Info("Generated AES session key", zap.Int("key_length", len(c.aesKey)))
 
+	return c.exchangeHandshake(ctx)
+}
+
+// exchangeHandshake sends c.aesKey to the server and checks its signed confirmation
+func (c *Client) exchangeHandshake(ctx context.Context) error {
 	// Step 2: Encrypt AES key with server's public key
-	encryptedAESKey := rsautil.EncryptWithPublicKey(c.aesKey, c.serverPubKey)
+	encryptedAESKey, err := rsautil.EncryptOAEP(c.aesKey, c.serverPubKey)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt session key: %w", err)
+	}
 	c.logger.Info("Encrypted AES key with server's public key")
 
-	// Step 3: Send encrypted AES key to server
-	handshakeMsg := protocol.NewMessage(protocol.MessageTypeHandshake, encryptedAESKey)
+	// Step 3: Send encrypted AES key to server, with any session options encrypted under it.
+	// The nonce is signed by the server so we know it holds the private key we trust.
+	nonce := make([]byte, protocol.HandshakeNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate handshake nonce: %w", err)
+	}
+	request := &protocol.HandshakeRequest{EncryptedKey: encryptedAESKey}
+	options := &protocol.HandshakeOptions{
+		Namespace:       c.namespace,
+		ProtocolVersion: protocol.ProtocolVersion,
+		Nonce:           nonce,
+	}
+	if c.identity != nil {
+		if err := c.signIdentity(options, encryptedAESKey); err != nil {
+			return err
+		}
+	}
+	optionBytes, err := protocol.SerializeHandshakeOptions(options)
+	if err != nil {
+		return fmt.Errorf("failed to serialize handshake options: %w", err)
+	}
+	request.Options, err = aesutil.Encrypt(optionBytes, c.aesKey)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt handshake options: %w", err)
+	}
+	handshakePayload, err := protocol.SerializeHandshakeRequest(request)
+	if err != nil {
+		return fmt.Errorf("failed to serialize handshake: %w", err)
+	}
+	handshakeMsg := protocol.NewMessage(protocol.MessageTypeHandshake, handshakePayload)
 	if err := c.SendMessage(handshakeMsg); err != nil {
 		return fmt.Errorf("failed to send encrypted AES key: %w", err)
 	}
 
 	c.logger.Info("Sent encrypted AES key to server")
 
-	// Step 4: Wait for server's handshake confirmation
-	response, err := c.ReceiveMessage()
+	// Step 4: Wait for server's handshake confirmation, encrypted with the session key.
+	// Only a server that decrypted our AES key can produce it, so a forged plaintext
+	// confirmation fails authentication here.
+	response, err := c.ReceiveMessage(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to receive handshake confirmation: %w", err)
 	}
@@ -207,40 +402,405 @@ func (c *Client) PerformHandshake(ctx context.Context) error {
 		return fmt.Errorf("unexpected message type: %v (expected response)", response.Type)
 	}
 
-	c.logger.Info("Received handshake confirmation - handshake complete")
+	if err := response.Decrypt(c.aesKey); err != nil {
+		// A server that cannot use our key refuses in the clear. Such a refusal is not
+		// authenticated, but it can only fail a handshake an attacker could drop anyway.
+		if respMsg, parseErr := protocol.DeserializeResponse(response.Payload); parseErr == nil && !respMsg.Success {
+			return fmt.Errorf("handshake rejected: %s", respMsg.Message)
+		}
+		return fmt.Errorf("handshake confirmation failed verification: %w", err)
+	}
+
+	respMsg, err := protocol.DeserializeResponse(response.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to deserialize handshake confirmation: %w", err)
+	}
+
+	if !respMsg.Success {
+		return fmt.Errorf("handshake rejected: %s", respMsg.Message)
+	}
+
+	// Data is the negotiated version (2 bytes) followed by the server's signature over
+	// our nonce, the wrapped session key and that version
+	if len(respMsg.Data) <= 2 {
+		return errors.New("handshake confirmation is not signed by the server")
+	}
+	version := binary.BigEndian.Uint16(respMsg.Data[:2])
+	digest := protocol.HandshakeSignatureDigest(nonce, encryptedAESKey, version)
+	if err := rsa.VerifyPSS(c.serverPubKey, crypto.SHA256, digest, respMsg.Data[2:], rsautil.PSSOptions()); err != nil {
+		return fmt.Errorf("handshake signature verification failed: %w", err)
+	}
+	c.protocolVersion = protocol.NegotiateProtocolVersion(version)
+
+	c.logger.Info("Received handshake confirmation - handshake complete",
+		zap.Uint16("protocol_version", c.protocolVersion))
+
+	return nil
+}
 
+// signIdentity adds the client's identity key and its signature over this session's
+// wrapped key to the handshake options
+func (c *Client) signIdentity(options *protocol.HandshakeOptions, encryptedKey []byte) error {
+	identityKey, err := x509.MarshalPKIXPublicKey(&c.identity.Private.PublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to encode identity key: %w", err)
+	}
+	digest := protocol.ClientIdentityDigest(encryptedKey)
+	signature, err := rsa.SignPSS(rand.Reader, c.identity.Private, crypto.SHA256, digest, rsautil.PSSOptions())
+	if err != nil {
+		return fmt.Errorf("failed to sign identity: %w", err)
+	}
+	options.IdentityKey = identityKey
+	options.IdentitySignature = signature
 	return nil
 }
 
-// UploadFile uploads a file to the server
+// UploadFile uploads a file to the server under its base name, replacing any file
+// already stored there. From protocol.ProtocolVersionModTime on the stored file keeps
+// the local file's modification time, as do the other uploads of local files.
 func (c *Client) UploadFile(ctx context.Context, filename string) error {
-	c.logger.Info("Uploading file", zap.String("filename", filename))
+	// Send just the basename of the file, not the full path
+	return c.UploadFileAs(ctx, filename, filepath.Base(filename), nil)
+}
+
+// UploadFileNoClobber uploads a file to the server under its base name unless a file
+// with that name already exists, in which case it fails with ErrFileExists and the
+// stored file is left untouched. Servers before protocol.ProtocolVersionNoClobber
+// cannot honour this, so it fails with ErrUnsupported without uploading.
+func (c *Client) UploadFileNoClobber(ctx context.Context, filename string) error {
+	return c.uploadFile(ctx, filename, filepath.Base(filename), false, nil, nil)
+}
 
-	// Read file
-	fileData, err := os.ReadFile(filename)
+// UploadFileAs uploads a file to the server as remoteName, which may name a file in
+// an existing directory, e.g. "docs/report.txt". A non-nil progress is told how much
+// has been sent after every chunk.
+func (c *Client) UploadFileAs(ctx context.Context, filename string, remoteName string, progress ProgressFunc) error {
+	return c.uploadFile(ctx, filename, remoteName, true, progress, nil)
+}
+
+// UploadFileTo uploads a file to remotePath, first creating the directories along it
+// that are missing. A remotePath ending in "/" names a directory, and the file keeps
+// its local name inside it. A non-nil progress is told how much has been sent after
+// every chunk.
+func (c *Client) UploadFileTo(ctx context.Context, localPath string, remotePath string, progress ProgressFunc) error {
+	if strings.HasSuffix(remotePath, "/") {
+		remotePath += filepath.Base(localPath)
+	}
+	if dir := path.Dir(remotePath); dir != "." {
+		// Storage backends without a directory tree refuse mkdir; their directories
+		// exist as soon as they hold a file
+		if err := c.MakeDir(ctx, dir); err != nil && !errors.Is(err, ErrUnsupported) {
+			return err
+		}
+	}
+	return c.UploadFileAs(ctx, localPath, remotePath, progress)
+}
+
+// UploadFileWithStats is UploadFileAs, also reporting how much was sent and how fast.
+// The stats are only meaningful when the upload succeeds.
+func (c *Client) UploadFileWithStats(ctx context.Context, filename string, remoteName string, progress ProgressFunc) (TransferStats, error) {
+	meter := newTransferMeter()
+	err := c.uploadFile(ctx, filename, remoteName, true, progress, meter)
+	return meter.stats(), err
+}
+
+// ValidateUpload asks the server whether uploading filename under its base name would
+// be accepted: the name, the size limit, the quota and the collision policy are checked
+// as for UploadFile, but nothing is sent or stored. A refusal is returned as the
+// matching error, e.g. ErrInvalidPath or ErrQuotaExceeded. Servers before
+// protocol.ProtocolVersionValidate cannot do this, so it fails with ErrUnsupported.
+func (c *Client) ValidateUpload(ctx context.Context, filename string) error {
+	remoteName := filepath.Base(filename)
+	c.logger.Info("Validating upload", zap.String("filename", remoteName))
+
+	info, err := os.Stat(filename)
 	if err != nil {
 		return fmt.Errorf("failed to read file: %w", err)
 	}
+	if c.wireVersion() < protocol.ProtocolVersionValidate {
+		return fmt.Errorf("upload failed: validation is %w", ErrUnsupported)
+	}
+	// Pipes and devices report no meaningful size
+	request := &protocol.UploadRequest{Overwrite: true, ValidateOnly: true}
+	if info.Mode().IsRegular() {
+		request.Size = uint64(info.Size())
+		if err := c.checkUploadLimits(remoteName, info.Size()); err != nil {
+			return err
+		}
+	} else {
+		request.SizeUnknown = true
+	}
 
-	// Create command message (file data is now included as-is, encryption happens at message level)
-	// Send just the basename of the file, not the full path
-	cmdPayload, err := protocol.SerializeCommand(protocol.CommandUpload, filepath.Base(filename), fileData)
+	respMsg, err := c.runCommand(ctx, protocol.CommandUploadChunk, remoteName, protocol.SerializeUploadRequest(request), "upload")
 	if err != nil {
-		return fmt.Errorf(errSerializeCommand, err)
+		return err
 	}
 
-	// Send encrypted command
+	c.logger.Info("Upload would be accepted", zap.String("stored_as", string(respMsg.Data)))
+	return nil
+}
+
+// uploadFile uploads a file as remoteName, replacing an existing one only if overwrite
+// is set. A non-nil meter counts the chunks sent.
+func (c *Client) uploadFile(ctx context.Context, filename string, remoteName string, overwrite bool, progress ProgressFunc, meter *transferMeter) error {
+	file, size, modTime, err := openUploadFile(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return c.uploadStream(ctx, remoteName, file, size, modTime, overwrite, progress, meter)
+}
+
+// openUploadFile opens filename to be streamed, not read into memory, and returns its
+// size and modification time. Pipes and devices report no meaningful size or
+// modification time, so they get a size of -1 and a zero time.
+func openUploadFile(filename string) (*os.File, int64, time.Time, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, time.Time{}, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, time.Time{}, fmt.Errorf("failed to read file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return file, -1, time.Time{}, nil
+	}
+	return file, info.Size(), info.ModTime(), nil
+}
+
+// UploadStream uploads the contents of r to the server as remoteName. size is the
+// number of bytes r will yield; a reader ending early or holding more fails the upload
+// and the server keeps nothing. A negative size uploads everything up to EOF, for data
+// whose length is not known in advance. A non-nil progress is told how much has been
+// sent after every chunk; see ProgressFunc.
+func (c *Client) UploadStream(ctx context.Context, remoteName string, r io.Reader, size int64, progress ProgressFunc) error {
+	return c.uploadStream(ctx, remoteName, r, size, time.Time{}, true, progress, nil)
+}
+
+// uploadStream is UploadStream, replacing an existing file only if overwrite is set. A
+// non-zero modTime is asked of the stored file when the size is known and the server
+// supports it. A non-nil meter counts the chunks sent.
+func (c *Client) uploadStream(ctx context.Context, remoteName string, r io.Reader, size int64, modTime time.Time, overwrite bool, progress ProgressFunc, meter *transferMeter) error {
+	c.logger.Info("Uploading file", zap.String("filename", remoteName), zap.Int64("size", size), zap.Bool("overwrite", overwrite))
+
+	// Take the connection for the whole exchange once outstanding asynchronous uploads drain
+	defer c.lockExchange()()
+
+	if !overwrite && c.wireVersion() < protocol.ProtocolVersionNoClobber {
+		return fmt.Errorf("upload failed: no-clobber uploads are %w", ErrUnsupported)
+	}
+	if err := c.checkUploadLimits(remoteName, max(size, 0)); err != nil {
+		return err
+	}
+
+	// Announce the upload with its size, if known; the server answers once it is ready for chunks
+	cmdPayload, err := c.uploadCommand(remoteName, size, modTime, overwrite)
+	if err != nil {
+		return err
+	}
 	msg := protocol.NewMessage(protocol.MessageTypeCommand, cmdPayload)
 	if err := c.SendSecureMessage(msg); err != nil {
 		return fmt.Errorf("failed to send upload command: %w", err)
 	}
 
-	// Wait for encrypted response
-	response, err := c.ReceiveSecureMessage()
+	respMsg, err := c.receiveResponse(ctx)
+	if err != nil {
+		return err
+	}
+	if !respMsg.Success {
+		return responseError("upload", respMsg)
+	}
+
+	var sendErr error
+	if size >= 0 {
+		sendErr = c.sendFileChunks(ctx, remoteName, r, uint64(size), progress, meter)
+	} else {
+		sendErr = c.sendStreamChunks(ctx, remoteName, r, progress, meter)
+	}
+	if errors.Is(sendErr, errSendFailed) {
+		return sendErr
+	}
+
+	// The server reports the outcome after the last chunk, even when the stream was cut short
+	response, err := c.ReceiveSecureMessage(ctx)
 	if err != nil {
 		return fmt.Errorf(errReceiveResponse, err)
 	}
+	if sendErr != nil {
+		return sendErr
+	}
+
+	return c.checkUploadResponse(response)
+}
+
+// uploadCommand serializes the command announcing a chunked upload of size bytes, a
+// negative size when it is not known
+func (c *Client) uploadCommand(remoteName string, size int64, modTime time.Time, overwrite bool) ([]byte, error) {
+	request := &protocol.UploadRequest{
+		Size:        uint64(max(size, 0)),
+		SizeUnknown: size < 0,
+		Overwrite:   overwrite,
+	}
+	if !modTime.IsZero() && c.wireVersion() >= protocol.ProtocolVersionModTime {
+		request.ModTime = modTime.UnixNano()
+	}
+	cmdPayload, err := protocol.SerializeCommand(protocol.CommandUploadChunk, remoteName, protocol.SerializeUploadRequest(request))
+	if err != nil {
+		return nil, fmt.Errorf(errSerializeCommand, err)
+	}
+	return cmdPayload, nil
+}
+
+// errSendFailed marks chunk stream errors that leave the connection unusable
+var errSendFailed = errors.New("failed to send upload chunk")
+
+// sendFileChunks streams totalSize bytes of r as data chunks sized with the same
+// heuristic as downloads. If reading stops early (read error, cancelled context, r
+// ending before totalSize or holding more) an empty final chunk ends the stream so the
+// server discards the partial file; the reason is returned. An empty upload has no
+// chunks, so r is not read at all.
+func (c *Client) sendFileChunks(ctx context.Context, name string, r io.Reader, totalSize uint64, progress ProgressFunc, meter *transferMeter) error {
+	chunkSize := protocol.ChunkSizeFor(totalSize)
+	totalChunks := protocol.ChunkCount(totalSize, chunkSize)
+
+	if totalChunks == 0 {
+		progress.report(0, 0)
+		return nil
+	}
+
+	// ReadFull gathers short reads into whole chunks
+	reader := bufio.NewReaderSize(r, int(chunkSize))
+	buffer := make([]byte, chunkSize)
+
+	var stopErr error
+	for i := uint32(0); i < totalChunks; i++ {
+		var n int
+		if stopErr = ctx.Err(); stopErr == nil {
+			want := min(uint64(chunkSize), totalSize-uint64(i)*uint64(chunkSize))
+			n, stopErr = io.ReadFull(reader, buffer[:want])
+			if stopErr != nil {
+				stopErr = fmt.Errorf("failed to read file: %w", stopErr)
+			} else if i == totalChunks-1 {
+				if _, err := reader.Peek(1); err == nil {
+					stopErr = fmt.Errorf("failed to read file: more than the declared %d bytes", totalSize)
+				} else if err != io.EOF {
+					stopErr = fmt.Errorf("failed to read file: %w", err)
+				}
+			}
+		}
+
+		index := i
+		data := buffer[:n]
+		if stopErr != nil {
+			index, data = totalChunks-1, nil
+		}
+
+		if err := c.sendUploadChunk(name, index, totalChunks, totalSize, data); err != nil {
+			return fmt.Errorf("%w %d: %v", errSendFailed, i, err)
+		}
+
+		if stopErr != nil {
+			return stopErr
+		}
+		meter.chunk(n)
+		progress.report(uint64(i)*uint64(chunkSize)+uint64(n), totalSize)
+
+		c.logger.Debug("Sent chunk",
+			zap.String("filename", name),
+			zap.Uint32("chunkIndex", i),
+			zap.Uint32("totalChunks", totalChunks))
+	}
+
+	return nil
+}
+
+// sendStreamChunks streams r up to EOF for an upload announced without a size. Each
+// chunk is read ahead of sending so the last one can be marked: it carries the final
+// index as TotalChunks-1 and the final TotalSize. Earlier chunks claim one more chunk
+// than they know of. A stream that stops early ends with an empty chunk of
+// UploadAbortedSize.
+func (c *Client) sendStreamChunks(ctx context.Context, name string, r io.Reader, progress ProgressFunc, meter *transferMeter) error {
+	chunkSize := protocol.LargeChunkSize
+	reader := bufio.NewReaderSize(r, chunkSize)
+	buffer := make([]byte, chunkSize)
+
+	var sent uint64
+	for i := uint32(0); ; i++ {
+		var n int
+		var last bool
+		stopErr := ctx.Err()
+		if stopErr == nil {
+			n, stopErr = io.ReadFull(reader, buffer)
+			switch {
+			case stopErr == io.EOF || stopErr == io.ErrUnexpectedEOF:
+				stopErr, last = nil, true
+			case stopErr != nil:
+				stopErr = fmt.Errorf("failed to read file: %w", stopErr)
+			default:
+				// A full chunk may still be the last one
+				if _, err := reader.Peek(1); err == io.EOF {
+					last = true
+				} else if err != nil {
+					stopErr = fmt.Errorf("failed to read file: %w", err)
+				}
+			}
+		}
+
+		data := buffer[:n]
+		totalChunks, totalSize := i+2, sent+uint64(n)
+		if last {
+			totalChunks = i + 1
+		}
+		if stopErr != nil {
+			data, totalChunks, totalSize = nil, i+1, protocol.UploadAbortedSize
+		}
+
+		if err := c.sendUploadChunk(name, i, totalChunks, totalSize, data); err != nil {
+			return fmt.Errorf("%w %d: %v", errSendFailed, i, err)
+		}
+		if stopErr != nil {
+			return stopErr
+		}
+		sent += uint64(n)
+		meter.chunk(n)
+		if last {
+			progress.report(sent, sent)
+		} else {
+			progress.report(sent, 0)
+		}
+
+		c.logger.Debug("Sent chunk",
+			zap.String("filename", name),
+			zap.Uint32("chunkIndex", i),
+			zap.Uint64("sent", sent))
+		if last {
+			return nil
+		}
+	}
+}
 
+// sendUploadChunk sends one data chunk of an upload
+func (c *Client) sendUploadChunk(name string, index, totalChunks uint32, totalSize uint64, data []byte) error {
+	chunkPayload, err := protocol.SerializeChunkDataVersion(&protocol.ChunkDataMessage{
+		Filename:    name,
+		ChunkIndex:  index,
+		TotalChunks: totalChunks,
+		ChunkSize:   uint32(len(data)),
+		TotalSize:   totalSize,
+		Data:        data,
+	}, c.wireVersion())
+	if err != nil {
+		return err
+	}
+	return c.SendSecureMessage(protocol.NewMessage(protocol.MessageTypeData, chunkPayload))
+}
+
+// checkUploadResponse validates the server's acknowledgement of an upload
+func (c *Client) checkUploadResponse(response *protocol.Message) error {
 	if response.Type != protocol.MessageTypeResponse {
 		return fmt.Errorf(errUnexpectedResponse, response.Type)
 	}
@@ -251,19 +811,168 @@ func (c *Client) UploadFile(ctx context.Context, filename string) error {
 	}
 
 	if !respMsg.Success {
-		return fmt.Errorf("upload failed: %s", respMsg.Message)
+		return responseError("upload", respMsg)
 	}
 
 	c.logger.Info("File uploaded successfully", zap.String("message", respMsg.Message))
 	return nil
 }
 
-// DownloadFile downloads a file from the server using chunked transfer
-func (c *Client) DownloadFile(ctx context.Context, filename string, outputPath string) error {
+// DownloadFile downloads a file from the server using chunked transfer. When outputPath
+// already holds the start of the file, e.g. from an interrupted download, only the
+// remainder is transferred; a prefix that does not match the server's file is discarded
+// and the download starts over, as is any prefix when the server does not speak transfer
+// v2 (see TransferV2). A non-nil progress is told how much of the file has
+// arrived after every chunk, counting any resumed prefix. It is DownloadToWriter into
+// outputPath, plus resuming and, with WithDownloadStreams, parallel streams, which
+// both need a file to write at offsets.
+func (c *Client) DownloadFile(ctx context.Context, filename string, outputPath string, progress ProgressFunc) error {
+	return c.downloadFile(ctx, filename, outputPath, c.retry, progress, nil)
+}
+
+// DownloadFileResilient is DownloadFile for large transfers over unreliable networks.
+// When the connection fails partway, it reconnects into the same session and resumes
+// from the bytes already written to out, which the server checks against its file
+// before sending the rest. Unless WithDownloadVerification turned it off, the finished
+// file is verified against the server's checksum. Retries follow the client's retry policy, or DefaultResilientRetryPolicy when it has
+// none.
+func (c *Client) DownloadFileResilient(ctx context.Context, name string, out string) error {
+	retry := c.retry
+	if retry.MaxRetries == 0 {
+		retry = DefaultResilientRetryPolicy
+	}
+	return c.downloadFile(ctx, name, out, retry, nil, nil)
+}
+
+// DownloadFileWithStats is DownloadFile, also reporting how much was received and how
+// fast. The stats are only meaningful when the download succeeds.
+func (c *Client) DownloadFileWithStats(ctx context.Context, filename string, outputPath string, progress ProgressFunc) (TransferStats, error) {
+	meter := newTransferMeter()
+	err := c.downloadFile(ctx, filename, outputPath, c.retry, progress, meter)
+	return meter.stats(), err
+}
+
+// downloadFile is DownloadFile, retrying under retry; a non-nil meter counts the chunks
+// received, over every attempt and stream
+func (c *Client) downloadFile(ctx context.Context, filename string, outputPath string, retry RetryPolicy, progress ProgressFunc, meter *transferMeter) error {
+	// Open output file, keeping any partial download
+	_, statErr := os.Stat(outputPath)
+	created := errors.Is(statErr, os.ErrNotExist)
+	file, err := os.OpenFile(outputPath, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer file.Close()
+
+	download := func(resume *resumePoint) error {
+		if c.downloadStreams > 1 && c.tlsConfig == nil {
+			return c.downloadParallel(ctx, filename, file, resume, progress, meter)
+		}
+		return c.downloadTo(ctx, filename, file, c.downloadLimit(), byteRange{}, resume, progress, meter)
+	}
+
+	// A retry after a dropped connection resumes from whatever the failed attempt wrote
+	err = c.withRetryPolicy(ctx, retry, "download", func() error {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind output file: %w", err)
+		}
+		resume, err := resumePointFor(file)
+		if err != nil {
+			return fmt.Errorf("failed to read partial download: %w", err)
+		}
+		if resume != nil && !c.TransferV2() {
+			c.logger.Info("Server cannot resume downloads, starting over", zap.String("filename", filename))
+			if err := file.Truncate(0); err != nil {
+				return fmt.Errorf("failed to truncate output file: %w", err)
+			}
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("failed to rewind output file: %w", err)
+			}
+			resume = nil
+		}
+
+		err = download(resume)
+		if errors.Is(err, errResumeRejected) {
+			c.logger.Warn("Cannot resume download, starting over",
+				zap.String("filename", filename),
+				zap.Error(err))
+			if err := file.Truncate(0); err != nil {
+				return fmt.Errorf("failed to truncate output file: %w", err)
+			}
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("failed to rewind output file: %w", err)
+			}
+			err = download(nil)
+		}
+		return err
+	})
+	if errors.Is(err, ErrDownloadChecksum) || errors.Is(err, ErrDownloadTooLarge) || errors.Is(err, ErrDownloadAborted) {
+		// Never leave corrupted data behind, a later resume would build on it; a refused
+		// or aborted file has nothing worth keeping
+		file.Close()
+		os.Remove(outputPath)
+	} else if err != nil && created {
+		// A download that failed before receiving any data leaves no empty file behind
+		if info, statErr := file.Stat(); statErr == nil && info.Size() == 0 {
+			file.Close()
+			os.Remove(outputPath)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	c.logger.Info("File downloaded successfully", zap.String("output", outputPath))
+	return nil
+}
+
+// downloadTo downloads filename into w. A positive limit fails downloads larger than limit bytes
+// without writing any of their data. A non-nil resume asks the server for the bytes after
+// resume.offset only. Unless verification is disabled, the data is checked against the
+// server's whole-file SHA-256 and a mismatch, or a transfer v2 server sending none,
+// fails with ErrDownloadChecksum. A non-nil
+// progress is told how much of the file w holds after every chunk, and a non-nil meter
+// counts the chunks received. When w is a file,
+// chunks are written at their offsets after any resumed prefix, so they may arrive in
+// any order; other writers need them in order.
+func (c *Client) downloadTo(ctx context.Context, filename string, w io.Writer, limit int64, span byteRange, resume *resumePoint, progress ProgressFunc, meter *transferMeter) error {
 	c.logger.Info("Downloading file", zap.String("filename", filename))
 
+	// Take the connection for the whole exchange once outstanding asynchronous uploads drain
+	defer c.lockExchange()()
+
+	var offset uint64
+	request := &protocol.DownloadRequest{Streams: 1, ChunkSize: c.requestedChunkSize(), RangeStart: span.start, RangeLength: span.length}
+	fileHash := sha256.New()
+	if resume != nil {
+		offset = resume.offset
+		request.Offset, request.PrefixSum = resume.offset, resume.prefixSum
+		// The hash continues from the kept prefix so it covers the whole file
+		fileHash = resume.hash
+		c.logger.Info("Resuming download", zap.String("filename", filename), zap.Uint64("offset", offset))
+	}
+	cmdData := protocol.SerializeDownloadRequest(request)
+
+	// The adaptive chunk size learns from this request alone, whatever meter covers
+	var sample *transferMeter
+	if c.chunkControl != nil && request.ChunkSize > 0 {
+		sample = newTransferMeter()
+	}
+
+	file, seekable := w.(*os.File)
+	var out io.WriterAt
+	if seekable {
+		out = io.NewOffsetWriter(file, int64(offset))
+	} else {
+		out = &sequentialWriterAt{w: w}
+	}
+	hashed := &orderedHashWriterAt{w: out, hash: fileHash, inOrder: true}
+	if !c.skipDownloadVerification {
+		out = hashed
+	}
+
 	// Create command message
-	cmdPayload, err := protocol.SerializeCommand(protocol.CommandDownload, filename, nil)
+	cmdPayload, err := protocol.SerializeCommand(protocol.CommandDownload, filename, cmdData)
 	if err != nil {
 		return fmt.Errorf(errSerializeCommand, err)
 	}
@@ -275,68 +984,141 @@ func (c *Client) DownloadFile(ctx context.Context, filename string, outputPath s
 	}
 
 	// Wait for initial response
-	response, err := c.ReceiveSecureMessage()
+	respMsg, err := c.receiveResponse(ctx)
 	if err != nil {
-		return fmt.Errorf(errReceiveResponse, err)
-	}
-
-	if response.Type != protocol.MessageTypeResponse {
-		return fmt.Errorf(errUnexpectedResponse, response.Type)
-	}
-
-	respMsg, err := protocol.DeserializeResponse(response.Payload)
-	if err != nil {
-		return fmt.Errorf(errDeserializeResponse, err)
+		return err
 	}
+	meter.answered()
+	sample.answered()
 
 	if !respMsg.Success {
-		return fmt.Errorf("download failed: %s", respMsg.Message)
+		if resume != nil && strings.HasPrefix(respMsg.Message, protocol.ResumeRejectedMessage) {
+			return fmt.Errorf("%w: %s", errResumeRejected, respMsg.Message)
+		}
+		return responseError("download", respMsg)
 	}
 
 	c.logger.Info("Starting chunked download", zap.String("message", respMsg.Message))
 
-	// Receive chunks and reconstruct file
-	return c.receiveFileChunks(ctx, filename, outputPath)
+	// The start response carries the full file size and its SHA-256
+	var expectedSum []byte
+	if len(respMsg.Data) == 8+sha256.Size {
+		expectedSum = respMsg.Data[8:]
+	} else if c.TransferV2() && !c.skipDownloadVerification {
+		return fmt.Errorf("%w: %s: server sent no file digest", ErrDownloadChecksum, filename)
+	}
+	var counter *progressCounter
+	if progress != nil && len(respMsg.Data) >= 8 {
+		counter = &progressCounter{progress: progress, done: offset, total: binary.BigEndian.Uint64(respMsg.Data)}
+		out = &progressWriterAt{w: out, counter: counter}
+	}
+	out = metered(metered(out, meter), sample)
+
+	// Nothing follows when we already have the whole file, bar the completion response
+	// of newer servers
+	if c.wireVersion() < protocol.ProtocolVersionDownloadComplete && len(respMsg.Data) >= 8 && binary.BigEndian.Uint64(respMsg.Data) == offset {
+		c.logger.Info("Nothing left to download", zap.String("filename", filename), zap.Uint64("size", offset))
+	} else if err := c.receiveFileChunks(ctx, filename, out, limit); err != nil {
+		if sample != nil && errors.Is(err, ErrIncompleteDownload) {
+			c.logger.Info("Reducing download chunk size",
+				zap.String("filename", filename),
+				zap.Uint32("chunkSize", c.chunkControl.backOff()))
+		}
+		return err
+	}
+	if sample != nil {
+		stats := sample.stats()
+		c.logger.Debug("Adapted download chunk size",
+			zap.String("filename", filename),
+			zap.Float64("throughputMBps", stats.ThroughputMBps),
+			zap.Duration("rtt", stats.RTT),
+			zap.Uint32("chunkSize", c.chunkControl.observe(stats)))
+	}
+
+	if !c.skipDownloadVerification && expectedSum != nil {
+		// Chunks that arrived out of order went to the file unhashed, so hash it afresh
+		if !hashed.inOrder {
+			fileHash = sha256.New()
+			if _, err := io.Copy(fileHash, io.NewSectionReader(file, 0, int64(binary.BigEndian.Uint64(respMsg.Data)))); err != nil {
+				return fmt.Errorf("failed to verify download: %w", err)
+			}
+		}
+		if !bytes.Equal(fileHash.Sum(nil), expectedSum) {
+			return fmt.Errorf("%w: %s", ErrDownloadChecksum, filename)
+		}
+	}
+	if counter != nil {
+		counter.finish()
+	}
+	return nil
 }
 
-// receiveFileChunks receives file chunks and reconstructs the complete file
-func (c *Client) receiveFileChunks(ctx context.Context, filename string, outputPath string) error {
-	var chunks []protocol.ChunkDataMessage
+// receiveFileChunks receives file chunks and writes each at its offset in w, so a chunk
+// arriving out of order still lands in place; a repeated chunk fails the download and
+// gaps fail it once the transfer ends without them. From ProtocolVersionDownloadComplete
+// on the server's completion response ends the transfer; older servers are done once
+// TotalChunks chunks have arrived. From protocol.ProtocolVersionAbort on, ending ctx
+// asks the server to stop and fails the download with ErrDownloadAborted once it has.
+func (c *Client) receiveFileChunks(ctx context.Context, filename string, w io.WriterAt, limit int64) (err error) {
+	var receivedChunks uint32
 	var totalSize uint64
 	var totalChunks uint32
-
-	// Create output file
-	file, err := os.Create(outputPath)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
+	var chunkSize uint64
+	var written uint64
+	var tooLarge bool
+	var coverage *chunkCoverage
+	marked := c.wireVersion() >= protocol.ProtocolVersionDownloadComplete
+
+	// Reads wait for the frames in flight rather than end with ctx, as a frame cut short
+	// would leave the connection out of step with the server
+	readCtx := ctx
+	var abort *downloadAbort
+	if c.wireVersion() >= protocol.ProtocolVersionAbort {
+		readCtx = context.WithoutCancel(ctx)
+		abort = c.abortOnCancel(ctx)
+		defer func() {
+			if !abort.stop() {
+				return
+			}
+			if abortErr := c.awaitAbort(ctx, abort); abortErr != nil {
+				err = abortErr
+			} else if errors.Is(err, errAborting) {
+				err = fmt.Errorf("%w: %s: %w", ErrDownloadAborted, filename, ctx.Err())
+			}
+		}()
 	}
-	defer file.Close()
 
 	// Receive all chunks
 	for {
 		// Wait for chunk data message
-		chunkMsg, err := c.ReceiveSecureMessage()
+		chunkMsg, err := c.ReceiveSecureMessage(readCtx)
 		if err != nil {
-			return fmt.Errorf("failed to receive chunk: %w", err)
+			return fmt.Errorf("%w: connection lost after %d of %d chunks: %v", ErrIncompleteDownload, receivedChunks, totalChunks, err)
+		}
+		if abort != nil && ctx.Err() != nil {
+			abort.received = chunkMsg
+			return errAborting
 		}
 
-		// Check if this is the end of transfer (no more chunks)
-		if chunkMsg.Type != protocol.MessageTypeData {
-			// If we receive a response message, it might be an error or completion
-			if chunkMsg.Type == protocol.MessageTypeResponse {
-				respMsg, err := protocol.DeserializeResponse(chunkMsg.Payload)
-				if err == nil && respMsg.Success {
-					c.logger.Info("Download completed", zap.String("message", respMsg.Message))
-					break
-				}
+		if chunkMsg.Type == protocol.MessageTypeResponse && marked {
+			sent, err := c.downloadCompletion(chunkMsg.Payload)
+			if err != nil {
+				return err
+			}
+			if sent != receivedChunks {
+				return fmt.Errorf("%w: server sent %d chunks, received %d", ErrIncompleteDownload, sent, receivedChunks)
 			}
+			c.logger.Info("Download completed", zap.String("filename", filename))
+			break
+		}
+		if chunkMsg.Type != protocol.MessageTypeData {
 			return fmt.Errorf("unexpected message type during chunked download: %v", chunkMsg.Type)
 		}
 
 		// Deserialize chunk data
-		chunk, err := protocol.DeserializeChunkData(chunkMsg.Payload)
+		chunk, err := c.decodeChunk(chunkMsg.Payload)
 		if err != nil {
-			return fmt.Errorf("failed to deserialize chunk: %w", err)
+			return err
 		}
 
 		// Validate chunk belongs to this file
@@ -345,102 +1127,248 @@ func (c *Client) receiveFileChunks(ctx context.Context, filename string, outputP
 		}
 
 		// Store metadata from first chunk
-		if len(chunks) == 0 {
+		if receivedChunks == 0 {
 			totalSize = chunk.TotalSize
 			totalChunks = chunk.TotalChunks
 			c.logger.Info("Receiving file chunks",
 				zap.String("filename", filename),
 				zap.Uint64("totalSize", totalSize),
 				zap.Uint32("totalChunks", totalChunks))
+
+			// The chunk count sizes the coverage map, so a count no file of this size
+			// could have is refused before anything is allocated
+			if totalChunks > maxDownloadChunks || uint64(totalChunks) > max(totalSize, 1) {
+				return fmt.Errorf("%w: %s declares %d chunks for %d bytes", ErrDownloadTooLarge, filename, totalChunks, totalSize)
+			}
+
+			// The server sends the whole file regardless, so an oversized one is drained, not written
+			tooLarge = limit > 0 && totalSize > uint64(limit)
+			coverage = newChunkCoverage(totalChunks)
+		}
+		if chunk.TotalSize != totalSize || chunk.TotalChunks != totalChunks {
+			return fmt.Errorf("chunk %d describes a different transfer: %d bytes in %d chunks, expected %d in %d",
+				chunk.ChunkIndex, chunk.TotalSize, chunk.TotalChunks, totalSize, totalChunks)
 		}
 
-		// Write chunk data to file
-		if _, err := file.Write(chunk.Data); err != nil {
-			return fmt.Errorf("failed to write chunk %d to file: %w", chunk.ChunkIndex, err)
+		// Only which chunks arrived is kept; their data goes straight to w
+		if err := coverage.claim(chunk.ChunkIndex); err != nil {
+			return err
 		}
+		receivedChunks++
 
-		chunks = append(chunks, *chunk)
+		// Every chunk but the last is full, so the first one to arrive fixes where all of them go
+		if chunkSize == 0 {
+			if chunkSize, err = fullChunkSize(chunk); err != nil {
+				return err
+			}
+		}
+		position := uint64(chunk.ChunkIndex) * chunkSize
+		if position > totalSize || uint64(len(chunk.Data)) != min(chunkSize, totalSize-position) {
+			return fmt.Errorf("chunk %d has %d bytes, which does not fit %d byte chunks of a %d byte file",
+				chunk.ChunkIndex, len(chunk.Data), chunkSize, totalSize)
+		}
+
+		if !tooLarge {
+			if _, err := w.WriteAt(chunk.Data, int64(position)); err != nil {
+				return fmt.Errorf("failed to write chunk %d: %w", chunk.ChunkIndex, err)
+			}
+			written += uint64(len(chunk.Data))
+		}
 
 		// Log progress
-		progress := float64(len(chunks)) / float64(totalChunks) * 100
+		progress := float64(receivedChunks) / float64(totalChunks) * 100
 		c.logger.Debug("Received chunk",
 			zap.String("filename", filename),
 			zap.Uint32("chunkIndex", chunk.ChunkIndex),
 			zap.Uint32("chunkSize", chunk.ChunkSize),
 			zap.Float64("progress", progress))
 
-		// Check if we've received all chunks
-		if len(chunks) >= int(totalChunks) {
+		// Without a completion response the chunk count is all we have to go on
+		if !marked && receivedChunks >= totalChunks {
 			c.logger.Info("All chunks received", zap.String("filename", filename))
 			break
 		}
 	}
 
-	// Verify we received all chunks
-	if len(chunks) != int(totalChunks) {
-		return fmt.Errorf("incomplete download: received %d chunks, expected %d", len(chunks), totalChunks)
+	if tooLarge {
+		return fmt.Errorf("%w: %s is %d bytes (limit %d)", ErrDownloadTooLarge, filename, totalSize, limit)
 	}
 
-	// Verify file size
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return fmt.Errorf("failed to get file info: %w", err)
+	// Verify we received all chunks
+	if receivedChunks != totalChunks || (coverage != nil && coverage.missing() > 0) {
+		return fmt.Errorf("%w: received %d chunks, expected %d", ErrIncompleteDownload, receivedChunks, totalChunks)
 	}
 
-	if uint64(fileInfo.Size()) != totalSize {
-		return fmt.Errorf("file size mismatch: expected %d bytes, got %d", totalSize, fileInfo.Size())
+	// Verify size
+	if written != totalSize {
+		return fmt.Errorf("file size mismatch: expected %d bytes, got %d", totalSize, written)
 	}
 
-	c.logger.Info("File downloaded successfully",
-		zap.String("output", outputPath),
+	c.logger.Info("Download finished",
+		zap.String("filename", filename),
 		zap.Uint64("size", totalSize),
 		zap.Uint32("chunks", totalChunks))
 
 	return nil
 }
 
-// ListFiles lists files on the server
-func (c *Client) ListFiles(ctx context.Context) (string, error) {
-	c.logger.Info("Listing files")
+// fullChunkSize infers the size of a download's full chunks from any one of them: a
+// chunk before the last is full, and the last follows ChunkIndex full chunks
+func fullChunkSize(chunk *protocol.ChunkDataMessage) (uint64, error) {
+	length := uint64(len(chunk.Data))
+	switch {
+	case chunk.ChunkIndex+1 < chunk.TotalChunks && length > 0:
+		return length, nil
+	case chunk.ChunkIndex+1 < chunk.TotalChunks:
+		return 0, fmt.Errorf("chunk %d is empty but not the last", chunk.ChunkIndex)
+	case chunk.ChunkIndex == 0:
+		return length, nil
+	}
+	rest := chunk.TotalSize - length
+	if length > chunk.TotalSize || rest%uint64(chunk.ChunkIndex) != 0 || rest/uint64(chunk.ChunkIndex) < length {
+		return 0, fmt.Errorf("last chunk %d has %d bytes, which does not fit a %d byte file", chunk.ChunkIndex, length, chunk.TotalSize)
+	}
+	return rest / uint64(chunk.ChunkIndex), nil
+}
 
-	// Create command message
-	cmdPayload, err := protocol.SerializeCommand(protocol.CommandList, "", nil)
+// downloadCompletion decodes the response that ends a download's chunks, returning the
+// number of chunks the server says it sent
+func (c *Client) downloadCompletion(payload []byte) (uint32, error) {
+	respMsg, err := protocol.DeserializeResponse(payload)
 	if err != nil {
-		return "", fmt.Errorf(errSerializeCommand, err)
+		return 0, fmt.Errorf(errDeserializeResponse, err)
 	}
+	if !respMsg.Success {
+		return 0, responseError("download", respMsg)
+	}
+	if respMsg.Message != protocol.DownloadCompleteMessage {
+		return 0, fmt.Errorf("unexpected response during chunked download: %s", respMsg.Message)
+	}
+	sent, err := protocol.DeserializeDownloadComplete(respMsg.Data)
+	if err != nil {
+		return 0, fmt.Errorf("invalid download completion: %w", err)
+	}
+	return sent, nil
+}
 
-	// Send encrypted command
-	msg := protocol.NewMessage(protocol.MessageTypeCommand, cmdPayload)
-	if err := c.SendSecureMessage(msg); err != nil {
-		return "", fmt.Errorf("failed to send list command: %w", err)
+// FileInfo describes a file stored on the server
+type FileInfo = protocol.FileInfo
+
+// ListFiles lists the names of the files on the server, one per line
+func (c *Client) ListFiles(ctx context.Context) (string, error) {
+	infos, err := c.ListFilesDetailed(ctx)
+	if err != nil {
+		return "", err
 	}
 
-	// Wait for encrypted response
-	response, err := c.ReceiveSecureMessage()
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if !info.IsDir {
+			names = append(names, info.Name)
+		}
+	}
+	return strings.Join(names, "\n"), nil
+}
+
+// ListFilesDetailed lists the entries on the server with their size and modification time
+func (c *Client) ListFilesDetailed(ctx context.Context) ([]FileInfo, error) {
+	return c.ListDir(ctx, "", false)
+}
+
+// ListDir lists the entries of a directory on the server, the client's top-level
+// directory when dir is empty. A recursive listing includes everything below dir,
+// each entry named by its slash-separated path relative to dir. A wildcard in the
+// last element of dir, e.g. "logs/*.log", lists only the matching entries.
+func (c *Client) ListDir(ctx context.Context, dir string, recursive bool) ([]FileInfo, error) {
+	c.logger.Info("Listing files", zap.String("dir", dir), zap.Bool("recursive", recursive))
+
+	request := &protocol.ListRequest{Flags: c.listFlags()}
+	if recursive {
+		request.Flags |= protocol.ListFlagRecursive
+	}
+	respMsg, err := c.list(ctx, dir, request)
 	if err != nil {
-		return "", fmt.Errorf(errReceiveResponse, err)
+		return nil, err
 	}
+	return decodeListing(respMsg.Message, respMsg.Data)
+}
 
-	if response.Type != protocol.MessageTypeResponse {
-		return "", fmt.Errorf(errUnexpectedResponse, response.Type)
+// ListFilesPage lists up to limit entries of the client's top-level directory from
+// offset on, sorted by name, with their size and modification time. It also returns the
+// offset of the following page, to pass as offset in the next call, or 0 when this page
+// is the last. Servers before protocol.ProtocolVersionListPage cannot page listings, so
+// it fails with ErrUnsupported.
+func (c *Client) ListFilesPage(ctx context.Context, offset, limit int) ([]FileInfo, int, error) {
+	if offset < 0 || limit <= 0 || offset > math.MaxUint32 || limit > math.MaxUint32 {
+		return nil, 0, fmt.Errorf("invalid page: offset %d, limit %d", offset, limit)
+	}
+	if c.wireVersion() < protocol.ProtocolVersionListPage {
+		return nil, 0, fmt.Errorf("%w: listing pages needs protocol revision %d, the server speaks %d",
+			ErrUnsupported, protocol.ProtocolVersionListPage, c.wireVersion())
 	}
+	c.logger.Info("Listing files", zap.Int("offset", offset), zap.Int("limit", limit))
 
-	respMsg, err := protocol.DeserializeResponse(response.Payload)
+	respMsg, err := c.list(ctx, "", &protocol.ListRequest{Flags: c.listFlags(), Offset: uint32(offset), Limit: uint32(limit)})
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(respMsg.Data) == 0 {
+		return nil, 0, fmt.Errorf("failed to parse file list: paged listing without a page marker")
+	}
+	infos, err := decodeListing(respMsg.Message, respMsg.Data[1:])
 	if err != nil {
-		return "", fmt.Errorf(errDeserializeResponse, err)
+		return nil, 0, err
 	}
+	next := 0
+	if respMsg.Data[0] != 0 {
+		next = offset + len(infos)
+	}
+	return infos, next, nil
+}
 
-	if !respMsg.Success {
-		return "", fmt.Errorf("list failed: %s", respMsg.Message)
+// listFlags returns the flags of a detailed listing, compressed when compression is enabled
+func (c *Client) listFlags() byte {
+	flags := protocol.ListFlagDetailed
+	if c.compression {
+		flags |= protocol.ListFlagCompress
 	}
+	return flags
+}
 
-	return respMsg.Message, nil
+// list sends a List command for dir and returns the server's response
+func (c *Client) list(ctx context.Context, dir string, request *protocol.ListRequest) (*protocol.ResponseMessage, error) {
+	var respMsg *protocol.ResponseMessage
+	err := c.withRetry(ctx, "list", func() (err error) {
+		respMsg, err = c.runCommand(ctx, protocol.CommandList, dir, protocol.SerializeListRequest(request), "list")
+		return err
+	})
+	return respMsg, err
+}
+
+// decodeListing parses a detailed listing, decompressing it when message names gzip
+func decodeListing(message string, listing []byte) ([]FileInfo, error) {
+	if message == protocol.EncodingGzip {
+		var err error
+		listing, err = protocol.DecompressPayload(listing)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress file list: %w", err)
+		}
+	}
+
+	infos, err := protocol.DeserializeFileInfos(listing)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse file list: %w", err)
+	}
+	return infos, nil
 }
 
 // DeleteFile deletes a file on the server
 func (c *Client) DeleteFile(ctx context.Context, filename string) error {
 	c.logger.Info("Deleting file", zap.String("filename", filename))
 
+	// Take the connection for the whole exchange once outstanding asynchronous uploads drain
+	defer c.lockExchange()()
+
 	// Create command message
 	cmdPayload, err := protocol.SerializeCommand(protocol.CommandDelete, filename, nil)
 	if err != nil {
@@ -454,7 +1382,7 @@ func (c *Client) DeleteFile(ctx context.Context, filename string) error {
 	}
 
 	// Wait for encrypted response
-	response, err := c.ReceiveSecureMessage()
+	response, err := c.ReceiveSecureMessage(ctx)
 	if err != nil {
 		return fmt.Errorf(errReceiveResponse, err)
 	}
@@ -469,9 +1397,113 @@ func (c *Client) DeleteFile(ctx context.Context, filename string) error {
 	}
 
 	if !respMsg.Success {
-		return fmt.Errorf("delete failed: %s", respMsg.Message)
+		return responseError("delete", respMsg)
 	}
 
 	c.logger.Info("File deleted successfully", zap.String("message", respMsg.Message))
 	return nil
 }
+
+// DeleteFiles deletes every file on the server matching pattern and returns how many
+// were deleted. Wildcards (see path.Match) may appear only in the last element, e.g.
+// "logs/*.log"; subdirectories are never deleted. No match is not an error.
+func (c *Client) DeleteFiles(ctx context.Context, pattern string) (int, error) {
+	c.logger.Info("Deleting files", zap.String("pattern", pattern))
+
+	respMsg, err := c.runCommand(ctx, protocol.CommandDeleteGlob, pattern, nil, "delete")
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := protocol.DeserializeDeleteCount(respMsg.Data)
+	if err != nil {
+		return 0, err
+	}
+
+	c.logger.Info("Files deleted successfully", zap.String("pattern", pattern), zap.Uint32("deleted", deleted))
+	return int(deleted), nil
+}
+
+// runCommand sends a command and waits for a single successful response
+func (c *Client) runCommand(ctx context.Context, cmd protocol.CommandType, filename string, data []byte, operation string) (*protocol.ResponseMessage, error) {
+	cmdPayload, err := protocol.SerializeCommand(cmd, filename, data)
+	if err != nil {
+		return nil, fmt.Errorf(errSerializeCommand, err)
+	}
+	return c.exchangeCommand(ctx, cmdPayload, operation)
+}
+
+// exchangeCommand sends a serialized command and returns the server's successful response
+func (c *Client) exchangeCommand(ctx context.Context, cmdPayload []byte, operation string) (*protocol.ResponseMessage, error) {
+	respMsg, err := c.exchange(ctx, cmdPayload, operation)
+	if err != nil {
+		return nil, err
+	}
+
+	if !respMsg.Success {
+		return nil, responseError(operation, respMsg)
+	}
+
+	return respMsg, nil
+}
+
+// exchange sends a serialized command and returns the server's response, successful or not
+func (c *Client) exchange(ctx context.Context, cmdPayload []byte, operation string) (*protocol.ResponseMessage, error) {
+	// Take the connection for the whole exchange once outstanding asynchronous uploads drain
+	defer c.lockExchange()()
+
+	msg := protocol.NewMessage(protocol.MessageTypeCommand, cmdPayload)
+	if err := c.SendSecureMessage(msg); err != nil {
+		return nil, fmt.Errorf("failed to send %s command: %w", operation, err)
+	}
+
+	return c.receiveResponse(ctx)
+}
+
+// wireVersion returns the negotiated protocol version, the base version before a handshake
+func (c *Client) wireVersion() uint16 {
+	if c.protocolVersion == 0 {
+		return protocol.ProtocolVersionBase
+	}
+	return c.protocolVersion
+}
+
+// TransferV2 reports whether the handshake agreed on transfer v2
+// (protocol.ProtocolVersionTransferV2). Without it downloads cannot rely on the server
+// to resume them, so they start over, and are verified only if the server sends a digest.
+func (c *Client) TransferV2() bool {
+	return c.wireVersion() >= protocol.ProtocolVersionTransferV2
+}
+
+// decodeChunk parses a data chunk and, when the protocol carries checksums, verifies it
+// so corrupted data is never written
+func (c *Client) decodeChunk(payload []byte) (*protocol.ChunkDataMessage, error) {
+	version := c.wireVersion()
+	chunk, err := protocol.DeserializeChunkDataVersion(payload, version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to deserialize chunk: %w", err)
+	}
+	if version >= protocol.ProtocolVersionChunkChecksums {
+		if err := chunk.VerifyChecksum(); err != nil {
+			return nil, err
+		}
+	}
+	return chunk, nil
+}
+
+// receiveResponse reads the next message and decodes it as a response
+func (c *Client) receiveResponse(ctx context.Context) (*protocol.ResponseMessage, error) {
+	response, err := c.ReceiveSecureMessage(ctx)
+	if err != nil {
+		return nil, fmt.Errorf(errReceiveResponse, err)
+	}
+
+	if response.Type != protocol.MessageTypeResponse {
+		return nil, fmt.Errorf(errUnexpectedResponse, response.Type)
+	}
+
+	respMsg, err := protocol.DeserializeResponse(response.Payload)
+	if err != nil {
+		return nil, fmt.Errorf(errDeserializeResponse, err)
+	}
+	return respMsg, nil
+}
@@ -0,0 +1,48 @@
+package entity
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// CopyFile duplicates src as dst on the server without transferring the contents.
+// If dst exists, the server's collision policy decides whether it is replaced, the
+// copy is refused, or the copy is stored under a versioned name. The copy counts
+// against the storage quota.
+func (c *Client) CopyFile(ctx context.Context, src string, dst string) error {
+	return c.copyFile(ctx, src, dst, true)
+}
+
+// CopyFileNoClobber is CopyFile, failing with ErrFileExists instead when dst exists
+func (c *Client) CopyFileNoClobber(ctx context.Context, src string, dst string) error {
+	return c.copyFile(ctx, src, dst, false)
+}
+
+// copyFile copies src to dst, replacing an existing dst only if overwrite is set
+func (c *Client) copyFile(ctx context.Context, src string, dst string, overwrite bool) error {
+	c.logger.Info("Copying file", zap.String("from", src), zap.String("to", dst), zap.Bool("overwrite", overwrite))
+
+	if dst == "" {
+		return fmt.Errorf("copy failed: destination filename is empty")
+	}
+
+	fields := [][]byte{[]byte(src), []byte(dst)}
+	if !overwrite {
+		fields = append(fields, []byte{protocol.CopyFlagNoClobber})
+	}
+	cmdPayload, err := protocol.SerializeCommandFields(protocol.CommandCopy, fields...)
+	if err != nil {
+		return fmt.Errorf(errSerializeCommand, err)
+	}
+
+	respMsg, err := c.exchangeCommand(ctx, cmdPayload, "copy")
+	if err != nil {
+		return err
+	}
+
+	c.logger.Info("File copied successfully", zap.String("stored_as", string(respMsg.Data)))
+	return nil
+}
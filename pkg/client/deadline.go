@@ -0,0 +1,55 @@
+package entity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// noReadTimeoutKey marks contexts whose reads may wait indefinitely, see withoutReadTimeout
+type noReadTimeoutKey struct{}
+
+// withoutReadTimeout lets reads under ctx wait past DefaultReadTimeout, for streams
+// where silence is normal (a followed file that is not growing). A deadline or
+// cancellation of ctx still applies.
+func withoutReadTimeout(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noReadTimeoutKey{}, true)
+}
+
+// readDeadline is when a read started now under ctx must give up; zero means never
+func readDeadline(ctx context.Context) time.Time {
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline
+	}
+	if ctx.Value(noReadTimeoutKey{}) != nil {
+		return time.Time{}
+	}
+	return time.Now().Add(DefaultReadTimeout)
+}
+
+// watchRead bounds the next read on the connection by ctx: the read deadline follows
+// readDeadline and cancelling ctx interrupts a blocked read. Call the returned function
+// once the read is done.
+func (c *Client) watchRead(ctx context.Context) func() {
+	c.conn.SetReadDeadline(readDeadline(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		c.conn.SetReadDeadline(time.Now())
+	})
+	return func() { stop() }
+}
+
+// readError describes a failed read, reporting the context's error when the read was
+// cut short because ctx ended so callers can match context.Canceled and
+// context.DeadlineExceeded
+func readError(ctx context.Context, what string, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("%s: %w", what, ctxErr)
+	}
+	// The connection deadline can pass a moment before the context's own timer fires
+	if deadline, ok := ctx.Deadline(); ok && errors.Is(err, os.ErrDeadlineExceeded) && !time.Now().Before(deadline) {
+		return fmt.Errorf("%s: %w", what, context.DeadlineExceeded)
+	}
+	return fmt.Errorf("%s: %w", what, err)
+}
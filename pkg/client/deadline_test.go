@@ -0,0 +1,92 @@
+package entity
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	aesutil "github.com/lcensies/ssnproj/pkg/aes"
+	rsautil "github.com/lcensies/ssnproj/pkg/rsa"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// newStalledServerForTest listens on a local port and accepts connections, reading
+// whatever arrives but never replying
+func newStalledServerForTest(t *testing.T) (host, port string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+
+	host, port, err = net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+	return host, port
+}
+
+func TestReads_StalledServer(t *testing.T) {
+	host, port := newStalledServerForTest(t)
+
+	connect := func() *Client {
+		c, err := NewClient(context.Background(), host, port, nil, zap.NewNop())
+		require.NoError(t, err)
+		t.Cleanup(func() { c.Close(context.Background()) })
+		// Skip the handshake; the stalled server would not answer it either
+		c.aesKey, err = aesutil.GenerateKey()
+		require.NoError(t, err)
+		return c
+	}
+
+	t.Run("deadline", func(t *testing.T) {
+		c := connect()
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err := c.ListFiles(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), 2*time.Second, "read should end at the context deadline")
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		c := connect()
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		start := time.Now()
+		err := c.DownloadFile(ctx, "report.txt", t.TempDir()+"/report.txt", nil)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Less(t, time.Since(start), 2*time.Second, "read should end once the context is cancelled")
+	})
+
+	t.Run("handshake", func(t *testing.T) {
+		_, serverPubKey := rsautil.GenerateKeyPair(2048)
+		c, err := NewClient(context.Background(), host, port, serverPubKey, zap.NewNop())
+		require.NoError(t, err)
+		defer c.Close(context.Background())
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		err = c.PerformHandshake(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("default timeout", func(t *testing.T) {
+		ctx := context.Background()
+		assert.WithinDuration(t, time.Now().Add(DefaultReadTimeout), readDeadline(ctx), time.Second)
+		assert.True(t, readDeadline(withoutReadTimeout(ctx)).IsZero())
+	})
+}
@@ -0,0 +1,17 @@
+package entity
+
+import (
+	"context"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// MakeDir creates a directory on the server, along with any missing parents.
+// Creating a directory that already exists is not an error.
+func (c *Client) MakeDir(ctx context.Context, path string) error {
+	c.logger.Info("Creating directory", zap.String("path", path))
+
+	_, err := c.runCommand(ctx, protocol.CommandMkdir, path, nil, "mkdir")
+	return err
+}
@@ -0,0 +1,194 @@
+package entity
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+)
+
+// DefaultMaxDownloadBytes caps DownloadBytes unless overridden with WithMaxDownloadBytes
+const DefaultMaxDownloadBytes = 16 * 1024 * 1024 // 16 MB
+
+// DefaultMaxDownloadSize caps DownloadFile and DownloadToWriter unless overridden with
+// WithMaxDownloadSize. It is far above any real transfer; it stops a faulty or hostile
+// server from announcing a file that would fill the disk.
+const DefaultMaxDownloadSize = 64 * 1024 * 1024 * 1024 // 64 GB
+
+// maxDownloadChunks bounds the chunk count a download may declare, which sizes the map
+// of chunks received. At the smallest chunk size it allows files of 256 GB.
+const maxDownloadChunks = 1 << 22
+
+// ErrDownloadTooLarge is returned when a file exceeds the client's download limit, or
+// the server describes a transfer no file could have
+var ErrDownloadTooLarge = errors.New("download exceeds size limit")
+
+// ErrDownloadChecksum is returned when a downloaded file does not match the SHA-256
+// the server reported for it
+var ErrDownloadChecksum = errors.New("downloaded file does not match server checksum")
+
+// ErrIncompleteDownload is returned when a download ends before all of its chunks
+// arrived, e.g. because the server or the connection went away mid-transfer
+var ErrIncompleteDownload = errors.New("incomplete download")
+
+// ErrDownloadAborted is returned when a download's context ends while its chunks are
+// arriving and the server stopped sending them, leaving the connection usable
+var ErrDownloadAborted = errors.New("download aborted")
+
+// DownloadBytes downloads a small file into memory and returns its contents.
+// Files larger than the client's limit (DefaultMaxDownloadBytes unless set with
+// WithMaxDownloadBytes) fail with ErrDownloadTooLarge.
+func (c *Client) DownloadBytes(ctx context.Context, filename string) ([]byte, error) {
+	limit := c.maxDownloadBytes
+	if limit <= 0 {
+		limit = DefaultMaxDownloadBytes
+	}
+
+	var buf bytes.Buffer
+	err := c.withRetry(ctx, "download", func() error {
+		buf.Reset()
+		return c.downloadTo(ctx, filename, &buf, limit, byteRange{}, nil, nil, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DownloadToWriter downloads a file into w, writing each chunk as it arrives, so the
+// file never has to fit in memory or on disk; w can be stdout, a network connection or
+// a hash. The byte count and the server's SHA-256 are checked as the data passes
+// through, so w need not be seekable; it does need the chunks in order, which a single
+// stream delivers. On ErrDownloadChecksum or ErrIncompleteDownload
+// w has already received data that must be discarded. A retry policy only applies
+// while w has received nothing.
+func (c *Client) DownloadToWriter(ctx context.Context, filename string, w io.Writer) error {
+	return c.downloadToWriter(ctx, filename, w, byteRange{})
+}
+
+// downloadLimit returns the largest file DownloadFile and DownloadToWriter accept, or 0
+// when WithMaxDownloadSize removed the limit
+func (c *Client) downloadLimit() int64 {
+	switch {
+	case c.maxDownloadSize < 0:
+		return 0
+	case c.maxDownloadSize == 0:
+		return DefaultMaxDownloadSize
+	default:
+		return c.maxDownloadSize
+	}
+}
+
+// downloadToWriter downloads span of filename into w, retrying after connection failures
+// only while nothing has been written
+func (c *Client) downloadToWriter(ctx context.Context, filename string, w io.Writer, span byteRange) error {
+	counted := &countingWriter{w: w}
+	return c.withRetry(ctx, "download", func() error {
+		err := c.downloadTo(ctx, filename, counted, c.downloadLimit(), span, nil, nil, nil)
+		if err != nil && counted.n > 0 {
+			return noRetry(err)
+		}
+		return err
+	})
+}
+
+// byteRange selects length bytes of a file from start; the zero value is the whole file
+// and a zero length runs to the end
+type byteRange struct {
+	start, length uint64
+}
+
+// DownloadRange downloads length bytes of a file starting at offset into w, as
+// DownloadToWriter does for the whole file; a zero length reads to the end of the file.
+// A range running past the end of the file is cut short there, one starting past it
+// fails with ErrInvalidRequest. The server checksums the range itself, so it is
+// verified like a whole file. Servers before protocol.ProtocolVersionRange fail with
+// ErrUnsupported.
+func (c *Client) DownloadRange(ctx context.Context, filename string, offset, length int64, w io.Writer) error {
+	if offset < 0 || length < 0 {
+		return fmt.Errorf("download failed: invalid range of %d bytes at offset %d", length, offset)
+	}
+	if c.wireVersion() < protocol.ProtocolVersionRange {
+		return fmt.Errorf("download failed: byte ranges are %w", ErrUnsupported)
+	}
+	// Writing through countingWriter, which hides a file's WriteAt, makes the range land
+	// at the file's current position, not at offset
+	return c.downloadToWriter(ctx, filename, w, byteRange{uint64(offset), uint64(length)})
+}
+
+// sequentialWriterAt lets a writer that cannot seek take chunks placed by offset,
+// provided they come in order
+type sequentialWriterAt struct {
+	w    io.Writer
+	next int64
+}
+
+func (s *sequentialWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if off != s.next {
+		return 0, fmt.Errorf("data for offset %d arrived out of order, expected offset %d", off, s.next)
+	}
+	n, err := s.w.Write(p)
+	s.next += int64(n)
+	return n, err
+}
+
+// orderedHashWriterAt writes through to w and hashes the data while it arrives in
+// order, so a download received in order need not be read back to be verified
+type orderedHashWriterAt struct {
+	w    io.WriterAt
+	hash hash.Hash
+	next int64
+	// inOrder is cleared by the first write elsewhere than next; hash is then incomplete
+	inOrder bool
+}
+
+func (h *orderedHashWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	n, err := h.w.WriteAt(p, off)
+	if h.inOrder && off == h.next {
+		h.hash.Write(p[:n])
+		h.next += int64(n)
+	} else {
+		h.inOrder = false
+	}
+	return n, err
+}
+
+// errResumeRejected is returned by downloadTo when the server will not resume from the
+// requested offset
+var errResumeRejected = errors.New("download resume rejected")
+
+// resumePoint is where an interrupted download continues from
+type resumePoint struct {
+	offset    uint64
+	prefixSum [sha256.Size]byte
+	// hash has consumed the prefix, ready to continue over the rest of the file
+	hash hash.Hash
+}
+
+// resumePointFor hashes the data already in file, leaving the file positioned at its end
+// for appending. An empty file has nothing to resume and yields nil.
+func resumePointFor(file *os.File) (*resumePoint, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return nil, nil
+	}
+
+	prefixHash := sha256.New()
+	n, err := io.Copy(prefixHash, file)
+	if err != nil {
+		return nil, err
+	}
+
+	resume := &resumePoint{offset: uint64(n), hash: prefixHash}
+	copy(resume.prefixSum[:], prefixHash.Sum(nil))
+	return resume, nil
+}
@@ -0,0 +1,514 @@
+package entity
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	aesutil "github.com/lcensies/ssnproj/pkg/aes"
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// writeSecureForTest sends an encrypted frame from the fake server side
+func writeSecureForTest(t *testing.T, conn net.Conn, aesKey []byte, msgType protocol.MessageType, payload []byte) {
+	encrypted, err := aesutil.Encrypt(payload, aesKey)
+	require.NoError(t, err)
+	frame, err := protocol.NewMessage(msgType, encrypted).Serialize()
+	require.NoError(t, err)
+	if _, err := conn.Write(frame); err != nil {
+		t.Errorf("fake server write failed: %v", err)
+	}
+}
+
+// serveDownloadForTest answers one download with startData in the start response and one
+// checksummed chunk per element of chunks, corrupting the chunk at index corrupt (-1 for none)
+func serveDownloadForTest(t *testing.T, conn net.Conn, aesKey []byte, filename string, startData []byte, chunks []string, corrupt int) {
+	buffer := protocol.NewMessageBuffer()
+	readChunk := make([]byte, 1024)
+	var request *protocol.Message
+	for request == nil {
+		n, err := conn.Read(readChunk)
+		if err != nil {
+			t.Errorf("fake server read failed: %v", err)
+			return
+		}
+		buffer.AddData(readChunk[:n])
+		request, _ = buffer.TryDeserialize()
+	}
+
+	responsePayload, _ := protocol.SerializeResponse(true, "Starting chunked download", startData)
+	writeSecureForTest(t, conn, aesKey, protocol.MessageTypeResponse, responsePayload)
+
+	totalSize := 0
+	for _, data := range chunks {
+		totalSize += len(data)
+	}
+	for i, data := range chunks {
+		payload, err := protocol.SerializeChunkDataVersion(&protocol.ChunkDataMessage{
+			Filename:    filename,
+			ChunkIndex:  uint32(i),
+			TotalChunks: uint32(len(chunks)),
+			ChunkSize:   uint32(len(data)),
+			TotalSize:   uint64(totalSize),
+			Data:        []byte(data),
+		}, protocol.ProtocolVersionChunkChecksums)
+		require.NoError(t, err)
+		if i == corrupt {
+			payload[len(payload)-1] ^= 0xff
+		}
+		writeSecureForTest(t, conn, aesKey, protocol.MessageTypeData, payload)
+	}
+}
+
+// newPipeClientForTest returns a client speaking to the far end of an in-memory connection
+func newPipeClientForTest(t *testing.T, opts ...ClientOption) (*Client, net.Conn, []byte) {
+	aesKey, err := aesutil.GenerateKey()
+	require.NoError(t, err)
+
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	c := &Client{
+		conn:            clientConn,
+		logger:          zap.NewNop(),
+		aesKey:          aesKey,
+		protocolVersion: protocol.ProtocolVersionChunkChecksums,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, serverConn, aesKey
+}
+
+func TestDownload_ChunkChecksumMismatch(t *testing.T) {
+	c, serverConn, aesKey := newPipeClientForTest(t)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serveDownloadForTest(t, serverConn, aesKey, "report.txt", nil, []string{"good ", "data!"}, 1)
+	}()
+
+	data, err := c.DownloadBytes(context.Background(), "report.txt")
+	<-done
+	assert.Nil(t, data)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, protocol.ErrChunkChecksum), "unexpected error: %v", err)
+	assert.True(t, strings.Contains(err.Error(), "chunk 1"), "error should name the chunk: %v", err)
+}
+
+func TestDownload_FileChecksumMismatch(t *testing.T) {
+	// Every chunk is intact, but the file is not the one the server hashed
+	content := "whole file"
+	wrongSum := sha256.Sum256([]byte("another file"))
+	startData := append(binary.BigEndian.AppendUint64(nil, uint64(len(content))), wrongSum[:]...)
+
+	download := func(t *testing.T, c *Client, serverConn net.Conn, aesKey []byte, outputPath string) error {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			serveDownloadForTest(t, serverConn, aesKey, "report.txt", startData, []string{"whole", " file"}, -1)
+		}()
+		err := c.DownloadFile(context.Background(), "report.txt", outputPath, nil)
+		<-done
+		return err
+	}
+
+	t.Run("verified", func(t *testing.T) {
+		c, serverConn, aesKey := newPipeClientForTest(t)
+		outputPath := filepath.Join(t.TempDir(), "report.txt")
+
+		err := download(t, c, serverConn, aesKey, outputPath)
+		assert.True(t, errors.Is(err, ErrDownloadChecksum), "unexpected error: %v", err)
+		_, statErr := os.Stat(outputPath)
+		assert.True(t, os.IsNotExist(statErr), "corrupted output should be removed")
+	})
+
+	t.Run("verification disabled", func(t *testing.T) {
+		c, serverConn, aesKey := newPipeClientForTest(t, WithDownloadVerification(false))
+		outputPath := filepath.Join(t.TempDir(), "report.txt")
+
+		require.NoError(t, download(t, c, serverConn, aesKey, outputPath))
+		data, err := os.ReadFile(outputPath)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(data))
+	})
+}
+
+func TestDownload_TransferV2(t *testing.T) {
+	content := "whole file"
+	fileSum := sha256.Sum256([]byte(content))
+	sized := binary.BigEndian.AppendUint64(nil, uint64(len(content)))
+
+	download := func(t *testing.T, c *Client, serverConn net.Conn, aesKey []byte, outputPath string, startData []byte, chunks []string) error {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			serveDownloadForTest(t, serverConn, aesKey, "report.txt", startData, chunks, -1)
+		}()
+		err := c.DownloadFile(context.Background(), "report.txt", outputPath, nil)
+		<-done
+		return err
+	}
+
+	t.Run("older server starts over", func(t *testing.T) {
+		// The fake server ignores resume requests, as servers before transfer v2 may
+		c, serverConn, aesKey := newPipeClientForTest(t)
+		require.False(t, c.TransferV2())
+		outputPath := filepath.Join(t.TempDir(), "report.txt")
+		require.NoError(t, os.WriteFile(outputPath, []byte("whole"), 0644))
+
+		startData := append(sized, fileSum[:]...)
+		require.NoError(t, download(t, c, serverConn, aesKey, outputPath, startData, []string{"whole", " file"}))
+		data, err := os.ReadFile(outputPath)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(data))
+	})
+
+	t.Run("digest required", func(t *testing.T) {
+		c, serverConn, aesKey := newPipeClientForTest(t)
+		c.protocolVersion = protocol.ProtocolVersionTransferV2
+		require.True(t, c.TransferV2())
+		outputPath := filepath.Join(t.TempDir(), "report.txt")
+
+		err := download(t, c, serverConn, aesKey, outputPath, sized, nil)
+		assert.True(t, errors.Is(err, ErrDownloadChecksum), "unexpected error: %v", err)
+	})
+}
+
+func TestDownload_OversizedTotalRefused(t *testing.T) {
+	c, serverConn, aesKey := newPipeClientForTest(t, WithMaxDownloadSize(8))
+	outputPath := filepath.Join(t.TempDir(), "huge.bin")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serveDownloadForTest(t, serverConn, aesKey, "huge.bin", nil, []string{"too much ", "data"}, -1)
+	}()
+	err := c.DownloadFile(context.Background(), "huge.bin", outputPath, nil)
+	<-done
+
+	assert.True(t, errors.Is(err, ErrDownloadTooLarge), "unexpected error: %v", err)
+	_, statErr := os.Stat(outputPath)
+	assert.True(t, os.IsNotExist(statErr), "refused download should leave no output")
+}
+
+func TestDownload_ImplausibleChunkCountRefused(t *testing.T) {
+	tests := []struct {
+		name        string
+		totalSize   uint64
+		totalChunks uint32
+	}{
+		{"more chunks than bytes", 10, 1000},
+		{"beyond the chunk limit", 1 << 40, maxDownloadChunks + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The size limit is lifted so only the chunk count is at fault
+			c, serverConn, aesKey := newPipeClientForTest(t, WithMaxDownloadSize(-1))
+
+			go func() {
+				buffer := protocol.NewMessageBuffer()
+				readChunk := make([]byte, 1024)
+				for request := (*protocol.Message)(nil); request == nil; {
+					n, err := serverConn.Read(readChunk)
+					if err != nil {
+						return
+					}
+					buffer.AddData(readChunk[:n])
+					request, _ = buffer.TryDeserialize()
+				}
+				responsePayload, _ := protocol.SerializeResponse(true, "Starting chunked download", nil)
+				writeSecureForTest(t, serverConn, aesKey, protocol.MessageTypeResponse, responsePayload)
+				payload, err := protocol.SerializeChunkDataVersion(&protocol.ChunkDataMessage{
+					Filename:    "huge.bin",
+					TotalChunks: tt.totalChunks,
+					ChunkSize:   1,
+					TotalSize:   tt.totalSize,
+					Data:        []byte("x"),
+				}, protocol.ProtocolVersionChunkChecksums)
+				require.NoError(t, err)
+				writeSecureForTest(t, serverConn, aesKey, protocol.MessageTypeData, payload)
+			}()
+
+			var buf bytes.Buffer
+			err := c.DownloadToWriter(context.Background(), "huge.bin", &buf)
+			assert.True(t, errors.Is(err, ErrDownloadTooLarge), "unexpected error: %v", err)
+			assert.Zero(t, buf.Len(), "nothing should be written")
+		})
+	}
+}
+
+func TestReceiveFileChunks_MemoryBounded(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping large download in short mode")
+	}
+	c, serverConn, aesKey := newPipeClientForTest(t)
+
+	const chunkSize = protocol.LargeChunkSize
+	const totalChunks = 256 // 64 MB
+	data := make([]byte, chunkSize)
+	go func() {
+		for i := range uint32(totalChunks) {
+			payload, err := protocol.SerializeChunkDataVersion(&protocol.ChunkDataMessage{
+				Filename:    "large.bin",
+				ChunkIndex:  i,
+				TotalChunks: totalChunks,
+				ChunkSize:   chunkSize,
+				TotalSize:   chunkSize * totalChunks,
+				Data:        data,
+			}, protocol.ProtocolVersionChunkChecksums)
+			require.NoError(t, err)
+			writeSecureForTest(t, serverConn, aesKey, protocol.MessageTypeData, payload)
+		}
+	}()
+
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	baseline := stats.HeapInuse
+
+	// Sample the heap while the chunks arrive
+	var peak atomic.Uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var stats runtime.MemStats
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapInuse > peak.Load() {
+				peak.Store(stats.HeapInuse)
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}()
+
+	err := c.receiveFileChunks(context.Background(), "large.bin", &sequentialWriterAt{w: io.Discard}, 0)
+	close(done)
+	<-sampled
+	require.NoError(t, err)
+
+	const size = chunkSize * totalChunks
+	growth := int64(peak.Load()) - int64(baseline)
+	t.Logf("Peak heap growth receiving %d MB: %.1f MB", size>>20, float64(growth)/(1<<20))
+	assert.Less(t, growth, int64(size/4), "chunk bodies should not be retained")
+}
+
+func TestDownload_ChunkOrder(t *testing.T) {
+	content := []byte("0123456789abcdefghij-tail")
+	const chunkSize = 10
+	fileSum := sha256.Sum256(content)
+	startData := append(binary.BigEndian.AppendUint64(nil, uint64(len(content))), fileSum[:]...)
+
+	// serve answers a download by sending the chunks at indices, in that order
+	serve := func(t *testing.T, conn net.Conn, aesKey []byte, indices ...uint32) {
+		buffer := protocol.NewMessageBuffer()
+		readChunk := make([]byte, 1024)
+		for request := (*protocol.Message)(nil); request == nil; request, _ = buffer.TryDeserialize() {
+			n, err := conn.Read(readChunk)
+			if err != nil {
+				t.Errorf("fake server read failed: %v", err)
+				return
+			}
+			buffer.AddData(readChunk[:n])
+		}
+		responsePayload, _ := protocol.SerializeResponse(true, "Starting chunked download", startData)
+		writeSecureForTest(t, conn, aesKey, protocol.MessageTypeResponse, responsePayload)
+
+		totalChunks := protocol.ChunkCount(uint64(len(content)), chunkSize)
+		for _, index := range indices {
+			data := content[index*chunkSize : min((index+1)*chunkSize, uint32(len(content)))]
+			payload, err := protocol.SerializeChunkDataVersion(&protocol.ChunkDataMessage{
+				Filename:    "data.bin",
+				ChunkIndex:  index,
+				TotalChunks: totalChunks,
+				ChunkSize:   uint32(len(data)),
+				TotalSize:   uint64(len(content)),
+				Data:        data,
+			}, protocol.ProtocolVersionChunkChecksums)
+			require.NoError(t, err)
+			writeSecureForTest(t, conn, aesKey, protocol.MessageTypeData, payload)
+		}
+	}
+
+	t.Run("out of order into a file", func(t *testing.T) {
+		c, serverConn, aesKey := newPipeClientForTest(t)
+		outputPath := filepath.Join(t.TempDir(), "data.bin")
+		go serve(t, serverConn, aesKey, 2, 0, 1)
+
+		require.NoError(t, c.DownloadFile(context.Background(), "data.bin", outputPath, nil))
+		data, err := os.ReadFile(outputPath)
+		require.NoError(t, err)
+		assert.Equal(t, content, data, "chunks should land at their offsets")
+	})
+
+	t.Run("out of order into a stream", func(t *testing.T) {
+		c, serverConn, aesKey := newPipeClientForTest(t)
+		go serve(t, serverConn, aesKey, 1)
+
+		var buf bytes.Buffer
+		err := c.DownloadToWriter(context.Background(), "data.bin", &buf)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "out of order")
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		c, serverConn, aesKey := newPipeClientForTest(t)
+		outputPath := filepath.Join(t.TempDir(), "data.bin")
+		go serve(t, serverConn, aesKey, 0, 2, 0)
+
+		err := c.DownloadFile(context.Background(), "data.bin", outputPath, nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "chunk 0 received twice")
+	})
+}
+
+func TestReceiveChunksAt_Reassembly(t *testing.T) {
+	content := make([]byte, 3*protocol.SmallChunkSize-10)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	chunkSize := int(protocol.SmallChunkSize)
+
+	// sendChunks writes the chunks at indices, in that order, from the fake server side
+	sendChunks := func(t *testing.T, conn net.Conn, aesKey []byte, indices ...uint32) {
+		for _, index := range indices {
+			data := content[int(index)*chunkSize : min(int(index+1)*chunkSize, len(content))]
+			payload, err := protocol.SerializeChunkDataVersion(&protocol.ChunkDataMessage{
+				Filename:    "data.bin",
+				ChunkIndex:  index,
+				TotalChunks: 3,
+				ChunkSize:   uint32(len(data)),
+				TotalSize:   uint64(len(content)),
+				Data:        data,
+			}, protocol.ProtocolVersionChunkChecksums)
+			require.NoError(t, err)
+			writeSecureForTest(t, conn, aesKey, protocol.MessageTypeData, payload)
+		}
+	}
+
+	t.Run("out of order", func(t *testing.T) {
+		c, serverConn, aesKey := newPipeClientForTest(t)
+		output, err := os.Create(filepath.Join(t.TempDir(), "data.bin"))
+		require.NoError(t, err)
+		defer output.Close()
+
+		go sendChunks(t, serverConn, aesKey, 2, 0, 1)
+		coverage := newChunkCoverage(3)
+		require.NoError(t, c.receiveChunksAt(context.Background(), "data.bin", output, 5, uint64(len(content)), protocol.SmallChunkSize, 0, 3, coverage))
+		assert.Equal(t, 0, coverage.missing())
+
+		data, err := os.ReadFile(output.Name())
+		require.NoError(t, err)
+		assert.Equal(t, content, data[5:], "chunks should land at their offsets after the base")
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		c, serverConn, aesKey := newPipeClientForTest(t)
+		go sendChunks(t, serverConn, aesKey, 1, 1)
+		coverage := newChunkCoverage(3)
+		err := c.receiveChunksAt(context.Background(), "data.bin", discardWriterAt{}, 0, uint64(len(content)), protocol.SmallChunkSize, 0, 2, coverage)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "chunk 1 received twice")
+	})
+
+	t.Run("outside range", func(t *testing.T) {
+		c, serverConn, aesKey := newPipeClientForTest(t)
+		go sendChunks(t, serverConn, aesKey, 2)
+		coverage := newChunkCoverage(3)
+		err := c.receiveChunksAt(context.Background(), "data.bin", discardWriterAt{}, 0, uint64(len(content)), protocol.SmallChunkSize, 0, 2, coverage)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "outside this stream's range")
+	})
+}
+
+// discardWriterAt accepts and drops all writes
+type discardWriterAt struct{}
+
+func (discardWriterAt) WriteAt(p []byte, off int64) (int, error) { return len(p), nil }
+
+func TestDownload_Incomplete(t *testing.T) {
+	content := "first half|second half"
+	fileSum := sha256.Sum256([]byte(content))
+	startData := append(binary.BigEndian.AppendUint64(nil, uint64(len(content))), fileSum[:]...)
+
+	// serve answers a download with the first chunk of two, then lets finish end the stream
+	serve := func(t *testing.T, conn net.Conn, aesKey []byte, finish func()) {
+		buffer := protocol.NewMessageBuffer()
+		readChunk := make([]byte, 1024)
+		for request := (*protocol.Message)(nil); request == nil; request, _ = buffer.TryDeserialize() {
+			n, err := conn.Read(readChunk)
+			if err != nil {
+				t.Errorf("fake server read failed: %v", err)
+				return
+			}
+			buffer.AddData(readChunk[:n])
+		}
+		responsePayload, _ := protocol.SerializeResponse(true, "Starting chunked download", startData)
+		writeSecureForTest(t, conn, aesKey, protocol.MessageTypeResponse, responsePayload)
+
+		payload, err := protocol.SerializeChunkDataVersion(&protocol.ChunkDataMessage{
+			Filename:    "report.txt",
+			ChunkIndex:  0,
+			TotalChunks: 2,
+			ChunkSize:   11,
+			TotalSize:   uint64(len(content)),
+			Data:        []byte(content[:11]),
+		}, protocol.ProtocolVersionDownloadComplete)
+		require.NoError(t, err)
+		writeSecureForTest(t, conn, aesKey, protocol.MessageTypeData, payload)
+		finish()
+	}
+
+	tests := []struct {
+		name   string
+		finish func(t *testing.T, conn net.Conn, aesKey []byte)
+	}{
+		{"server dies mid-stream", func(t *testing.T, conn net.Conn, aesKey []byte) {
+			conn.Close()
+		}},
+		{"completion after a lost chunk", func(t *testing.T, conn net.Conn, aesKey []byte) {
+			responsePayload, _ := protocol.SerializeResponse(true, protocol.DownloadCompleteMessage, protocol.SerializeDownloadComplete(2))
+			writeSecureForTest(t, conn, aesKey, protocol.MessageTypeResponse, responsePayload)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, serverConn, aesKey := newPipeClientForTest(t)
+			c.protocolVersion = protocol.ProtocolVersionDownloadComplete
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				serve(t, serverConn, aesKey, func() { tt.finish(t, serverConn, aesKey) })
+			}()
+
+			data, err := c.DownloadBytes(context.Background(), "report.txt")
+			<-done
+			assert.Nil(t, data)
+			assert.True(t, errors.Is(err, ErrIncompleteDownload), "unexpected error: %v", err)
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package entity
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+)
+
+// Errors a failed command matches with errors.Is, according to the error code the
+// server sent. Servers before protocol.ProtocolVersionErrorCodes send no code, so only
+// the message describes their failures.
+var (
+	// ErrFileNotFound is returned when the named file or directory does not exist on the server
+	ErrFileNotFound = errors.New("file not found")
+	// ErrInvalidPath is returned when the server rejects a name, e.g. one escaping the client directory
+	ErrInvalidPath = errors.New("invalid path")
+	// ErrQuotaExceeded is returned when a write would exceed the storage quota or size limit
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrServerIO is returned when the server fails to read or write its storage
+	ErrServerIO = errors.New("server I/O error")
+	// ErrInvalidRequest is returned when the server rejects a command as malformed or out of place
+	ErrInvalidRequest = errors.New("invalid request")
+	// ErrFileExists is returned when the target exists and the server refuses to replace it
+	ErrFileExists = errors.New("file already exists")
+	// ErrServerBusy is returned when the server is at a resource limit; retrying later may succeed
+	ErrServerBusy = errors.New("server busy")
+	// ErrUnsupported is returned when the server does not offer the command or feature
+	ErrUnsupported = errors.New("not supported by server")
+)
+
+// errorCodes maps the server's error codes to the errors above
+var errorCodes = map[protocol.ErrorCode]error{
+	protocol.ErrCodeNotFound:       ErrFileNotFound,
+	protocol.ErrCodeInvalidPath:    ErrInvalidPath,
+	protocol.ErrCodeQuotaExceeded:  ErrQuotaExceeded,
+	protocol.ErrCodeIO:             ErrServerIO,
+	protocol.ErrCodeInvalidRequest: ErrInvalidRequest,
+	protocol.ErrCodeExists:         ErrFileExists,
+	protocol.ErrCodeBusy:           ErrServerBusy,
+	protocol.ErrCodeUnsupported:    ErrUnsupported,
+}
+
+// commandError is a failed response. Its text is the server's message, and it unwraps
+// to the error matching the response's code, if any.
+type commandError struct {
+	operation string
+	message   string
+	code      protocol.ErrorCode
+}
+
+func (e *commandError) Error() string {
+	return fmt.Sprintf("%s failed: %s", e.operation, e.message)
+}
+
+func (e *commandError) Unwrap() error {
+	return errorCodes[e.code]
+}
+
+// responseError returns the error for a failed response to operation
+func responseError(operation string, respMsg *protocol.ResponseMessage) error {
+	return &commandError{operation: operation, message: respMsg.Message, code: respMsg.ErrorCode}
+}
@@ -0,0 +1,32 @@
+package entity
+
+import (
+	"fmt"
+	"os"
+
+	rsautil "github.com/lcensies/ssnproj/pkg/rsa"
+)
+
+// identityDirMode keeps the client's identity directory private to its owner
+const identityDirMode = 0700
+
+// LoadOrCreateClientIdentity loads the client's long-lived RSA key pair from dir,
+// generating and persisting a new one on first use. The directory is restricted
+// to the owner and the private key is written with 0600 permissions.
+func LoadOrCreateClientIdentity(dir string) (*rsautil.RSAKeyPair, error) {
+	if err := os.MkdirAll(dir, identityDirMode); err != nil {
+		return nil, fmt.Errorf("failed to create identity directory: %w", err)
+	}
+
+	// MkdirAll leaves existing directories untouched, so tighten them explicitly
+	if err := os.Chmod(dir, identityDirMode); err != nil {
+		return nil, fmt.Errorf("failed to secure identity directory: %w", err)
+	}
+
+	keyPair, err := rsautil.LoadKeypair(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client identity: %w", err)
+	}
+
+	return keyPair, nil
+}
@@ -0,0 +1,33 @@
+package entity
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadOrCreateClientIdentity(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "identity")
+
+	// First call generates and persists a key pair
+	created, err := LoadOrCreateClientIdentity(dir)
+	require.NoError(t, err)
+	require.NotNil(t, created.Private)
+
+	dirInfo, err := os.Stat(dir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), dirInfo.Mode().Perm(), "identity directory should be owner-only")
+
+	privInfo, err := os.Stat(filepath.Join(dir, "private.pem"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), privInfo.Mode().Perm(), "private key should be owner-only")
+
+	// Second call loads the same key pair
+	loaded, err := LoadOrCreateClientIdentity(dir)
+	require.NoError(t, err)
+	assert.True(t, created.Private.Equal(loaded.Private), "private key should be reused")
+	assert.True(t, created.Public.Equal(loaded.Public), "public key should be reused")
+}
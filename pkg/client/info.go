@@ -0,0 +1,85 @@
+package entity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// ServerInfo describes the limits the server enforces
+type ServerInfo = protocol.ServerInfo
+
+// ErrExceedsServerLimit is returned when an operation is refused locally because
+// it would break a limit reported by ServerInfo
+var ErrExceedsServerLimit = errors.New("exceeds server limit")
+
+// ServerInfo fetches the server's limits and caches them, so later uploads that
+// would be refused are rejected before any data is sent.
+func (c *Client) ServerInfo(ctx context.Context) (*ServerInfo, error) {
+	respMsg, err := c.runCommand(ctx, protocol.CommandInfo, "", nil, "info")
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := protocol.DeserializeServerInfo(respMsg.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse server info: %w", err)
+	}
+
+	c.serverInfo.Store(info)
+	c.logger.Info("Server limits",
+		zap.Int64("max_upload_size", info.MaxUploadSize),
+		zap.Uint16("max_filename_length", info.MaxFilenameLength),
+		zap.Uint16("max_path_length", info.MaxPathLength),
+		zap.Strings("ciphers", info.Ciphers))
+
+	return info, nil
+}
+
+// checkUploadLimits validates an upload against the cached server limits.
+// Nothing is checked until ServerInfo has been called.
+func (c *Client) checkUploadLimits(name string, size int64) error {
+	info := c.serverInfo.Load()
+	if info == nil {
+		return nil
+	}
+
+	if info.MaxUploadSize > 0 && size > info.MaxUploadSize {
+		return fmt.Errorf("%w: %s is %d bytes, server accepts at most %d", ErrExceedsServerLimit, name, size, info.MaxUploadSize)
+	}
+	if info.Quota > 0 && size > info.Quota {
+		return fmt.Errorf("%w: %s is %d bytes, quota is %d", ErrExceedsServerLimit, name, size, info.Quota)
+	}
+	if info.MaxPathLength > 0 && len(name) > int(info.MaxPathLength) {
+		return fmt.Errorf("%w: path %q is longer than %d bytes", ErrExceedsServerLimit, name, info.MaxPathLength)
+	}
+	if info.MaxFilenameLength > 0 {
+		for _, element := range strings.Split(name, "/") {
+			if len(element) > int(info.MaxFilenameLength) {
+				return fmt.Errorf("%w: filename %q is longer than %d bytes", ErrExceedsServerLimit, element, info.MaxFilenameLength)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Usage returns how many bytes of files the client stores on the server and its
+// quota, zero when the server sets none. Uploads staged in an open transaction count
+// towards the total, as they do towards the quota.
+func (c *Client) Usage(ctx context.Context) (used int64, quota int64, err error) {
+	respMsg, err := c.runCommand(ctx, protocol.CommandUsage, "", nil, "usage")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	used, quota, err = protocol.DeserializeUsage(respMsg.Data)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse usage: %w", err)
+	}
+	return used, quota, nil
+}
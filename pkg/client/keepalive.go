@@ -0,0 +1,96 @@
+package entity
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net"
+	"time"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// markActive records that the connection just carried a message, see keepAlive
+func (c *Client) markActive() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// startKeepAlive begins the heartbeat set by WithKeepAliveInterval, once per client
+func (c *Client) startKeepAlive() {
+	if c.keepAliveInterval <= 0 || c.stopKeepAlive != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.stopKeepAlive = cancel
+	c.markActive()
+	go c.keepAlive(ctx)
+}
+
+// keepAlive pings the server whenever the connection has been idle for the keep-alive
+// interval. A ping that gets no answer within the interval closes the connection, so
+// the next call fails at once (or reconnects, see WithRetryPolicy) instead of waiting
+// on a path that dropped silently. Busy connections are left alone: an exchange in
+// progress shows the peer is there, or will fail by its own deadline.
+func (c *Client) keepAlive(ctx context.Context) {
+	ticker := time.NewTicker(c.keepAliveInterval)
+	defer ticker.Stop()
+
+	var dead net.Conn
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if time.Since(time.Unix(0, c.lastActive.Load())) < c.keepAliveInterval {
+			continue
+		}
+		if !c.exchangeMu.TryLock() {
+			continue
+		}
+		c.asyncMu.Lock()
+		busy := len(c.asyncPending) > 0
+		c.asyncMu.Unlock()
+		if !busy && c.conn != dead {
+			if err := c.heartbeat(ctx); err != nil && ctx.Err() == nil {
+				c.logger.Warn("Keep-alive failed, closing connection", zap.Error(err))
+				c.conn.Close()
+				dead = c.conn
+			}
+		}
+		c.exchangeMu.Unlock()
+	}
+}
+
+// heartbeat sends one ping and waits up to the keep-alive interval for its echo.
+// The caller holds exchangeMu.
+func (c *Client) heartbeat(ctx context.Context) error {
+	nonce := make([]byte, pingNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	cmdPayload, err := protocol.SerializeCommand(protocol.CommandPing, "", nonce)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.keepAliveInterval)
+	defer cancel()
+	c.conn.SetWriteDeadline(time.Now().Add(c.keepAliveInterval))
+	defer c.conn.SetWriteDeadline(time.Time{})
+	if err := c.SendSecureMessage(protocol.NewMessage(protocol.MessageTypeCommand, cmdPayload)); err != nil {
+		return err
+	}
+	respMsg, err := c.receiveResponse(ctx)
+	if err != nil {
+		return err
+	}
+	if !respMsg.Success {
+		return responseError("ping", respMsg)
+	}
+	if !bytes.Equal(respMsg.Data, nonce) {
+		return ErrPingMismatch
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package entity
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	rsautil "github.com/lcensies/ssnproj/pkg/rsa"
+)
+
+// ClientOption configures optional client behaviour
+type ClientOption func(*Client)
+
+// WithNamespace makes the client store its files in the server directory for name
+// under its identity, which WithIdentity must set; the server refuses a namespace
+// without one. Clients using the same identity and namespace share files, e.g. a team
+// sharing an identity directory; without a namespace each session gets its own directory.
+func WithNamespace(name string) ClientOption {
+	return func(c *Client) {
+		c.namespace = name
+	}
+}
+
+// WithDialTimeout bounds connection establishment independently of the context deadline
+func WithDialTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.dialer.Timeout = timeout
+	}
+}
+
+// WithKeepAlive sets the TCP keep-alive period. A negative period disables keep-alives;
+// zero keeps the operating system default.
+func WithKeepAlive(period time.Duration) ClientOption {
+	return func(c *Client) {
+		c.dialer.KeepAlive = period
+	}
+}
+
+// WithKeepAliveInterval makes the client ping the server whenever the connection has
+// been idle for interval, closing it if the ping is not answered within another
+// interval. Unlike TCP keep-alives (WithKeepAlive) this notices paths that drop packets
+// silently, e.g. NAT or load balancer state that has expired. Zero, the default,
+// disables the heartbeat. A server with an IdleTimeout longer than interval keeps such
+// connections open indefinitely.
+func WithKeepAliveInterval(interval time.Duration) ClientOption {
+	return func(c *Client) {
+		c.keepAliveInterval = interval
+	}
+}
+
+// WithLocalAddr binds the connection to a local address, e.g. to pick an interface.
+// A nil address lets the system choose.
+func WithLocalAddr(addr *net.TCPAddr) ClientOption {
+	return func(c *Client) {
+		// Avoid storing a typed nil in the net.Addr interface
+		if addr == nil {
+			c.dialer.LocalAddr = nil
+			return
+		}
+		c.dialer.LocalAddr = addr
+	}
+}
+
+// WithDualStackFallback sets how long to wait for the preferred address family before
+// racing the other one (RFC 6555). A negative delay disables the fallback.
+func WithDualStackFallback(delay time.Duration) ClientOption {
+	return func(c *Client) {
+		c.dialer.FallbackDelay = delay
+	}
+}
+
+// WithMaxDownloadBytes sets the largest file DownloadBytes will hold in memory
+func WithMaxDownloadBytes(limit int64) ClientOption {
+	return func(c *Client) {
+		c.maxDownloadBytes = limit
+	}
+}
+
+// WithMaxDownloadSize sets the largest file DownloadFile and DownloadToWriter accept,
+// DefaultMaxDownloadSize unless set. Larger files fail with ErrDownloadTooLarge before
+// any of their data is written. A negative limit removes the cap.
+func WithMaxDownloadSize(limit int64) ClientOption {
+	return func(c *Client) {
+		c.maxDownloadSize = limit
+	}
+}
+
+// WithDownloadStreams makes DownloadFile fetch each file over n connections in parallel,
+// which helps on high-latency links. The extra connections join the current session by
+// reusing its key. Values below 2 keep the single-connection transfer.
+func WithDownloadStreams(n int) ClientOption {
+	return func(c *Client) {
+		c.downloadStreams = n
+	}
+}
+
+// WithAdaptiveChunkSize makes the client choose the chunk size of its downloads from
+// how the previous ones went, starting small and growing while throughput holds up,
+// halving when it drops or a connection is lost (see TransferStats.ChunkSize). It
+// replaces SetPreferredChunkSize; servers older than protocol revision 4 ignore it.
+func WithAdaptiveChunkSize() ClientOption {
+	return func(c *Client) {
+		c.chunkControl = newChunkController()
+	}
+}
+
+// WithSessionKeySize picks the AES session key size (128, 192 or 256 bits, default 256).
+// Servers may refuse keys below their configured minimum.
+func WithSessionKeySize(bits int) ClientOption {
+	return func(c *Client) {
+		c.sessionKeyBits = bits
+	}
+}
+
+// WithIdentity authenticates the client with a long-lived key pair, e.g. from
+// LoadOrCreateClientIdentity. The server then keeps the client's files in a directory
+// tied to this key, so they remain available after reconnecting.
+func WithIdentity(keyPair *rsautil.RSAKeyPair) ClientOption {
+	return func(c *Client) {
+		c.identity = keyPair
+	}
+}
+
+// WithDownloadVerification controls whether downloads are checked against the whole-file
+// SHA-256 the server reports (on by default). DownloadFile deletes output that fails.
+func WithDownloadVerification(enabled bool) ClientOption {
+	return func(c *Client) {
+		c.skipDownloadVerification = !enabled
+	}
+}
+
+// WithTLS connects over TLS with config instead of running the RSA/AES handshake, for
+// servers started with ServerConfig.TLSConfig. The server's public key is not needed.
+// Namespaces, identities and parallel download streams rely on the RSA/AES handshake
+// and are not available over TLS; downloads use a single connection.
+func WithTLS(config *tls.Config) ClientOption {
+	return func(c *Client) {
+		c.tlsConfig = config
+	}
+}
+
+// WithRetryPolicy makes the client reconnect and retry operations that are safe to
+// repeat when the connection fails, see RetryPolicy
+func WithRetryPolicy(policy RetryPolicy) ClientOption {
+	return func(c *Client) {
+		c.retry = policy
+	}
+}
@@ -0,0 +1,65 @@
+package entity
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestNewClient_DialTimeout(t *testing.T) {
+	// The context alone would allow a long wait; the dial timeout must cut it short.
+	// 192.0.2.1 (TEST-NET-1) is reserved and unreachable, and a 1ns timeout expires
+	// before any connection attempt can complete regardless of the network.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	client, err := NewClient(ctx, "192.0.2.1", "9", nil, zap.NewNop(), WithDialTimeout(time.Nanosecond))
+	elapsed := time.Since(start)
+
+	require.Error(t, err)
+	assert.Nil(t, client)
+
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout(), "expected a timeout error, got %v", err)
+	assert.Less(t, elapsed, 5*time.Second, "dial timeout should fire well before the context deadline")
+}
+
+func TestNewClient_LocalAddr(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn.RemoteAddr()
+		conn.Close()
+	}()
+
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+
+	client, err := NewClient(context.Background(), host, port, nil, zap.NewNop(),
+		WithLocalAddr(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}),
+		WithKeepAlive(15*time.Second),
+		WithDualStackFallback(-1))
+	require.NoError(t, err)
+	defer client.Close(context.Background())
+
+	select {
+	case remote := <-accepted:
+		assert.Equal(t, "127.0.0.1", remote.(*net.TCPAddr).IP.String())
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not accept the connection")
+	}
+}
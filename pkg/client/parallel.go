@@ -0,0 +1,302 @@
+package entity
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// maxDownloadStreams caps WithDownloadStreams; beyond a handful of connections the
+// handshakes cost more than the parallelism gains
+const maxDownloadStreams = 32
+
+// openStream dials another connection to the server and joins it to this session by
+// handshaking with the same session key, so the server serves it from the same directory
+func (c *Client) openStream(ctx context.Context) (*Client, error) {
+	conn, err := c.dialer.DialContext(ctx, "tcp", c.conn.RemoteAddr().String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open download stream: %w", err)
+	}
+	stream := &Client{
+		conn:         conn,
+		logger:       c.logger,
+		serverPubKey: c.serverPubKey,
+		aesKey:       c.aesKey,
+		namespace:    c.namespace,
+		dialer:       c.dialer,
+		identity:     c.identity,
+	}
+	if err := stream.exchangeHandshake(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open download stream: %w", err)
+	}
+	return stream, nil
+}
+
+// chunkCoverage records which chunks of a download have been written, one bit per
+// chunk, so tracking them costs far less than the chunks themselves
+type chunkCoverage struct {
+	mu       sync.Mutex
+	received []uint64
+	total    uint32
+	claimed  uint32
+}
+
+// newChunkCoverage tracks a download of total chunks
+func newChunkCoverage(total uint32) *chunkCoverage {
+	return &chunkCoverage{received: make([]uint64, (uint64(total)+63)/64), total: total}
+}
+
+// claim marks chunk index as received, failing if it was already or is out of range
+func (cov *chunkCoverage) claim(index uint32) error {
+	cov.mu.Lock()
+	defer cov.mu.Unlock()
+	if index >= cov.total {
+		return fmt.Errorf("chunk %d out of range, the download has %d chunks", index, cov.total)
+	}
+	word, bit := index/64, uint64(1)<<(index%64)
+	if cov.received[word]&bit != 0 {
+		return fmt.Errorf("chunk %d received twice", index)
+	}
+	cov.received[word] |= bit
+	cov.claimed++
+	return nil
+}
+
+// missing returns the number of chunks not yet received
+func (cov *chunkCoverage) missing() int {
+	cov.mu.Lock()
+	defer cov.mu.Unlock()
+	return int(cov.total - cov.claimed)
+}
+
+// downloadParallel downloads filename into file over c.downloadStreams connections. The
+// server splits the chunks between the streams and each chunk is written at its own
+// offset, so chunks may arrive in any order. A non-nil resume continues after the data
+// already in file. A non-nil progress is told how much of the file has arrived after
+// every chunk, whichever stream it came on, and a non-nil meter counts the chunks.
+func (c *Client) downloadParallel(ctx context.Context, filename string, file *os.File, resume *resumePoint, progress ProgressFunc, meter *transferMeter) error {
+	c.logger.Info("Downloading file", zap.String("filename", filename), zap.Int("streams", c.downloadStreams))
+
+	defer c.lockExchange()()
+
+	streams := []*Client{c}
+	defer func() {
+		for _, stream := range streams[1:] {
+			stream.conn.Close()
+		}
+	}()
+	for len(streams) < min(c.downloadStreams, maxDownloadStreams) {
+		stream, err := c.openStream(ctx)
+		if err != nil {
+			return err
+		}
+		streams = append(streams, stream)
+	}
+
+	var offset uint64
+	var prefixSum [sha256.Size]byte
+	if resume != nil {
+		offset = resume.offset
+		prefixSum = resume.prefixSum
+		c.logger.Info("Resuming download", zap.String("filename", filename), zap.Uint64("offset", offset))
+	}
+
+	// Every stream asks for its share before any data is read
+	for i, stream := range streams {
+		cmdData := protocol.SerializeDownloadRequest(&protocol.DownloadRequest{
+			Offset:    offset,
+			PrefixSum: prefixSum,
+			Stream:    uint16(i),
+			Streams:   uint16(len(streams)),
+			ChunkSize: c.requestedChunkSize(),
+		})
+		cmdPayload, err := protocol.SerializeCommand(protocol.CommandDownload, filename, cmdData)
+		if err != nil {
+			return fmt.Errorf(errSerializeCommand, err)
+		}
+		if err := stream.SendSecureMessage(protocol.NewMessage(protocol.MessageTypeCommand, cmdPayload)); err != nil {
+			return fmt.Errorf("failed to send download command: %w", err)
+		}
+	}
+
+	// All streams report the same file; the first start response sizes the coverage map
+	type startInfo struct {
+		size uint64
+		sum  []byte
+	}
+	starts := make([]startInfo, len(streams))
+	for i, stream := range streams {
+		respMsg, err := stream.receiveResponse(ctx)
+		if err != nil {
+			return err
+		}
+		if !respMsg.Success {
+			if resume != nil && strings.HasPrefix(respMsg.Message, protocol.ResumeRejectedMessage) {
+				return fmt.Errorf("%w: %s", errResumeRejected, respMsg.Message)
+			}
+			return responseError("download", respMsg)
+		}
+		if len(respMsg.Data) != 8+sha256.Size {
+			return fmt.Errorf("download failed: start response has %d bytes of data", len(respMsg.Data))
+		}
+		starts[i] = startInfo{size: binary.BigEndian.Uint64(respMsg.Data), sum: respMsg.Data[8:]}
+		if starts[i].size != starts[0].size || !bytes.Equal(starts[i].sum, starts[0].sum) {
+			return fmt.Errorf("download failed: %s changed while opening streams", filename)
+		}
+	}
+	size := starts[0].size
+	if size < offset {
+		return fmt.Errorf("download failed: server file is %d bytes, shorter than the %d already held", size, offset)
+	}
+
+	if limit := c.downloadLimit(); limit > 0 && size > uint64(limit) {
+		return fmt.Errorf("%w: %s is %d bytes (limit %d)", ErrDownloadTooLarge, filename, size, limit)
+	}
+
+	remaining := size - offset
+	chunkSize := protocol.PreferredChunkSize(remaining, c.requestedChunkSize())
+	totalChunks := protocol.ChunkCount(remaining, chunkSize)
+	coverage := newChunkCoverage(totalChunks)
+	var output io.WriterAt = file
+	var counter *progressCounter
+	if progress != nil {
+		counter = &progressCounter{progress: progress, done: offset, total: size}
+		output = &progressWriterAt{w: file, counter: counter}
+	}
+	output = metered(output, meter)
+	c.logger.Info("Receiving file chunks",
+		zap.String("filename", filename),
+		zap.Uint64("totalSize", remaining),
+		zap.Uint32("totalChunks", totalChunks),
+		zap.Int("streams", len(streams)))
+
+	// The first stream to fail cancels the others, which may be waiting on a server that stopped sending
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	for i, stream := range streams {
+		first, end := protocol.StreamChunkRange(totalChunks, uint16(i), uint16(len(streams)))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := stream.receiveChunksAt(streamCtx, filename, output, offset, remaining, chunkSize, first, end, coverage)
+			if err == nil {
+				return
+			}
+			errOnce.Do(func() {
+				firstErr = err
+				cancel()
+			})
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if missing := coverage.missing(); missing > 0 {
+		return fmt.Errorf("incomplete download: %d of %d chunks missing", missing, totalChunks)
+	}
+
+	if !c.skipDownloadVerification {
+		fileHash := sha256.New()
+		if _, err := io.Copy(fileHash, io.NewSectionReader(file, 0, int64(size))); err != nil {
+			return fmt.Errorf("failed to verify download: %w", err)
+		}
+		if !bytes.Equal(fileHash.Sum(nil), starts[0].sum) {
+			return fmt.Errorf("%w: %s", ErrDownloadChecksum, filename)
+		}
+	}
+
+	if counter != nil {
+		counter.finish()
+	}
+
+	c.logger.Info("Download finished",
+		zap.String("filename", filename),
+		zap.Uint64("size", size),
+		zap.Uint32("chunks", totalChunks))
+	return nil
+}
+
+// receiveChunksAt receives the chunks [first, end) of a parallel download, writing each
+// at its place after base. totalSize is the size of the data after base, sent in chunks
+// of chunkSize bytes.
+func (c *Client) receiveChunksAt(ctx context.Context, filename string, w io.WriterAt, base uint64, totalSize uint64, chunkSize uint32, first, end uint32, coverage *chunkCoverage) error {
+	totalChunks := protocol.ChunkCount(totalSize, chunkSize)
+
+	for received := first; received < end; received++ {
+		chunkMsg, err := c.ReceiveSecureMessage(ctx)
+		if err != nil {
+			return fmt.Errorf("%w: connection lost after %d of %d chunks: %v", ErrIncompleteDownload, received-first, end-first, err)
+		}
+		if chunkMsg.Type != protocol.MessageTypeData {
+			return fmt.Errorf("unexpected message type during chunked download: %v", chunkMsg.Type)
+		}
+
+		chunk, err := c.decodeChunk(chunkMsg.Payload)
+		if err != nil {
+			return err
+		}
+		if chunk.Filename != filename {
+			return fmt.Errorf("chunk filename mismatch: expected %s, got %s", filename, chunk.Filename)
+		}
+		if chunk.TotalSize != totalSize || chunk.TotalChunks != totalChunks {
+			return fmt.Errorf("chunk %d describes a different transfer: %d bytes in %d chunks, expected %d in %d",
+				chunk.ChunkIndex, chunk.TotalSize, chunk.TotalChunks, totalSize, totalChunks)
+		}
+		if chunk.ChunkIndex < first || chunk.ChunkIndex >= end {
+			return fmt.Errorf("chunk %d outside this stream's range [%d, %d)", chunk.ChunkIndex, first, end)
+		}
+
+		// Every chunk but the last is full, so the index fixes both position and length
+		position := uint64(chunk.ChunkIndex) * uint64(chunkSize)
+		want := min(uint64(chunkSize), totalSize-position)
+		if uint64(len(chunk.Data)) != want {
+			return fmt.Errorf("chunk %d has %d bytes, expected %d", chunk.ChunkIndex, len(chunk.Data), want)
+		}
+		if err := coverage.claim(chunk.ChunkIndex); err != nil {
+			return err
+		}
+		if _, err := w.WriteAt(chunk.Data, int64(base+position)); err != nil {
+			return fmt.Errorf("failed to write chunk %d: %w", chunk.ChunkIndex, err)
+		}
+
+		c.logger.Debug("Received chunk",
+			zap.String("filename", filename),
+			zap.Uint32("chunkIndex", chunk.ChunkIndex),
+			zap.Uint32("chunkSize", chunk.ChunkSize))
+	}
+
+	if c.wireVersion() < protocol.ProtocolVersionDownloadComplete {
+		return nil
+	}
+	response, err := c.ReceiveSecureMessage(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: connection lost before completion: %v", ErrIncompleteDownload, err)
+	}
+	if response.Type != protocol.MessageTypeResponse {
+		return fmt.Errorf("chunks beyond this stream's range [%d, %d)", first, end)
+	}
+	sent, err := c.downloadCompletion(response.Payload)
+	if err != nil {
+		return err
+	}
+	if sent != end-first {
+		return fmt.Errorf("%w: server sent %d chunks on this stream, expected %d", ErrIncompleteDownload, sent, end-first)
+	}
+	return nil
+}
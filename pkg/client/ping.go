@@ -0,0 +1,36 @@
+package entity
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+)
+
+// pingNonceSize is the length of the random nonce a ping asks the server to echo
+const pingNonceSize = 16
+
+// ErrPingMismatch is returned by Ping when the server echoes something other than the nonce sent
+var ErrPingMismatch = errors.New("ping response does not echo the nonce")
+
+// Ping checks that the connection is alive and that both sides still share the session
+// key, by having the server echo a random nonce through the encrypted channel. It is
+// cheap enough to run before a large upload or from a health check.
+func (c *Client) Ping(ctx context.Context) error {
+	nonce := make([]byte, pingNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate ping nonce: %w", err)
+	}
+
+	respMsg, err := c.runCommand(ctx, protocol.CommandPing, "", nonce, "ping")
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(respMsg.Data, nonce) {
+		return ErrPingMismatch
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package entity
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	aesutil "github.com/lcensies/ssnproj/pkg/aes"
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// servePing answers a single CommandPing on conn, passing the nonce through echo. Like
+// the real server it drops the connection when the command does not decrypt.
+func servePing(t *testing.T, conn net.Conn, aesKey []byte, echo func([]byte) []byte) {
+	buffer := protocol.NewMessageBuffer()
+	chunk := make([]byte, 1024)
+
+	var request *protocol.Message
+	for request == nil {
+		n, err := conn.Read(chunk)
+		if err != nil {
+			t.Errorf("fake server read failed: %v", err)
+			return
+		}
+		buffer.AddData(chunk[:n])
+		request, _ = buffer.TryDeserialize()
+	}
+
+	if err := request.Decrypt(aesKey); err != nil {
+		conn.Close()
+		return
+	}
+	command, err := protocol.DeserializeCommand(request.Payload)
+	if err != nil || command.Command != protocol.CommandPing {
+		t.Errorf("fake server expected a ping command, got %v (%v)", command, err)
+		return
+	}
+	if len(command.Data) != pingNonceSize {
+		t.Errorf("ping nonce is %d bytes, want %d", len(command.Data), pingNonceSize)
+	}
+
+	responsePayload, _ := protocol.SerializeResponse(true, "pong", echo(command.Data))
+	writeSecureForTest(t, conn, aesKey, protocol.MessageTypeResponse, responsePayload)
+}
+
+func TestPing(t *testing.T) {
+	otherKey, err := aesutil.GenerateKey()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		wrongKey bool
+		echo     func([]byte) []byte
+		check    func(t *testing.T, err error)
+	}{
+		{
+			name:  "echoed nonce",
+			echo:  func(nonce []byte) []byte { return nonce },
+			check: func(t *testing.T, err error) { assert.NoError(t, err) },
+		},
+		{
+			name: "altered nonce",
+			echo: func(nonce []byte) []byte {
+				altered := append([]byte(nil), nonce...)
+				altered[0] ^= 0xff
+				return altered
+			},
+			check: func(t *testing.T, err error) { assert.ErrorIs(t, err, ErrPingMismatch) },
+		},
+		{
+			name:     "wrong session key",
+			wrongKey: true,
+			echo:     func(nonce []byte) []byte { return nonce },
+			check:    func(t *testing.T, err error) { assert.Error(t, err) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, serverConn, aesKey := newPipeClientForTest(t)
+			if tt.wrongKey {
+				c.aesKey = otherKey
+			}
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				servePing(t, serverConn, aesKey, tt.echo)
+			}()
+
+			err := c.Ping(context.Background())
+			<-done
+			tt.check(t, err)
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package entity
+
+import (
+	"io"
+	"sync"
+)
+
+// ProgressFunc is told how many bytes of a transfer are done after every chunk and once
+// more, with transferred equal to total, when the transfer completes. total is 0 while
+// the size of a streamed upload is still unknown. A nil ProgressFunc does nothing.
+type ProgressFunc func(transferred, total uint64)
+
+// report calls p, if set
+func (p ProgressFunc) report(transferred, total uint64) {
+	if p != nil {
+		p(transferred, total)
+	}
+}
+
+// progressCounter accumulates the bytes written by one or more download streams and
+// reports them one call at a time, so callbacks need not be safe for concurrent use
+type progressCounter struct {
+	mu       sync.Mutex
+	progress ProgressFunc
+	done     uint64
+	total    uint64
+	reported bool
+}
+
+// add counts n more bytes and reports the new total
+func (pc *progressCounter) add(n int) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.done += uint64(n)
+	pc.reported = pc.done == pc.total
+	pc.progress.report(pc.done, pc.total)
+}
+
+// finish reports completion unless the last chunk already did, e.g. for empty files
+// or a resume that had nothing left to fetch
+func (pc *progressCounter) finish() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if !pc.reported {
+		pc.progress.report(pc.total, pc.total)
+	}
+}
+
+// progressWriterAt counts what is written through it, from any number of goroutines
+type progressWriterAt struct {
+	w       io.WriterAt
+	counter *progressCounter
+}
+
+func (pw *progressWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	n, err := pw.w.WriteAt(p, off)
+	pw.counter.add(n)
+	return n, err
+}
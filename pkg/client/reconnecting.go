@@ -0,0 +1,128 @@
+package entity
+
+import (
+	"context"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// ReconnectingClient keeps a long-lived session, such as the interactive CLI, going
+// across server restarts. When a command fails because the connection dropped, it dials
+// again, handshakes with the same session key and identity, so the server serves the
+// same directory, and runs the command once more.
+//
+// Unlike RetryPolicy it repeats every command, uploads, deletes and renames included: a
+// command the server applied just before the connection dropped may run twice. Methods
+// it does not override run on the embedded Client without reconnecting.
+type ReconnectingClient struct {
+	*Client
+}
+
+// NewReconnectingClient wraps client, which must have completed its handshake
+func NewReconnectingClient(client *Client) *ReconnectingClient {
+	return &ReconnectingClient{Client: client}
+}
+
+// Do runs op, reconnecting and running it once more if it failed with a connection error
+func (rc *ReconnectingClient) Do(ctx context.Context, operation string, op func() error) error {
+	err := op()
+	if err == nil || !isConnectionError(err) || ctx.Err() != nil {
+		return err
+	}
+
+	rc.logger.Warn("Connection lost, reconnecting",
+		zap.String("operation", operation),
+		zap.Error(err))
+	if reconnectErr := rc.reconnect(ctx); reconnectErr != nil {
+		return fmt.Errorf("%s: failed to reconnect: %w", operation, reconnectErr)
+	}
+	rc.logger.Info("Reconnected to server", zap.String("operation", operation))
+	return op()
+}
+
+func (rc *ReconnectingClient) UploadFileWithStats(ctx context.Context, filename string, remoteName string, progress ProgressFunc) (stats TransferStats, err error) {
+	err = rc.Do(ctx, "upload", func() (err error) {
+		stats, err = rc.Client.UploadFileWithStats(ctx, filename, remoteName, progress)
+		return err
+	})
+	return stats, err
+}
+
+func (rc *ReconnectingClient) UploadFiles(ctx context.Context, filenames []string) (results []UploadResult, err error) {
+	err = rc.Do(ctx, "upload", func() (err error) {
+		results, err = rc.Client.UploadFiles(ctx, filenames)
+		return err
+	})
+	return results, err
+}
+
+func (rc *ReconnectingClient) DownloadFileWithStats(ctx context.Context, filename string, outputPath string, progress ProgressFunc) (stats TransferStats, err error) {
+	err = rc.Do(ctx, "download", func() (err error) {
+		stats, err = rc.Client.DownloadFileWithStats(ctx, filename, outputPath, progress)
+		return err
+	})
+	return stats, err
+}
+
+func (rc *ReconnectingClient) ListDir(ctx context.Context, dir string, recursive bool) (files []FileInfo, err error) {
+	err = rc.Do(ctx, "list", func() (err error) {
+		files, err = rc.Client.ListDir(ctx, dir, recursive)
+		return err
+	})
+	return files, err
+}
+
+func (rc *ReconnectingClient) MakeDir(ctx context.Context, path string) error {
+	return rc.Do(ctx, "mkdir", func() error {
+		return rc.Client.MakeDir(ctx, path)
+	})
+}
+
+func (rc *ReconnectingClient) DeleteFile(ctx context.Context, filename string) error {
+	return rc.Do(ctx, "delete", func() error {
+		return rc.Client.DeleteFile(ctx, filename)
+	})
+}
+
+func (rc *ReconnectingClient) DeleteFiles(ctx context.Context, pattern string) (deleted int, err error) {
+	err = rc.Do(ctx, "delete", func() (err error) {
+		deleted, err = rc.Client.DeleteFiles(ctx, pattern)
+		return err
+	})
+	return deleted, err
+}
+
+func (rc *ReconnectingClient) RenameFile(ctx context.Context, oldName string, newName string) error {
+	return rc.Do(ctx, "rename", func() error {
+		return rc.Client.RenameFile(ctx, oldName, newName)
+	})
+}
+
+func (rc *ReconnectingClient) CopyFile(ctx context.Context, src string, dst string) error {
+	return rc.Do(ctx, "copy", func() error {
+		return rc.Client.CopyFile(ctx, src, dst)
+	})
+}
+
+func (rc *ReconnectingClient) RestoreFile(ctx context.Context, filename string) error {
+	return rc.Do(ctx, "restore", func() error {
+		return rc.Client.RestoreFile(ctx, filename)
+	})
+}
+
+func (rc *ReconnectingClient) EmptyTrash(ctx context.Context) (purged int, err error) {
+	err = rc.Do(ctx, "empty trash", func() (err error) {
+		purged, err = rc.Client.EmptyTrash(ctx)
+		return err
+	})
+	return purged, err
+}
+
+func (rc *ReconnectingClient) Usage(ctx context.Context) (used int64, quota int64, err error) {
+	err = rc.Do(ctx, "usage", func() (err error) {
+		used, quota, err = rc.Client.Usage(ctx)
+		return err
+	})
+	return used, quota, err
+}
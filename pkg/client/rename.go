@@ -0,0 +1,33 @@
+package entity
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// RenameFile moves oldName to newName on the server without re-uploading it.
+// If newName exists, the server's collision policy decides whether it is replaced,
+// the rename is refused, or the file is stored under a versioned name.
+func (c *Client) RenameFile(ctx context.Context, oldName string, newName string) error {
+	c.logger.Info("Renaming file", zap.String("from", oldName), zap.String("to", newName))
+
+	if newName == "" {
+		return fmt.Errorf("rename failed: destination filename is empty")
+	}
+
+	cmdPayload, err := protocol.SerializeCommandFields(protocol.CommandRename, []byte(oldName), []byte(newName))
+	if err != nil {
+		return fmt.Errorf(errSerializeCommand, err)
+	}
+
+	respMsg, err := c.exchangeCommand(ctx, cmdPayload, "rename")
+	if err != nil {
+		return err
+	}
+
+	c.logger.Info("File renamed successfully", zap.String("stored_as", string(respMsg.Data)))
+	return nil
+}
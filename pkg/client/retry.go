@@ -0,0 +1,125 @@
+package entity
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RetryPolicy lets operations that are safe to repeat survive a dropped connection: the
+// client reconnects, handshakes again with the same session key so the server serves the
+// same directory, and runs the operation again. Listing and downloads are retried;
+// DownloadFile resumes from the data already written. Uploads, deletes and renames are
+// not, since a server that applied the command before the connection dropped could
+// apply it twice, e.g. storing a second copy under a collision policy that renames.
+type RetryPolicy struct {
+	// MaxRetries is how many times an operation is run again after its first attempt;
+	// zero disables retries
+	MaxRetries int
+	// Backoff is the wait before the first retry, doubled before each one after it
+	Backoff time.Duration
+}
+
+// DefaultResilientRetryPolicy is the retry policy of DownloadFileResilient on clients
+// without one of their own
+var DefaultResilientRetryPolicy = RetryPolicy{MaxRetries: 5, Backoff: 200 * time.Millisecond}
+
+// noRetryError carries an error that must be returned as is even though it looks like a
+// connection failure
+type noRetryError struct {
+	err error
+}
+
+func (e *noRetryError) Error() string { return e.err.Error() }
+
+// noRetry stops withRetry from retrying after err
+func noRetry(err error) error {
+	return &noRetryError{err: err}
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// isConnectionError reports whether err means the connection failed rather than the
+// server refusing the command
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, ErrIncompleteDownload) ||
+		errors.As(err, &netErr)
+}
+
+// withRetry runs op, reconnecting and running it again after connection failures as
+// the retry policy allows. Errors op marks with noRetry are returned unwrapped.
+func (c *Client) withRetry(ctx context.Context, operation string, op func() error) error {
+	return c.withRetryPolicy(ctx, c.retry, operation, op)
+}
+
+// withRetryPolicy is withRetry under policy instead of the client's retry policy
+func (c *Client) withRetryPolicy(ctx context.Context, policy RetryPolicy, operation string, op func() error) error {
+	err := op()
+	delay := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		var final *noRetryError
+		if errors.As(err, &final) {
+			return final.err
+		}
+		if err == nil || attempt > policy.MaxRetries || !isConnectionError(err) || ctx.Err() != nil {
+			return err
+		}
+
+		c.logger.Warn("Connection failed, retrying",
+			zap.String("operation", operation),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", delay),
+			zap.Error(err))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		delay *= 2
+
+		if reconnectErr := c.reconnect(ctx); reconnectErr != nil {
+			err = reconnectErr
+			continue
+		}
+		err = op()
+	}
+}
+
+// reconnect replaces the connection with a new one joined to the current session
+func (c *Client) reconnect(ctx context.Context) error {
+	defer c.lockExchange()()
+
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+
+	if c.tlsConfig != nil {
+		return c.startTLSSession()
+	}
+	return c.exchangeHandshake(ctx)
+}
@@ -0,0 +1,229 @@
+package entity
+
+import (
+	"bytes"
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	aesutil "github.com/lcensies/ssnproj/pkg/aes"
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// ErrSessionTicketRejected is returned by ResumeSession when the saved ticket has expired
+// or the server no longer accepts it. The connection is still open for PerformHandshake.
+var ErrSessionTicketRejected = errors.New("session ticket rejected")
+
+// Saved session files start with sessionFileMagic, then a random salt for deriving the
+// file key from the passphrase, then the session sealed with AES-GCM under that key
+const (
+	sessionFileMagic     = "SSNSESS1"
+	sessionSaltSize      = 16
+	sessionKDFIterations = 600000
+	sessionFileMode      = 0600
+)
+
+// savedSession is what a session file holds
+type savedSession struct {
+	key    []byte
+	ticket *protocol.SessionTicket
+}
+
+// SaveSession asks the server for a session ticket and writes it, with the session key,
+// to path encrypted under passphrase. A later client can pass the file to ResumeSession
+// to skip the RSA handshake until the ticket expires. The server must have session
+// tickets enabled, and sessions over TLS cannot be saved.
+func (c *Client) SaveSession(ctx context.Context, path string, passphrase string) error {
+	if c.tlsConfig != nil {
+		return errors.New("TLS sessions cannot be saved")
+	}
+	if c.aesKey == nil {
+		return errors.New("no session to save, perform the handshake first")
+	}
+
+	respMsg, err := c.runCommand(ctx, protocol.CommandSessionTicket, "", nil, "session ticket")
+	if err != nil {
+		return err
+	}
+	ticket, err := protocol.DeserializeSessionTicket(respMsg.Data)
+	if err != nil {
+		return err
+	}
+	if err := writeSessionFile(path, passphrase, &savedSession{key: c.aesKey, ticket: ticket}); err != nil {
+		return err
+	}
+
+	c.logger.Info("Saved session", zap.String("path", path), zap.Time("expires", ticket.Expires))
+	return nil
+}
+
+// ResumeSession restores the session saved at path in place of PerformHandshake. Tickets
+// are single-use, so the file is rewritten with the replacement the server sends; an
+// error doing so is returned although the session is then usable. When the ticket is
+// no longer accepted the error wraps ErrSessionTicketRejected and the caller can fall
+// back to PerformHandshake on the same connection.
+func (c *Client) ResumeSession(ctx context.Context, path string, passphrase string) error {
+	c.exchangeMu.Lock()
+	defer c.exchangeMu.Unlock()
+
+	if c.tlsConfig != nil {
+		return errors.New("TLS sessions cannot be resumed")
+	}
+	saved, err := readSessionFile(path, passphrase)
+	if err != nil {
+		return err
+	}
+	if !time.Now().Before(saved.ticket.Expires) {
+		return fmt.Errorf("%w: ticket expired at %s", ErrSessionTicketRejected, saved.ticket.Expires.Format(time.RFC3339))
+	}
+
+	// The options prove we hold the session key; the nonce keeps the confirmation fresh
+	nonce := make([]byte, protocol.HandshakeNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate handshake nonce: %w", err)
+	}
+	optionBytes, err := protocol.SerializeHandshakeOptions(&protocol.HandshakeOptions{
+		ProtocolVersion: protocol.ProtocolVersion,
+		Nonce:           nonce,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to serialize handshake options: %w", err)
+	}
+	request := &protocol.ResumeRequest{Ticket: saved.ticket.Ticket}
+	if request.Options, err = aesutil.Encrypt(optionBytes, saved.key); err != nil {
+		return fmt.Errorf("failed to encrypt handshake options: %w", err)
+	}
+	payload, err := protocol.SerializeResumeRequest(request)
+	if err != nil {
+		return err
+	}
+	if err := c.SendMessage(protocol.NewMessage(protocol.MessageTypeResume, payload)); err != nil {
+		return fmt.Errorf("failed to send session ticket: %w", err)
+	}
+
+	response, err := c.ReceiveMessage(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to receive resume confirmation: %w", err)
+	}
+	if response.Type != protocol.MessageTypeResponse {
+		return fmt.Errorf("unexpected message type: %v (expected response)", response.Type)
+	}
+	if err := response.Decrypt(saved.key); err != nil {
+		// Refusals are sent in the clear, the server may not have been able to read our key
+		if respMsg, parseErr := protocol.DeserializeResponse(response.Payload); parseErr == nil && !respMsg.Success {
+			if reason, ok := strings.CutPrefix(respMsg.Message, protocol.SessionTicketRejectedMessage+": "); ok {
+				return fmt.Errorf("%w: %s", ErrSessionTicketRejected, reason)
+			}
+			return fmt.Errorf("session resumption rejected: %s", respMsg.Message)
+		}
+		return fmt.Errorf("resume confirmation failed verification: %w", err)
+	}
+	respMsg, err := protocol.DeserializeResponse(response.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to deserialize resume confirmation: %w", err)
+	}
+	if !respMsg.Success {
+		return fmt.Errorf("session resumption rejected: %s", respMsg.Message)
+	}
+	confirmation, err := protocol.DeserializeResumeConfirmation(respMsg.Data)
+	if err != nil {
+		return fmt.Errorf("failed to parse resume confirmation: %w", err)
+	}
+	if !bytes.Equal(confirmation.Nonce, nonce) {
+		return errors.New("resume confirmation does not answer this request")
+	}
+
+	c.aesKey = saved.key
+	c.protocolVersion = protocol.NegotiateProtocolVersion(confirmation.Version)
+	c.logger.Info("Resumed session", zap.Uint16("protocol_version", c.protocolVersion))
+
+	if err := writeSessionFile(path, passphrase, &savedSession{key: saved.key, ticket: confirmation.Next}); err != nil {
+		return fmt.Errorf("session resumed, but the next ticket was not saved: %w", err)
+	}
+	return nil
+}
+
+// sessionFileKey derives the key sealing a session file from the passphrase
+func sessionFileKey(passphrase string, salt []byte) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, passphrase, salt, sessionKDFIterations, 32)
+}
+
+// writeSessionFile seals session under passphrase and replaces path with it
+func writeSessionFile(path string, passphrase string, session *savedSession) error {
+	// [key length (1)][key][ticket expiry and ticket, see SerializeSessionTicket]
+	plain := append([]byte{byte(len(session.key))}, session.key...)
+	plain = append(plain, protocol.SerializeSessionTicket(session.ticket)...)
+
+	salt := make([]byte, sessionSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("failed to generate salt: %w", err)
+	}
+	key, err := sessionFileKey(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	sealed, err := aesutil.Encrypt(plain, key)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt session: %w", err)
+	}
+	data := append([]byte(sessionFileMagic), salt...)
+	data = append(data, sealed...)
+
+	// Write beside the target and rename, so a crash never leaves half a file
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to save session: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(sessionFileMode); err == nil {
+		_, err = tmp.Write(data)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save session: %w", err)
+	}
+	return nil
+}
+
+// readSessionFile opens a session file written by writeSessionFile
+func readSessionFile(path string, passphrase string) (*savedSession, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session: %w", err)
+	}
+	if len(data) < len(sessionFileMagic)+sessionSaltSize || string(data[:len(sessionFileMagic)]) != sessionFileMagic {
+		return nil, fmt.Errorf("%s is not a saved session", path)
+	}
+	salt := data[len(sessionFileMagic) : len(sessionFileMagic)+sessionSaltSize]
+	key, err := sessionFileKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aesutil.Decrypt(data[len(sessionFileMagic)+sessionSaltSize:], key)
+	if err != nil {
+		return nil, errors.New("failed to decrypt session: wrong passphrase or corrupted file")
+	}
+
+	if len(plain) < 1 || len(plain) < 1+int(plain[0]) {
+		return nil, fmt.Errorf("%w: saved session truncated", protocol.ErrMalformedData)
+	}
+	keyLen := int(plain[0])
+	ticket, err := protocol.DeserializeSessionTicket(plain[1+keyLen:])
+	if err != nil {
+		return nil, err
+	}
+	return &savedSession{key: plain[1 : 1+keyLen], ticket: ticket}, nil
+}
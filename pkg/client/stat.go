@@ -0,0 +1,39 @@
+package entity
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// StatFile returns a file's size and modification time without transferring its contents.
+// A missing file fails with ErrFileNotFound.
+func (c *Client) StatFile(ctx context.Context, filename string) (*FileInfo, error) {
+	c.logger.Info("Querying file", zap.String("filename", filename))
+
+	cmdPayload, err := protocol.SerializeCommand(protocol.CommandStat, filename, nil)
+	if err != nil {
+		return nil, fmt.Errorf(errSerializeCommand, err)
+	}
+
+	respMsg, err := c.exchange(ctx, cmdPayload, "stat")
+	if err != nil {
+		return nil, err
+	}
+
+	if !respMsg.Success {
+		// Servers that predate error codes only say so in the message
+		if respMsg.ErrorCode == protocol.ErrCodeNotFound || respMsg.Message == protocol.FileNotFoundMessage {
+			return nil, fmt.Errorf("%w: %s", ErrFileNotFound, filename)
+		}
+		return nil, responseError("stat", respMsg)
+	}
+
+	info, err := protocol.DeserializeFileInfo(respMsg.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse file info: %w", err)
+	}
+	return info, nil
+}
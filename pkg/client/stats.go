@@ -0,0 +1,98 @@
+package entity
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// TransferStats describes a completed upload or download
+type TransferStats struct {
+	// Bytes is the file data sent or received, not counting protocol overhead or the
+	// prefix a resumed download already held
+	Bytes uint64
+	// Duration runs from the request to the server's final answer; connecting and the
+	// handshake happen before it starts
+	Duration time.Duration
+	// Chunks is the number of data chunks that carried Bytes
+	Chunks uint32
+	// ThroughputMBps is Bytes over Duration in megabytes (10^6 bytes) per second
+	ThroughputMBps float64
+	// ChunkSize is the size of the largest chunk, which is the full chunk size the
+	// transfer used; see WithAdaptiveChunkSize for downloads that choose it
+	ChunkSize uint32
+	// RTT is how long the server took to first answer a download request, roughly one
+	// round trip; zero for uploads
+	RTT time.Duration
+}
+
+// transferMeter counts the chunks of one transfer, from any number of streams. A nil
+// meter counts nothing.
+type transferMeter struct {
+	start     time.Time
+	bytes     atomic.Uint64
+	chunks    atomic.Uint32
+	chunkSize atomic.Uint32
+	// rtt is the time to the first answer in nanoseconds, zero until there is one
+	rtt atomic.Int64
+}
+
+func newTransferMeter() *transferMeter {
+	return &transferMeter{start: time.Now()}
+}
+
+// chunk counts one chunk of n bytes
+func (m *transferMeter) chunk(n int) {
+	if m != nil {
+		m.bytes.Add(uint64(n))
+		m.chunks.Add(1)
+		for size := m.chunkSize.Load(); uint32(n) > size; size = m.chunkSize.Load() {
+			if m.chunkSize.CompareAndSwap(size, uint32(n)) {
+				break
+			}
+		}
+	}
+}
+
+// answered records the round trip to the server's first answer, once
+func (m *transferMeter) answered() {
+	if m != nil {
+		m.rtt.CompareAndSwap(0, max(int64(time.Since(m.start)), 1))
+	}
+}
+
+// stats reports what was counted, timed up to now
+func (m *transferMeter) stats() TransferStats {
+	stats := TransferStats{
+		Bytes:     m.bytes.Load(),
+		Duration:  time.Since(m.start),
+		Chunks:    m.chunks.Load(),
+		ChunkSize: m.chunkSize.Load(),
+		RTT:       time.Duration(m.rtt.Load()),
+	}
+	if seconds := stats.Duration.Seconds(); seconds > 0 {
+		stats.ThroughputMBps = float64(stats.Bytes) / 1e6 / seconds
+	}
+	return stats
+}
+
+// meteredWriterAt counts every write through it as one chunk; the download paths write
+// each chunk with a single WriteAt
+type meteredWriterAt struct {
+	w     io.WriterAt
+	meter *transferMeter
+}
+
+func (mw *meteredWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	n, err := mw.w.WriteAt(p, off)
+	mw.meter.chunk(n)
+	return n, err
+}
+
+// metered wraps w to count its writes in meter, if set
+func metered(w io.WriterAt, meter *transferMeter) io.WriterAt {
+	if meter == nil {
+		return w
+	}
+	return &meteredWriterAt{w: w, meter: meter}
+}
@@ -0,0 +1,133 @@
+package entity
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// DefaultTailBytes is how much existing content Tail shows before following
+const DefaultTailBytes = 4096
+
+// Tail writes the last DefaultTailBytes of a server file to w and keeps streaming data
+// appended to it, like tail -f, until ctx is done. It returns nil once the server
+// acknowledges the cancellation.
+func (c *Client) Tail(ctx context.Context, name string, w io.Writer) error {
+	return c.TailN(ctx, name, DefaultTailBytes, true, w)
+}
+
+// TailN writes the last lastN bytes of a server file to w. With follow set it keeps
+// streaming appended data until ctx is done; otherwise it returns after the existing data.
+func (c *Client) TailN(ctx context.Context, name string, lastN int64, follow bool, w io.Writer) error {
+	c.logger.Info("Tailing file", zap.String("filename", name), zap.Int64("last_bytes", lastN), zap.Bool("follow", follow))
+
+	// Take the connection for the whole exchange once outstanding asynchronous uploads drain
+	defer c.lockExchange()()
+
+	request := make([]byte, 9)
+	binary.BigEndian.PutUint64(request[:8], uint64(lastN))
+	if follow {
+		request[8] = protocol.TailFlagFollow
+	}
+
+	cmdPayload, err := protocol.SerializeCommand(protocol.CommandTail, name, request)
+	if err != nil {
+		return fmt.Errorf(errSerializeCommand, err)
+	}
+	if err := c.SendSecureMessage(protocol.NewMessage(protocol.MessageTypeCommand, cmdPayload)); err != nil {
+		return fmt.Errorf("failed to send tail command: %w", err)
+	}
+
+	respMsg, err := c.receiveResponse(ctx)
+	if err != nil {
+		return err
+	}
+	if !respMsg.Success {
+		return responseError("tail", respMsg)
+	}
+
+	// In follow mode the stream only ends when we ask, so cancel it from the side while reading
+	var stopSent atomic.Bool
+	var wg sync.WaitGroup
+	finished := make(chan struct{})
+	if follow {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-ctx.Done():
+				stopSent.Store(true)
+				stopPayload, _ := protocol.SerializeCommand(protocol.CommandTailStop, "", nil)
+				if err := c.SendSecureMessage(protocol.NewMessage(protocol.MessageTypeCommand, stopPayload)); err != nil {
+					c.logger.Warn("Failed to send tail stop", zap.Error(err))
+				}
+			case <-finished:
+			}
+		}()
+	}
+
+	// Stopping a follow-mode tail still needs the server's final response, and a quiet
+	// file legitimately sends nothing for a long time
+	streamCtx := ctx
+	if follow {
+		streamCtx = withoutReadTimeout(context.WithoutCancel(ctx))
+	}
+	final, streamErr := c.receiveTailStream(streamCtx, name, w)
+	close(finished)
+	wg.Wait()
+
+	if streamErr != nil {
+		return streamErr
+	}
+
+	// The server ended the tail on its own (e.g. a read error) before seeing our stop,
+	// so the stop gets a separate response that must not leak into the next exchange
+	if stopSent.Load() && !final.Success {
+		if _, err := c.receiveResponse(context.WithoutCancel(ctx)); err != nil {
+			return err
+		}
+	}
+
+	if !final.Success {
+		return responseError("tail", final)
+	}
+	return nil
+}
+
+// receiveTailStream copies tail chunks to w until the terminating response arrives
+func (c *Client) receiveTailStream(ctx context.Context, name string, w io.Writer) (*protocol.ResponseMessage, error) {
+	for {
+		msg, err := c.ReceiveSecureMessage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to receive tail data: %w", err)
+		}
+
+		switch msg.Type {
+		case protocol.MessageTypeData:
+			chunk, err := c.decodeChunk(msg.Payload)
+			if err != nil {
+				return nil, err
+			}
+			if chunk.Filename != name {
+				return nil, fmt.Errorf("chunk filename mismatch: expected %s, got %s", name, chunk.Filename)
+			}
+			if _, err := w.Write(chunk.Data); err != nil {
+				return nil, fmt.Errorf("failed to write tail data: %w", err)
+			}
+		case protocol.MessageTypeResponse:
+			respMsg, err := protocol.DeserializeResponse(msg.Payload)
+			if err != nil {
+				return nil, fmt.Errorf(errDeserializeResponse, err)
+			}
+			return respMsg, nil
+		default:
+			return nil, fmt.Errorf("unexpected message type during tail: %v", msg.Type)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package entity
+
+import (
+	"errors"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// errTLSSessionOptions is returned by PerformHandshake over TLS when options that need
+// the RSA/AES handshake were given
+var errTLSSessionOptions = errors.New("namespaces and client identities are not supported over TLS")
+
+// startTLSSession stands in for the handshake on a TLS connection. The server starts the
+// session as soon as the connection is accepted, speaking the current protocol version.
+func (c *Client) startTLSSession() error {
+	if c.namespace != "" || c.identity != nil {
+		return errTLSSessionOptions
+	}
+	c.protocolVersion = protocol.ProtocolVersion
+	c.logger.Info("Using TLS session, skipping RSA handshake",
+		zap.Uint16("protocol_version", c.protocolVersion))
+	return nil
+}
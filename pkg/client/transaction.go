@@ -0,0 +1,36 @@
+package entity
+
+import (
+	"context"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// BeginTransaction starts an all-or-nothing upload envelope. Uploads made until
+// CommitTransaction are staged on the server and only become visible on commit.
+// Disconnecting without committing discards them.
+func (c *Client) BeginTransaction(ctx context.Context) error {
+	c.logger.Info("Beginning transaction")
+	_, err := c.runCommand(ctx, protocol.CommandBeginTx, "", nil, "begin transaction")
+	return err
+}
+
+// CommitTransaction atomically moves all staged uploads into place
+func (c *Client) CommitTransaction(ctx context.Context) error {
+	c.logger.Info("Committing transaction")
+	respMsg, err := c.runCommand(ctx, protocol.CommandCommitTx, "", nil, "commit transaction")
+	if err != nil {
+		return err
+	}
+
+	c.logger.Info("Transaction committed", zap.String("message", respMsg.Message))
+	return nil
+}
+
+// RollbackTransaction discards all staged uploads
+func (c *Client) RollbackTransaction(ctx context.Context) error {
+	c.logger.Info("Rolling back transaction")
+	_, err := c.runCommand(ctx, protocol.CommandRollbackTx, "", nil, "rollback transaction")
+	return err
+}
@@ -0,0 +1,41 @@
+package entity
+
+import (
+	"context"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// RestoreFile brings back the most recently deleted copy of filename from the server's
+// trash. It fails with ErrFileNotFound when the trash holds no copy, with ErrFileExists
+// when a file has been stored under the name since, and with ErrUnsupported when the
+// server keeps no trash and deletes are final.
+func (c *Client) RestoreFile(ctx context.Context, filename string) error {
+	c.logger.Info("Restoring file", zap.String("filename", filename))
+
+	if _, err := c.runCommand(ctx, protocol.CommandRestore, filename, nil, "restore"); err != nil {
+		return err
+	}
+
+	c.logger.Info("File restored successfully", zap.String("filename", filename))
+	return nil
+}
+
+// EmptyTrash permanently deletes every file in the client's trash on the server and
+// returns how many were purged. Servers without a trash fail with ErrUnsupported.
+func (c *Client) EmptyTrash(ctx context.Context) (int, error) {
+	c.logger.Info("Emptying trash")
+
+	respMsg, err := c.runCommand(ctx, protocol.CommandEmptyTrash, "", nil, "empty trash")
+	if err != nil {
+		return 0, err
+	}
+	purged, err := protocol.DeserializeDeleteCount(respMsg.Data)
+	if err != nil {
+		return 0, err
+	}
+
+	c.logger.Info("Trash emptied", zap.Uint32("purged", purged))
+	return int(purged), nil
+}
@@ -0,0 +1,28 @@
+package entity
+
+import (
+	"context"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// ServerVersion returns the server's build version.
+// A version that differs from the client's is logged as a warning.
+func (c *Client) ServerVersion(ctx context.Context) (string, error) {
+	respMsg, err := c.runCommand(ctx, protocol.CommandVersion, "", nil, "version")
+	if err != nil {
+		return "", err
+	}
+
+	serverVersion := respMsg.Message
+	if serverVersion != protocol.Version {
+		c.logger.Warn("Client and server versions differ",
+			zap.String("client_version", protocol.Version),
+			zap.String("server_version", serverVersion))
+	} else {
+		c.logger.Info("Server version", zap.String("version", serverVersion))
+	}
+
+	return serverVersion, nil
+}
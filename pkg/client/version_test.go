@@ -0,0 +1,86 @@
+package entity
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	aesutil "github.com/lcensies/ssnproj/pkg/aes"
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// serveVersion answers a single CommandVersion on conn with version
+func serveVersion(t *testing.T, conn net.Conn, aesKey []byte, version string) {
+	buffer := protocol.NewMessageBuffer()
+	chunk := make([]byte, 1024)
+
+	var request *protocol.Message
+	for request == nil {
+		n, err := conn.Read(chunk)
+		if err != nil {
+			t.Errorf("fake server read failed: %v", err)
+			return
+		}
+		buffer.AddData(chunk[:n])
+		request, _ = buffer.TryDeserialize()
+	}
+
+	if err := request.Decrypt(aesKey); err != nil {
+		t.Errorf("fake server decrypt failed: %v", err)
+		return
+	}
+	command, err := protocol.DeserializeCommand(request.Payload)
+	if err != nil || command.Command != protocol.CommandVersion {
+		t.Errorf("fake server expected a version command, got %v (%v)", command, err)
+		return
+	}
+
+	responsePayload, _ := protocol.SerializeResponse(true, version, nil)
+	encrypted, _ := aesutil.Encrypt(responsePayload, aesKey)
+	frame, _ := protocol.NewMessage(protocol.MessageTypeResponse, encrypted).Serialize()
+	if _, err := conn.Write(frame); err != nil {
+		t.Errorf("fake server write failed: %v", err)
+	}
+}
+
+func TestServerVersion_MismatchIsLogged(t *testing.T) {
+	aesKey, err := aesutil.GenerateKey()
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		name          string
+		serverVersion string
+		expectWarning bool
+	}{
+		{name: "matching", serverVersion: protocol.Version, expectWarning: false},
+		{name: "mismatched", serverVersion: protocol.Version + "-other", expectWarning: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			core, logs := observer.New(zapcore.InfoLevel)
+			c := &Client{conn: clientConn, logger: zap.New(core), aesKey: aesKey}
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				serveVersion(t, serverConn, aesKey, tt.serverVersion)
+			}()
+
+			version, err := c.ServerVersion(context.Background())
+			<-done
+			require.NoError(t, err)
+			assert.Equal(t, tt.serverVersion, version)
+
+			warnings := logs.FilterLevelExact(zapcore.WarnLevel).FilterMessage("Client and server versions differ")
+			assert.Equal(t, tt.expectWarning, warnings.Len() == 1)
+		})
+	}
+}
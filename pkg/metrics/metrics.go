@@ -0,0 +1,125 @@
+// Package metrics exposes the server's Prometheus collectors. A nil *Metrics is valid
+// and records nothing, so instrumented code costs a nil check when metrics are disabled.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "ssn"
+
+// Transfer directions, the values of the direction label
+const (
+	DirectionUpload   = "upload"
+	DirectionDownload = "download"
+)
+
+// Metrics holds the server's collectors in a registry of their own
+type Metrics struct {
+	registry *prometheus.Registry
+
+	bytes             *prometheus.CounterVec
+	transferDuration  *prometheus.HistogramVec
+	activeConnections prometheus.Gauge
+	handshakes        *prometheus.CounterVec
+	commands          *prometheus.CounterVec
+	commandErrors     *prometheus.CounterVec
+}
+
+// New creates the collectors and registers them
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "transfer_bytes_total",
+			Help:      "File bytes moved by completed uploads and downloads.",
+		}, []string{"direction"}),
+		transferDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "transfer_duration_seconds",
+			Help:      "Time taken by completed uploads and downloads.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"direction"}),
+		activeConnections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_connections",
+			Help:      "Connections currently being served.",
+		}),
+		handshakes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "handshakes_total",
+			Help:      "Handshakes by result.",
+		}, []string{"result"}),
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "commands_total",
+			Help:      "Commands received, by command byte.",
+		}, []string{"command"}),
+		commandErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "command_errors_total",
+			Help:      "Commands that failed, by command byte.",
+		}, []string{"command"}),
+	}
+	m.registry.MustRegister(m.bytes, m.transferDuration, m.activeConnections, m.handshakes, m.commands, m.commandErrors)
+	return m
+}
+
+// Handler serves the collectors in the Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// ConnectionOpened counts a connection as active until ConnectionClosed
+func (m *Metrics) ConnectionOpened() {
+	if m != nil {
+		m.activeConnections.Inc()
+	}
+}
+
+// ConnectionClosed ends a connection counted by ConnectionOpened
+func (m *Metrics) ConnectionClosed() {
+	if m != nil {
+		m.activeConnections.Dec()
+	}
+}
+
+// Handshake counts a handshake and whether it succeeded
+func (m *Metrics) Handshake(ok bool) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if !ok {
+		result = "failure"
+	}
+	m.handshakes.WithLabelValues(result).Inc()
+}
+
+// Command counts a received command
+func (m *Metrics) Command(command string) {
+	if m != nil {
+		m.commands.WithLabelValues(command).Inc()
+	}
+}
+
+// CommandFailed counts a command that was refused or could not complete
+func (m *Metrics) CommandFailed(command string) {
+	if m != nil {
+		m.commandErrors.WithLabelValues(command).Inc()
+	}
+}
+
+// Transfer records a completed upload or download of n bytes that took d
+func (m *Metrics) Transfer(direction string, n uint64, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.bytes.WithLabelValues(direction).Add(float64(n))
+	m.transferDuration.WithLabelValues(direction).Observe(d.Seconds())
+}
@@ -0,0 +1,49 @@
+package protocol
+
+// Chunk size configuration shared by downloads and streamed uploads
+const (
+	SmallFileThreshold  = 256 * 1024      // 256 KB
+	MediumFileThreshold = 5 * 1024 * 1024 // 5 MB
+	SmallChunkSize      = 64 * 1024       // 64 KB for small files
+	MediumChunkSize     = 128 * 1024      // 128 KB for medium files
+	LargeChunkSize      = 256 * 1024      // 256 KB for large files
+	MaxChunkSize        = 512 * 1024      // 512 KB maximum
+)
+
+// UploadAbortedSize is the TotalSize of the empty last chunk with which a client abandons
+// a chunked upload of unknown size
+const UploadAbortedSize = ^uint64(0)
+
+// ChunkSizeFor picks the chunk size for a transfer of totalSize bytes:
+// larger files use larger chunks for better throughput
+func ChunkSizeFor(totalSize uint64) uint32 {
+	switch {
+	case totalSize < SmallFileThreshold:
+		return SmallChunkSize
+	case totalSize < MediumFileThreshold:
+		return MediumChunkSize
+	default:
+		return LargeChunkSize
+	}
+}
+
+// PreferredChunkSize returns the chunk size for a transfer of totalSize bytes when the
+// client prefers preferred: zero keeps ChunkSizeFor's choice, anything else is bounded
+// to [SmallChunkSize, MaxChunkSize]
+func PreferredChunkSize(totalSize uint64, preferred uint32) uint32 {
+	switch {
+	case preferred == 0:
+		return ChunkSizeFor(totalSize)
+	case preferred < SmallChunkSize:
+		return SmallChunkSize
+	case preferred > MaxChunkSize:
+		return MaxChunkSize
+	default:
+		return preferred
+	}
+}
+
+// ChunkCount returns how many chunks of chunkSize carry totalSize bytes
+func ChunkCount(totalSize uint64, chunkSize uint32) uint32 {
+	return uint32((totalSize + uint64(chunkSize) - 1) / uint64(chunkSize)) // Round up division
+}
@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+)
+
+// Content encodings advertised in the Message field of a response whose Data is compressed
+const (
+	EncodingGzip = "gzip"
+)
+
+// List command flags carried in the first byte of CommandMessage.Data
+const (
+	ListFlagCompress byte = 0x01
+	// ListFlagDetailed asks for FileInfo entries in Data instead of bare names in Message
+	ListFlagDetailed byte = 0x02
+	// ListFlagRecursive includes the contents of subdirectories, named by their path
+	// relative to the listed directory
+	ListFlagRecursive byte = 0x04
+)
+
+// MaxDecompressedSize bounds the output of DecompressPayload to guard against compression bombs
+const MaxDecompressedSize = 64 * 1024 * 1024 // 64 MB
+
+// ErrDecompressedTooLarge is returned when a compressed payload expands beyond MaxDecompressedSize
+var ErrDecompressedTooLarge = errors.New("decompressed payload exceeds maximum size")
+
+// CompressPayload gzips data before it is handed to AES
+func CompressPayload(data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	writer, err := gzip.NewWriterLevel(buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecompressPayload reverses CompressPayload
+func DecompressPayload(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// Read one byte past the limit so an oversized payload can be detected
+	decompressed, err := io.ReadAll(io.LimitReader(reader, MaxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(decompressed) > MaxDecompressedSize {
+		return nil, ErrDecompressedTooLarge
+	}
+
+	return decompressed, nil
+}
@@ -0,0 +1,109 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// DecodeError reports which field of which structure failed to parse and where
+type DecodeError struct {
+	Structure string // e.g. "command", "response"
+	Field     string // e.g. "filename length"
+	Offset    int    // byte offset at which the field starts
+	Reason    string // e.g. "truncated", "exceeds payload"
+	Need      int    // bytes the field required
+	Have      int    // bytes remaining at Offset
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s: %s %s at offset %d (need %d bytes, have %d)",
+		e.Structure, e.Field, e.Reason, e.Offset, e.Need, e.Have)
+}
+
+// Unwrap lets callers match any DecodeError with errors.Is(err, ErrMalformedData)
+func (e *DecodeError) Unwrap() error {
+	return ErrMalformedData
+}
+
+// decoder reads big-endian fields from a byte slice, tracking the offset for error reporting
+type decoder struct {
+	structure string
+	data      []byte
+	offset    int
+}
+
+func newDecoder(structure string, data []byte) *decoder {
+	return &decoder{structure: structure, data: data}
+}
+
+func (d *decoder) fail(field string, reason string, need int) error {
+	return &DecodeError{
+		Structure: d.structure,
+		Field:     field,
+		Offset:    d.offset,
+		Reason:    reason,
+		Need:      need,
+		Have:      len(d.data) - d.offset,
+	}
+}
+
+// take returns the next n bytes, or a DecodeError naming field if fewer remain
+func (d *decoder) take(field string, n int) ([]byte, error) {
+	if n > len(d.data)-d.offset {
+		return nil, d.fail(field, "truncated", n)
+	}
+	b := d.data[d.offset : d.offset+n]
+	d.offset += n
+	return b, nil
+}
+
+func (d *decoder) readByte(field string) (byte, error) {
+	b, err := d.take(field, 1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *decoder) readUint16(field string) (uint16, error) {
+	b, err := d.take(field, 2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b), nil
+}
+
+func (d *decoder) readUint32(field string) (uint32, error) {
+	b, err := d.take(field, 4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+func (d *decoder) readUint64(field string) (uint64, error) {
+	b, err := d.take(field, 8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// readBytes copies the n-byte body of a length-prefixed field
+func (d *decoder) readBytes(field string, n int) ([]byte, error) {
+	if n > len(d.data)-d.offset {
+		return nil, d.fail(field+" length", "exceeds payload", n)
+	}
+	b := make([]byte, n)
+	copy(b, d.data[d.offset:d.offset+n])
+	d.offset += n
+	return b, nil
+}
+
+// rest copies everything after the current offset
+func (d *decoder) rest() []byte {
+	b := make([]byte, len(d.data)-d.offset)
+	copy(b, d.data[d.offset:])
+	d.offset = len(d.data)
+	return b
+}
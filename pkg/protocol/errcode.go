@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// ErrorCode classifies a failed response so clients need not match on its message.
+// Codes are only sent to peers at ProtocolVersionErrorCodes or later; responses from
+// older servers, and failures the server does not classify, carry ErrCodeNone.
+type ErrorCode uint16
+
+const (
+	// ErrCodeNone means the failure is not classified
+	ErrCodeNone ErrorCode = 0
+	// ErrCodeNotFound means the named file or directory does not exist
+	ErrCodeNotFound ErrorCode = 1
+	// ErrCodeInvalidPath means the name was rejected, e.g. it escapes the client directory
+	ErrCodeInvalidPath ErrorCode = 2
+	// ErrCodeQuotaExceeded means the write would exceed the storage quota or size limit
+	ErrCodeQuotaExceeded ErrorCode = 3
+	// ErrCodeIO means the server failed to read or write its storage
+	ErrCodeIO ErrorCode = 4
+	// ErrCodeInvalidRequest means the command was malformed or not allowed in this state
+	ErrCodeInvalidRequest ErrorCode = 5
+	// ErrCodeExists means the target already exists and the server refuses to replace it
+	ErrCodeExists ErrorCode = 6
+	// ErrCodeBusy means the server is at a resource limit; the command may succeed later
+	ErrCodeBusy ErrorCode = 7
+	// ErrCodeUnsupported means the server does not offer the command or feature
+	ErrCodeUnsupported ErrorCode = 8
+)
+
+// String returns the code name
+func (code ErrorCode) String() string {
+	switch code {
+	case ErrCodeNone:
+		return "none"
+	case ErrCodeNotFound:
+		return "not found"
+	case ErrCodeInvalidPath:
+		return "invalid path"
+	case ErrCodeQuotaExceeded:
+		return "quota exceeded"
+	case ErrCodeIO:
+		return "I/O error"
+	case ErrCodeInvalidRequest:
+		return "invalid request"
+	case ErrCodeExists:
+		return "already exists"
+	case ErrCodeBusy:
+		return "busy"
+	case ErrCodeUnsupported:
+		return "unsupported"
+	default:
+		return fmt.Sprintf("ErrorCode(%d)", uint16(code))
+	}
+}
+
+// Values of a response's first byte. Peers before ProtocolVersionErrorCodes treat
+// anything other than responseSuccess as a failure, so a coded failure still reads as one.
+const (
+	responseFailure      byte = 0
+	responseSuccess      byte = 1
+	responseFailureCoded byte = 2
+)
+
+// SerializeErrorResponse serializes a failed response carrying code. The code follows
+// the message: [2 (1 byte)][message length (2)][message][code (2)][data]
+func SerializeErrorResponse(code ErrorCode, message string, data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(responseFailureCoded)
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(message))); err != nil {
+		return nil, err
+	}
+	buf.WriteString(message)
+	if err := binary.Write(buf, binary.BigEndian, uint16(code)); err != nil {
+		return nil, err
+	}
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,170 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FileInfo describes one stored file
+type FileInfo struct {
+	Name string
+	// Size is the file size in bytes
+	Size int64
+	// ModTime is the last modification time in Unix seconds
+	ModTime int64
+	IsDir   bool
+	// ContentType is the file's MIME type as sniffed by the server, e.g. "image/png".
+	// It is empty for directories and for servers before ProtocolVersionContentType.
+	ContentType string
+}
+
+const (
+	// fileInfoFlagDir marks a directory entry in the FileInfo flags byte
+	fileInfoFlagDir byte = 0x01
+	// fileInfoFlagContentType marks an entry followed by its content type: length (1
+	// byte) and the type itself
+	fileInfoFlagContentType byte = 0x02
+)
+
+// SerializeFileInfos encodes a listing as an entry count (4 bytes) followed by each entry:
+// name length (2 bytes), name, size (8 bytes), modification time (8 bytes), flags (1 byte),
+// then the content type if it is set. Names are length-prefixed so any byte, including a
+// newline, survives the round trip. Peers before ProtocolVersionContentType do not
+// expect content types, so entries meant for them must leave ContentType empty.
+func SerializeFileInfos(infos []FileInfo) ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.BigEndian, uint32(len(infos))); err != nil {
+		return nil, err
+	}
+	for i := range infos {
+		if err := writeFileInfo(buf, &infos[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DeserializeFileInfos decodes a listing written by SerializeFileInfos
+func DeserializeFileInfos(data []byte) ([]FileInfo, error) {
+	buf := bytes.NewReader(data)
+
+	var count uint32
+	if err := binary.Read(buf, binary.BigEndian, &count); err != nil {
+		return nil, fmt.Errorf("%w: file listing too short", ErrMalformedData)
+	}
+
+	// Every entry takes at least 19 bytes, which bounds the allocation for a bogus count
+	const minEntrySize = 2 + 8 + 8 + 1
+	if uint64(count)*minEntrySize > uint64(buf.Len()) {
+		return nil, fmt.Errorf("%w: file listing claims %d entries in %d bytes", ErrMalformedData, count, buf.Len())
+	}
+
+	infos := make([]FileInfo, 0, count)
+	for i := uint32(0); i < count; i++ {
+		info, err := readFileInfo(buf)
+		if err != nil {
+			return nil, fmt.Errorf("file listing entry %d: %w", i, err)
+		}
+		infos = append(infos, *info)
+	}
+
+	if buf.Len() != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes after file listing", ErrMalformedData, buf.Len())
+	}
+
+	return infos, nil
+}
+
+// SerializeFileInfo encodes a single entry in the SerializeFileInfos entry layout
+func SerializeFileInfo(info *FileInfo) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := writeFileInfo(buf, info); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DeserializeFileInfo decodes a single entry written by SerializeFileInfo
+func DeserializeFileInfo(data []byte) (*FileInfo, error) {
+	buf := bytes.NewReader(data)
+	info, err := readFileInfo(buf)
+	if err != nil {
+		return nil, err
+	}
+	if buf.Len() != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes after file info", ErrMalformedData, buf.Len())
+	}
+	return info, nil
+}
+
+func writeFileInfo(buf *bytes.Buffer, info *FileInfo) error {
+	if len(info.Name) > 0xFFFF {
+		return errors.New("file name too long")
+	}
+	if len(info.ContentType) > 0xFF {
+		return errors.New("content type too long")
+	}
+
+	var flags byte
+	if info.IsDir {
+		flags |= fileInfoFlagDir
+	}
+	if info.ContentType != "" {
+		flags |= fileInfoFlagContentType
+	}
+
+	binary.Write(buf, binary.BigEndian, uint16(len(info.Name)))
+	buf.WriteString(info.Name)
+	binary.Write(buf, binary.BigEndian, info.Size)
+	binary.Write(buf, binary.BigEndian, info.ModTime)
+	buf.WriteByte(flags)
+	if info.ContentType != "" {
+		buf.WriteByte(byte(len(info.ContentType)))
+		buf.WriteString(info.ContentType)
+	}
+	return nil
+}
+
+func readFileInfo(buf *bytes.Reader) (*FileInfo, error) {
+	var nameLen uint16
+	if err := binary.Read(buf, binary.BigEndian, &nameLen); err != nil {
+		return nil, fmt.Errorf("%w: name length truncated", ErrMalformedData)
+	}
+
+	name := make([]byte, nameLen)
+	if _, err := io.ReadFull(buf, name); err != nil {
+		return nil, fmt.Errorf("%w: name truncated", ErrMalformedData)
+	}
+
+	info := &FileInfo{Name: string(name)}
+	if err := binary.Read(buf, binary.BigEndian, &info.Size); err != nil {
+		return nil, fmt.Errorf("%w: size truncated", ErrMalformedData)
+	}
+	if err := binary.Read(buf, binary.BigEndian, &info.ModTime); err != nil {
+		return nil, fmt.Errorf("%w: modification time truncated", ErrMalformedData)
+	}
+	flags, err := buf.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("%w: flags truncated", ErrMalformedData)
+	}
+	info.IsDir = flags&fileInfoFlagDir != 0
+
+	if flags&fileInfoFlagContentType != 0 {
+		typeLen, err := buf.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: content type length truncated", ErrMalformedData)
+		}
+		contentType := make([]byte, typeLen)
+		if _, err := io.ReadFull(buf, contentType); err != nil {
+			return nil, fmt.Errorf("%w: content type truncated", ErrMalformedData)
+		}
+		info.ContentType = string(contentType)
+	}
+
+	return info, nil
+}
@@ -0,0 +1,28 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// IsGlobPattern reports whether name holds any of the wildcards understood by
+// path.Match, and so names a set of files rather than one
+func IsGlobPattern(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// SerializeDeleteCount encodes the Data of a successful CommandDeleteGlob or
+// CommandEmptyTrash response
+func SerializeDeleteCount(deleted uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, deleted)
+}
+
+// DeserializeDeleteCount decodes the number of files a CommandDeleteGlob or
+// CommandEmptyTrash removed
+func DeserializeDeleteCount(data []byte) (uint32, error) {
+	if len(data) != 4 {
+		return 0, fmt.Errorf("%w: delete count has %d bytes", ErrMalformedData, len(data))
+	}
+	return binary.BigEndian.Uint32(data), nil
+}
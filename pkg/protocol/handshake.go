@@ -0,0 +1,243 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// HandshakeRequest is the payload of the client's MessageTypeHandshake message
+type HandshakeRequest struct {
+	// EncryptedKey is the AES session key wrapped with the server's RSA public key
+	EncryptedKey []byte
+	// Options holds serialized HandshakeOptions encrypted with the session key (may be empty)
+	Options []byte
+}
+
+// HandshakeOptions carries optional session parameters chosen by the client
+type HandshakeOptions struct {
+	// Namespace selects a shared storage directory instead of the per-session one
+	Namespace string
+	// ProtocolVersion is the newest wire revision the client speaks, zero if not announced
+	ProtocolVersion uint16
+	// Nonce is a fresh random challenge the server signs with its private key, proving
+	// its identity; empty if the client does not ask for a signature
+	Nonce []byte
+	// IdentityKey is the client's long-lived RSA public key (PKIX DER). Storage is then
+	// tied to this key instead of the session, so files survive reconnects.
+	IdentityKey []byte
+	// IdentitySignature proves possession of IdentityKey, see ClientIdentityDigest
+	IdentitySignature []byte
+}
+
+// HandshakeNonceSize is the length of the handshake nonce
+const HandshakeNonceSize = 32
+
+// Signature contexts separate handshake signatures from any other use of the keys
+const (
+	handshakeSignatureContext = "ssnproj handshake signature"
+	clientIdentityContext     = "ssnproj client identity"
+)
+
+// Handshake option tags
+const (
+	handshakeOptionNamespace       byte = 0x01
+	handshakeOptionProtocolVersion byte = 0x02
+	handshakeOptionNonce           byte = 0x03
+	handshakeOptionIdentityKey     byte = 0x04
+	handshakeOptionIdentitySig     byte = 0x05
+)
+
+// SerializeHandshakeRequest serializes a handshake request
+func SerializeHandshakeRequest(req *HandshakeRequest) ([]byte, error) {
+	if len(req.EncryptedKey) > 0xFFFF {
+		return nil, errors.New("encrypted key too long")
+	}
+
+	buf := new(bytes.Buffer)
+
+	// Write encrypted key length (2 bytes)
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(req.EncryptedKey))); err != nil {
+		return nil, err
+	}
+
+	// Write encrypted key
+	if _, err := buf.Write(req.EncryptedKey); err != nil {
+		return nil, err
+	}
+
+	// Write options
+	if _, err := buf.Write(req.Options); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DeserializeHandshakeRequest deserializes a handshake request
+func DeserializeHandshakeRequest(data []byte) (*HandshakeRequest, error) {
+	if len(data) < 2 {
+		return nil, errors.New("handshake data too short")
+	}
+
+	buf := bytes.NewReader(data)
+
+	// Read encrypted key length
+	var keyLen uint16
+	if err := binary.Read(buf, binary.BigEndian, &keyLen); err != nil {
+		return nil, err
+	}
+
+	// Read encrypted key
+	encryptedKey := make([]byte, keyLen)
+	if _, err := io.ReadFull(buf, encryptedKey); err != nil {
+		return nil, fmt.Errorf("handshake key truncated: %w", err)
+	}
+
+	// Remaining data is the encrypted options
+	options := make([]byte, buf.Len())
+	if _, err := io.ReadFull(buf, options); err != nil {
+		return nil, err
+	}
+
+	return &HandshakeRequest{
+		EncryptedKey: encryptedKey,
+		Options:      options,
+	}, nil
+}
+
+// SerializeHandshakeOptions encodes options as tag (1 byte), length (2 bytes), value records.
+// Unset options are omitted.
+func SerializeHandshakeOptions(opts *HandshakeOptions) ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if opts.Namespace != "" {
+		if err := writeTLV(buf, handshakeOptionNamespace, []byte(opts.Namespace)); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.ProtocolVersion != 0 {
+		if err := writeTLV(buf, handshakeOptionProtocolVersion, binary.BigEndian.AppendUint16(nil, opts.ProtocolVersion)); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(opts.Nonce) > 0 {
+		if err := writeTLV(buf, handshakeOptionNonce, opts.Nonce); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(opts.IdentityKey) > 0 {
+		if err := writeTLV(buf, handshakeOptionIdentityKey, opts.IdentityKey); err != nil {
+			return nil, err
+		}
+		if err := writeTLV(buf, handshakeOptionIdentitySig, opts.IdentitySignature); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DeserializeHandshakeOptions decodes options, skipping tags it does not know
+func DeserializeHandshakeOptions(data []byte) (*HandshakeOptions, error) {
+	opts := &HandshakeOptions{}
+
+	err := readTLV(data, "handshake option", func(tag byte, value []byte) error {
+		switch tag {
+		case handshakeOptionNamespace:
+			opts.Namespace = string(value)
+		case handshakeOptionProtocolVersion:
+			if len(value) != 2 {
+				return fmt.Errorf("%w: handshake option 0x%02x has %d bytes", ErrMalformedData, tag, len(value))
+			}
+			opts.ProtocolVersion = binary.BigEndian.Uint16(value)
+		case handshakeOptionNonce:
+			if len(value) != HandshakeNonceSize {
+				return fmt.Errorf("%w: handshake option 0x%02x has %d bytes", ErrMalformedData, tag, len(value))
+			}
+			opts.Nonce = value
+		case handshakeOptionIdentityKey:
+			opts.IdentityKey = value
+		case handshakeOptionIdentitySig:
+			opts.IdentitySignature = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return opts, nil
+}
+
+// HandshakeSignatureDigest is the SHA-256 digest the server signs to confirm a handshake.
+// It covers the client's nonce, the wrapped session key and the negotiated version, so
+// a signature cannot be replayed into another session or alter the negotiation.
+func HandshakeSignatureDigest(nonce, encryptedKey []byte, version uint16) []byte {
+	hash := sha256.New()
+	hash.Write([]byte(handshakeSignatureContext))
+	hash.Write(nonce)
+	hash.Write(encryptedKey)
+	binary.Write(hash, binary.BigEndian, version)
+	return hash.Sum(nil)
+}
+
+// ClientIdentityDigest is the SHA-256 digest a client signs with its identity key. It
+// covers the wrapped session key, which only the server can unwrap, so the signature
+// cannot be replayed into another session.
+func ClientIdentityDigest(encryptedKey []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte(clientIdentityContext))
+	hash.Write(encryptedKey)
+	return hash.Sum(nil)
+}
+
+// writeTLV appends a tag (1 byte), length (2 bytes), value record to buf
+func writeTLV(buf *bytes.Buffer, tag byte, value []byte) error {
+	if len(value) > 0xFFFF {
+		return fmt.Errorf("record 0x%02x too long", tag)
+	}
+
+	if err := buf.WriteByte(tag); err != nil {
+		return err
+	}
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(value))); err != nil {
+		return err
+	}
+	_, err := buf.Write(value)
+	return err
+}
+
+// readTLV calls fn for every tag/length/value record in data; kind names the records in errors
+func readTLV(data []byte, kind string, fn func(tag byte, value []byte) error) error {
+	buf := bytes.NewReader(data)
+
+	for buf.Len() > 0 {
+		tag, err := buf.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		var valueLen uint16
+		if err := binary.Read(buf, binary.BigEndian, &valueLen); err != nil {
+			return fmt.Errorf("%s 0x%02x length truncated: %w", kind, tag, err)
+		}
+
+		value := make([]byte, valueLen)
+		if _, err := io.ReadFull(buf, value); err != nil {
+			return fmt.Errorf("%s 0x%02x value truncated: %w", kind, tag, err)
+		}
+
+		if err := fn(tag, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// ServerInfo describes the limits a server enforces so clients can validate
+// operations before sending them. Zero numeric limits mean "no limit".
+type ServerInfo struct {
+	// MaxUploadSize is the largest file, in bytes, the server accepts
+	MaxUploadSize int64
+	// MinChunkSize and MaxChunkSize bound the size of download chunks
+	MinChunkSize uint32
+	MaxChunkSize uint32
+	// Quota is the storage available to the session in bytes
+	Quota int64
+	// MaxFilenameLength is the longest accepted name of a single path element in bytes
+	MaxFilenameLength uint16
+	// MaxPathLength is the longest accepted path in bytes, elements and separators
+	// together
+	MaxPathLength uint16
+	// Ciphers lists the accepted session ciphers, strongest first
+	Ciphers []string
+	// Compression lists the supported payload encodings
+	Compression []string
+}
+
+// Server info record tags
+const (
+	infoMaxUploadSize     byte = 0x01
+	infoMinChunkSize      byte = 0x02
+	infoMaxChunkSize      byte = 0x03
+	infoQuota             byte = 0x04
+	infoMaxFilenameLength byte = 0x05
+	infoCiphers           byte = 0x06
+	infoCompression       byte = 0x07
+	infoMaxPathLength     byte = 0x08
+)
+
+// SerializeServerInfo encodes info as tag (1 byte), length (2 bytes), value records,
+// the same layout as handshake options. Lists are comma separated.
+func SerializeServerInfo(info *ServerInfo) ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	records := []struct {
+		tag   byte
+		value []byte
+	}{
+		{infoMaxUploadSize, binary.BigEndian.AppendUint64(nil, uint64(info.MaxUploadSize))},
+		{infoMinChunkSize, binary.BigEndian.AppendUint32(nil, info.MinChunkSize)},
+		{infoMaxChunkSize, binary.BigEndian.AppendUint32(nil, info.MaxChunkSize)},
+		{infoQuota, binary.BigEndian.AppendUint64(nil, uint64(info.Quota))},
+		{infoMaxFilenameLength, binary.BigEndian.AppendUint16(nil, info.MaxFilenameLength)},
+		{infoCiphers, []byte(strings.Join(info.Ciphers, ","))},
+		{infoCompression, []byte(strings.Join(info.Compression, ","))},
+		{infoMaxPathLength, binary.BigEndian.AppendUint16(nil, info.MaxPathLength)},
+	}
+	for _, record := range records {
+		if err := writeTLV(buf, record.tag, record.value); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DeserializeServerInfo decodes server info, skipping records it does not know
+func DeserializeServerInfo(data []byte) (*ServerInfo, error) {
+	info := &ServerInfo{}
+
+	err := readTLV(data, "server info", func(tag byte, value []byte) error {
+		switch tag {
+		case infoMaxUploadSize:
+			if len(value) != 8 {
+				return fmt.Errorf("%w: server info 0x%02x has %d bytes", ErrMalformedData, tag, len(value))
+			}
+			info.MaxUploadSize = int64(binary.BigEndian.Uint64(value))
+		case infoMinChunkSize:
+			if len(value) != 4 {
+				return fmt.Errorf("%w: server info 0x%02x has %d bytes", ErrMalformedData, tag, len(value))
+			}
+			info.MinChunkSize = binary.BigEndian.Uint32(value)
+		case infoMaxChunkSize:
+			if len(value) != 4 {
+				return fmt.Errorf("%w: server info 0x%02x has %d bytes", ErrMalformedData, tag, len(value))
+			}
+			info.MaxChunkSize = binary.BigEndian.Uint32(value)
+		case infoQuota:
+			if len(value) != 8 {
+				return fmt.Errorf("%w: server info 0x%02x has %d bytes", ErrMalformedData, tag, len(value))
+			}
+			info.Quota = int64(binary.BigEndian.Uint64(value))
+		case infoMaxFilenameLength:
+			if len(value) != 2 {
+				return fmt.Errorf("%w: server info 0x%02x has %d bytes", ErrMalformedData, tag, len(value))
+			}
+			info.MaxFilenameLength = binary.BigEndian.Uint16(value)
+		case infoMaxPathLength:
+			if len(value) != 2 {
+				return fmt.Errorf("%w: server info 0x%02x has %d bytes", ErrMalformedData, tag, len(value))
+			}
+			info.MaxPathLength = binary.BigEndian.Uint16(value)
+		case infoCiphers:
+			info.Ciphers = splitList(value)
+		case infoCompression:
+			info.Compression = splitList(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+func splitList(value []byte) []string {
+	if len(value) == 0 {
+		return nil
+	}
+	return strings.Split(string(value), ",")
+}
@@ -0,0 +1,57 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ListPageSize is the length of CommandList data asking for one page of the listing:
+// the flags byte followed by the offset of the first entry and the most entries to
+// return (4 bytes each, big-endian), from ProtocolVersionListPage on
+const ListPageSize = 1 + 8
+
+// ListRequest is the decoded Data of a CommandList
+type ListRequest struct {
+	Flags byte
+	// Offset and Limit select a page of the listing, entries sorted by name; a zero
+	// Limit returns every entry after Offset
+	Offset uint32
+	Limit  uint32
+}
+
+// Paged reports whether request asks for part of the listing. The response Data of a
+// paged listing starts with a byte that is 1 when entries follow the page and 0 when it
+// is the last, followed by whatever Data the listing would otherwise carry.
+func (request *ListRequest) Paged() bool {
+	return request.Offset > 0 || request.Limit > 0
+}
+
+// SerializeListRequest encodes request in the shortest form that carries its fields,
+// so only paged requests need ProtocolVersionListPage
+func SerializeListRequest(request *ListRequest) []byte {
+	data := []byte{request.Flags}
+	if !request.Paged() {
+		return data
+	}
+	data = binary.BigEndian.AppendUint32(data, request.Offset)
+	return binary.BigEndian.AppendUint32(data, request.Limit)
+}
+
+// DeserializeListRequest decodes CommandList data. Empty data lists every entry by name.
+func DeserializeListRequest(data []byte) (*ListRequest, error) {
+	request := &ListRequest{}
+	switch len(data) {
+	case 0:
+		return request, nil
+	case 1:
+		request.Flags = data[0]
+		return request, nil
+	case ListPageSize:
+		request.Flags = data[0]
+		request.Offset = binary.BigEndian.Uint32(data[1:5])
+		request.Limit = binary.BigEndian.Uint32(data[5:9])
+		return request, nil
+	default:
+		return nil, fmt.Errorf("%w: list request has %d bytes", ErrMalformedData, len(data))
+	}
+}
@@ -2,20 +2,39 @@ package protocol
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
-	"io"
+	"fmt"
 
 	aesUtil "github.com/lcensies/ssnproj/pkg/aes"
 )
 
 // Custom error types for message deserialization
 var (
-	ErrMessageNotReady   = errors.New("message not ready")
-	ErrInsufficientData  = errors.New("insufficient data for message header")
-	ErrIncompletePayload = errors.New("incomplete message payload")
+	ErrMessageNotReady    = errors.New("message not ready")
+	ErrInsufficientData   = errors.New("insufficient data for message header")
+	ErrIncompletePayload  = errors.New("incomplete message payload")
+	ErrUnknownMessageType = errors.New("unknown message type")
+	ErrPayloadTooLarge    = errors.New("message payload too large")
+	ErrMalformedData      = errors.New("malformed data")
+	// ErrFilenameTooLong is returned when a filename does not fit its 2-byte length prefix
+	ErrFilenameTooLong = errors.New("filename too long")
 )
 
+// MaxWireFilenameLength is the longest filename, in bytes, a 2-byte length prefix can
+// describe. Servers accept far shorter names, see ServerInfo.MaxFilenameLength.
+const MaxWireFilenameLength = 0xFFFF
+
+// checkWireFilename refuses names that would overflow their length prefix, which would
+// otherwise be silently truncated and misread by the peer
+func checkWireFilename(filename string) error {
+	if len(filename) > MaxWireFilenameLength {
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrFilenameTooLong, len(filename), MaxWireFilenameLength)
+	}
+	return nil
+}
+
 // MessageType represents the type of message
 type MessageType byte
 
@@ -25,8 +44,33 @@ const (
 	MessageTypeCommand   MessageType = 0x02
 	MessageTypeData      MessageType = 0x03
 	MessageTypeResponse  MessageType = 0x04
+	// MessageTypeResume replaces the handshake when the client holds a session ticket
+	MessageTypeResume MessageType = 0x05
 )
 
+// knownMessageTypes is the set of message types accepted on the wire
+var knownMessageTypes = map[MessageType]struct{}{
+	MessageTypeHandshake: {},
+	MessageTypeCommand:   {},
+	MessageTypeData:      {},
+	MessageTypeResponse:  {},
+	MessageTypeResume:    {},
+}
+
+// IsValid reports whether t is one of the defined message types
+func (t MessageType) IsValid() bool {
+	_, ok := knownMessageTypes[t]
+	return ok
+}
+
+// validateMessageType returns ErrUnknownMessageType, annotated with the offending byte, for undefined types
+func validateMessageType(b byte) error {
+	if !MessageType(b).IsValid() {
+		return fmt.Errorf("%w: 0x%02x", ErrUnknownMessageType, b)
+	}
+	return nil
+}
+
 // CommandType represents different file operations
 type CommandType byte
 
@@ -35,8 +79,92 @@ const (
 	CommandDownload CommandType = 0x02
 	CommandList     CommandType = 0x03
 	CommandDelete   CommandType = 0x04
+	// CommandRename moves a file; it uses the field layout (source, destination)
+	CommandRename CommandType = 0x05
+	// CommandStat returns a single file's FileInfo without transferring its contents
+	CommandStat CommandType = 0x06
+	// CommandPing echoes its Data back, exercising the session without touching any file
+	CommandPing CommandType = 0x07
+
+	// Transaction envelope for all-or-nothing multi-file uploads
+	CommandBeginTx    CommandType = 0x10
+	CommandCommitTx   CommandType = 0x11
+	CommandRollbackTx CommandType = 0x12
+
+	// CommandVersion asks the server for its build version
+	CommandVersion CommandType = 0x13
+
+	// Tail streams the end of a file and, in follow mode, data appended to it until stopped
+	CommandTail     CommandType = 0x14
+	CommandTailStop CommandType = 0x15
+
+	// CommandInfo asks the server for its limits, see ServerInfo
+	CommandInfo CommandType = 0x16
+
+	// CommandUploadChunk starts an upload whose contents follow as MessageTypeData chunks
+	CommandUploadChunk CommandType = 0x17
+
+	// CommandMkdir creates a directory, and any missing parents, in the client's storage
+	CommandMkdir CommandType = 0x18
+
+	// CommandDeleteGlob deletes every file in a directory whose name matches a pattern
+	CommandDeleteGlob CommandType = 0x19
+
+	// CommandSessionTicket asks for a ticket that resumes this session, see ResumeRequest
+	CommandSessionTicket CommandType = 0x1A
+
+	// CommandUsage asks how many bytes the client stores and its quota, see SerializeUsage
+	CommandUsage CommandType = 0x1B
+
+	// CommandClose ends the session. The server sends no response and closes the connection.
+	CommandClose CommandType = 0x1C
+
+	// CommandCopy duplicates a file on the server; it uses the field layout (source,
+	// destination, optional flags byte)
+	CommandCopy CommandType = 0x1D
+
+	// CommandRestore moves the most recently deleted copy of a file back from the
+	// server's trash
+	CommandRestore CommandType = 0x1E
+
+	// CommandEmptyTrash permanently deletes everything in the client's trash
+	CommandEmptyTrash CommandType = 0x1F
+
+	// CommandAbort stops the download in progress; it is answered with AbortMessage
+	CommandAbort CommandType = 0x20
 )
 
+// CopyFlagNoClobber in a CommandCopy's flags field refuses to replace an existing file
+const CopyFlagNoClobber byte = 0x01
+
+// CommandFlagFields marks a command encoded with the field layout: instead of a
+// filename followed by unprefixed data, the payload is a 2-byte field count and then
+// each field as a 4-byte length and its bytes. Commands that need several values
+// (two names, metadata plus data) use it; servers that predate it reject the command
+// byte as unknown.
+const CommandFlagFields CommandType = 0x80
+
+// FileNotFoundMessage is the failure message for commands naming a file that does not exist
+const FileNotFoundMessage = "File not found"
+
+// TailFlagFollow in the CommandTail flags byte keeps streaming appended data
+const TailFlagFollow byte = 0x01
+
+// RequiresFilename reports whether the command operates on a named file
+func (c CommandType) RequiresFilename() bool {
+	switch c {
+	case CommandUpload, CommandDownload, CommandDelete, CommandTail, CommandUploadChunk, CommandRename, CommandStat, CommandMkdir, CommandDeleteGlob, CommandCopy, CommandRestore:
+		return true
+	default:
+		return false
+	}
+}
+
+// UsesFieldLayout reports whether the command is sent with the field layout, see CommandFlagFields
+func (c CommandType) UsesFieldLayout() bool {
+	return c == CommandRename || c == CommandCopy
+}
+
 // Message represents a protocol message
 type Message struct {
 	Type    MessageType
@@ -48,6 +176,14 @@ type CommandMessage struct {
 	Command  CommandType
 	Filename string
 	Data     []byte
+	// Fields holds every field of a command sent with the field layout, nil otherwise.
+	// Filename is set from the first field.
+	Fields [][]byte
+}
+
+// UsesFields reports whether the command was sent with the field layout
+func (c *CommandMessage) UsesFields() bool {
+	return c.Fields != nil
 }
 
 // ResponseMessage represents a response message
@@ -55,6 +191,8 @@ type ResponseMessage struct {
 	Success bool
 	Message string
 	Data    []byte
+	// ErrorCode classifies a failure, ErrCodeNone when the server did not send one
+	ErrorCode ErrorCode
 }
 
 // ChunkDataMessage represents a chunk of file data with progress information
@@ -65,6 +203,22 @@ type ChunkDataMessage struct {
 	ChunkSize   uint32
 	TotalSize   uint64
 	Data        []byte
+	// Checksum is the SHA-256 of Data, carried from ProtocolVersionChunkChecksums on
+	Checksum [32]byte
+}
+
+// ChecksumSize is the length of a chunk checksum
+const ChecksumSize = sha256.Size
+
+// ErrChunkChecksum reports a chunk whose data does not match its checksum
+var ErrChunkChecksum = errors.New("chunk checksum mismatch")
+
+// VerifyChecksum checks Data against Checksum, naming the chunk index on mismatch
+func (c *ChunkDataMessage) VerifyChecksum() error {
+	if sha256.Sum256(c.Data) != c.Checksum {
+		return fmt.Errorf("%w: chunk %d of %s", ErrChunkChecksum, c.ChunkIndex, c.Filename)
+	}
+	return nil
 }
 
 // NewMessage creates a new message
@@ -109,27 +263,26 @@ func (m *Message) Serialize() ([]byte, error) {
 
 // Deserialize converts bytes to a message
 func Deserialize(data []byte) (*Message, error) {
-	if len(data) < 5 {
-		return nil, errors.New("data too short")
-	}
-
-	buf := bytes.NewReader(data)
+	d := newDecoder("message", data)
 
 	// Read message type
-	msgType, err := buf.ReadByte()
+	msgType, err := d.readByte("type")
 	if err != nil {
 		return nil, err
 	}
+	if err := validateMessageType(msgType); err != nil {
+		return nil, err
+	}
 
 	// Read payload length
-	var payloadLen uint32
-	if err := binary.Read(buf, binary.BigEndian, &payloadLen); err != nil {
+	payloadLen, err := d.readUint32("payload length")
+	if err != nil {
 		return nil, err
 	}
 
 	// Read payload
-	payload := make([]byte, payloadLen)
-	if _, err := buf.Read(payload); err != nil {
+	payload, err := d.readBytes("payload", int(payloadLen))
+	if err != nil {
 		return nil, err
 	}
 
@@ -141,7 +294,8 @@ func Deserialize(data []byte) (*Message, error) {
 
 // MessageBuffer handles partial message reading with proper buffering
 type MessageBuffer struct {
-	buffer []byte
+	buffer     []byte
+	maxPayload uint32
 }
 
 // NewMessageBuffer creates a new message buffer
@@ -151,6 +305,12 @@ func NewMessageBuffer() *MessageBuffer {
 	}
 }
 
+// SetMaxPayload makes TryDeserialize reject a message whose header declares a payload
+// longer than limit, before any of the payload is buffered. Zero removes the limit.
+func (mb *MessageBuffer) SetMaxPayload(limit uint32) {
+	mb.maxPayload = limit
+}
+
 // AddData adds new data to the buffer
 func (mb *MessageBuffer) AddData(data []byte) {
 	mb.buffer = append(mb.buffer, data...)
@@ -159,6 +319,13 @@ func (mb *MessageBuffer) AddData(data []byte) {
 // TryDeserialize attempts to deserialize a complete message from the buffer
 // Returns the message and remaining buffer data if successful, or nil and error if not ready
 func (mb *MessageBuffer) TryDeserialize() (*Message, error) {
+	// Reject an undefined type as soon as its byte arrives rather than waiting for the payload
+	if len(mb.buffer) > 0 {
+		if err := validateMessageType(mb.buffer[0]); err != nil {
+			return nil, err
+		}
+	}
+
 	// Need at least 5 bytes (1 for type + 4 for length)
 	if len(mb.buffer) < 5 {
 		return nil, ErrInsufficientData
@@ -166,6 +333,9 @@ func (mb *MessageBuffer) TryDeserialize() (*Message, error) {
 
 	// Read payload length from the buffer
 	payloadLen := binary.BigEndian.Uint32(mb.buffer[1:5])
+	if mb.maxPayload > 0 && payloadLen > mb.maxPayload {
+		return nil, fmt.Errorf("%w: %d bytes exceeds the limit of %d", ErrPayloadTooLarge, payloadLen, mb.maxPayload)
+	}
 
 	// Calculate total message length: 1 (type) + 4 (length) + payload
 	totalMessageLen := 5 + int(payloadLen)
@@ -203,6 +373,9 @@ func (mb *MessageBuffer) Clear() {
 
 // SerializeCommand serializes a command message
 func SerializeCommand(cmd CommandType, filename string, data []byte) ([]byte, error) {
+	if err := checkWireFilename(filename); err != nil {
+		return nil, err
+	}
 	buf := new(bytes.Buffer)
 
 	// Write command type (1 byte)
@@ -229,57 +402,113 @@ func SerializeCommand(cmd CommandType, filename string, data []byte) ([]byte, er
 	return buf.Bytes(), nil
 }
 
-// DeserializeCommand deserializes a command message
-func DeserializeCommand(data []byte) (*CommandMessage, error) {
-	if len(data) < 3 {
-		return nil, errors.New("command data too short")
+// SerializeCommandFields serializes a command using the field layout, see CommandFlagFields
+func SerializeCommandFields(cmd CommandType, fields ...[]byte) ([]byte, error) {
+	if len(fields) > 0xFFFF {
+		return nil, fmt.Errorf("too many command fields: %d", len(fields))
 	}
 
-	buf := bytes.NewReader(data)
+	buf := new(bytes.Buffer)
 
-	// Read command type
-	cmdType, err := buf.ReadByte()
-	if err != nil {
+	// Write command type with the field layout flag (1 byte)
+	if err := buf.WriteByte(byte(cmd | CommandFlagFields)); err != nil {
 		return nil, err
 	}
 
-	// Read filename length
-	var filenameLen uint16
-	if err := binary.Read(buf, binary.BigEndian, &filenameLen); err != nil {
+	// Write field count (2 bytes)
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(fields))); err != nil {
 		return nil, err
 	}
 
-	// Read filename
-	filename := make([]byte, filenameLen)
-	if filenameLen > 0 {
-		if _, err := buf.Read(filename); err != nil {
+	// Write each field with its length (4 bytes)
+	for i, field := range fields {
+		if uint64(len(field)) > 0xFFFFFFFF {
+			return nil, fmt.Errorf("command field %d too long", i)
+		}
+		if err := binary.Write(buf, binary.BigEndian, uint32(len(field))); err != nil {
 			return nil, err
 		}
-	}
-
-	// Read remaining data
-	remaining := make([]byte, buf.Len())
-	if len(remaining) > 0 {
-		if _, err := buf.Read(remaining); err != nil && err != io.EOF {
+		if _, err := buf.Write(field); err != nil {
 			return nil, err
 		}
 	}
 
+	return buf.Bytes(), nil
+}
+
+// DeserializeCommand deserializes a command message
+func DeserializeCommand(data []byte) (*CommandMessage, error) {
+	d := newDecoder("command", data)
+
+	// Read command type
+	cmdType, err := d.readByte("command type")
+	if err != nil {
+		return nil, err
+	}
+
+	if CommandType(cmdType)&CommandFlagFields != 0 {
+		return deserializeCommandFields(d, CommandType(cmdType)&^CommandFlagFields)
+	}
+
+	// Read filename length
+	filenameLen, err := d.readUint16("filename length")
+	if err != nil {
+		return nil, err
+	}
+
+	// Read filename
+	filename, err := d.readBytes("filename", int(filenameLen))
+	if err != nil {
+		return nil, err
+	}
+
 	return &CommandMessage{
 		Command:  CommandType(cmdType),
 		Filename: string(filename),
-		Data:     remaining,
+		Data:     d.rest(),
 	}, nil
 }
 
+// deserializeCommandFields reads the rest of a field layout command
+func deserializeCommandFields(d *decoder, cmd CommandType) (*CommandMessage, error) {
+	count, err := d.readUint16("field count")
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make([][]byte, 0, count)
+	for i := 0; i < int(count); i++ {
+		name := fmt.Sprintf("field %d", i)
+		fieldLen, err := d.readUint32(name + " length")
+		if err != nil {
+			return nil, err
+		}
+		field, err := d.readBytes(name, int(fieldLen))
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+
+	if trailing := d.rest(); len(trailing) > 0 {
+		return nil, fmt.Errorf("%w: %d bytes after the last command field", ErrMalformedData, len(trailing))
+	}
+
+	command := &CommandMessage{Command: cmd, Fields: fields}
+	if len(fields) > 0 {
+		command.Filename = string(fields[0])
+	}
+	return command, nil
+}
+
 // SerializeResponse serializes a response message
 func SerializeResponse(success bool, message string, data []byte) ([]byte, error) {
 	buf := new(bytes.Buffer)
 
 	// Write success flag (1 byte)
-	successByte := byte(0)
+	successByte := responseFailure
 	if success {
-		successByte = 1
+		successByte = responseSuccess
 	}
 	if err := buf.WriteByte(successByte); err != nil {
 		return nil, err
@@ -306,48 +535,54 @@ func SerializeResponse(success bool, message string, data []byte) ([]byte, error
 
 // DeserializeResponse deserializes a response message
 func DeserializeResponse(data []byte) (*ResponseMessage, error) {
-	if len(data) < 3 {
-		return nil, errors.New("response data too short")
-	}
-
-	buf := bytes.NewReader(data)
+	d := newDecoder("response", data)
 
 	// Read success flag
-	successByte, err := buf.ReadByte()
+	successByte, err := d.readByte("success flag")
 	if err != nil {
 		return nil, err
 	}
-	success := successByte == 1
 
 	// Read message length
-	var messageLen uint16
-	if err := binary.Read(buf, binary.BigEndian, &messageLen); err != nil {
+	messageLen, err := d.readUint16("message length")
+	if err != nil {
 		return nil, err
 	}
 
 	// Read message
-	message := make([]byte, messageLen)
-	if messageLen > 0 {
-		if _, err := buf.Read(message); err != nil {
-			return nil, err
-		}
+	message, err := d.readBytes("message", int(messageLen))
+	if err != nil {
+		return nil, err
 	}
 
-	// Read remaining data
-	remaining := make([]byte, buf.Len())
-	if _, err := buf.Read(remaining); err != nil && err != io.EOF {
-		return nil, err
+	// A coded failure carries its error code between the message and the data
+	var code uint16
+	if successByte == responseFailureCoded {
+		if code, err = d.readUint16("error code"); err != nil {
+			return nil, err
+		}
 	}
 
 	return &ResponseMessage{
-		Success: success,
-		Message: string(message),
-		Data:    remaining,
+		Success:   successByte == responseSuccess,
+		Message:   string(message),
+		Data:      d.rest(),
+		ErrorCode: ErrorCode(code),
 	}, nil
 }
 
 // SerializeChunkData serializes a chunk data message
 func SerializeChunkData(chunk *ChunkDataMessage) ([]byte, error) {
+	return SerializeChunkDataVersion(chunk, ProtocolVersionBase)
+}
+
+// SerializeChunkDataVersion serializes a chunk for the negotiated protocol version.
+// From ProtocolVersionChunkChecksums on, the SHA-256 of Data is computed and written
+// between the total size and the data.
+func SerializeChunkDataVersion(chunk *ChunkDataMessage, version uint16) ([]byte, error) {
+	if err := checkWireFilename(chunk.Filename); err != nil {
+		return nil, err
+	}
 	buf := new(bytes.Buffer)
 
 	// Write filename length (2 bytes)
@@ -381,6 +616,14 @@ func SerializeChunkData(chunk *ChunkDataMessage) ([]byte, error) {
 		return nil, err
 	}
 
+	// Write checksum (32 bytes)
+	if version >= ProtocolVersionChunkChecksums {
+		chunk.Checksum = sha256.Sum256(chunk.Data)
+		if _, err := buf.Write(chunk.Checksum[:]); err != nil {
+			return nil, err
+		}
+	}
+
 	// Write data
 	if _, err := buf.Write(chunk.Data); err != nil {
 		return nil, err
@@ -391,62 +634,67 @@ func SerializeChunkData(chunk *ChunkDataMessage) ([]byte, error) {
 
 // DeserializeChunkData deserializes a chunk data message
 func DeserializeChunkData(data []byte) (*ChunkDataMessage, error) {
-	if len(data) < 22 { // minimum size: 2 + 4 + 4 + 4 + 8 = 22 bytes
-		return nil, errors.New("chunk data too short")
-	}
+	return DeserializeChunkDataVersion(data, ProtocolVersionBase)
+}
 
-	buf := bytes.NewReader(data)
+// DeserializeChunkDataVersion deserializes a chunk sent with the negotiated protocol
+// version. The checksum is read but not verified; see VerifyChecksum.
+func DeserializeChunkDataVersion(data []byte, version uint16) (*ChunkDataMessage, error) {
+	d := newDecoder("chunk", data)
 
 	// Read filename length
-	var filenameLen uint16
-	if err := binary.Read(buf, binary.BigEndian, &filenameLen); err != nil {
+	filenameLen, err := d.readUint16("filename length")
+	if err != nil {
 		return nil, err
 	}
 
 	// Read filename
-	filename := make([]byte, filenameLen)
-	if filenameLen > 0 {
-		if _, err := buf.Read(filename); err != nil {
-			return nil, err
-		}
+	filename, err := d.readBytes("filename", int(filenameLen))
+	if err != nil {
+		return nil, err
 	}
 
 	// Read chunk index
-	var chunkIndex uint32
-	if err := binary.Read(buf, binary.BigEndian, &chunkIndex); err != nil {
+	chunkIndex, err := d.readUint32("chunk index")
+	if err != nil {
 		return nil, err
 	}
 
 	// Read total chunks
-	var totalChunks uint32
-	if err := binary.Read(buf, binary.BigEndian, &totalChunks); err != nil {
+	totalChunks, err := d.readUint32("total chunks")
+	if err != nil {
 		return nil, err
 	}
 
 	// Read chunk size
-	var chunkSize uint32
-	if err := binary.Read(buf, binary.BigEndian, &chunkSize); err != nil {
+	chunkSize, err := d.readUint32("chunk size")
+	if err != nil {
 		return nil, err
 	}
 
 	// Read total size
-	var totalSize uint64
-	if err := binary.Read(buf, binary.BigEndian, &totalSize); err != nil {
-		return nil, err
-	}
-
-	// Read remaining data
-	remaining := make([]byte, buf.Len())
-	if _, err := buf.Read(remaining); err != nil && err != io.EOF {
+	totalSize, err := d.readUint64("total size")
+	if err != nil {
 		return nil, err
 	}
 
-	return &ChunkDataMessage{
+	chunk := &ChunkDataMessage{
 		Filename:    string(filename),
 		ChunkIndex:  chunkIndex,
 		TotalChunks: totalChunks,
 		ChunkSize:   chunkSize,
 		TotalSize:   totalSize,
-		Data:        remaining,
-	}, nil
+	}
+
+	// Read checksum
+	if version >= ProtocolVersionChunkChecksums {
+		checksum, err := d.take("checksum", ChecksumSize)
+		if err != nil {
+			return nil, err
+		}
+		copy(chunk.Checksum[:], checksum)
+	}
+
+	chunk.Data = d.rest()
+	return chunk, nil
 }
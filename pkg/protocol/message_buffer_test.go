@@ -1,7 +1,11 @@
 package protocol
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"testing"
+	"testing/iotest"
 )
 
 func TestMessageBuffer_PartialMessage(t *testing.T) {
@@ -191,3 +195,92 @@ func TestMessageBuffer_LargeMessage(t *testing.T) {
 		t.Errorf("Expected payload length %d, got %d", len(largePayload), len(message.Payload))
 	}
 }
+
+// TestMessageBuffer_OneByteReads assembles messages from a reader that returns one byte
+// per call and checks the command and response inside decode without truncation
+func TestMessageBuffer_OneByteReads(t *testing.T) {
+	commandPayload, err := SerializeCommand(CommandUpload, "notes.txt", bytes.Repeat([]byte("data"), 300))
+	if err != nil {
+		t.Fatalf("SerializeCommand failed: %v", err)
+	}
+	responsePayload, err := SerializeResponse(true, "File uploaded successfully", []byte("notes.txt"))
+	if err != nil {
+		t.Fatalf("SerializeResponse failed: %v", err)
+	}
+
+	var stream []byte
+	for _, msg := range []*Message{NewMessage(MessageTypeCommand, commandPayload), NewMessage(MessageTypeResponse, responsePayload)} {
+		serialized, err := msg.Serialize()
+		if err != nil {
+			t.Fatalf("Serialize failed: %v", err)
+		}
+		stream = append(stream, serialized...)
+	}
+
+	reader := iotest.OneByteReader(bytes.NewReader(stream))
+	buffer := NewMessageBuffer()
+	var messages []*Message
+	chunk := make([]byte, 64)
+	for {
+		n, err := reader.Read(chunk)
+		buffer.AddData(chunk[:n])
+		for {
+			msg, decodeErr := buffer.TryDeserialize()
+			if decodeErr != nil {
+				break
+			}
+			messages = append(messages, msg)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+	}
+
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(messages))
+	}
+
+	command, err := DeserializeCommand(messages[0].Payload)
+	if err != nil {
+		t.Fatalf("DeserializeCommand failed: %v", err)
+	}
+	if command.Filename != "notes.txt" || !bytes.Equal(command.Data, bytes.Repeat([]byte("data"), 300)) {
+		t.Errorf("Command decoded as filename %q with %d data bytes", command.Filename, len(command.Data))
+	}
+
+	response, err := DeserializeResponse(messages[1].Payload)
+	if err != nil {
+		t.Fatalf("DeserializeResponse failed: %v", err)
+	}
+	if response.Message != "File uploaded successfully" || string(response.Data) != "notes.txt" {
+		t.Errorf("Response decoded as %+v", response)
+	}
+}
+
+func TestMessageBuffer_MaxPayload(t *testing.T) {
+	small, _ := NewMessage(MessageTypeData, bytes.Repeat([]byte("a"), 16)).Serialize()
+	large, _ := NewMessage(MessageTypeData, bytes.Repeat([]byte("b"), 17)).Serialize()
+
+	buffer := NewMessageBuffer()
+	buffer.SetMaxPayload(16)
+	buffer.AddData(small)
+	if message, err := buffer.TryDeserialize(); err != nil || len(message.Payload) != 16 {
+		t.Fatalf("Expected a payload at the limit to be accepted, got %v", err)
+	}
+
+	// The oversized frame is refused from its header alone
+	buffer.AddData(large[:5])
+	if _, err := buffer.TryDeserialize(); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("Expected ErrPayloadTooLarge, got %v", err)
+	}
+
+	// Removing the limit accepts it again
+	buffer.SetMaxPayload(0)
+	buffer.AddData(large[5:])
+	if message, err := buffer.TryDeserialize(); err != nil || len(message.Payload) != 17 {
+		t.Errorf("Expected the frame to be accepted without a limit, got %v", err)
+	}
+}
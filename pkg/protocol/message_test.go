@@ -0,0 +1,599 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDeserialize_UnknownMessageType(t *testing.T) {
+	// 0x7f is not a defined message type
+	data := []byte{0x7f, 0x00, 0x00, 0x00, 0x02, 'h', 'i'}
+
+	message, err := Deserialize(data)
+	if !errors.Is(err, ErrUnknownMessageType) {
+		t.Fatalf("Expected ErrUnknownMessageType, got %v", err)
+	}
+	if message != nil {
+		t.Error("Expected nil message for unknown type")
+	}
+}
+
+func TestMessageBuffer_UnknownMessageType(t *testing.T) {
+	buffer := NewMessageBuffer()
+
+	// Only the type byte has arrived, the rejection should not wait for the rest
+	buffer.AddData([]byte{0x00})
+
+	message, err := buffer.TryDeserialize()
+	if !errors.Is(err, ErrUnknownMessageType) {
+		t.Fatalf("Expected ErrUnknownMessageType, got %v", err)
+	}
+	if message != nil {
+		t.Error("Expected nil message for unknown type")
+	}
+}
+
+func TestMessageType_IsValid(t *testing.T) {
+	for _, msgType := range []MessageType{MessageTypeHandshake, MessageTypeCommand, MessageTypeData, MessageTypeResponse} {
+		if !msgType.IsValid() {
+			t.Errorf("Expected message type 0x%02x to be valid", byte(msgType))
+		}
+	}
+
+	if MessageType(0xff).IsValid() {
+		t.Error("Expected message type 0xff to be invalid")
+	}
+}
+
+func TestDeserialize_ErrorsIdentifyField(t *testing.T) {
+	tests := []struct {
+		name     string
+		decode   func() error
+		expected string
+	}{
+		{
+			name: "message payload truncated",
+			decode: func() error {
+				_, err := Deserialize([]byte{byte(MessageTypeCommand), 0x00, 0x00, 0x00, 0x08, 'a', 'b'})
+				return err
+			},
+			expected: "message: payload length exceeds payload at offset 5 (need 8 bytes, have 2)",
+		},
+		{
+			name: "message header truncated",
+			decode: func() error {
+				_, err := Deserialize([]byte{byte(MessageTypeCommand), 0x00})
+				return err
+			},
+			expected: "message: payload length truncated at offset 1 (need 4 bytes, have 1)",
+		},
+		{
+			name: "command filename length exceeds payload",
+			decode: func() error {
+				_, err := DeserializeCommand([]byte{byte(CommandUpload), 0x00, 0x0a, 'a', 'b'})
+				return err
+			},
+			expected: "command: filename length exceeds payload at offset 3 (need 10 bytes, have 2)",
+		},
+		{
+			name: "command empty",
+			decode: func() error {
+				_, err := DeserializeCommand(nil)
+				return err
+			},
+			expected: "command: command type truncated at offset 0 (need 1 bytes, have 0)",
+		},
+		{
+			name: "response message length exceeds payload",
+			decode: func() error {
+				_, err := DeserializeResponse([]byte{0x01, 0x00, 0x05, 'o', 'k'})
+				return err
+			},
+			expected: "response: message length exceeds payload at offset 3 (need 5 bytes, have 2)",
+		},
+		{
+			name: "chunk total size truncated",
+			decode: func() error {
+				payload, err := SerializeChunkData(&ChunkDataMessage{Filename: "f.txt", TotalSize: 1})
+				if err != nil {
+					return err
+				}
+				_, err = DeserializeChunkData(payload[:len(payload)-3])
+				return err
+			},
+			expected: "chunk: total size truncated at offset 19 (need 8 bytes, have 5)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.decode()
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			if err.Error() != tt.expected {
+				t.Errorf("Unexpected error message.\nExpected: %s\nGot:      %s", tt.expected, err.Error())
+			}
+
+			var decodeErr *DecodeError
+			if !errors.As(err, &decodeErr) {
+				t.Errorf("Expected a *DecodeError, got %T", err)
+			}
+			if !errors.Is(err, ErrMalformedData) {
+				t.Error("Expected error to match ErrMalformedData")
+			}
+		})
+	}
+}
+
+func TestServerInfo_RoundTrip(t *testing.T) {
+	info := &ServerInfo{
+		MaxUploadSize:     1 << 20,
+		MinChunkSize:      64 * 1024,
+		MaxChunkSize:      512 * 1024,
+		MaxFilenameLength: 255,
+		MaxPathLength:     4096,
+		Ciphers:           []string{"AES-256-GCM", "AES-128-GCM"},
+		Compression:       []string{EncodingGzip},
+	}
+
+	data, err := SerializeServerInfo(info)
+	if err != nil {
+		t.Fatalf("SerializeServerInfo failed: %v", err)
+	}
+
+	// Records from newer servers are skipped
+	data = append(data, 0x7f, 0x00, 0x01, 0xff)
+
+	got, err := DeserializeServerInfo(data)
+	if err != nil {
+		t.Fatalf("DeserializeServerInfo failed: %v", err)
+	}
+	if got.MaxUploadSize != info.MaxUploadSize || got.MinChunkSize != info.MinChunkSize ||
+		got.MaxChunkSize != info.MaxChunkSize || got.Quota != 0 || got.MaxFilenameLength != info.MaxFilenameLength ||
+		got.MaxPathLength != info.MaxPathLength {
+		t.Errorf("Limits mismatch: %+v", got)
+	}
+	if len(got.Ciphers) != 2 || got.Ciphers[1] != "AES-128-GCM" || len(got.Compression) != 1 {
+		t.Errorf("Lists mismatch: %+v", got)
+	}
+
+	if _, err := DeserializeServerInfo([]byte{infoMaxUploadSize, 0x00, 0x01, 0x00}); !errors.Is(err, ErrMalformedData) {
+		t.Errorf("Expected ErrMalformedData for a short limit, got %v", err)
+	}
+}
+
+func TestCommandFields_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		cmd    CommandType
+		fields [][]byte
+	}{
+		{name: "rename", cmd: CommandRename, fields: [][]byte{[]byte("old name.txt"), []byte("new name.txt")}},
+		{name: "upload with metadata", cmd: CommandUpload, fields: [][]byte{[]byte("report.pdf"), []byte("mode=0600\nowner=alice"), {0x00, 0x01, 0x02, 0xff}}},
+		{name: "empty fields", cmd: CommandUpload, fields: [][]byte{[]byte("empty.txt"), {}, {}}},
+		{name: "no fields", cmd: CommandList, fields: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := SerializeCommandFields(tt.cmd, tt.fields...)
+			if err != nil {
+				t.Fatalf("SerializeCommandFields failed: %v", err)
+			}
+
+			got, err := DeserializeCommand(data)
+			if err != nil {
+				t.Fatalf("DeserializeCommand failed: %v", err)
+			}
+			if got.Command != tt.cmd {
+				t.Errorf("Command = 0x%02x, want 0x%02x", byte(got.Command), byte(tt.cmd))
+			}
+			if !got.UsesFields() || len(got.Fields) != len(tt.fields) {
+				t.Fatalf("Fields = %q, want %q", got.Fields, tt.fields)
+			}
+			for i := range tt.fields {
+				if string(got.Fields[i]) != string(tt.fields[i]) {
+					t.Errorf("Field %d = %q, want %q", i, got.Fields[i], tt.fields[i])
+				}
+			}
+			if len(tt.fields) > 0 && got.Filename != string(tt.fields[0]) {
+				t.Errorf("Filename = %q, want the first field %q", got.Filename, tt.fields[0])
+			}
+		})
+	}
+}
+
+func TestCommandFields_Malformed(t *testing.T) {
+	data, err := SerializeCommandFields(CommandUpload, []byte("a.txt"), []byte("payload"))
+	if err != nil {
+		t.Fatalf("SerializeCommandFields failed: %v", err)
+	}
+
+	// Cutting into the second field is reported against that field
+	_, err = DeserializeCommand(data[:len(data)-3])
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Field != "field 1 length" {
+		t.Errorf("Expected a DecodeError for field 1, got %v", err)
+	}
+
+	// Bytes after the declared fields are not silently dropped
+	if _, err := DeserializeCommand(append(data, 0x00)); !errors.Is(err, ErrMalformedData) {
+		t.Errorf("Expected ErrMalformedData for trailing bytes, got %v", err)
+	}
+
+	// The classic layout is unchanged
+	legacy, _ := SerializeCommand(CommandUpload, "a.txt", []byte("payload"))
+	got, err := DeserializeCommand(legacy)
+	if err != nil || got.UsesFields() || string(got.Data) != "payload" {
+		t.Errorf("Classic layout decoded as %+v (%v)", got, err)
+	}
+}
+
+func TestSerialize_FilenameTooLong(t *testing.T) {
+	longest := strings.Repeat("a", MaxWireFilenameLength)
+	payload, err := SerializeCommand(CommandUpload, longest, []byte("data"))
+	if err != nil {
+		t.Fatalf("SerializeCommand failed for the longest name: %v", err)
+	}
+	if decoded, err := DeserializeCommand(payload); err != nil || decoded.Filename != longest || string(decoded.Data) != "data" {
+		t.Errorf("Longest name did not round-trip (%v)", err)
+	}
+
+	// One byte more would wrap the length prefix and be misread, so it is refused
+	tooLong := longest + "a"
+	if _, err := SerializeCommand(CommandUpload, tooLong, nil); !errors.Is(err, ErrFilenameTooLong) {
+		t.Errorf("Expected ErrFilenameTooLong from SerializeCommand, got %v", err)
+	}
+	if _, err := SerializeChunkData(&ChunkDataMessage{Filename: tooLong}); !errors.Is(err, ErrFilenameTooLong) {
+		t.Errorf("Expected ErrFilenameTooLong from SerializeChunkData, got %v", err)
+	}
+}
+
+func TestChunkData_Checksum(t *testing.T) {
+	chunk := &ChunkDataMessage{
+		Filename:    "data.bin",
+		ChunkIndex:  3,
+		TotalChunks: 5,
+		ChunkSize:   4,
+		TotalSize:   20,
+		Data:        []byte{0xde, 0xad, 0xbe, 0xef},
+	}
+
+	v1, err := SerializeChunkData(chunk)
+	if err != nil {
+		t.Fatalf("SerializeChunkData failed: %v", err)
+	}
+	v2, err := SerializeChunkDataVersion(chunk, ProtocolVersionChunkChecksums)
+	if err != nil {
+		t.Fatalf("SerializeChunkDataVersion failed: %v", err)
+	}
+	if len(v2) != len(v1)+ChecksumSize {
+		t.Fatalf("Checksummed chunk is %d bytes, want %d", len(v2), len(v1)+ChecksumSize)
+	}
+
+	// The base layout is unchanged for peers that did not negotiate checksums
+	got, err := DeserializeChunkData(v1)
+	if err != nil || !bytes.Equal(got.Data, chunk.Data) {
+		t.Fatalf("Base chunk decoded as %+v (%v)", got, err)
+	}
+
+	got, err = DeserializeChunkDataVersion(v2, ProtocolVersionChunkChecksums)
+	if err != nil {
+		t.Fatalf("DeserializeChunkDataVersion failed: %v", err)
+	}
+	if !bytes.Equal(got.Data, chunk.Data) {
+		t.Errorf("Data = %x, want %x", got.Data, chunk.Data)
+	}
+	if err := got.VerifyChecksum(); err != nil {
+		t.Errorf("VerifyChecksum failed on intact chunk: %v", err)
+	}
+
+	// Flip a data bit in transit
+	v2[len(v2)-1] ^= 0x01
+	got, err = DeserializeChunkDataVersion(v2, ProtocolVersionChunkChecksums)
+	if err != nil {
+		t.Fatalf("DeserializeChunkDataVersion failed: %v", err)
+	}
+	err = got.VerifyChecksum()
+	if !errors.Is(err, ErrChunkChecksum) || !strings.Contains(err.Error(), "chunk 3") {
+		t.Errorf("Expected checksum error naming chunk 3, got %v", err)
+	}
+}
+
+func TestNegotiateProtocolVersion(t *testing.T) {
+	tests := []struct {
+		peer uint16
+		want uint16
+	}{
+		{peer: 0, want: ProtocolVersionBase},
+		{peer: ProtocolVersionBase, want: ProtocolVersionBase},
+		{peer: ProtocolVersion, want: ProtocolVersion},
+		{peer: ProtocolVersion + 1, want: ProtocolVersion},
+	}
+	for _, tt := range tests {
+		if got := NegotiateProtocolVersion(tt.peer); got != tt.want {
+			t.Errorf("NegotiateProtocolVersion(%d) = %d, want %d", tt.peer, got, tt.want)
+		}
+	}
+
+	data, err := SerializeHandshakeOptions(&HandshakeOptions{ProtocolVersion: ProtocolVersion})
+	if err != nil {
+		t.Fatalf("SerializeHandshakeOptions failed: %v", err)
+	}
+	opts, err := DeserializeHandshakeOptions(data)
+	if err != nil || opts.ProtocolVersion != ProtocolVersion {
+		t.Errorf("Handshake options decoded as %+v (%v)", opts, err)
+	}
+}
+
+func TestFileInfos_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		infos []FileInfo
+	}{
+		{"empty listing", []FileInfo{}},
+		{"files and directories", []FileInfo{
+			{Name: "report.pdf", Size: 1 << 40, ModTime: 1700000000},
+			{Name: "line\nbreak.txt", Size: 3, ModTime: -1},
+			{Name: "archive", ModTime: 42, IsDir: true},
+		}},
+		{"content types", []FileInfo{
+			{Name: "logo.png", Size: 8, ModTime: 1, ContentType: "image/png"},
+			{Name: "empty", ModTime: 2, ContentType: "application/octet-stream"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := SerializeFileInfos(tt.infos)
+			if err != nil {
+				t.Fatalf("SerializeFileInfos failed: %v", err)
+			}
+			decoded, err := DeserializeFileInfos(data)
+			if err != nil {
+				t.Fatalf("DeserializeFileInfos failed: %v", err)
+			}
+			if len(decoded) != len(tt.infos) {
+				t.Fatalf("Expected %d entries, got %d", len(tt.infos), len(decoded))
+			}
+			for i := range tt.infos {
+				if decoded[i] != tt.infos[i] {
+					t.Errorf("Entry %d: expected %+v, got %+v", i, tt.infos[i], decoded[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFileInfos_Malformed(t *testing.T) {
+	valid, err := SerializeFileInfos([]FileInfo{{Name: "a.txt", Size: 1}})
+	if err != nil {
+		t.Fatalf("SerializeFileInfos failed: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"missing count", []byte{0x00, 0x01}},
+		{"count larger than data", []byte{0xff, 0xff, 0xff, 0xff, 0x00}},
+		{"truncated entry", valid[:len(valid)-1]},
+		{"content type flag without type", append(append([]byte{}, valid[:len(valid)-1]...), 0x02)},
+		{"trailing bytes", append(append([]byte{}, valid...), 0x00)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DeserializeFileInfos(tt.data); !errors.Is(err, ErrMalformedData) {
+				t.Errorf("Expected ErrMalformedData, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDownloadRequest_Streams(t *testing.T) {
+	var prefixSum [32]byte
+	prefixSum[0] = 0xab
+	request, err := DeserializeDownloadRequest(SerializeDownloadStream(42, prefixSum, 2, 3))
+	if err != nil {
+		t.Fatalf("DeserializeDownloadRequest failed: %v", err)
+	}
+	if request.Offset != 42 || request.PrefixSum != prefixSum || request.Stream != 2 || request.Streams != 3 {
+		t.Errorf("Round trip mismatch: %+v", request)
+	}
+
+	for _, data := range [][]byte{
+		SerializeDownloadStream(0, prefixSum, 3, 3),
+		SerializeDownloadStream(0, prefixSum, 0, 0),
+		make([]byte, DownloadStreamSize-1),
+	} {
+		if _, err := DeserializeDownloadRequest(data); !errors.Is(err, ErrMalformedData) {
+			t.Errorf("Expected ErrMalformedData for %x, got %v", data[DownloadResumeSize-1:], err)
+		}
+	}
+
+	// The streams' ranges cover every chunk exactly once
+	for _, totalChunks := range []uint32{0, 1, 7, 9, 100} {
+		for streams := uint16(1); streams <= 8; streams++ {
+			next := uint32(0)
+			for stream := uint16(0); stream < streams; stream++ {
+				first, end := StreamChunkRange(totalChunks, stream, streams)
+				if first != next || end < first {
+					t.Fatalf("%d chunks over %d streams: stream %d got [%d, %d), expected to start at %d",
+						totalChunks, streams, stream, first, end, next)
+				}
+				next = end
+			}
+			if next != totalChunks {
+				t.Errorf("%d chunks over %d streams: ranges end at %d", totalChunks, streams, next)
+			}
+		}
+	}
+}
+
+func TestDownloadRequest_ChunkSize(t *testing.T) {
+	var prefixSum [32]byte
+	prefixSum[0] = 0xcd
+
+	// Requests without a chunk size keep the layouts older servers accept
+	forms := []struct {
+		request DownloadRequest
+		size    int
+	}{
+		{DownloadRequest{Streams: 1}, 0},
+		{DownloadRequest{Offset: 7, PrefixSum: prefixSum, Streams: 1}, DownloadResumeSize},
+		{DownloadRequest{Stream: 1, Streams: 2}, DownloadStreamSize},
+		{DownloadRequest{Streams: 1, ChunkSize: 100000}, DownloadChunkSizeSize},
+		{DownloadRequest{Offset: 7, PrefixSum: prefixSum, Stream: 1, Streams: 2, ChunkSize: 100000}, DownloadChunkSizeSize},
+		{DownloadRequest{Streams: 1, RangeStart: 10, RangeLength: 20}, DownloadRangeSize},
+		{DownloadRequest{Streams: 1, RangeStart: 10}, DownloadRangeSize},
+		{DownloadRequest{Offset: 7, PrefixSum: prefixSum, Streams: 1, ChunkSize: 100000, RangeLength: 5}, DownloadRangeSize},
+	}
+	for _, form := range forms {
+		data := SerializeDownloadRequest(&form.request)
+		if len(data) != form.size {
+			t.Errorf("%+v encoded in %d bytes, want %d", form.request, len(data), form.size)
+		}
+		decoded, err := DeserializeDownloadRequest(data)
+		if err != nil {
+			t.Fatalf("DeserializeDownloadRequest failed for %+v: %v", form.request, err)
+		}
+		if *decoded != form.request {
+			t.Errorf("Round trip mismatch: got %+v, want %+v", *decoded, form.request)
+		}
+	}
+
+	for _, tt := range []struct {
+		preferred uint32
+		want      uint32
+	}{
+		{0, ChunkSizeFor(10 * 1024 * 1024)},
+		{1000, SmallChunkSize},
+		{100000, 100000},
+		{MaxChunkSize + 1, MaxChunkSize},
+	} {
+		if got := PreferredChunkSize(10*1024*1024, tt.preferred); got != tt.want {
+			t.Errorf("PreferredChunkSize(%d) = %d, want %d", tt.preferred, got, tt.want)
+		}
+	}
+}
+
+func TestResponse_ErrorCode(t *testing.T) {
+	data, err := SerializeErrorResponse(ErrCodeNotFound, "File not found", []byte{0x01, 0x02})
+	if err != nil {
+		t.Fatalf("SerializeErrorResponse failed: %v", err)
+	}
+	resp, err := DeserializeResponse(data)
+	if err != nil {
+		t.Fatalf("DeserializeResponse failed: %v", err)
+	}
+	if resp.Success || resp.Message != "File not found" || resp.ErrorCode != ErrCodeNotFound || !bytes.Equal(resp.Data, []byte{0x01, 0x02}) {
+		t.Errorf("Round trip mismatch: %+v", resp)
+	}
+
+	// Responses without a code, as older servers send them, decode as ErrCodeNone
+	data, _ = SerializeResponse(false, "File not found", []byte{0x01})
+	resp, err = DeserializeResponse(data)
+	if err != nil {
+		t.Fatalf("DeserializeResponse failed: %v", err)
+	}
+	if resp.Success || resp.ErrorCode != ErrCodeNone || !bytes.Equal(resp.Data, []byte{0x01}) {
+		t.Errorf("Uncoded failure decoded as %+v", resp)
+	}
+
+	// A coded failure cut off inside its code is malformed
+	data, _ = SerializeErrorResponse(ErrCodeIO, "x", nil)
+	if _, err := DeserializeResponse(data[:len(data)-1]); !errors.Is(err, ErrMalformedData) {
+		t.Errorf("Expected ErrMalformedData for a truncated code, got %v", err)
+	}
+}
+
+func TestUploadRequest_Flags(t *testing.T) {
+	// Uploads that overwrite keep the layouts older servers accept
+	forms := []struct {
+		request UploadRequest
+		size    int
+	}{
+		{UploadRequest{Size: 42, Overwrite: true}, 8},
+		{UploadRequest{SizeUnknown: true, Overwrite: true}, 0},
+		{UploadRequest{Size: 42}, 9},
+		{UploadRequest{SizeUnknown: true}, 1},
+		{UploadRequest{Size: 42, Overwrite: true, ValidateOnly: true}, 9},
+		{UploadRequest{SizeUnknown: true, ValidateOnly: true}, 1},
+		{UploadRequest{Size: 42, Overwrite: true, ModTime: 981173106000000000}, 17},
+		{UploadRequest{Size: 42, ModTime: -1}, 17},
+	}
+	for _, form := range forms {
+		data := SerializeUploadRequest(&form.request)
+		if len(data) != form.size {
+			t.Errorf("%+v encoded in %d bytes, want %d", form.request, len(data), form.size)
+		}
+		decoded, err := DeserializeUploadRequest(data)
+		if err != nil {
+			t.Fatalf("DeserializeUploadRequest failed for %+v: %v", form.request, err)
+		}
+		if *decoded != form.request {
+			t.Errorf("Round trip mismatch: got %+v, want %+v", *decoded, form.request)
+		}
+	}
+
+	// A modification time without a size cannot be told apart from a size, so it is dropped
+	if data := SerializeUploadRequest(&UploadRequest{SizeUnknown: true, Overwrite: true, ModTime: 1}); len(data) != 0 {
+		t.Errorf("Modification time of an upload of unknown size encoded in %d bytes, want 0", len(data))
+	}
+
+	for _, data := range [][]byte{make([]byte, 4), {0x80}, append(make([]byte, 8), 0x04), make([]byte, 17)} {
+		if _, err := DeserializeUploadRequest(data); !errors.Is(err, ErrMalformedData) {
+			t.Errorf("Expected ErrMalformedData for %x, got %v", data, err)
+		}
+	}
+}
+
+func TestListRequest_Page(t *testing.T) {
+	// Unpaged listings keep the single flags byte older servers accept
+	forms := []struct {
+		request ListRequest
+		size    int
+	}{
+		{ListRequest{}, 1},
+		{ListRequest{Flags: ListFlagDetailed | ListFlagRecursive}, 1},
+		{ListRequest{Flags: ListFlagDetailed, Limit: 100}, ListPageSize},
+		{ListRequest{Offset: 200, Limit: 100}, ListPageSize},
+		{ListRequest{Offset: 200}, ListPageSize},
+	}
+	for _, form := range forms {
+		data := SerializeListRequest(&form.request)
+		if len(data) != form.size {
+			t.Errorf("%+v encoded in %d bytes, want %d", form.request, len(data), form.size)
+		}
+		decoded, err := DeserializeListRequest(data)
+		if err != nil {
+			t.Fatalf("DeserializeListRequest failed for %+v: %v", form.request, err)
+		}
+		if *decoded != form.request {
+			t.Errorf("Round trip mismatch: got %+v, want %+v", *decoded, form.request)
+		}
+	}
+
+	if decoded, err := DeserializeListRequest(nil); err != nil || decoded.Paged() || decoded.Flags != 0 {
+		t.Errorf("Expected empty data to list everything, got %+v (%v)", decoded, err)
+	}
+	for _, data := range [][]byte{make([]byte, 2), make([]byte, ListPageSize+1)} {
+		if _, err := DeserializeListRequest(data); !errors.Is(err, ErrMalformedData) {
+			t.Errorf("Expected ErrMalformedData for %x, got %v", data, err)
+		}
+	}
+}
+
+func TestUsage_RoundTrip(t *testing.T) {
+	used, quota, err := DeserializeUsage(SerializeUsage(12300000, 100000000))
+	if err != nil || used != 12300000 || quota != 100000000 {
+		t.Errorf("Round trip = %d / %d (%v)", used, quota, err)
+	}
+	if _, _, err := DeserializeUsage(make([]byte, 8)); !errors.Is(err, ErrMalformedData) {
+		t.Errorf("Expected ErrMalformedData for short usage, got %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// DownloadResumeSize is the length of CommandDownload data that resumes a transfer:
+// the byte offset to continue from (8 bytes) and the SHA-256 of the first offset
+// bytes the client already holds
+const DownloadResumeSize = 8 + sha256.Size
+
+// ResumeRejectedMessage starts the failure message a server sends when it cannot
+// resume a download, either because the offset is past the end of the file or the
+// client's prefix does not match. The client then downloads from the start.
+const ResumeRejectedMessage = "Resume rejected"
+
+// SerializeDownloadResume encodes a CommandDownload resume request
+func SerializeDownloadResume(offset uint64, prefixSum [sha256.Size]byte) []byte {
+	data := binary.BigEndian.AppendUint64(make([]byte, 0, DownloadResumeSize), offset)
+	return append(data, prefixSum[:]...)
+}
+
+// DownloadCompleteMessage is the message of the response that follows the last chunk of
+// a download from ProtocolVersionDownloadComplete on. Its Data is the number of chunks
+// the server sent (4 bytes, big-endian), so a client can tell a finished transfer from
+// one cut short.
+const DownloadCompleteMessage = "Download complete"
+
+// AbortMessage is the message of the response to CommandAbort. A download the abort
+// interrupts ends without its completion response, so a client reads past any chunks
+// still in flight until this response arrives.
+const AbortMessage = "Transfer aborted"
+
+// SerializeDownloadComplete encodes the Data of the download completion response
+func SerializeDownloadComplete(chunksSent uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, chunksSent)
+}
+
+// DeserializeDownloadComplete decodes the Data of the download completion response
+func DeserializeDownloadComplete(data []byte) (uint32, error) {
+	if len(data) != 4 {
+		return 0, fmt.Errorf("%w: download completion has %d bytes", ErrMalformedData, len(data))
+	}
+	return binary.BigEndian.Uint32(data), nil
+}
+
+// DownloadStreamSize is the length of CommandDownload data for one stream of a parallel
+// download: the resume fields followed by the stream index and the stream count (2 bytes each)
+const DownloadStreamSize = DownloadResumeSize + 4
+
+// DownloadChunkSizeSize is the length of CommandDownload data carrying a preferred chunk
+// size (4 bytes) after the stream fields, from ProtocolVersionChunkSize on
+const DownloadChunkSizeSize = DownloadStreamSize + 4
+
+// DownloadRangeSize is the length of CommandDownload data selecting a byte range (8 bytes
+// of start, 8 of length, big-endian) after the chunk size, from ProtocolVersionRange on
+const DownloadRangeSize = DownloadChunkSizeSize + 16
+
+// RangeBeyondEOFMessage is the failure message for a range starting past the end of the file
+const RangeBeyondEOFMessage = "Range starts beyond end of file"
+
+// DownloadRequest is the decoded Data of a CommandDownload
+type DownloadRequest struct {
+	// Offset is where the transfer starts; PrefixSum covers the Offset bytes before it
+	Offset    uint64
+	PrefixSum [sha256.Size]byte
+	// Stream selects this connection's share of the chunks when Streams is above 1
+	Stream  uint16
+	Streams uint16
+	// ChunkSize is the chunk size the client prefers, zero to let the server choose
+	ChunkSize uint32
+	// RangeStart and RangeLength select part of the file, which then stands in for the
+	// whole file: Offset, the size and the checksum all refer to the range. A zero
+	// RangeLength reads to the end of the file.
+	RangeStart  uint64
+	RangeLength uint64
+}
+
+// Ranged reports whether request selects less than the whole file
+func (request *DownloadRequest) Ranged() bool {
+	return request.RangeStart > 0 || request.RangeLength > 0
+}
+
+// SerializeDownloadRequest encodes request in the shortest form that carries its fields,
+// so only requests with a ChunkSize need ProtocolVersionChunkSize and only ranged ones
+// ProtocolVersionRange
+func SerializeDownloadRequest(request *DownloadRequest) []byte {
+	parallel := request.Streams > 1
+	ranged := request.Ranged()
+	switch {
+	case request.ChunkSize == 0 && !parallel && !ranged && request.Offset == 0:
+		return nil
+	case request.ChunkSize == 0 && !parallel && !ranged:
+		return SerializeDownloadResume(request.Offset, request.PrefixSum)
+	}
+	streams := max(request.Streams, 1)
+	data := SerializeDownloadStream(request.Offset, request.PrefixSum, request.Stream, streams)
+	if request.ChunkSize == 0 && !ranged {
+		return data
+	}
+	data = binary.BigEndian.AppendUint32(data, request.ChunkSize)
+	if !ranged {
+		return data
+	}
+	data = binary.BigEndian.AppendUint64(data, request.RangeStart)
+	return binary.BigEndian.AppendUint64(data, request.RangeLength)
+}
+
+// SerializeDownloadStream encodes the request for stream of streams parallel connections,
+// each continuing from offset
+func SerializeDownloadStream(offset uint64, prefixSum [sha256.Size]byte, stream, streams uint16) []byte {
+	data := append(make([]byte, 0, DownloadStreamSize), SerializeDownloadResume(offset, prefixSum)...)
+	data = binary.BigEndian.AppendUint16(data, stream)
+	return binary.BigEndian.AppendUint16(data, streams)
+}
+
+// DeserializeDownloadRequest decodes CommandDownload data. Empty data downloads the
+// whole file over a single stream.
+func DeserializeDownloadRequest(data []byte) (*DownloadRequest, error) {
+	request := &DownloadRequest{Streams: 1}
+	switch len(data) {
+	case 0:
+		return request, nil
+	case DownloadResumeSize, DownloadStreamSize, DownloadChunkSizeSize, DownloadRangeSize:
+	default:
+		return nil, fmt.Errorf("%w: download request has %d bytes", ErrMalformedData, len(data))
+	}
+	request.Offset = binary.BigEndian.Uint64(data[:8])
+	copy(request.PrefixSum[:], data[8:DownloadResumeSize])
+	if len(data) >= DownloadStreamSize {
+		request.Stream = binary.BigEndian.Uint16(data[DownloadResumeSize:])
+		request.Streams = binary.BigEndian.Uint16(data[DownloadResumeSize+2:])
+		if request.Streams == 0 || request.Stream >= request.Streams {
+			return nil, fmt.Errorf("%w: download stream %d of %d", ErrMalformedData, request.Stream, request.Streams)
+		}
+	}
+	if len(data) >= DownloadChunkSizeSize {
+		request.ChunkSize = binary.BigEndian.Uint32(data[DownloadStreamSize:])
+	}
+	if len(data) == DownloadRangeSize {
+		request.RangeStart = binary.BigEndian.Uint64(data[DownloadChunkSizeSize:])
+		request.RangeLength = binary.BigEndian.Uint64(data[DownloadChunkSizeSize+8:])
+	}
+	return request, nil
+}
+
+// StreamChunkRange returns the chunk indices [first, end) that stream sends when
+// totalChunks are split between streams connections. Each stream gets a contiguous run
+// and the runs cover every chunk exactly once.
+func StreamChunkRange(totalChunks uint32, stream, streams uint16) (first, end uint32) {
+	if streams <= 1 {
+		return 0, totalChunks
+	}
+	first = uint32(uint64(totalChunks) * uint64(stream) / uint64(streams))
+	end = uint32(uint64(totalChunks) * uint64(stream+1) / uint64(streams))
+	return first, end
+}
@@ -0,0 +1,107 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SessionTicketRejectedMessage starts the unencrypted failure response to a
+// MessageTypeResume the server cannot honour. The connection stays open for a full
+// handshake.
+const SessionTicketRejectedMessage = "Session ticket rejected"
+
+// SessionTicket is a ticket issued by the server and when it stops being accepted.
+// The ticket is opaque to the client.
+type SessionTicket struct {
+	Ticket  []byte
+	Expires time.Time
+}
+
+// SerializeSessionTicket encodes a ticket as its expiry (8 bytes, Unix seconds) followed
+// by the ticket, the Data of a CommandSessionTicket response
+func SerializeSessionTicket(ticket *SessionTicket) []byte {
+	data := binary.BigEndian.AppendUint64(nil, uint64(ticket.Expires.Unix()))
+	return append(data, ticket.Ticket...)
+}
+
+// DeserializeSessionTicket decodes a ticket encoded by SerializeSessionTicket
+func DeserializeSessionTicket(data []byte) (*SessionTicket, error) {
+	if len(data) <= 8 {
+		return nil, fmt.Errorf("%w: session ticket has %d bytes", ErrMalformedData, len(data))
+	}
+	return &SessionTicket{
+		Expires: time.Unix(int64(binary.BigEndian.Uint64(data)), 0),
+		Ticket:  data[8:],
+	}, nil
+}
+
+// ResumeRequest is the payload of a MessageTypeResume message
+type ResumeRequest struct {
+	// Ticket is a ticket from an earlier session of this server
+	Ticket []byte
+	// Options holds serialized HandshakeOptions encrypted with the session key the ticket
+	// restores. They must include a Nonce, which the server echoes in its confirmation.
+	Options []byte
+}
+
+// SerializeResumeRequest encodes a resume request as the ticket length (2 bytes), the
+// ticket and the encrypted options
+func SerializeResumeRequest(req *ResumeRequest) ([]byte, error) {
+	if len(req.Ticket) > 0xFFFF {
+		return nil, errors.New("session ticket too long")
+	}
+	data := binary.BigEndian.AppendUint16(nil, uint16(len(req.Ticket)))
+	data = append(data, req.Ticket...)
+	return append(data, req.Options...), nil
+}
+
+// DeserializeResumeRequest decodes a resume request
+func DeserializeResumeRequest(data []byte) (*ResumeRequest, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("%w: resume request has %d bytes", ErrMalformedData, len(data))
+	}
+	ticketLen := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+ticketLen {
+		return nil, fmt.Errorf("%w: resume ticket truncated", ErrMalformedData)
+	}
+	return &ResumeRequest{
+		Ticket:  data[2 : 2+ticketLen],
+		Options: data[2+ticketLen:],
+	}, nil
+}
+
+// ResumeConfirmation is the Data of the encrypted response confirming a resumed session
+type ResumeConfirmation struct {
+	// Version is the negotiated protocol version
+	Version uint16
+	// Nonce echoes the client's nonce, so an old confirmation cannot be replayed
+	Nonce []byte
+	// Next replaces the ticket just used, which is not accepted again
+	Next *SessionTicket
+}
+
+// SerializeResumeConfirmation encodes the version (2 bytes), the nonce and the
+// replacement ticket in SerializeSessionTicket form
+func SerializeResumeConfirmation(confirmation *ResumeConfirmation) []byte {
+	data := binary.BigEndian.AppendUint16(nil, confirmation.Version)
+	data = append(data, confirmation.Nonce...)
+	return append(data, SerializeSessionTicket(confirmation.Next)...)
+}
+
+// DeserializeResumeConfirmation decodes a resume confirmation
+func DeserializeResumeConfirmation(data []byte) (*ResumeConfirmation, error) {
+	if len(data) < 2+HandshakeNonceSize {
+		return nil, fmt.Errorf("%w: resume confirmation has %d bytes", ErrMalformedData, len(data))
+	}
+	next, err := DeserializeSessionTicket(data[2+HandshakeNonceSize:])
+	if err != nil {
+		return nil, err
+	}
+	return &ResumeConfirmation{
+		Version: binary.BigEndian.Uint16(data),
+		Nonce:   data[2 : 2+HandshakeNonceSize],
+		Next:    next,
+	}, nil
+}
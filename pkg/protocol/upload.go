@@ -0,0 +1,101 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// UploadFlagNoClobber in a CommandUploadChunk's flags byte refuses to replace an
+// existing file, from ProtocolVersionNoClobber on
+const UploadFlagNoClobber byte = 0x01
+
+// UploadFlagValidate in a CommandUploadChunk's flags byte asks the server to run every
+// check the upload would face and answer without storing anything or expecting chunks,
+// from ProtocolVersionValidate on
+const UploadFlagValidate byte = 0x02
+
+// UploadFlagModTime in a CommandUploadChunk's flags byte marks a modification time
+// following it, from ProtocolVersionModTime on
+const UploadFlagModTime byte = 0x04
+
+// uploadRequestModTimeSize is the length of a request carrying a modification time:
+// size, flags and the time, 8 bytes each but the flags
+const uploadRequestModTimeSize = 8 + 1 + 8
+
+// UploadRequest is the decoded Data of a CommandUploadChunk
+type UploadRequest struct {
+	// Size is the total size of the upload, ignored when SizeUnknown is set
+	Size        uint64
+	SizeUnknown bool
+	// Overwrite lets the upload replace an existing file. Requests without a flags
+	// byte overwrite, as they did before ProtocolVersionNoClobber.
+	Overwrite bool
+	// ValidateOnly checks the upload without performing it, see UploadFlagValidate
+	ValidateOnly bool
+	// ModTime is the modification time, in Unix nanoseconds, the stored file should
+	// have; zero leaves it at the time of the upload. It needs a known Size.
+	ModTime int64
+}
+
+// SerializeUploadRequest encodes request: the size (8 bytes, big-endian) unless it is
+// unknown, then a flags byte only when a flag is set, so plain uploads that overwrite
+// stay readable by older servers, then the modification time (8 bytes, big-endian) if
+// it is set. A modification time is dropped when the size is unknown.
+func SerializeUploadRequest(request *UploadRequest) []byte {
+	var data []byte
+	if !request.SizeUnknown {
+		data = binary.BigEndian.AppendUint64(data, request.Size)
+	}
+	var flags byte
+	if !request.Overwrite {
+		flags |= UploadFlagNoClobber
+	}
+	if request.ValidateOnly {
+		flags |= UploadFlagValidate
+	}
+	withModTime := request.ModTime != 0 && !request.SizeUnknown
+	if withModTime {
+		flags |= UploadFlagModTime
+	}
+	if flags != 0 {
+		data = append(data, flags)
+	}
+	if withModTime {
+		data = binary.BigEndian.AppendUint64(data, uint64(request.ModTime))
+	}
+	return data
+}
+
+// DeserializeUploadRequest decodes CommandUploadChunk data
+func DeserializeUploadRequest(data []byte) (*UploadRequest, error) {
+	request := &UploadRequest{Overwrite: true}
+	switch len(data) {
+	case 0, 1:
+		request.SizeUnknown = true
+	case 8, 9, uploadRequestModTimeSize:
+		request.Size = binary.BigEndian.Uint64(data)
+	default:
+		return nil, fmt.Errorf("%w: upload request has %d bytes", ErrMalformedData, len(data))
+	}
+	if len(data)%8 != 1 {
+		return request, nil
+	}
+
+	flags := data[0]
+	if !request.SizeUnknown {
+		flags = data[8]
+	}
+	if flags&^(UploadFlagNoClobber|UploadFlagValidate|UploadFlagModTime) != 0 {
+		return nil, fmt.Errorf("%w: unknown upload flags 0x%02x", ErrMalformedData, flags)
+	}
+	// The modification time flag and its 8 bytes come together
+	if (flags&UploadFlagModTime != 0) != (len(data) == uploadRequestModTimeSize) {
+		return nil, fmt.Errorf("%w: upload request has %d bytes for flags 0x%02x", ErrMalformedData, len(data), flags)
+	}
+	request.Overwrite = flags&UploadFlagNoClobber == 0
+	request.ValidateOnly = flags&UploadFlagValidate != 0
+	if len(data) == uploadRequestModTimeSize {
+		request.ModTime = int64(binary.BigEndian.Uint64(data[9:]))
+	}
+	return request, nil
+}
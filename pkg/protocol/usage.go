@@ -0,0 +1,24 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// UsageSize is the length of a CommandUsage response's Data
+const UsageSize = 16
+
+// SerializeUsage encodes the bytes a client stores and its quota (8 bytes each,
+// big-endian), the Data of a CommandUsage response. A zero quota means no limit.
+func SerializeUsage(used, quota int64) []byte {
+	data := binary.BigEndian.AppendUint64(make([]byte, 0, UsageSize), uint64(used))
+	return binary.BigEndian.AppendUint64(data, uint64(quota))
+}
+
+// DeserializeUsage decodes the Data of a CommandUsage response
+func DeserializeUsage(data []byte) (used, quota int64, err error) {
+	if len(data) != UsageSize {
+		return 0, 0, fmt.Errorf("%w: usage has %d bytes", ErrMalformedData, len(data))
+	}
+	return int64(binary.BigEndian.Uint64(data)), int64(binary.BigEndian.Uint64(data[8:])), nil
+}
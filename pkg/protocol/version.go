@@ -0,0 +1,57 @@
+package protocol
+
+// Version identifies the build of the client and server. It is set at build time:
+//
+//	go build -ldflags "-X github.com/lcensies/ssnproj/pkg/protocol.Version=v1.2.3" ./cmd/server
+var Version = "dev"
+
+// Wire protocol revisions. Peers agree on the lower of their versions during the
+// handshake; a peer that does not announce one speaks ProtocolVersionBase.
+const (
+	// ProtocolVersionBase is the original protocol
+	ProtocolVersionBase uint16 = 1
+	// ProtocolVersionChunkChecksums adds a SHA-256 checksum to every data chunk
+	ProtocolVersionChunkChecksums uint16 = 2
+	// ProtocolVersionDownloadComplete ends every download's chunks with a completion response
+	ProtocolVersionDownloadComplete uint16 = 3
+	// ProtocolVersionChunkSize lets download requests carry a preferred chunk size
+	ProtocolVersionChunkSize uint16 = 4
+	// ProtocolVersionErrorCodes lets failed responses carry an ErrorCode
+	ProtocolVersionErrorCodes uint16 = 5
+	// ProtocolVersionNoClobber lets chunked uploads refuse to replace an existing file
+	ProtocolVersionNoClobber uint16 = 6
+	// ProtocolVersionRange lets download requests select a byte range of the file
+	ProtocolVersionRange uint16 = 7
+	// ProtocolVersionClose lets clients end the session with CommandClose
+	ProtocolVersionClose uint16 = 8
+	// ProtocolVersionValidate lets chunked upload requests only validate the upload
+	ProtocolVersionValidate uint16 = 9
+	// ProtocolVersionListPage lets list requests select a page of the listing
+	ProtocolVersionListPage uint16 = 10
+	// ProtocolVersionContentType lets file listings and stat carry each file's content type
+	ProtocolVersionContentType uint16 = 11
+	// ProtocolVersionModTime lets chunked upload requests carry the file's modification time
+	ProtocolVersionModTime uint16 = 12
+	// ProtocolVersionAbort lets clients stop a download in progress with CommandAbort
+	ProtocolVersionAbort uint16 = 13
+
+	// ProtocolVersionTransferV2 is the first revision with the whole large-file transfer
+	// mode: streamed, checksummed chunks, downloads that resume from an offset and are
+	// verified against a whole-file digest, and an explicit end to every download
+	ProtocolVersionTransferV2 = ProtocolVersionDownloadComplete
+
+	// ProtocolVersion is the newest revision this build speaks
+	ProtocolVersion = ProtocolVersionAbort
+)
+
+// NegotiateProtocolVersion returns the revision to use with a peer announcing peerVersion
+func NegotiateProtocolVersion(peerVersion uint16) uint16 {
+	switch {
+	case peerVersion == 0:
+		return ProtocolVersionBase
+	case peerVersion < ProtocolVersion:
+		return peerVersion
+	default:
+		return ProtocolVersion
+	}
+}
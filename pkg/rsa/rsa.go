@@ -1,11 +1,13 @@
 package rsa
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha512"
+	_ "crypto/sha512"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -18,6 +20,13 @@ type RSAKeyPair struct {
 
 const defaultRsaKeySize = 2048
 
+// Errors returned by LoadKeypair, wrapped with the offending file path
+var (
+	ErrKeyMissing    = errors.New("missing key file")
+	ErrKeyUnreadable = errors.New("unreadable key file")
+	ErrInvalidKey    = errors.New("invalid PEM/DER key")
+)
+
 // GenerateKeyPair generates a new key pair
 func GenerateKeyPair(bits int) (*rsa.PrivateKey, *rsa.PublicKey) {
 	privkey, err := rsa.GenerateKey(rand.Reader, bits)
@@ -56,18 +65,7 @@ func PublicKeyToBytes(pub *rsa.PublicKey) []byte {
 
 // BytesToPrivateKey bytes to private key
 func BytesToPrivateKey(priv []byte) *rsa.PrivateKey {
-	block, _ := pem.Decode(priv)
-	enc := x509.IsEncryptedPEMBlock(block)
-	b := block.Bytes
-	var err error
-	if enc {
-		log.Println("is encrypted pem block")
-		b, err = x509.DecryptPEMBlock(block, nil)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}
-	key, err := x509.ParsePKCS1PrivateKey(b)
+	key, err := ParsePrivateKey(priv)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -76,42 +74,98 @@ func BytesToPrivateKey(priv []byte) *rsa.PrivateKey {
 
 // BytesToPublicKey bytes to public key
 func BytesToPublicKey(pub []byte) *rsa.PublicKey {
-	block, _ := pem.Decode(pub)
-	enc := x509.IsEncryptedPEMBlock(block)
-	b := block.Bytes
-	var err error
-	if enc {
-		log.Println("is encrypted pem block")
-		b, err = x509.DecryptPEMBlock(block, nil)
-		if err != nil {
-			log.Fatal(err)
-		}
+	key, err := ParsePublicKey(pub)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return key
+}
+
+// ParsePrivateKey parses a PEM encoded PKCS#1 private key, returning ErrInvalidKey on failure
+func ParsePrivateKey(priv []byte) (*rsa.PrivateKey, error) {
+	b, err := decodePEMBlock(priv)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS1PrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	return key, nil
+}
+
+// ParsePublicKey parses a PEM encoded PKIX RSA public key, returning ErrInvalidKey on failure
+func ParsePublicKey(pub []byte) (*rsa.PublicKey, error) {
+	b, err := decodePEMBlock(pub)
+	if err != nil {
+		return nil, err
 	}
 	ifc, err := x509.ParsePKIXPublicKey(b)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
 	}
 	key, ok := ifc.(*rsa.PublicKey)
 	if !ok {
-		log.Fatal("not ok")
+		return nil, fmt.Errorf("%w: not an RSA public key", ErrInvalidKey)
 	}
-	return key
+	return key, nil
 }
 
-// EncryptWithPublicKey encrypts data with public key
+// decodePEMBlock returns the DER bytes of the first PEM block in data
+func decodePEMBlock(data []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM block found", ErrInvalidKey)
+	}
+	b := block.Bytes
+	if x509.IsEncryptedPEMBlock(block) {
+		log.Println("is encrypted pem block")
+		var err error
+		b, err = x509.DecryptPEMBlock(block, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+		}
+	}
+	return b, nil
+}
+
+// The handshake wraps session keys with RSA-OAEP over SHA-512 and no label. Changing
+// either would break existing clients, so it needs a protocol version bump.
+var oaepHash = crypto.SHA512
+
+// OAEPOptions returns the decryption options matching EncryptOAEP, for use with crypto.Decrypter
+func OAEPOptions() *rsa.OAEPOptions {
+	return &rsa.OAEPOptions{Hash: oaepHash}
+}
+
+// PSSOptions returns the signature options used for handshake signatures over SHA-256 digests
+func PSSOptions() *rsa.PSSOptions {
+	return &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+}
+
+// EncryptOAEP wraps msg for the holder of pub's private key using the handshake's OAEP parameters
+func EncryptOAEP(msg []byte, pub *rsa.PublicKey) ([]byte, error) {
+	return rsa.EncryptOAEP(oaepHash.New(), rand.Reader, pub, msg, nil)
+}
+
+// DecryptOAEP unwraps a ciphertext produced by EncryptOAEP. Tampered ciphertexts and
+// ones made for another key fail with an error that does not say which check failed.
+func DecryptOAEP(ciphertext []byte, priv *rsa.PrivateKey) ([]byte, error) {
+	return rsa.DecryptOAEP(oaepHash.New(), rand.Reader, priv, ciphertext, nil)
+}
+
+// EncryptWithPublicKey encrypts data with public key, exiting on failure
 func EncryptWithPublicKey(msg []byte, pub *rsa.PublicKey) []byte {
-	hash := sha512.New()
-	ciphertext, err := rsa.EncryptOAEP(hash, rand.Reader, pub, msg, nil)
+	ciphertext, err := EncryptOAEP(msg, pub)
 	if err != nil {
 		log.Fatal(err)
 	}
 	return ciphertext
 }
 
-// DecryptWithPrivateKey decrypts data with private key
+// DecryptWithPrivateKey decrypts data with private key, exiting on failure
 func DecryptWithPrivateKey(ciphertext []byte, priv *rsa.PrivateKey) []byte {
-	hash := sha512.New()
-	plaintext, err := rsa.DecryptOAEP(hash, rand.Reader, priv, ciphertext, nil)
+	plaintext, err := DecryptOAEP(ciphertext, priv)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -131,11 +185,11 @@ func LoadKeypair(configFolder string) (*RSAKeyPair, error) {
 	privKeyPath := fmt.Sprintf("%s/private.pem", configFolder)
 	pubKeyPath := fmt.Sprintf("%s/public.pem", configFolder)
 
-	_, privExists := os.Stat(privKeyPath)
-	_, pubExists := os.Stat(pubKeyPath)
+	privErr := statKeyFile(privKeyPath)
+	pubErr := statKeyFile(pubKeyPath)
 
-	// If either key file doesn't exist, generate new keys
-	if os.IsNotExist(privExists) || os.IsNotExist(pubExists) {
+	// Generate new keys only for a fresh folder; a lone key file is a deployment problem
+	if errors.Is(privErr, ErrKeyMissing) && errors.Is(pubErr, ErrKeyMissing) {
 		privKey, pubKey := GenerateKeyPair(defaultRsaKeySize)
 
 		// Save private key
@@ -155,21 +209,48 @@ func LoadKeypair(configFolder string) (*RSAKeyPair, error) {
 			Public:  pubKey,
 		}, nil
 	}
+	if privErr != nil {
+		return nil, privErr
+	}
+	if pubErr != nil {
+		return nil, pubErr
+	}
 
 	// Load existing keys
 	privKeyBytes, err := os.ReadFile(privKeyPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read private key: %w", err)
+		return nil, fmt.Errorf("%w %s: %v", ErrKeyUnreadable, privKeyPath, err)
 	}
 	pubKeyBytes, err := os.ReadFile(pubKeyPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read public key: %w", err)
+		return nil, fmt.Errorf("%w %s: %v", ErrKeyUnreadable, pubKeyPath, err)
 	}
 
-	privKey := BytesToPrivateKey(privKeyBytes)
-	pubKey := BytesToPublicKey(pubKeyBytes)
+	privKey, err := ParsePrivateKey(privKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", privKeyPath, err)
+	}
+	pubKey, err := ParsePublicKey(pubKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", pubKeyPath, err)
+	}
 	return &RSAKeyPair{
 		Private: privKey,
 		Public:  pubKey,
 	}, nil
 }
+
+// statKeyFile reports ErrKeyMissing or ErrKeyUnreadable for a key file that cannot be used
+func statKeyFile(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w %s", ErrKeyMissing, path)
+	}
+	if err != nil {
+		return fmt.Errorf("%w %s: %v", ErrKeyUnreadable, path, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%w %s: is a directory", ErrKeyUnreadable, path)
+	}
+	return nil
+}
@@ -1,9 +1,15 @@
 package rsa
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGenerateKeyPair(t *testing.T) {
@@ -28,3 +34,130 @@ func TestBytesToPublicKey(t *testing.T) {
 	pubKey := BytesToPublicKey(pubBytes)
 	assert.Equal(t, pubKey, pub)
 }
+
+func TestLoadKeypair_GeneratesInEmptyFolder(t *testing.T) {
+	dir := t.TempDir()
+
+	created, err := LoadKeypair(dir)
+	require.NoError(t, err)
+
+	loaded, err := LoadKeypair(dir)
+	require.NoError(t, err)
+	assert.Equal(t, created.Public, loaded.Public)
+}
+
+func TestLoadKeypair_MalformedKeys(t *testing.T) {
+	priv, pub := GenerateKeyPair(2048)
+	validPriv := PrivateKeyToBytes(priv)
+	validPub := PublicKeyToBytes(pub)
+
+	tests := []struct {
+		name        string
+		setup       func(t *testing.T, dir string)
+		expectedErr error
+		mentions    string
+	}{
+		{
+			name: "missing public key",
+			setup: func(t *testing.T, dir string) {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "private.pem"), validPriv, 0600))
+			},
+			expectedErr: ErrKeyMissing,
+			mentions:    "public.pem",
+		},
+		{
+			name: "missing private key",
+			setup: func(t *testing.T, dir string) {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "public.pem"), validPub, 0644))
+			},
+			expectedErr: ErrKeyMissing,
+			mentions:    "private.pem",
+		},
+		{
+			name: "unreadable private key",
+			setup: func(t *testing.T, dir string) {
+				require.NoError(t, os.Mkdir(filepath.Join(dir, "private.pem"), 0755))
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "public.pem"), validPub, 0644))
+			},
+			expectedErr: ErrKeyUnreadable,
+			mentions:    "private.pem",
+		},
+		{
+			name: "empty private key",
+			setup: func(t *testing.T, dir string) {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "private.pem"), nil, 0600))
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "public.pem"), validPub, 0644))
+			},
+			expectedErr: ErrInvalidKey,
+			mentions:    "private.pem",
+		},
+		{
+			name: "corrupt DER in public key",
+			setup: func(t *testing.T, dir string) {
+				corrupt := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: []byte("not der")})
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "private.pem"), validPriv, 0600))
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "public.pem"), corrupt, 0644))
+			},
+			expectedErr: ErrInvalidKey,
+			mentions:    "public.pem",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tt.setup(t, dir)
+
+			keyPair, err := LoadKeypair(dir)
+			require.Error(t, err)
+			assert.Nil(t, keyPair)
+			assert.ErrorIs(t, err, tt.expectedErr)
+			assert.Contains(t, err.Error(), tt.mentions)
+		})
+	}
+}
+
+func TestOAEP_RoundTrip(t *testing.T) {
+	priv, pub := GenerateKeyPair(2048)
+	sessionKey := []byte("0123456789abcdef0123456789abcdef")
+
+	ciphertext, err := EncryptOAEP(sessionKey, pub)
+	require.NoError(t, err)
+	plaintext, err := DecryptOAEP(ciphertext, priv)
+	require.NoError(t, err)
+	assert.Equal(t, sessionKey, plaintext)
+
+	// Padding is randomized, so the same key never encrypts the same way twice
+	again, err := EncryptOAEP(sessionKey, pub)
+	require.NoError(t, err)
+	assert.NotEqual(t, ciphertext, again)
+
+	// crypto.Decrypter implementations unwrap it with OAEPOptions
+	plaintext, err = priv.Decrypt(rand.Reader, ciphertext, OAEPOptions())
+	require.NoError(t, err)
+	assert.Equal(t, sessionKey, plaintext)
+}
+
+func TestOAEP_RejectsTampering(t *testing.T) {
+	priv, pub := GenerateKeyPair(2048)
+	ciphertext, err := EncryptOAEP([]byte("session key"), pub)
+	require.NoError(t, err)
+
+	for _, i := range []int{0, len(ciphertext) / 2, len(ciphertext) - 1} {
+		tampered := bytes.Clone(ciphertext)
+		tampered[i] ^= 0x01
+		_, err := DecryptOAEP(tampered, priv)
+		assert.Error(t, err, "flipping a bit at byte %d should fail decryption", i)
+	}
+
+	_, err = DecryptOAEP(ciphertext[1:], priv)
+	assert.Error(t, err, "truncated ciphertext should fail decryption")
+
+	otherPriv, _ := GenerateKeyPair(2048)
+	_, err = DecryptOAEP(ciphertext, otherPriv)
+	assert.Error(t, err, "ciphertext for another key should fail decryption")
+
+	// A message too long for the key is refused rather than truncated
+	_, err = EncryptOAEP(make([]byte, 256), pub)
+	assert.Error(t, err)
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	aesUtil "github.com/lcensies/ssnproj/pkg/aes"
+	"github.com/lcensies/ssnproj/pkg/protocol"
+)
+
+// watchAbort reads ahead while a download is sent, which otherwise keeps the request
+// loop from reading, so a CommandAbort from the client cancels the download's transfer
+// context. Messages read meanwhile are queued in pending for the request loop, which
+// handles them, the abort included, once the download returns. The returned stop ends
+// the watch and must be called before the request loop reads again.
+func (handler *ConnectionHandler) watchAbort() (stop func()) {
+	if handler.reader == nil {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(handler.ctx)
+	handler.cmdHandler.transferCtx = ctx
+
+	var stopping atomic.Bool
+	done := make(chan struct{})
+	// The request loop sets its own deadline before its next read
+	handler.conn.SetReadDeadline(time.Time{})
+	go func() {
+		defer close(done)
+		buffer := make([]byte, 1024)
+		for {
+			n, err := handler.reader.Read(buffer)
+			if n > 0 {
+				handler.messageBuffer.AddData(buffer[:n])
+				if handler.queuePending() {
+					cancel()
+				}
+			}
+			if err != nil {
+				// A client gone mid-download is noticed by the request loop afterwards
+				if !stopping.Load() {
+					handler.readAheadErr = err
+					cancel()
+				}
+				return
+			}
+		}
+	}()
+
+	return func() {
+		stopping.Store(true)
+		handler.conn.SetReadDeadline(time.Now())
+		<-done
+		cancel()
+		handler.cmdHandler.transferCtx = nil
+	}
+}
+
+// queuePending moves the complete messages in the buffer to pending, reporting whether
+// one of them is a CommandAbort. Malformed data is left for the request loop to reject.
+func (handler *ConnectionHandler) queuePending() bool {
+	aborted := false
+	for {
+		message, err := handler.messageBuffer.TryDeserialize()
+		if err != nil {
+			return aborted
+		}
+		handler.pending = append(handler.pending, message)
+		if handler.isAbort(message) {
+			aborted = true
+		}
+	}
+}
+
+// nextMessage returns the oldest message watchAbort queued, or else the next complete
+// message in the buffer
+func (handler *ConnectionHandler) nextMessage() (*protocol.Message, error) {
+	if len(handler.pending) > 0 {
+		message := handler.pending[0]
+		handler.pending = handler.pending[1:]
+		return message, nil
+	}
+	return handler.messageBuffer.TryDeserialize()
+}
+
+// isAbort reports whether message is a CommandAbort. The message itself stays encrypted
+// for the request loop.
+func (handler *ConnectionHandler) isAbort(message *protocol.Message) bool {
+	if message.Type != protocol.MessageTypeCommand {
+		return false
+	}
+	payload := message.Payload
+	if !handler.secureTransport {
+		var err error
+		if payload, err = aesUtil.Decrypt(payload, handler.aesKey); err != nil {
+			return false
+		}
+	}
+	command, err := protocol.DeserializeCommand(payload)
+	return err == nil && command.Command == protocol.CommandAbort
+}
+
+// transferContext returns the context of the download being sent: cancelled by
+// CommandAbort, see watchAbort, or with the connection
+func (handler *CommandHandler) transferContext() context.Context {
+	if handler.transferCtx != nil {
+		return handler.transferCtx
+	}
+	return handler.sessionContext()
+}
+
+// transferAborted reports whether the client aborted the download being sent, as
+// opposed to the connection ending
+func (handler *CommandHandler) transferAborted() bool {
+	return handler.transferCtx != nil && handler.transferCtx.Err() != nil && handler.sessionContext().Err() == nil
+}
+
+// handleAbort answers CommandAbort. Any download it stopped has already returned, and
+// one that finished before the abort arrived is left as it is.
+func (handler *CommandHandler) handleAbort(command *protocol.CommandMessage) error {
+	handler.logger.Info("Abort command received")
+
+	responsePayload, err := protocol.SerializeResponse(true, protocol.AbortMessage, nil)
+	if err != nil {
+		return err
+	}
+	return handler.conn.SendSecureMessage(protocol.NewMessage(protocol.MessageTypeResponse, responsePayload))
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lcensies/ssnproj/pkg/metrics"
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// auditMessage is the log message of every audit record
+const auditMessage = "audit"
+
+// auditedCommands names the commands that read or change a client's files; each one
+// leaves an audit record
+var auditedCommands = map[protocol.CommandType]string{
+	protocol.CommandUpload:      "upload",
+	protocol.CommandUploadChunk: "upload",
+	protocol.CommandDownload:    "download",
+	protocol.CommandDelete:      "delete",
+	protocol.CommandDeleteGlob:  "delete",
+	protocol.CommandList:        "list",
+	protocol.CommandRename:      "rename",
+	protocol.CommandStat:        "stat",
+	protocol.CommandMkdir:       "mkdir",
+	protocol.CommandTail:        "tail",
+}
+
+// auditRecord is the outcome of one audited command, filled in while it runs
+type auditRecord struct {
+	command  string
+	filename string
+	bytes    uint64
+	failure  string
+	code     protocol.ErrorCode
+	start    time.Time
+}
+
+// openAuditLog returns a logger appending JSON records to path, and the file to close
+// when the server stops
+func openAuditLog(path string) (*zap.Logger, *os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), zapcore.AddSync(file), zapcore.InfoLevel)
+	return zap.New(core), file, nil
+}
+
+// beginAudit starts the audit record of command, if it is audited
+func (handler *CommandHandler) beginAudit(command *protocol.CommandMessage) {
+	name, ok := auditedCommands[command.Command]
+	if !ok {
+		handler.record = nil
+		return
+	}
+	handler.record = &auditRecord{command: name, filename: command.Filename, start: time.Now()}
+}
+
+// auditBytes records how many bytes of file data the current command moved
+func (handler *CommandHandler) auditBytes(n uint64) {
+	if handler.record != nil {
+		handler.record.bytes = n
+	}
+}
+
+// auditFailure marks the current command as failed
+func (handler *CommandHandler) auditFailure(code protocol.ErrorCode, reason string) {
+	if handler.record != nil && handler.record.failure == "" {
+		handler.record.failure = reason
+		handler.record.code = code
+	}
+}
+
+// endAudit writes the current record once its command is over. A chunked upload is
+// over when its last chunk arrives, so its record waits for finishUpload or abortUpload.
+func (handler *CommandHandler) endAudit(err error) {
+	record := handler.record
+	if record == nil || (handler.upload != nil && handler.upload.record == record) {
+		return
+	}
+	handler.record = nil
+	if err != nil && record.failure == "" {
+		record.failure = err.Error()
+	}
+
+	clientID := ""
+	if len(handler.aesKey) > 0 {
+		clientID = handler.clientID()
+	}
+	fields := []zap.Field{
+		zap.String("client", clientID),
+		zap.String("command", record.command),
+		zap.String("filename", record.filename),
+		zap.Uint64("bytes", record.bytes),
+		zap.Bool("success", record.failure == ""),
+	}
+	if record.failure != "" {
+		fields = append(fields, zap.String("error", record.failure), zap.Stringer("code", record.code))
+	}
+	handler.logger.Info(auditMessage, fields...)
+	if handler.audit != nil {
+		handler.audit.Info(auditMessage, fields...)
+	}
+
+	if record.failure == "" && (record.command == metrics.DirectionUpload || record.command == metrics.DirectionDownload) {
+		handler.metrics.Transfer(record.command, record.bytes, time.Since(record.start))
+	}
+}
@@ -7,11 +7,14 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	aesUtil "github.com/lcensies/ssnproj/pkg/aes"
 	entity "github.com/lcensies/ssnproj/pkg/client"
+	"github.com/lcensies/ssnproj/pkg/protocol"
 	rsaUtil "github.com/lcensies/ssnproj/pkg/rsa"
 	"go.uber.org/zap"
 )
@@ -395,7 +398,7 @@ func BenchmarkFullUploadDownloadCycle(b *testing.B) {
 				}
 
 				// Download file
-				if err := client.DownloadFile(ctx, filepath.Base(testFile), outputFile); err != nil {
+				if err := client.DownloadFile(ctx, filepath.Base(testFile), outputFile, nil); err != nil {
 					client.Close(ctx)
 					b.Fatalf("Download failed: %v", err)
 				}
@@ -510,7 +513,7 @@ func BenchmarkLargeFileWithChunkSizes(b *testing.B) {
 
 			// Download file
 			start = time.Now()
-			if err := client.DownloadFile(ctx, filepath.Base(testFile), outputFile); err != nil {
+			if err := client.DownloadFile(ctx, filepath.Base(testFile), outputFile, nil); err != nil {
 				client.Close(ctx)
 				b.Fatalf("Download failed: %v", err)
 			}
@@ -630,3 +633,218 @@ func BenchmarkLargeFileUploadOnly(b *testing.B) {
 		})
 	}
 }
+
+// latencyConn delays every write, simulating a link where each frame costs a round trip
+type latencyConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (c latencyConn) Write(p []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.Conn.Write(p)
+}
+
+// BenchmarkParallelDownload compares single and multi-stream downloads over a high-latency link
+func BenchmarkParallelDownload(b *testing.B) {
+	ctx := context.Background()
+	const fileSize = 4 * 1024 * 1024
+	const linkLatency = 5 * time.Millisecond
+
+	for _, streams := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("Streams_%d", streams), func(b *testing.B) {
+			server, rootDir, cleanup := setupBenchmarkServer(b)
+			defer cleanup()
+
+			listener, err := net.Listen("tcp", "localhost:0")
+			if err != nil {
+				b.Fatalf("Failed to create listener: %v", err)
+			}
+			defer listener.Close()
+
+			_, port, err := net.SplitHostPort(listener.Addr().String())
+			if err != nil {
+				b.Fatalf("Failed to get port: %v", err)
+			}
+
+			// Serve every connection through the simulated link
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return // Listener closed
+					}
+					client := NewConnectionHandler(latencyConn{Conn: conn, delay: linkLatency}, server.rsaKeyPair, server.logger, rootDir)
+					go client.HandleRawRequest()
+				}
+			}()
+
+			testFile := filepath.Join(b.TempDir(), "bench_parallel.bin")
+			os.WriteFile(testFile, generateRandomData(fileSize), 0644)
+			outputFile := filepath.Join(b.TempDir(), "bench_parallel_download.bin")
+
+			pubKeyFile := filepath.Join(b.TempDir(), "server_public.pem")
+			os.WriteFile(pubKeyFile, rsaUtil.PublicKeyToBytes(server.rsaKeyPair.Public), 0644)
+
+			client, err := entity.NewClientWithServerPubKey(ctx, "localhost", port, pubKeyFile, zap.NewNop(),
+				entity.WithDownloadStreams(streams))
+			if err != nil {
+				b.Fatalf("Failed to create client: %v", err)
+			}
+			defer client.Close(ctx)
+			if err := client.PerformHandshake(ctx); err != nil {
+				b.Fatalf("Handshake failed: %v", err)
+			}
+			if err := client.UploadFile(ctx, testFile); err != nil {
+				b.Fatalf("Upload failed: %v", err)
+			}
+
+			b.ResetTimer()
+			b.SetBytes(fileSize)
+
+			for i := 0; i < b.N; i++ {
+				// A leftover output would be resumed rather than downloaded
+				os.Remove(outputFile)
+				if err := client.DownloadFile(ctx, filepath.Base(testFile), outputFile, nil); err != nil {
+					b.Fatalf("Download failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// peakHeapDuring runs fn while sampling HeapInuse and returns the largest growth over
+// the heap in use before it started
+func peakHeapDuring(fn func() error) (uint64, error) {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	baseline := stats.HeapInuse
+
+	var peak atomic.Uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var stats runtime.MemStats
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapInuse > peak.Load() {
+				peak.Store(stats.HeapInuse)
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+
+	err := fn()
+	close(done)
+	<-sampled
+	if peak.Load() < baseline {
+		return 0, err
+	}
+	return peak.Load() - baseline, err
+}
+
+// BenchmarkUploadSingleShotVsChunked compares reading a file whole and sending it as one
+// CommandUpload frame with streaming it as CommandUploadChunk chunks, across sizes on
+// both sides of protocol.SmallFileThreshold. Client and server share the process, so
+// the peak heap growth covers both ends.
+func BenchmarkUploadSingleShotVsChunked(b *testing.B) {
+	ctx := context.Background()
+
+	sizes := []struct {
+		name string
+		size int
+	}{
+		{"16KB", 16 * 1024},
+		{"64KB", 64 * 1024},
+		{"256KB", protocol.SmallFileThreshold},
+		{"1MB", mediumFileSize},
+		{"10MB", largeFileSize},
+		{"64MB", 64 * 1024 * 1024},
+	}
+	paths := []struct {
+		name   string
+		upload func(client *entity.Client, testFile string) error
+	}{
+		{"SingleShot", func(client *entity.Client, testFile string) error {
+			data, err := os.ReadFile(testFile)
+			if err != nil {
+				return err
+			}
+			return uploadSingleFrame(ctx, client, filepath.Base(testFile), data)
+		}},
+		{"Chunked", func(client *entity.Client, testFile string) error {
+			return client.UploadFile(ctx, testFile)
+		}},
+	}
+
+	for _, size := range sizes {
+		for _, path := range paths {
+			b.Run(fmt.Sprintf("%s_%s", size.name, path.name), func(b *testing.B) {
+				server, rootDir, cleanup := setupBenchmarkServer(b)
+				defer cleanup()
+
+				listener, err := net.Listen("tcp", "localhost:0")
+				if err != nil {
+					b.Fatalf("Failed to create listener: %v", err)
+				}
+				defer listener.Close()
+
+				_, port, err := net.SplitHostPort(listener.Addr().String())
+				if err != nil {
+					b.Fatalf("Failed to get port: %v", err)
+				}
+
+				go func() {
+					for {
+						conn, err := listener.Accept()
+						if err != nil {
+							return // Listener closed
+						}
+						client := NewConnectionHandler(conn, server.rsaKeyPair, server.logger, rootDir)
+						go client.HandleRawRequest()
+					}
+				}()
+
+				testFile := filepath.Join(b.TempDir(), "bench_upload.bin")
+				os.WriteFile(testFile, generateRandomData(size.size), 0644)
+
+				pubKeyFile := filepath.Join(b.TempDir(), "server_public.pem")
+				os.WriteFile(pubKeyFile, rsaUtil.PublicKeyToBytes(server.rsaKeyPair.Public), 0644)
+
+				client, err := entity.NewClientWithServerPubKey(ctx, "localhost", port, pubKeyFile, zap.NewNop())
+				if err != nil {
+					b.Fatalf("Failed to create client: %v", err)
+				}
+				defer client.Close(ctx)
+				if err := client.PerformHandshake(ctx); err != nil {
+					b.Fatalf("Handshake failed: %v", err)
+				}
+
+				b.ResetTimer()
+				b.SetBytes(int64(size.size))
+
+				var peak uint64
+				var elapsed time.Duration
+				for i := 0; i < b.N; i++ {
+					start := time.Now()
+					growth, err := peakHeapDuring(func() error { return path.upload(client, testFile) })
+					elapsed += time.Since(start)
+					if err != nil {
+						b.Fatalf("Upload failed: %v", err)
+					}
+					peak = max(peak, growth)
+				}
+
+				throughput := float64(size.size) * float64(b.N) / elapsed.Seconds() / (1024 * 1024) // MB/s
+				b.Logf("Size: %s, Path: %s, Throughput: %.2f MB/s, Peak heap growth: %.2f MB (%.1fx the file)",
+					size.name, path.name, throughput, float64(peak)/(1024*1024), float64(peak)/float64(size.size))
+			})
+		}
+	}
+}
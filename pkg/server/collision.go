@@ -0,0 +1,92 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	protocol "github.com/lcensies/ssnproj/pkg/protocol"
+)
+
+// CollisionPolicy decides what happens when a write targets a name that already exists
+type CollisionPolicy int
+
+const (
+	// CollisionOverwrite replaces the existing file (default)
+	CollisionOverwrite CollisionPolicy = iota
+	// CollisionReject refuses the write and leaves the existing file untouched
+	CollisionReject
+	// CollisionVersion keeps the existing file and stores the new one as "name (N).ext"
+	CollisionVersion
+)
+
+// maxCollisionVersions bounds the search for a free versioned name
+const maxCollisionVersions = 10000
+
+// errFileExists is returned when a write collides with an existing file under CollisionReject
+var errFileExists = errors.New("File already exists")
+
+// String returns the policy name
+func (p CollisionPolicy) String() string {
+	switch p {
+	case CollisionOverwrite:
+		return "overwrite"
+	case CollisionReject:
+		return "reject"
+	case CollisionVersion:
+		return "version"
+	default:
+		return fmt.Sprintf("CollisionPolicy(%d)", int(p))
+	}
+}
+
+// resolveCollision applies the configured collision policy to a validated target path.
+// Every command that creates a file goes through it so the rules stay consistent.
+// It returns the path the data should be written to.
+func (handler *CommandHandler) resolveCollision(filePath string) (string, error) {
+	info, err := handler.storage().Stat(handler.storageClient(), handler.storedName(filePath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return filePath, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to check target: %w", err)
+	}
+	if info.IsDir {
+		return "", fmt.Errorf("target is a directory")
+	}
+
+	switch handler.settings().OnCollision {
+	case CollisionReject:
+		return "", errFileExists
+	case CollisionVersion:
+		return handler.nextVersionedPath(filePath)
+	default:
+		return filePath, nil
+	}
+}
+
+// nextVersionedPath finds the first free "name (N).ext" next to filePath
+func (handler *CommandHandler) nextVersionedPath(filePath string) (string, error) {
+	dir := filepath.Dir(filePath)
+	ext := filepath.Ext(filePath)
+	base := strings.TrimSuffix(filepath.Base(filePath), ext)
+
+	for i := 1; i <= maxCollisionVersions; i++ {
+		candidate := filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+		if _, err := handler.storage().Stat(handler.storageClient(), handler.storedName(candidate)); errors.Is(err, fs.ErrNotExist) {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("too many versions of %s", filepath.Base(filePath))
+}
+
+// collisionErrorCode classifies an error from resolveCollision
+func collisionErrorCode(err error) protocol.ErrorCode {
+	if errors.Is(err, errFileExists) {
+		return protocol.ErrCodeExists
+	}
+	return protocol.ErrCodeIO
+}
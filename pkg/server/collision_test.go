@@ -0,0 +1,103 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	protocol "github.com/lcensies/ssnproj/pkg/protocol"
+)
+
+// uploadForTest runs handleUpload and returns the decoded response
+func uploadForTest(t *testing.T, cmdHandler *CommandHandler, mockConn *MockConnectionHandler, filename string, data []byte) *protocol.ResponseMessage {
+	mockConn.ClearSentMessages()
+
+	command := &protocol.CommandMessage{
+		Command:  protocol.CommandUpload,
+		Filename: filename,
+		Data:     data,
+	}
+	if err := cmdHandler.handleUpload(command); err != nil {
+		t.Fatalf("handleUpload failed: %v", err)
+	}
+
+	if len(mockConn.sentMessages) != 1 {
+		t.Fatalf("Expected 1 sent message, got %d", len(mockConn.sentMessages))
+	}
+
+	respMsg, err := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload)
+	if err != nil {
+		t.Fatalf("Failed to deserialize response: %v", err)
+	}
+	return respMsg
+}
+
+func TestUploadCollisionPolicies(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        CollisionPolicy
+		expectSuccess bool
+		expectContent map[string]string
+	}{
+		{
+			name:          "overwrite",
+			policy:        CollisionOverwrite,
+			expectSuccess: true,
+			expectContent: map[string]string{"report.txt": "second"},
+		},
+		{
+			name:          "reject",
+			policy:        CollisionReject,
+			expectSuccess: false,
+			expectContent: map[string]string{"report.txt": "first"},
+		},
+		{
+			name:          "version",
+			policy:        CollisionVersion,
+			expectSuccess: true,
+			expectContent: map[string]string{"report.txt": "first", "report (1).txt": "second"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := createTestTempDir(t)
+			defer cleanupTestTempDir(t, tempDir)
+
+			cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+			cmdHandler.config = &ServerConfig{RootDir: &tempDir, OnCollision: tt.policy}
+
+			clientDir, err := cmdHandler.getClientDir()
+			if err != nil {
+				t.Fatalf("Failed to get client directory: %v", err)
+			}
+
+			if resp := uploadForTest(t, cmdHandler, mockConn, "report.txt", []byte("first")); !resp.Success {
+				t.Fatalf("Initial upload failed: %s", resp.Message)
+			}
+
+			resp := uploadForTest(t, cmdHandler, mockConn, "report.txt", []byte("second"))
+			if resp.Success != tt.expectSuccess {
+				t.Errorf("Expected success=%v, got %v. Message: %s", tt.expectSuccess, resp.Success, resp.Message)
+			}
+
+			for name, content := range tt.expectContent {
+				actual, err := os.ReadFile(filepath.Join(clientDir, name))
+				if err != nil {
+					t.Fatalf("Failed to read %s: %v", name, err)
+				}
+				if string(actual) != content {
+					t.Errorf("Content mismatch for %s. Expected: %s, Got: %s", name, content, string(actual))
+				}
+			}
+
+			entries, err := os.ReadDir(clientDir)
+			if err != nil {
+				t.Fatalf("Failed to read client directory: %v", err)
+			}
+			if len(entries) != len(tt.expectContent) {
+				t.Errorf("Expected %d files, got %d", len(tt.expectContent), len(entries))
+			}
+		})
+	}
+}
@@ -1,15 +1,24 @@
 package server
 
 import (
+	"context"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/lcensies/ssnproj/pkg/metrics"
 	protocol "github.com/lcensies/ssnproj/pkg/protocol"
 	"go.uber.org/zap"
+	"golang.org/x/text/unicode/norm"
 )
 
 // ConnectionSender interface for sending secure messages
@@ -20,23 +29,67 @@ type ConnectionSender interface {
 const (
 	errPathValidationFailed = "Path validation failed"
 	errInvalidFilename      = "Invalid filename"
+	errServerBusy           = "Server busy, too many open files; try again later"
 )
 
-// Chunk size configuration for optimal performance
-const (
-	smallFileThreshold  = 256 * 1024      // 256 KB
-	mediumFileThreshold = 5 * 1024 * 1024 // 5 MB
-	smallChunkSize      = 64 * 1024       // 64 KB for small files
-	mediumChunkSize     = 128 * 1024      // 128 KB for medium files
-	largeChunkSize      = 256 * 1024      // 256 KB for large files
-	maxChunkSize        = 512 * 1024      // 512 KB maximum
-)
+// maxFilenameLength matches the common filesystem limit on a single name, in bytes;
+// it applies to each element of a path
+const maxFilenameLength = 255
+
+// maxPathLength matches the common PATH_MAX limit on a whole path, in bytes
+const maxPathLength = 4096
+
+// readErrorCode classifies a failure to open or read a client file
+func readErrorCode(err error) protocol.ErrorCode {
+	if errors.Is(err, fs.ErrNotExist) {
+		return protocol.ErrCodeNotFound
+	}
+	return protocol.ErrCodeIO
+}
 
 type CommandHandler struct {
 	conn    ConnectionSender
 	logger  *zap.Logger
 	rootDir *string
 	aesKey  []byte
+	config  *ServerConfig
+	tx      *transaction
+	tail    *tailSession
+	upload  *uploadStream
+	ctx     context.Context
+	// store is the Storage in use, see storage
+	store Storage
+	// transferCtx is the context of the download being sent, see transferContext
+	transferCtx context.Context
+
+	// openFiles is the server-wide open file semaphore, nil when unlimited
+	openFiles chan struct{}
+	// tickets issues session tickets, nil when they are disabled or the session cannot resume
+	tickets *ticketStore
+	// authenticated is when the session's full handshake took place, before any resumes
+	authenticated time.Time
+	// fileLocks is the server-wide lock of each file in use, nil when running standalone
+	fileLocks *fileLocks
+
+	// namespace, when set, selects a directory of the identity shared by its sessions
+	namespace string
+	// identityDir, when set, is the directory of the client's verified long-lived identity
+	identityDir string
+
+	// protocolVersion is the wire revision agreed in the handshake
+	protocolVersion uint16
+
+	// audit, when set, receives audit records besides logger
+	audit *zap.Logger
+	// record is the audit record of the command being handled, nil if it is not audited
+	record *auditRecord
+
+	// metrics is nil when metrics are disabled
+	metrics *metrics.Metrics
+	// commandFailed is set when the command being handled sends a failure response
+	commandFailed bool
+	// closed is set by CommandClose; the connection handler then ends the session
+	closed bool
 }
 
 func NewCommandHandler(conn ConnectionSender, logger *zap.Logger, rootDirectory *string, aesKey []byte) *CommandHandler {
@@ -48,28 +101,91 @@ func NewCommandHandler(conn ConnectionSender, logger *zap.Logger, rootDirectory
 	}
 }
 
+// wireVersion returns the negotiated protocol version, the base version when the
+// handler runs standalone
+func (handler *CommandHandler) wireVersion() uint16 {
+	if handler.protocolVersion == 0 {
+		return protocol.ProtocolVersionBase
+	}
+	return handler.protocolVersion
+}
+
+// settings returns the server configuration, or defaults when the handler runs standalone
+func (handler *CommandHandler) settings() *ServerConfig {
+	if handler.config == nil {
+		return &ServerConfig{}
+	}
+	return handler.config
+}
+
 func (handler *CommandHandler) handleUpload(command *protocol.CommandMessage) error {
 	handler.logger.Info("Upload command received", zap.String("filename", command.Filename))
 
 	// Validate and get safe path
 	filePath, err := handler.validatePath(command.Filename)
 	if err != nil {
-		responsePayload, _ := protocol.SerializeResponse(false, errInvalidFilename, nil)
-		response := protocol.NewMessage(protocol.MessageTypeResponse, responsePayload)
-		handler.conn.SendSecureMessage(response)
+		handler.sendFailure(protocol.ErrCodeInvalidPath, errInvalidFilename)
 		return err
 	}
+	if err := handler.validateFilename(handler.clientRelativeName(filePath)); err != nil {
+		return handler.refuseFilename(command.Filename, err)
+	}
+
+	if refusal := handler.checkParentDir(filePath); refusal != "" {
+		return handler.sendFailure(protocol.ErrCodeNotFound, refusal)
+	}
+	if refusal := handler.checkRegularFile(filePath); refusal != "" {
+		return handler.sendFailure(protocol.ErrCodeInvalidPath, refusal)
+	}
+
+	if maxSize := handler.settings().MaxUploadSize; maxSize > 0 && int64(len(command.Data)) > maxSize {
+		handler.logger.Warn("Upload exceeds size limit",
+			zap.String("filename", command.Filename),
+			zap.Int("size", len(command.Data)),
+			zap.Int64("limit", maxSize))
+		return handler.sendFailure(protocol.ErrCodeQuotaExceeded, fmt.Sprintf("File too large: %d bytes exceeds limit of %d", len(command.Data), maxSize))
+	}
+	if code, refusal := handler.checkQuota(command.Filename, uint64(len(command.Data))); refusal != "" {
+		return handler.sendFailure(code, refusal)
+	}
 
-	// Write the file data
-	err = os.WriteFile(filePath, command.Data, 0644)
+	storedName := handler.clientRelativeName(filePath)
+	if handler.tx != nil {
+		// Inside a transaction the file is staged; collisions are resolved on commit
+		filePath = handler.tx.stagedPath(filePath)
+	} else {
+		// Apply the collision policy before touching the target
+		filePath, err = handler.resolveCollision(filePath)
+		if err != nil {
+			return handler.sendFailure(collisionErrorCode(err), err.Error())
+		}
+		storedName = handler.clientRelativeName(filePath)
+	}
+
+	// Write the file data, encrypted if the server stores files encrypted
+	stored, err := handler.sealForStorage(command.Data)
+	if err == nil && handler.tx != nil {
+		err = os.WriteFile(filePath, stored, handler.settings().fileMode())
+	} else if err == nil {
+		unlock := handler.lockFiles(false, filePath)
+		err = handler.storage().Put(handler.storageClient(), storedName, stored)
+		unlock()
+	}
 	if err != nil {
-		responsePayload, _ := protocol.SerializeResponse(false, "Failed to write file", nil)
-		response := protocol.NewMessage(protocol.MessageTypeResponse, responsePayload)
-		handler.conn.SendSecureMessage(response)
+		handler.sendFailure(protocol.ErrCodeIO, "Failed to write file")
 		return err
 	}
 
-	responsePayload, err := protocol.SerializeResponse(true, "File uploaded successfully", nil)
+	handler.auditBytes(uint64(len(command.Data)))
+
+	message := "File uploaded successfully"
+	if handler.tx != nil {
+		message = "File staged for commit"
+	} else if err := handler.mirrorWrite(filePath, stored); err != nil {
+		return handler.sendFailure(protocol.ErrCodeIO, errMirrorFailed)
+	}
+
+	responsePayload, err := protocol.SerializeResponse(true, message, []byte(storedName))
 	if err != nil {
 		return err
 	}
@@ -84,23 +200,71 @@ func (handler *CommandHandler) handleDownload(command *protocol.CommandMessage)
 	// Validate and get safe path
 	filePath, err := handler.validatePath(command.Filename)
 	if err != nil {
-		responsePayload, _ := protocol.SerializeResponse(false, errInvalidFilename, nil)
-		response := protocol.NewMessage(protocol.MessageTypeResponse, responsePayload)
-		handler.conn.SendSecureMessage(response)
+		handler.sendFailure(protocol.ErrCodeInvalidPath, errInvalidFilename)
 		return err
 	}
+	if refusal := handler.checkRegularFile(filePath); refusal != "" {
+		return handler.sendFailure(protocol.ErrCodeInvalidPath, refusal)
+	}
+
+	// Bound simultaneously open files so bursts of downloads cannot exhaust descriptors
+	if !handler.acquireOpenFile() {
+		handler.logger.Warn("Refusing download, open file limit reached", zap.String("filename", command.Filename))
+		return handler.sendFailure(protocol.ErrCodeBusy, errServerBusy)
+	}
 
 	// Read the file data
-	fileData, err := os.ReadFile(filePath)
+	unlock := handler.lockFiles(true, filePath)
+	fileData, err := handler.storage().Get(handler.storageClient(), handler.storedName(filePath))
+	unlock()
+	handler.releaseOpenFile()
 	if err != nil {
-		responsePayload, _ := protocol.SerializeResponse(false, "File not found or failed to read", nil)
-		response := protocol.NewMessage(protocol.MessageTypeResponse, responsePayload)
-		handler.conn.SendSecureMessage(response)
+		handler.sendFailure(readErrorCode(err), "File not found or failed to read")
 		return nil // Don't return the error, we've sent a response
 	}
+	if fileData, err = handler.openFromStorage(fileData); err != nil {
+		handler.logger.Error("Failed to read stored file", zap.String("filename", command.Filename), zap.Error(err))
+		return handler.sendFailure(protocol.ErrCodeIO, "File not found or failed to read")
+	}
+
+	// A resumed download skips the prefix the client already holds, provided it matches
+	request, err := protocol.DeserializeDownloadRequest(command.Data)
+	if err != nil {
+		return handler.sendFailure(protocol.ErrCodeInvalidRequest, "Invalid download request")
+	}
+
+	// A range stands in for the whole file from here on; one running past the end is cut short
+	if request.Ranged() {
+		if request.RangeStart > uint64(len(fileData)) {
+			return handler.sendFailure(protocol.ErrCodeInvalidRequest, protocol.RangeBeyondEOFMessage)
+		}
+		fileData = fileData[request.RangeStart:]
+		if request.RangeLength > 0 && request.RangeLength < uint64(len(fileData)) {
+			fileData = fileData[:request.RangeLength]
+		}
+	}
 
-	// Send initial response indicating chunked transfer will begin
-	responsePayload, err := protocol.SerializeResponse(true, "Starting chunked download", nil)
+	offset := request.Offset
+	if offset > uint64(len(fileData)) {
+		return handler.sendFailure(protocol.ErrCodeInvalidRequest, protocol.ResumeRejectedMessage+": offset beyond end of file")
+	}
+	if offset > 0 {
+		if sha256.Sum256(fileData[:offset]) != request.PrefixSum {
+			handler.logger.Info("Refusing to resume download, prefix differs",
+				zap.String("filename", command.Filename),
+				zap.Uint64("offset", offset))
+			return handler.sendFailure(protocol.ErrCodeInvalidRequest, protocol.ResumeRejectedMessage+": existing data does not match")
+		}
+		handler.logger.Info("Resuming download",
+			zap.String("filename", command.Filename),
+			zap.Uint64("offset", offset))
+	}
+
+	// Send initial response indicating chunked transfer will begin. Data is the full
+	// file size and its SHA-256, so the client can verify the reassembled file.
+	fileSum := sha256.Sum256(fileData)
+	startData := append(binary.BigEndian.AppendUint64(nil, uint64(len(fileData))), fileSum[:]...)
+	responsePayload, err := protocol.SerializeResponse(true, "Starting chunked download", startData)
 	if err != nil {
 		return err
 	}
@@ -110,45 +274,73 @@ func (handler *CommandHandler) handleDownload(command *protocol.CommandMessage)
 		return err
 	}
 
-	// Send file in chunks
-	return handler.sendFileInChunks(command.Filename, fileData)
+	// Send the rest of the file in chunks, only this stream's share of a parallel download
+	handler.auditBytes(uint64(len(fileData)) - offset)
+	return handler.sendFileInChunks(command.Filename, fileData[offset:], request.Stream, request.Streams, request.ChunkSize)
 }
 
-// sendFileInChunks sends a file in chunks with progress information
-// Chunk size is dynamically determined based on file size for optimal performance
-func (handler *CommandHandler) sendFileInChunks(filename string, fileData []byte) error {
-	totalSize := uint64(len(fileData))
-
-	// Determine optimal chunk size based on file size
-	var chunkSize uint32
-	switch {
-	case totalSize < smallFileThreshold:
-		// Small files: use smaller chunks or send in one piece
-		chunkSize = smallChunkSize
-	case totalSize < mediumFileThreshold:
-		// Medium files: use medium chunks
-		chunkSize = mediumChunkSize
+// acquireOpenFile takes an open file slot, reporting false when none is free
+func (handler *CommandHandler) acquireOpenFile() bool {
+	if handler.openFiles == nil {
+		return true
+	}
+	select {
+	case handler.openFiles <- struct{}{}:
+		return true
 	default:
-		// Large files: use larger chunks for better throughput
-		chunkSize = largeChunkSize
+		return false
 	}
+}
 
-	totalChunks := uint32((totalSize + uint64(chunkSize) - 1) / uint64(chunkSize)) // Round up division
+// releaseOpenFile returns a slot taken by acquireOpenFile
+func (handler *CommandHandler) releaseOpenFile() {
+	if handler.openFiles != nil {
+		<-handler.openFiles
+	}
+}
+
+// sendFileInChunks sends a file in chunks with progress information
+// Chunk size is the client's preferredChunkSize, bounded to the supported range, or when
+// that is zero dynamically determined based on file size for optimal performance.
+// With several streams only the chunks assigned to stream are sent; indices stay
+// relative to the whole of fileData so the client can place them.
+func (handler *CommandHandler) sendFileInChunks(filename string, fileData []byte, stream, streams uint16, preferredChunkSize uint32) error {
+	totalSize := uint64(len(fileData))
+
+	chunkSize := protocol.PreferredChunkSize(totalSize, preferredChunkSize)
+	totalChunks := protocol.ChunkCount(totalSize, chunkSize)
+	first, end := protocol.StreamChunkRange(totalChunks, stream, streams)
 
 	handler.logger.Info("Sending file in chunks",
 		zap.String("filename", filename),
 		zap.Uint64("totalSize", totalSize),
 		zap.Uint32("totalChunks", totalChunks),
-		zap.Uint32("chunkSize", chunkSize))
+		zap.Uint32("chunkSize", chunkSize),
+		zap.Uint32("firstChunk", first),
+		zap.Uint32("endChunk", end))
 
-	for i := uint32(0); i < totalChunks; i++ {
+	for i := first; i < end; i++ {
 		start := i * chunkSize
-		end := start + chunkSize
-		if end > uint32(totalSize) {
-			end = uint32(totalSize)
+		stop := start + chunkSize
+		if stop > uint32(totalSize) {
+			stop = uint32(totalSize)
 		}
 
-		chunkData := fileData[start:end]
+		if i > first {
+			err := handler.paceChunk()
+			// The client's CommandAbort ends the download between chunks, leaving the session open
+			if handler.transferAborted() {
+				handler.logger.Info("Download aborted by the client",
+					zap.String("filename", filename),
+					zap.Uint32("chunksSent", i-first))
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("download of %s interrupted: %w", filename, err)
+			}
+		}
+
+		chunkData := fileData[start:stop]
 		actualChunkSize := uint32(len(chunkData))
 
 		// Create chunk message
@@ -162,7 +354,7 @@ func (handler *CommandHandler) sendFileInChunks(filename string, fileData []byte
 		}
 
 		// Serialize chunk
-		chunkPayload, err := protocol.SerializeChunkData(chunk)
+		chunkPayload, err := protocol.SerializeChunkDataVersion(chunk, handler.wireVersion())
 		if err != nil {
 			return fmt.Errorf("failed to serialize chunk %d: %w", i, err)
 		}
@@ -174,7 +366,7 @@ func (handler *CommandHandler) sendFileInChunks(filename string, fileData []byte
 		}
 
 		// Log progress
-		progress := float64(i+1) / float64(totalChunks) * 100
+		progress := float64(i+1-first) / float64(end-first) * 100
 		handler.logger.Debug("Sent chunk",
 			zap.String("filename", filename),
 			zap.Uint32("chunkIndex", i),
@@ -182,29 +374,62 @@ func (handler *CommandHandler) sendFileInChunks(filename string, fileData []byte
 	}
 
 	handler.logger.Info("File transfer completed", zap.String("filename", filename))
-	return nil
+	if handler.wireVersion() < protocol.ProtocolVersionDownloadComplete {
+		return nil
+	}
+	// Mark the end explicitly so the client can tell a finished transfer from a dropped one
+	responsePayload, err := protocol.SerializeResponse(true, protocol.DownloadCompleteMessage, protocol.SerializeDownloadComplete(end-first))
+	if err != nil {
+		return err
+	}
+	return handler.conn.SendSecureMessage(protocol.NewMessage(protocol.MessageTypeResponse, responsePayload))
+}
+
+// sessionDirName maps a session key to its storage directory name. The whole SHA-256
+// hash is used so distinct sessions cannot end up sharing a directory.
+func sessionDirName(aesKey []byte) string {
+	hash := sha256.Sum256(aesKey)
+	return hex.EncodeToString(hash[:])
 }
 
 func (handler *CommandHandler) getClientDir() (string, error) {
-	// If no AES key yet (shouldn't happen after handshake), return root
-	if handler.aesKey == nil || len(handler.aesKey) == 0 {
-		return *handler.rootDir, nil
+	storage, ok := handler.storage().(*FilesystemStorage)
+	if !ok {
+		return "", errNotOnDisk
 	}
 
-	// Create a unique directory name based on SHA256 hash of AES key
-	hash := sha256.Sum256(handler.aesKey)
-	clientID := hex.EncodeToString(hash[:8]) // Use first 8 bytes (16 hex chars) for directory name
-	clientDir := filepath.Join(*handler.rootDir, clientID)
-
-	// Create client directory if it doesn't exist
-	if err := os.MkdirAll(clientDir, 0755); err != nil {
-		return "", fmt.Errorf("failed to create client directory: %w", err)
+	// If no AES key yet (shouldn't happen after handshake), this is the root
+	clientDir, err := storage.clientDir(handler.storageClient())
+	if err != nil {
+		return "", err
 	}
 
-	handler.logger.Debug("Using client directory", zap.String("clientID", clientID), zap.String("path", clientDir))
+	handler.logger.Debug("Using client directory", zap.String("clientID", handler.storageClient()), zap.String("path", clientDir))
 	return clientDir, nil
 }
 
+// clientRoot returns the path validatePath resolves names against: the client's
+// directory, or where it would be when the storage backend keeps no directories
+func (handler *CommandHandler) clientRoot() (string, error) {
+	if !handler.onDisk() {
+		return filepath.Join(string(filepath.Separator), handler.storageClient()), nil
+	}
+	return handler.getClientDir()
+}
+
+// clientID names the client's directory under the root: the identity's namespace or
+// the identity's own directory when there is one, otherwise a SHA-256 hash of the
+// session key
+func (handler *CommandHandler) clientID() string {
+	if handler.namespace != "" {
+		return namespaceDirName(handler.identityDir, handler.namespace)
+	}
+	if handler.identityDir != "" {
+		return handler.identityDir
+	}
+	return sessionDirName(handler.aesKey)
+}
+
 // validatePath ensures the resolved path stays within the root directory
 func (handler *CommandHandler) validatePath(filename string) (string, error) {
 	// Reject empty filenames
@@ -212,13 +437,27 @@ func (handler *CommandHandler) validatePath(filename string) (string, error) {
 		return "", fmt.Errorf("filename cannot be empty")
 	}
 
+	// Map equivalent Unicode spellings (e.g. NFD from macOS) to one name on disk
+	if handler.settings().NormalizeUnicode {
+		filename = norm.NFC.String(filename)
+	}
+
+	if len(filename) > maxPathLength {
+		return "", fmt.Errorf("path longer than %d bytes", maxPathLength)
+	}
+	for _, element := range strings.Split(filename, "/") {
+		if len(element) > maxFilenameLength {
+			return "", fmt.Errorf("filename longer than %d bytes", maxFilenameLength)
+		}
+	}
+
 	// Reject absolute paths
 	if filepath.IsAbs(filename) {
 		return "", fmt.Errorf("absolute paths are not allowed")
 	}
 
 	// Get root directory
-	rootDir, err := handler.getClientDir()
+	rootDir, err := handler.clientRoot()
 	if err != nil {
 		return "", err
 	}
@@ -248,32 +487,102 @@ func (handler *CommandHandler) validatePath(filename string) (string, error) {
 }
 
 func (handler *CommandHandler) handleList(command *protocol.CommandMessage) error {
-	clientDir, err := handler.getClientDir()
+	handler.logger.Info("List command received", zap.String("filename", command.Filename))
+
+	// A filename selects a subdirectory to list instead of the client directory itself.
+	// A wildcard in its last element lists only the matching entries of its parent.
+	listDir := ""
+	target, namePattern := command.Filename, ""
+	var err error
+	if protocol.IsGlobPattern(target) {
+		target, namePattern, err = splitGlob(target)
+		if err != nil {
+			handler.logger.Warn("Invalid list pattern", zap.String("pattern", command.Filename), zap.Error(err))
+			return handler.sendFailure(protocol.ErrCodeInvalidPath, errInvalidPattern)
+		}
+	}
+	if target != "" {
+		dirPath, err := handler.validatePath(target)
+		if err != nil {
+			handler.logger.Warn(errPathValidationFailed, zap.String("filename", target), zap.Error(err))
+			return handler.sendFailure(protocol.ErrCodeInvalidPath, errInvalidFilename)
+		}
+		listDir = handler.storedName(dirPath)
+		info, err := handler.storage().Stat(handler.storageClient(), listDir)
+		if errors.Is(err, fs.ErrNotExist) {
+			return handler.sendFailure(protocol.ErrCodeNotFound, errDirectoryNotFound)
+		}
+		if err != nil || !info.IsDir {
+			return handler.sendFailure(protocol.ErrCodeInvalidPath, "Not a directory")
+		}
+	}
+
+	request, err := protocol.DeserializeListRequest(command.Data)
 	if err != nil {
-		responsePayload, _ := protocol.SerializeResponse(false, "Failed to get client directory", nil)
-		response := protocol.NewMessage(protocol.MessageTypeResponse, responsePayload)
-		handler.conn.SendSecureMessage(response)
-		return err
+		return handler.sendFailure(protocol.ErrCodeInvalidRequest, "Invalid list request")
 	}
+	flags := request.Flags
 
-	handler.logger.Info("List command received", zap.String("filename", command.Filename))
-	files, err := os.ReadDir(clientDir)
+	files, err := handler.storage().List(handler.storageClient(), listDir, flags&protocol.ListFlagRecursive != 0)
 	if err != nil {
-		responsePayload, _ := protocol.SerializeResponse(false, "Failed to read directory", nil)
-		response := protocol.NewMessage(protocol.MessageTypeResponse, responsePayload)
-		handler.conn.SendSecureMessage(response)
+		handler.sendFailure(protocol.ErrCodeIO, "Failed to read directory")
 		return err
 	}
+	if namePattern != "" {
+		files = filterEntries(files, namePattern)
+	}
+	// A plain listing only names files, not directories
+	if flags&protocol.ListFlagDetailed == 0 {
+		files = slices.DeleteFunc(files, func(file protocol.FileInfo) bool { return file.IsDir })
+	}
+	// Sorting by name keeps pages from overlapping or skipping entries
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	more := false
+	if request.Paged() {
+		files, more = pageEntries(files, request.Offset, request.Limit)
+	}
+	for i := range files {
+		handler.reportPlainSize(&files[i])
+	}
 
-	filenames := make([]string, 0, len(files))
-	for _, file := range files {
-		if !file.IsDir() { // Only include files, not directories
-			filenames = append(filenames, file.Name())
+	// A detailed listing carries FileInfo entries in Data; a plain one carries names in Message
+	var listing []byte
+	if flags&protocol.ListFlagDetailed != 0 {
+		handler.addContentTypes(listDir, files)
+		listing, err = protocol.SerializeFileInfos(files)
+		if err != nil {
+			return err
+		}
+	} else {
+		filenames := make([]string, 0, len(files))
+		for _, file := range files {
+			filenames = append(filenames, file.Name)
+		}
+		listing = []byte(strings.Join(filenames, "\n"))
+	}
+
+	var message string
+	var data []byte
+	if flags&protocol.ListFlagCompress != 0 {
+		// Compressed listings travel in Data, the message only names the encoding
+		compressed, err := protocol.CompressPayload(listing)
+		if err != nil {
+			return err
 		}
+		handler.logger.Debug("Compressed file list",
+			zap.Int("originalSize", len(listing)),
+			zap.Int("compressedSize", len(compressed)))
+		message, data = protocol.EncodingGzip, compressed
+	} else if flags&protocol.ListFlagDetailed != 0 {
+		data = listing
+	} else {
+		message = string(listing)
+	}
+	if request.Paged() {
+		data = append([]byte{boolByte(more)}, data...)
 	}
 
-	fileList := strings.Join(filenames, "\n")
-	responsePayload, err := protocol.SerializeResponse(true, fileList, nil)
+	responsePayload, err := protocol.SerializeResponse(true, message, data)
 	if err != nil {
 		return err
 	}
@@ -282,6 +591,37 @@ func (handler *CommandHandler) handleList(command *protocol.CommandMessage) erro
 	return handler.conn.SendSecureMessage(response)
 }
 
+// pageEntries returns the limit entries of files from offset on, all of them for a zero
+// limit, and whether entries follow them
+func pageEntries(files []protocol.FileInfo, offset, limit uint32) ([]protocol.FileInfo, bool) {
+	if uint64(offset) >= uint64(len(files)) {
+		return nil, false
+	}
+	files = files[offset:]
+	if limit > 0 && uint64(limit) < uint64(len(files)) {
+		return files[:limit], true
+	}
+	return files, false
+}
+
+// boolByte encodes b as a single byte, 1 for true
+func boolByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// fileInfoFrom converts a local file's metadata to its wire form
+func fileInfoFrom(info os.FileInfo) protocol.FileInfo {
+	return protocol.FileInfo{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		ModTime: info.ModTime().Unix(),
+		IsDir:   info.IsDir(),
+	}
+}
+
 func (handler *CommandHandler) handleDelete(command *protocol.CommandMessage) error {
 	handler.logger.Info("Delete command received", zap.String("filename", command.Filename))
 
@@ -289,29 +629,31 @@ func (handler *CommandHandler) handleDelete(command *protocol.CommandMessage) er
 	filePath, err := handler.validatePath(command.Filename)
 	if err != nil {
 		handler.logger.Warn(errPathValidationFailed, zap.String("filename", command.Filename), zap.Error(err))
-		responsePayload, _ := protocol.SerializeResponse(false, errInvalidFilename, nil)
-		response := protocol.NewMessage(protocol.MessageTypeResponse, responsePayload)
-		handler.conn.SendSecureMessage(response)
+		handler.sendFailure(protocol.ErrCodeInvalidPath, errInvalidFilename)
 		return err
 	}
 
+	unlock := handler.lockFiles(false, filePath)
+	defer unlock()
+
 	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		responsePayload, _ := protocol.SerializeResponse(false, "File not found", nil)
-		response := protocol.NewMessage(protocol.MessageTypeResponse, responsePayload)
-		handler.conn.SendSecureMessage(response)
+	name := handler.storedName(filePath)
+	if _, err := handler.storage().Stat(handler.storageClient(), name); errors.Is(err, fs.ErrNotExist) {
+		handler.sendFailure(protocol.ErrCodeNotFound, protocol.FileNotFoundMessage)
 		return nil // Don't return the error, we've sent a response
 	}
 
-	// Delete the file
-	err = os.Remove(filePath)
+	// Delete the file, or move it to the trash
+	err = handler.removeFile(filePath)
 	if err != nil {
-		responsePayload, _ := protocol.SerializeResponse(false, "Failed to delete file", nil)
-		response := protocol.NewMessage(protocol.MessageTypeResponse, responsePayload)
-		handler.conn.SendSecureMessage(response)
+		handler.sendFailure(protocol.ErrCodeIO, "Failed to delete file")
 		return err
 	}
 
+	if err := handler.mirrorRemove(filePath); err != nil {
+		return handler.sendFailure(protocol.ErrCodeIO, errMirrorFailed)
+	}
+
 	responsePayload, err := protocol.SerializeResponse(true, "File deleted successfully", nil)
 	if err != nil {
 		return err
@@ -321,8 +663,85 @@ func (handler *CommandHandler) handleDelete(command *protocol.CommandMessage) er
 	return handler.conn.SendSecureMessage(response)
 }
 
-func (handler *CommandHandler) handle(command *protocol.CommandMessage) error {
+// handleClose marks the session closed by the client, which expects no response
+func (handler *CommandHandler) handleClose(command *protocol.CommandMessage) error {
+	handler.logger.Debug("Close command received")
+	handler.closed = true
+	return nil
+}
+
+// handlePing echoes the client's nonce so it can check the session works end to end
+func (handler *CommandHandler) handlePing(command *protocol.CommandMessage) error {
+	handler.logger.Debug("Ping command received")
+
+	responsePayload, err := protocol.SerializeResponse(true, "pong", command.Data)
+	if err != nil {
+		return err
+	}
+
+	response := protocol.NewMessage(protocol.MessageTypeResponse, responsePayload)
+	return handler.conn.SendSecureMessage(response)
+}
+
+func (handler *CommandHandler) handleVersion(command *protocol.CommandMessage) error {
+	handler.logger.Info("Version command received")
+
+	responsePayload, err := protocol.SerializeResponse(true, protocol.Version, nil)
+	if err != nil {
+		return err
+	}
+
+	response := protocol.NewMessage(protocol.MessageTypeResponse, responsePayload)
+	return handler.conn.SendSecureMessage(response)
+}
+
+func (handler *CommandHandler) handle(command *protocol.CommandMessage) (err error) {
 	handler.logger.Info("Command message received", zap.String("command", string(command.Command)))
+
+	if handler.metrics != nil {
+		label := fmt.Sprintf("0x%02x", byte(command.Command))
+		handler.metrics.Command(label)
+		handler.commandFailed = false
+		defer func() {
+			if err != nil || handler.commandFailed {
+				handler.metrics.CommandFailed(label)
+			}
+		}()
+	}
+
+	// A follow-mode tail owns the response stream until it is stopped
+	if handler.tail != nil && command.Command != protocol.CommandTailStop {
+		handler.stopTail()
+	}
+
+	// A command in the middle of a chunked upload means the client gave up on it
+	if handler.upload != nil {
+		handler.abortUpload()
+	}
+
+	handler.beginAudit(command)
+	defer func() { handler.endAudit(err) }()
+
+	// Each command has one layout; refuse the other rather than misread its payload
+	if command.UsesFields() != command.Command.UsesFieldLayout() {
+		handler.logger.Warn("Rejecting command in wrong layout", zap.String("command", fmt.Sprintf("0x%02x", byte(command.Command))))
+		if command.UsesFields() {
+			return handler.sendFailure(protocol.ErrCodeInvalidRequest, fmt.Sprintf("Command 0x%02x does not support the field layout", byte(command.Command)))
+		}
+		return handler.sendFailure(protocol.ErrCodeInvalidRequest, fmt.Sprintf("Command 0x%02x requires the field layout", byte(command.Command)))
+	}
+
+	// Refuse file commands without a name up front; this is a client mistake, not a
+	// reason to drop the session
+	if command.Command.RequiresFilename() && command.Filename == "" {
+		handler.logger.Warn("Rejecting command with empty filename", zap.String("command", fmt.Sprintf("0x%02x", byte(command.Command))))
+		return handler.sendFailure(protocol.ErrCodeInvalidPath, errInvalidFilename)
+	}
+
+	if requiresDisk(command.Command) && !handler.onDisk() {
+		return handler.sendFailure(protocol.ErrCodeUnsupported, errStorageUnsupported)
+	}
+
 	switch command.Command {
 	case protocol.CommandUpload:
 		return handler.handleUpload(command)
@@ -332,10 +751,51 @@ func (handler *CommandHandler) handle(command *protocol.CommandMessage) error {
 		return handler.handleList(command)
 	case protocol.CommandDelete:
 		return handler.handleDelete(command)
+	case protocol.CommandRename:
+		return handler.handleRename(command)
+	case protocol.CommandStat:
+		return handler.handleStat(command)
+	case protocol.CommandBeginTx:
+		return handler.handleBeginTx(command)
+	case protocol.CommandCommitTx:
+		return handler.handleCommitTx(command)
+	case protocol.CommandRollbackTx:
+		return handler.handleRollbackTx(command)
+	case protocol.CommandVersion:
+		return handler.handleVersion(command)
+	case protocol.CommandTail:
+		return handler.handleTail(command)
+	case protocol.CommandTailStop:
+		return handler.handleTailStop(command)
+	case protocol.CommandInfo:
+		return handler.handleInfo(command)
+	case protocol.CommandUploadChunk:
+		return handler.handleUploadChunk(command)
+	case protocol.CommandMkdir:
+		return handler.handleMkdir(command)
+	case protocol.CommandDeleteGlob:
+		return handler.handleDeleteGlob(command)
+	case protocol.CommandPing:
+		return handler.handlePing(command)
+	case protocol.CommandSessionTicket:
+		return handler.handleSessionTicket(command)
+	case protocol.CommandUsage:
+		return handler.handleUsage(command)
+	case protocol.CommandClose:
+		return handler.handleClose(command)
+	case protocol.CommandCopy:
+		return handler.handleCopy(command)
+	case protocol.CommandRestore:
+		return handler.handleRestore(command)
+	case protocol.CommandEmptyTrash:
+		return handler.handleEmptyTrash(command)
+	case protocol.CommandAbort:
+		return handler.handleAbort(command)
 	default:
-		responsePayload, _ := protocol.SerializeResponse(false, "Unknown command", nil)
-		response := protocol.NewMessage(protocol.MessageTypeResponse, responsePayload)
-		handler.conn.SendSecureMessage(response)
-		return fmt.Errorf("unknown command: %v", command.Command)
+		// Echo the byte back so client/server version mismatches are easy to spot
+		commandByte := byte(command.Command)
+		handler.logger.Warn("Unknown command received", zap.String("command", fmt.Sprintf("0x%02x", commandByte)))
+		handler.sendFailureData(protocol.ErrCodeUnsupported, fmt.Sprintf("Unknown command: 0x%02x", commandByte), []byte{commandByte})
+		return fmt.Errorf("unknown command: 0x%02x", commandByte)
 	}
 }
@@ -2,14 +2,23 @@ package server
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io/fs"
+	"math"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"syscall"
 	"testing"
 
 	protocol "github.com/lcensies/ssnproj/pkg/protocol"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 // MockConnectionHandler is a mock implementation for testing
@@ -56,6 +65,16 @@ func createTestFiles(t *testing.T, dir string, filenames []string) {
 	}
 }
 
+// storeTestFiles puts files like createTestFiles' into the client's area of storage
+func storeTestFiles(t *testing.T, cmdHandler *CommandHandler, storage Storage, filenames []string) {
+	for _, filename := range filenames {
+		content := fmt.Sprintf("Test content for %s", filename)
+		if err := storage.Put(cmdHandler.storageClient(), filename, []byte(content)); err != nil {
+			t.Fatalf("Failed to store test file %s: %v", filename, err)
+		}
+	}
+}
+
 func createTestLogger(t *testing.T) *zap.Logger {
 	logger, err := zap.NewDevelopment()
 	if err != nil {
@@ -66,27 +85,11 @@ func createTestLogger(t *testing.T) *zap.Logger {
 
 func TestHandleList(t *testing.T) {
 	// Setup
-	tempDir := createTestTempDir(t)
-	defer cleanupTestTempDir(t, tempDir)
-
-	logger := createTestLogger(t)
-	defer logger.Sync()
+	cmdHandler, mockConn, storage := createMemoryCommandHandler(t)
 
-	// Create mock connection handler
-	mockConn := &MockConnectionHandler{}
-	// Generate a test AES key for the handler
-	testAESKey := make([]byte, 32) // 256-bit key
-	cmdHandler := NewCommandHandler(mockConn, logger, &tempDir, testAESKey)
-
-	// Get client directory (will be created by getClientDir)
-	clientDir, err := cmdHandler.getClientDir()
-	if err != nil {
-		t.Fatalf("Failed to get client directory: %v", err)
-	}
-
-	// Create test files in client directory
+	// Create test files in the client's storage
 	testFiles := []string{"file1.txt", "file2.txt", "file3.txt"}
-	createTestFiles(t, clientDir, testFiles)
+	storeTestFiles(t, cmdHandler, storage, testFiles)
 
 	// Test handleList
 	command := &protocol.CommandMessage{
@@ -95,7 +98,7 @@ func TestHandleList(t *testing.T) {
 		Data:     nil,
 	}
 
-	err = cmdHandler.handleList(command)
+	err := cmdHandler.handleList(command)
 	if err != nil {
 		t.Fatalf("handleList failed: %v", err)
 	}
@@ -129,26 +132,133 @@ func TestHandleList(t *testing.T) {
 	}
 }
 
-func TestHandleUpload(t *testing.T) {
+func TestHandleList_Detailed(t *testing.T) {
 	// Setup
 	tempDir := createTestTempDir(t)
 	defer cleanupTestTempDir(t, tempDir)
 
-	logger := createTestLogger(t)
-	defer logger.Sync()
-
-	// Create mock connection handler
-	mockConn := &MockConnectionHandler{}
-	// Generate a test AES key for the handler
-	testAESKey := make([]byte, 32) // 256-bit key
-	cmdHandler := NewCommandHandler(mockConn, logger, &tempDir, testAESKey)
-
-	// Get client directory
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
 	clientDir, err := cmdHandler.getClientDir()
 	if err != nil {
 		t.Fatalf("Failed to get client directory: %v", err)
 	}
 
+	list := func() []protocol.FileInfo {
+		mockConn.ClearSentMessages()
+		command := &protocol.CommandMessage{Command: protocol.CommandList, Data: []byte{protocol.ListFlagDetailed}}
+		if err := cmdHandler.handleList(command); err != nil {
+			t.Fatalf("handleList failed: %v", err)
+		}
+		respMsg, err := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload)
+		if err != nil || !respMsg.Success {
+			t.Fatalf("List failed: %v %+v", err, respMsg)
+		}
+		infos, err := protocol.DeserializeFileInfos(respMsg.Data)
+		if err != nil {
+			t.Fatalf("Failed to parse listing: %v", err)
+		}
+		return infos
+	}
+
+	// An empty directory lists as zero entries, not one empty name
+	if infos := list(); len(infos) != 0 {
+		t.Errorf("Expected empty listing, got %+v", infos)
+	}
+
+	// A newline in a name cannot split it into two entries
+	if err := os.WriteFile(filepath.Join(clientDir, "two\nlines.txt"), []byte("12345"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(clientDir, "folder"), 0755); err != nil {
+		t.Fatalf("Failed to create test directory: %v", err)
+	}
+	// Unfinished uploads are not listed
+	if err := os.WriteFile(filepath.Join(clientDir, uploadTempPrefix+"123"), []byte("partial"), 0644); err != nil {
+		t.Fatalf("Failed to create temp upload: %v", err)
+	}
+
+	infos := list()
+	if len(infos) != 2 {
+		t.Fatalf("Expected 2 entries, got %+v", infos)
+	}
+	byName := map[string]protocol.FileInfo{}
+	for _, info := range infos {
+		byName[info.Name] = info
+	}
+	if file := byName["two\nlines.txt"]; file.Size != 5 || file.IsDir || file.ModTime == 0 {
+		t.Errorf("Unexpected file entry %+v", file)
+	}
+	if dir := byName["folder"]; !dir.IsDir {
+		t.Errorf("Expected folder to be a directory, got %+v", dir)
+	}
+}
+
+func TestHandleList_Paged(t *testing.T) {
+	cmdHandler, mockConn, storage := createMemoryCommandHandler(t)
+	// Created out of order; pages follow the names. The sub directory exists while it holds a file.
+	storeTestFiles(t, cmdHandler, storage, []string{"e.txt", "b.txt", "d.txt", "a.txt", "c.txt", "sub/f.txt"})
+
+	tests := []struct {
+		name          string
+		flags         byte
+		offset, limit uint32
+		want          []string
+		more          bool
+	}{
+		{"first page", 0, 0, 2, []string{"a.txt", "b.txt"}, true},
+		{"middle page", 0, 2, 2, []string{"c.txt", "d.txt"}, true},
+		{"final page", 0, 4, 2, []string{"e.txt"}, false},
+		{"exact final page", 0, 3, 2, []string{"d.txt", "e.txt"}, false},
+		{"past the end", 0, 9, 2, nil, false},
+		{"rest from offset", 0, 3, 0, []string{"d.txt", "e.txt"}, false},
+		{"detailed final page", protocol.ListFlagDetailed, 4, 2, []string{"e.txt", "sub"}, false},
+		{"compressed page", protocol.ListFlagDetailed | protocol.ListFlagCompress, 0, 3, []string{"a.txt", "b.txt", "c.txt"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			respMsg := runForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{
+				Command: protocol.CommandList,
+				Data:    protocol.SerializeListRequest(&protocol.ListRequest{Flags: tt.flags, Offset: tt.offset, Limit: tt.limit}),
+			})
+			if !respMsg.Success || len(respMsg.Data) == 0 {
+				t.Fatalf("Paged list failed: %+v", respMsg)
+			}
+			if more := respMsg.Data[0] == 1; more != tt.more {
+				t.Errorf("more = %v, want %v", more, tt.more)
+			}
+
+			var names []string
+			if tt.flags&protocol.ListFlagDetailed == 0 {
+				if respMsg.Message != "" {
+					names = strings.Split(respMsg.Message, "\n")
+				}
+			} else {
+				listing := respMsg.Data[1:]
+				if respMsg.Message == protocol.EncodingGzip {
+					var err error
+					if listing, err = protocol.DecompressPayload(listing); err != nil {
+						t.Fatalf("Failed to decompress listing: %v", err)
+					}
+				}
+				infos, err := protocol.DeserializeFileInfos(listing)
+				if err != nil {
+					t.Fatalf("Failed to parse listing: %v", err)
+				}
+				for _, info := range infos {
+					names = append(names, info.Name)
+				}
+			}
+			if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Page = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleUpload(t *testing.T) {
+	// Setup
+	cmdHandler, mockConn, storage := createMemoryCommandHandler(t)
+
 	// Test data
 	filename := "test_upload.txt"
 	fileContent := []byte("This is test content for upload")
@@ -159,7 +269,7 @@ func TestHandleUpload(t *testing.T) {
 		Data:     fileContent,
 	}
 
-	err = cmdHandler.handleUpload(command)
+	err := cmdHandler.handleUpload(command)
 	if err != nil {
 		t.Fatalf("handleUpload failed: %v", err)
 	}
@@ -184,14 +294,8 @@ func TestHandleUpload(t *testing.T) {
 		t.Errorf("Expected success=true, got %v. Message: %s", respMsg.Success, respMsg.Message)
 	}
 
-	// Verify file was created in client directory
-	filePath := filepath.Join(clientDir, filename)
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		t.Errorf("File was not created: %s", filePath)
-	}
-
-	// Verify file content
-	actualContent, err := os.ReadFile(filePath)
+	// Verify file was stored with its content
+	actualContent, err := storage.Get(cmdHandler.storageClient(), filename)
 	if err != nil {
 		t.Fatalf("Failed to read uploaded file: %v", err)
 	}
@@ -203,29 +307,12 @@ func TestHandleUpload(t *testing.T) {
 
 func TestHandleDownload(t *testing.T) {
 	// Setup
-	tempDir := createTestTempDir(t)
-	defer cleanupTestTempDir(t, tempDir)
-
-	logger := createTestLogger(t)
-	defer logger.Sync()
-
-	// Create mock connection handler
-	mockConn := &MockConnectionHandler{}
-	// Generate a test AES key for the handler
-	testAESKey := make([]byte, 32) // 256-bit key
-	cmdHandler := NewCommandHandler(mockConn, logger, &tempDir, testAESKey)
-
-	// Get client directory
-	clientDir, err := cmdHandler.getClientDir()
-	if err != nil {
-		t.Fatalf("Failed to get client directory: %v", err)
-	}
+	cmdHandler, mockConn, storage := createMemoryCommandHandler(t)
 
-	// Create test file in client directory
+	// Create test file in the client's storage
 	filename := "test_download.txt"
 	fileContent := []byte("This is test content for download")
-	filePath := filepath.Join(clientDir, filename)
-	if err := os.WriteFile(filePath, fileContent, 0644); err != nil {
+	if err := storage.Put(cmdHandler.storageClient(), filename, fileContent); err != nil {
 		t.Fatalf("Failed to create test file: %v", err)
 	}
 
@@ -235,7 +322,7 @@ func TestHandleDownload(t *testing.T) {
 		Data:     nil,
 	}
 
-	err = cmdHandler.handleDownload(command)
+	err := cmdHandler.handleDownload(command)
 	if err != nil {
 		t.Fatalf("handleDownload failed: %v", err)
 	}
@@ -280,17 +367,7 @@ func TestHandleDownload(t *testing.T) {
 
 func TestHandleDownload_FileNotFound(t *testing.T) {
 	// Setup
-	tempDir := createTestTempDir(t)
-	defer cleanupTestTempDir(t, tempDir)
-
-	logger := createTestLogger(t)
-	defer logger.Sync()
-
-	// Create mock connection handler
-	mockConn := &MockConnectionHandler{}
-	// Generate a test AES key for the handler
-	testAESKey := make([]byte, 32) // 256-bit key
-	cmdHandler := NewCommandHandler(mockConn, logger, &tempDir, testAESKey)
+	cmdHandler, mockConn, _ := createMemoryCommandHandler(t)
 
 	command := &protocol.CommandMessage{
 		Command:  protocol.CommandDownload,
@@ -321,32 +398,15 @@ func TestHandleDownload_FileNotFound(t *testing.T) {
 
 func TestHandleDownload_ChunkedTransfer(t *testing.T) {
 	// Setup
-	tempDir := createTestTempDir(t)
-	defer cleanupTestTempDir(t, tempDir)
-
-	logger := createTestLogger(t)
-	defer logger.Sync()
-
-	// Create mock connection handler
-	mockConn := &MockConnectionHandler{}
-	// Generate a test AES key for the handler
-	testAESKey := make([]byte, 32) // 256-bit key
-	cmdHandler := NewCommandHandler(mockConn, logger, &tempDir, testAESKey)
-
-	// Get client directory
-	clientDir, err := cmdHandler.getClientDir()
-	if err != nil {
-		t.Fatalf("Failed to get client directory: %v", err)
-	}
+	cmdHandler, mockConn, storage := createMemoryCommandHandler(t)
 
-	// Create a large test file in client directory (larger than chunk size)
+	// Create a large test file in the client's storage (larger than chunk size)
 	filename := "large_test_file.txt"
 	fileContent := make([]byte, 200*1024) // 200KB file
 	for i := range fileContent {
 		fileContent[i] = byte(i % 256)
 	}
-	filePath := filepath.Join(clientDir, filename)
-	if err := os.WriteFile(filePath, fileContent, 0644); err != nil {
+	if err := storage.Put(cmdHandler.storageClient(), filename, fileContent); err != nil {
 		t.Fatalf("Failed to create test file: %v", err)
 	}
 
@@ -356,7 +416,7 @@ func TestHandleDownload_ChunkedTransfer(t *testing.T) {
 		Data:     nil,
 	}
 
-	err = cmdHandler.handleDownload(command)
+	err := cmdHandler.handleDownload(command)
 	if err != nil {
 		t.Fatalf("handleDownload failed: %v", err)
 	}
@@ -431,24 +491,14 @@ func TestHandleDownload_ChunkedTransfer(t *testing.T) {
 
 func TestSendFileInChunks_SmallFile(t *testing.T) {
 	// Setup
-	tempDir := createTestTempDir(t)
-	defer cleanupTestTempDir(t, tempDir)
-
-	logger := createTestLogger(t)
-	defer logger.Sync()
+	cmdHandler, mockConn, _ := createMemoryCommandHandler(t)
 
 	// Create a small test file (smaller than chunk size)
 	filename := "small_test_file.txt"
 	fileContent := []byte("This is a small file")
 
-	// Create mock connection handler
-	mockConn := &MockConnectionHandler{}
-	// Generate a test AES key for the handler
-	testAESKey := make([]byte, 32) // 256-bit key
-	cmdHandler := NewCommandHandler(mockConn, logger, &tempDir, testAESKey)
-
 	// Test sendFileInChunks directly
-	err := cmdHandler.sendFileInChunks(filename, fileContent)
+	err := cmdHandler.sendFileInChunks(filename, fileContent, 0, 1, 0)
 	if err != nil {
 		t.Fatalf("sendFileInChunks failed: %v", err)
 	}
@@ -493,44 +543,22 @@ func TestSendFileInChunks_SmallFile(t *testing.T) {
 
 func TestHandleDelete(t *testing.T) {
 	// Setup
-	tempDir := createTestTempDir(t)
-	defer cleanupTestTempDir(t, tempDir)
-
-	logger := createTestLogger(t)
-	defer logger.Sync()
-
-	// Create mock connection handler
-	mockConn := &MockConnectionHandler{}
-	// Generate a test AES key for the handler
-	testAESKey := make([]byte, 32) // 256-bit key
-	cmdHandler := NewCommandHandler(mockConn, logger, &tempDir, testAESKey)
+	cmdHandler, mockConn, storage := createMemoryCommandHandler(t)
 
-	// Get client directory
-	clientDir, err := cmdHandler.getClientDir()
-	if err != nil {
-		t.Fatalf("Failed to get client directory: %v", err)
-	}
-
-	// Create test file in client directory
+	// Create test file in the client's storage
 	filename := "test_delete.txt"
 	fileContent := []byte("This file will be deleted")
-	filePath := filepath.Join(clientDir, filename)
-	if err := os.WriteFile(filePath, fileContent, 0644); err != nil {
+	if err := storage.Put(cmdHandler.storageClient(), filename, fileContent); err != nil {
 		t.Fatalf("Failed to create test file: %v", err)
 	}
 
-	// Verify file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		t.Fatalf("Test file was not created: %s", filePath)
-	}
-
 	command := &protocol.CommandMessage{
 		Command:  protocol.CommandDelete,
 		Filename: filename,
 		Data:     nil,
 	}
 
-	err = cmdHandler.handleDelete(command)
+	err := cmdHandler.handleDelete(command)
 	if err != nil {
 		t.Fatalf("handleDelete failed: %v", err)
 	}
@@ -556,24 +584,14 @@ func TestHandleDelete(t *testing.T) {
 	}
 
 	// Verify file was deleted
-	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
-		t.Errorf("File was not deleted: %s", filePath)
+	if _, err := storage.Get(cmdHandler.storageClient(), filename); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("File was not deleted: %s", filename)
 	}
 }
 
 func TestHandleDelete_FileNotFound(t *testing.T) {
 	// Setup
-	tempDir := createTestTempDir(t)
-	defer cleanupTestTempDir(t, tempDir)
-
-	logger := createTestLogger(t)
-	defer logger.Sync()
-
-	// Create mock connection handler
-	mockConn := &MockConnectionHandler{}
-	// Generate a test AES key for the handler
-	testAESKey := make([]byte, 32) // 256-bit key
-	cmdHandler := NewCommandHandler(mockConn, logger, &tempDir, testAESKey)
+	cmdHandler, mockConn, _ := createMemoryCommandHandler(t)
 
 	command := &protocol.CommandMessage{
 		Command:  protocol.CommandDelete,
@@ -601,3 +619,536 @@ func TestHandleDelete_FileNotFound(t *testing.T) {
 		t.Errorf("Expected success=false for nonexistent file, got %v", respMsg.Success)
 	}
 }
+
+func TestHandleList_Compressed(t *testing.T) {
+	// Setup
+	cmdHandler, mockConn, storage := createMemoryCommandHandler(t)
+
+	// Thousands of similarly named files compress extremely well
+	testFiles := make([]string, 0, 5000)
+	for i := 0; i < 5000; i++ {
+		testFiles = append(testFiles, fmt.Sprintf("daily_report_2024_archive_%05d.csv", i))
+	}
+	storeTestFiles(t, cmdHandler, storage, testFiles)
+
+	command := &protocol.CommandMessage{
+		Command:  protocol.CommandList,
+		Filename: "",
+		Data:     []byte{protocol.ListFlagCompress},
+	}
+
+	if err := cmdHandler.handleList(command); err != nil {
+		t.Fatalf("handleList failed: %v", err)
+	}
+
+	if len(mockConn.sentMessages) != 1 {
+		t.Fatalf("Expected 1 sent message, got %d", len(mockConn.sentMessages))
+	}
+
+	respMsg, err := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload)
+	if err != nil {
+		t.Fatalf("Failed to deserialize response: %v", err)
+	}
+
+	if !respMsg.Success {
+		t.Fatalf("Expected success=true, got %v. Message: %s", respMsg.Success, respMsg.Message)
+	}
+	if respMsg.Message != protocol.EncodingGzip {
+		t.Fatalf("Expected message %q, got %q", protocol.EncodingGzip, respMsg.Message)
+	}
+
+	decompressed, err := protocol.DecompressPayload(respMsg.Data)
+	if err != nil {
+		t.Fatalf("Failed to decompress file list: %v", err)
+	}
+
+	// The compressed listing should be a small fraction of the original
+	if len(respMsg.Data)*10 > len(decompressed) {
+		t.Errorf("Expected compressed list to be much smaller: compressed=%d, original=%d",
+			len(respMsg.Data), len(decompressed))
+	}
+
+	listed := strings.Split(string(decompressed), "\n")
+	if len(listed) != len(testFiles) {
+		t.Fatalf("Expected %d files in list, got %d", len(testFiles), len(listed))
+	}
+	for _, filename := range testFiles {
+		if !strings.Contains(string(decompressed), filename) {
+			t.Errorf("File list does not contain %s", filename)
+			break
+		}
+	}
+}
+
+func TestHandle_UnknownCommand(t *testing.T) {
+	// Setup, with a logger that records warnings
+	cmdHandler, mockConn, _ := createMemoryCommandHandler(t)
+	core, logs := observer.New(zapcore.WarnLevel)
+	cmdHandler.logger = zap.New(core)
+
+	command := &protocol.CommandMessage{
+		Command: protocol.CommandType(0x7e),
+	}
+
+	err := cmdHandler.handle(command)
+	if err == nil || !strings.Contains(err.Error(), "0x7e") {
+		t.Errorf("Expected error naming 0x7e, got %v", err)
+	}
+
+	if len(mockConn.sentMessages) != 1 {
+		t.Fatalf("Expected 1 sent message, got %d", len(mockConn.sentMessages))
+	}
+
+	respMsg, err := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload)
+	if err != nil {
+		t.Fatalf("Failed to deserialize response: %v", err)
+	}
+
+	if respMsg.Success {
+		t.Error("Expected success=false for unknown command")
+	}
+	if respMsg.Message != "Unknown command: 0x7e" {
+		t.Errorf("Expected message to include the command byte, got %q", respMsg.Message)
+	}
+	if !bytes.Equal(respMsg.Data, []byte{0x7e}) {
+		t.Errorf("Expected data to carry the command byte, got %v", respMsg.Data)
+	}
+
+	if logs.FilterMessage("Unknown command received").Len() != 1 {
+		t.Errorf("Expected one warning for the unknown command, got %d", logs.Len())
+	}
+}
+
+func TestHandle_EmptyFilenameKeepsSession(t *testing.T) {
+	// Setup
+	cmdHandler, mockConn, _ := createMemoryCommandHandler(t)
+
+	for _, cmd := range []protocol.CommandType{protocol.CommandUpload, protocol.CommandDownload, protocol.CommandDelete, protocol.CommandTail} {
+		mockConn.ClearSentMessages()
+
+		// A nil error keeps the connection open
+		if err := cmdHandler.handle(&protocol.CommandMessage{Command: cmd, Data: []byte("data")}); err != nil {
+			t.Fatalf("Expected command 0x%02x with empty filename to be refused without error, got %v", byte(cmd), err)
+		}
+
+		if len(mockConn.sentMessages) != 1 {
+			t.Fatalf("Expected 1 sent message, got %d", len(mockConn.sentMessages))
+		}
+		respMsg, err := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload)
+		if err != nil {
+			t.Fatalf("Failed to deserialize response: %v", err)
+		}
+		if respMsg.Success || respMsg.Message != errInvalidFilename {
+			t.Errorf("Expected %q failure for command 0x%02x, got success=%v message=%q",
+				errInvalidFilename, byte(cmd), respMsg.Success, respMsg.Message)
+		}
+	}
+
+	// The same handler keeps serving requests
+	if resp := uploadForTest(t, cmdHandler, mockConn, "after.txt", []byte("still here")); !resp.Success {
+		t.Fatalf("Upload after rejection failed: %s", resp.Message)
+	}
+}
+
+func TestHandleDownload_OpenFileLimit(t *testing.T) {
+	// Setup
+	cmdHandler, mockConn, _ := createMemoryCommandHandler(t)
+	if resp := uploadForTest(t, cmdHandler, mockConn, "busy.txt", []byte("contents")); !resp.Success {
+		t.Fatalf("Upload failed: %s", resp.Message)
+	}
+
+	// One slot, already held by another transfer
+	cmdHandler.openFiles = make(chan struct{}, 1)
+	cmdHandler.openFiles <- struct{}{}
+
+	mockConn.ClearSentMessages()
+	if err := cmdHandler.handle(&protocol.CommandMessage{Command: protocol.CommandDownload, Filename: "busy.txt"}); err != nil {
+		t.Fatalf("Busy download should keep the session, got %v", err)
+	}
+	if len(mockConn.sentMessages) != 1 {
+		t.Fatalf("Expected 1 sent message, got %d", len(mockConn.sentMessages))
+	}
+	respMsg, err := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload)
+	if err != nil {
+		t.Fatalf("Failed to deserialize response: %v", err)
+	}
+	if respMsg.Success || respMsg.Message != errServerBusy {
+		t.Errorf("Expected %q, got success=%v message=%q", errServerBusy, respMsg.Success, respMsg.Message)
+	}
+
+	// Once the slot is free the download goes through and releases it again
+	<-cmdHandler.openFiles
+	mockConn.ClearSentMessages()
+	if err := cmdHandler.handle(&protocol.CommandMessage{Command: protocol.CommandDownload, Filename: "busy.txt"}); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if respMsg, _ := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload); !respMsg.Success {
+		t.Errorf("Expected download to start, got %q", respMsg.Message)
+	}
+	if len(cmdHandler.openFiles) != 0 {
+		t.Errorf("Download did not release its open file slot")
+	}
+}
+
+func TestHandleDownload_Resume(t *testing.T) {
+	// Setup
+	cmdHandler, mockConn, _ := createMemoryCommandHandler(t)
+	content := bytes.Repeat([]byte("resumable download "), 10000)
+	if resp := uploadForTest(t, cmdHandler, mockConn, "resume.txt", content); !resp.Success {
+		t.Fatalf("Upload failed: %s", resp.Message)
+	}
+
+	offset := uint64(len(content) / 3)
+	download := func(data []byte) *protocol.ResponseMessage {
+		mockConn.ClearSentMessages()
+		command := &protocol.CommandMessage{Command: protocol.CommandDownload, Filename: "resume.txt", Data: data}
+		if err := cmdHandler.handle(command); err != nil {
+			t.Fatalf("Download failed: %v", err)
+		}
+		respMsg, err := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload)
+		if err != nil {
+			t.Fatalf("Failed to deserialize response: %v", err)
+		}
+		return respMsg
+	}
+
+	// A matching prefix gets only the remainder; the start response describes the full file
+	respMsg := download(protocol.SerializeDownloadResume(offset, sha256.Sum256(content[:offset])))
+	if !respMsg.Success {
+		t.Fatalf("Expected resume to start, got %q", respMsg.Message)
+	}
+	fileSum := sha256.Sum256(content)
+	if len(respMsg.Data) != 8+sha256.Size || binary.BigEndian.Uint64(respMsg.Data) != uint64(len(content)) || !bytes.Equal(respMsg.Data[8:], fileSum[:]) {
+		t.Errorf("Expected full size %d and checksum in start response, got %x", len(content), respMsg.Data)
+	}
+	var received []byte
+	for _, msg := range mockConn.sentMessages[1:] {
+		chunk, err := protocol.DeserializeChunkData(msg.Payload)
+		if err != nil {
+			t.Fatalf("Failed to deserialize chunk: %v", err)
+		}
+		received = append(received, chunk.Data...)
+	}
+	if !bytes.Equal(received, content[offset:]) {
+		t.Errorf("Resumed download sent %d bytes, want the last %d", len(received), len(content)-int(offset))
+	}
+
+	// A prefix that differs from the stored file is refused
+	respMsg = download(protocol.SerializeDownloadResume(offset, sha256.Sum256([]byte("something else"))))
+	if respMsg.Success || !strings.HasPrefix(respMsg.Message, protocol.ResumeRejectedMessage) {
+		t.Errorf("Expected mismatched prefix to be rejected, got success=%v message=%q", respMsg.Success, respMsg.Message)
+	}
+
+	// So is an offset past the end of the file
+	respMsg = download(protocol.SerializeDownloadResume(uint64(len(content))+1, sha256.Sum256(content)))
+	if respMsg.Success || !strings.HasPrefix(respMsg.Message, protocol.ResumeRejectedMessage) {
+		t.Errorf("Expected offset beyond end to be rejected, got success=%v message=%q", respMsg.Success, respMsg.Message)
+	}
+
+	// Malformed resume data is refused without ending the session
+	respMsg = download([]byte{0x01, 0x02})
+	if respMsg.Success {
+		t.Error("Expected malformed resume data to be refused")
+	}
+}
+
+func TestHandleDownload_CompletionResponse(t *testing.T) {
+	// Setup
+	cmdHandler, mockConn, _ := createMemoryCommandHandler(t)
+	content := bytes.Repeat([]byte("x"), 2*protocol.SmallChunkSize+1)
+	if resp := uploadForTest(t, cmdHandler, mockConn, "marked.bin", content); !resp.Success {
+		t.Fatalf("Upload failed: %s", resp.Message)
+	}
+
+	for _, version := range []uint16{protocol.ProtocolVersionChunkChecksums, protocol.ProtocolVersionDownloadComplete} {
+		cmdHandler.protocolVersion = version
+		mockConn.ClearSentMessages()
+		command := &protocol.CommandMessage{Command: protocol.CommandDownload, Filename: "marked.bin"}
+		if err := cmdHandler.handle(command); err != nil {
+			t.Fatalf("Download failed: %v", err)
+		}
+
+		// Start response and three chunks, then the completion response on newer versions
+		last := mockConn.sentMessages[len(mockConn.sentMessages)-1]
+		if version < protocol.ProtocolVersionDownloadComplete {
+			if len(mockConn.sentMessages) != 4 || last.Type != protocol.MessageTypeData {
+				t.Errorf("Version %d: expected 4 messages ending in a chunk, got %d", version, len(mockConn.sentMessages))
+			}
+			continue
+		}
+		if len(mockConn.sentMessages) != 5 || last.Type != protocol.MessageTypeResponse {
+			t.Fatalf("Version %d: expected 5 messages ending in a response, got %d", version, len(mockConn.sentMessages))
+		}
+		respMsg, err := protocol.DeserializeResponse(last.Payload)
+		if err != nil {
+			t.Fatalf("Failed to deserialize response: %v", err)
+		}
+		sent, err := protocol.DeserializeDownloadComplete(respMsg.Data)
+		if !respMsg.Success || respMsg.Message != protocol.DownloadCompleteMessage || err != nil || sent != 3 {
+			t.Errorf("Expected completion for 3 chunks, got success=%v message=%q sent=%d (%v)", respMsg.Success, respMsg.Message, sent, err)
+		}
+	}
+}
+
+func TestHandleDownload_PreferredChunkSize(t *testing.T) {
+	cmdHandler, mockConn, _ := createMemoryCommandHandler(t)
+	content := bytes.Repeat([]byte("c"), 250000)
+	if resp := uploadForTest(t, cmdHandler, mockConn, "sized.bin", content); !resp.Success {
+		t.Fatalf("Upload failed: %s", resp.Message)
+	}
+
+	tests := []struct {
+		name      string
+		preferred uint32
+		want      []uint32
+	}{
+		{"heuristic", 0, []uint32{protocol.SmallChunkSize, protocol.SmallChunkSize, protocol.SmallChunkSize, 250000 - 3*protocol.SmallChunkSize}},
+		{"requested", 100000, []uint32{100000, 100000, 50000}},
+		{"below minimum", 1000, []uint32{protocol.SmallChunkSize, protocol.SmallChunkSize, protocol.SmallChunkSize, 250000 - 3*protocol.SmallChunkSize}},
+		{"above maximum", protocol.MaxChunkSize + 1, []uint32{250000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockConn.ClearSentMessages()
+			command := &protocol.CommandMessage{
+				Command:  protocol.CommandDownload,
+				Filename: "sized.bin",
+				Data:     protocol.SerializeDownloadRequest(&protocol.DownloadRequest{Streams: 1, ChunkSize: tt.preferred}),
+			}
+			if err := cmdHandler.handle(command); err != nil {
+				t.Fatalf("Download failed: %v", err)
+			}
+
+			var sizes []uint32
+			for _, msg := range mockConn.sentMessages {
+				if msg.Type != protocol.MessageTypeData {
+					continue
+				}
+				chunk, err := protocol.DeserializeChunkDataVersion(msg.Payload, cmdHandler.wireVersion())
+				if err != nil {
+					t.Fatalf("Failed to decode chunk: %v", err)
+				}
+				if chunk.TotalChunks != uint32(len(tt.want)) {
+					t.Errorf("TotalChunks = %d, want %d", chunk.TotalChunks, len(tt.want))
+				}
+				sizes = append(sizes, chunk.ChunkSize)
+			}
+			if !slices.Equal(sizes, tt.want) {
+				t.Errorf("Chunk sizes = %v, want %v", sizes, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleDownload_ProgressLog(t *testing.T) {
+	cmdHandler, mockConn, _ := createMemoryCommandHandler(t)
+	content := bytes.Repeat([]byte("p"), 250000)
+	if resp := uploadForTest(t, cmdHandler, mockConn, "progress.bin", content); !resp.Success {
+		t.Fatalf("Upload failed: %s", resp.Message)
+	}
+	core, logs := observer.New(zapcore.DebugLevel)
+	cmdHandler.logger = zap.New(core)
+
+	command := &protocol.CommandMessage{
+		Command:  protocol.CommandDownload,
+		Filename: "progress.bin",
+		Data:     protocol.SerializeDownloadRequest(&protocol.DownloadRequest{Streams: 1, ChunkSize: 100000}),
+	}
+	if err := cmdHandler.handle(command); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+
+	// Progress counts chunks of the stream, not bytes
+	var progress []float64
+	for _, entry := range logs.FilterMessage("Sent chunk").All() {
+		progress = append(progress, entry.ContextMap()["progress"].(float64))
+	}
+	want := []float64{100.0 / 3, 200.0 / 3, 100}
+	if !slices.EqualFunc(progress, want, func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }) {
+		t.Errorf("Logged progress = %v, want %v", progress, want)
+	}
+}
+
+func TestGetClientDir_SharedHashPrefix(t *testing.T) {
+	// Setup
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	// Brute-force two keys whose hashes share a prefix; a directory name built from a
+	// truncated hash would put both sessions in the same place
+	const prefixLen = 3
+	seen := make(map[string][]byte)
+	var first, second []byte
+	for i := uint64(0); second == nil; i++ {
+		key := binary.BigEndian.AppendUint64(make([]byte, 24), i)
+		hash := sha256.Sum256(key)
+		prefix := string(hash[:prefixLen])
+		if other, ok := seen[prefix]; ok {
+			first, second = other, key
+		}
+		seen[prefix] = key
+	}
+
+	dirFor := func(key []byte) string {
+		handler := NewCommandHandler(&MockConnectionHandler{}, createTestLogger(t), &tempDir, key)
+		dir, err := handler.getClientDir()
+		if err != nil {
+			t.Fatalf("Failed to get client directory: %v", err)
+		}
+		return dir
+	}
+	firstDir, secondDir := dirFor(first), dirFor(second)
+	if firstDir == secondDir {
+		t.Fatalf("Keys with a shared hash prefix got the same directory %s", firstDir)
+	}
+	if name := filepath.Base(firstDir); len(name) != 2*sha256.Size {
+		t.Errorf("Expected the full hash as directory name, got %q", name)
+	}
+}
+
+func TestHandle_FieldLayoutRefused(t *testing.T) {
+	// Setup
+	cmdHandler, mockConn, storage := createMemoryCommandHandler(t)
+
+	payload, err := protocol.SerializeCommandFields(protocol.CommandUpload, []byte("fields.txt"), []byte("meta"), []byte("data"))
+	if err != nil {
+		t.Fatalf("SerializeCommandFields failed: %v", err)
+	}
+	command, err := protocol.DeserializeCommand(payload)
+	if err != nil {
+		t.Fatalf("DeserializeCommand failed: %v", err)
+	}
+
+	if err := cmdHandler.handle(command); err != nil {
+		t.Fatalf("Expected refusal without closing the session, got %v", err)
+	}
+	respMsg, err := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload)
+	if err != nil {
+		t.Fatalf("Failed to deserialize response: %v", err)
+	}
+	if respMsg.Success || !strings.Contains(respMsg.Message, "field layout") {
+		t.Errorf("Expected a field layout refusal, got success=%v message=%q", respMsg.Success, respMsg.Message)
+	}
+
+	// Nothing was written from the misread payload
+	if _, err := storage.Stat(cmdHandler.storageClient(), "fields.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Refused command should not create a file, stat error: %v", err)
+	}
+}
+
+func TestSendFileInChunks_ChecksumsFollowNegotiatedVersion(t *testing.T) {
+	data := []byte("checksummed content")
+	for _, version := range []uint16{0, protocol.ProtocolVersionBase, protocol.ProtocolVersionChunkChecksums} {
+		cmdHandler, mockConn, _ := createMemoryCommandHandler(t)
+		cmdHandler.protocolVersion = version
+
+		if err := cmdHandler.sendFileInChunks("file.txt", data, 0, 1, 0); err != nil {
+			t.Fatalf("sendFileInChunks failed: %v", err)
+		}
+		payload := mockConn.sentMessages[0].Payload
+
+		if version < protocol.ProtocolVersionChunkChecksums {
+			// Clients that did not negotiate checksums get the original layout
+			chunk, err := protocol.DeserializeChunkData(payload)
+			if err != nil || !bytes.Equal(chunk.Data, data) {
+				t.Errorf("Version %d: base chunk decoded as %q (%v)", version, chunk.Data, err)
+			}
+			continue
+		}
+
+		chunk, err := protocol.DeserializeChunkDataVersion(payload, version)
+		if err != nil {
+			t.Fatalf("Version %d: failed to decode chunk: %v", version, err)
+		}
+		if !bytes.Equal(chunk.Data, data) || chunk.VerifyChecksum() != nil {
+			t.Errorf("Version %d: chunk data %q failed checksum verification", version, chunk.Data)
+		}
+	}
+}
+
+func TestHandle_ErrorCodesFollowNegotiatedVersion(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+	if resp := uploadForTest(t, cmdHandler, mockConn, "file.txt", []byte("data")); !resp.Success {
+		t.Fatalf("Upload failed: %s", resp.Message)
+	}
+
+	failures := []struct {
+		command *protocol.CommandMessage
+		code    protocol.ErrorCode
+	}{
+		{&protocol.CommandMessage{Command: protocol.CommandStat, Filename: "missing.txt"}, protocol.ErrCodeNotFound},
+		{&protocol.CommandMessage{Command: protocol.CommandStat, Filename: "../escape.txt"}, protocol.ErrCodeInvalidPath},
+		{&protocol.CommandMessage{Command: protocol.CommandList, Filename: "nodir"}, protocol.ErrCodeNotFound},
+		{&protocol.CommandMessage{Command: protocol.CommandMkdir, Filename: "file.txt"}, protocol.ErrCodeExists},
+		{&protocol.CommandMessage{Command: protocol.CommandCommitTx}, protocol.ErrCodeInvalidRequest},
+	}
+	for _, version := range []uint16{protocol.ProtocolVersionChunkSize, protocol.ProtocolVersionErrorCodes} {
+		cmdHandler.protocolVersion = version
+		for _, failure := range failures {
+			resp := handleForTest(t, cmdHandler, mockConn, failure.command)
+			if resp.Success {
+				t.Fatalf("Command 0x%02x %q unexpectedly succeeded", byte(failure.command.Command), failure.command.Filename)
+			}
+			// Older clients would misread the code as data, so they never get one
+			want := failure.code
+			if version < protocol.ProtocolVersionErrorCodes {
+				want = protocol.ErrCodeNone
+			}
+			if resp.ErrorCode != want {
+				t.Errorf("Version %d: command 0x%02x %q failed with code %v, want %v",
+					version, byte(failure.command.Command), failure.command.Filename, resp.ErrorCode, want)
+			}
+		}
+	}
+}
+
+func TestCreatedFileModes(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   *ServerConfig
+		fileMode os.FileMode
+		dirMode  os.FileMode
+	}{
+		{"defaults", &ServerConfig{}, 0644, 0755},
+		{"configured", &ServerConfig{FileMode: 0600, DirMode: 0700}, 0600, 0700},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Modes are only trimmed by the umask, so clear it for exact comparisons
+			defer syscall.Umask(syscall.Umask(0))
+
+			tempDir := createTestTempDir(t)
+			defer cleanupTestTempDir(t, tempDir)
+			cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+			cmdHandler.config = tt.config
+			clientDir, _ := cmdHandler.getClientDir()
+
+			if resp := handleForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandMkdir, Filename: "sub"}); !resp.Success {
+				t.Fatalf("Mkdir failed: %s", resp.Message)
+			}
+			if resp := uploadForTest(t, cmdHandler, mockConn, "sub/whole.txt", []byte("whole")); !resp.Success {
+				t.Fatalf("Upload failed: %s", resp.Message)
+			}
+			beginUploadForTest(t, cmdHandler, mockConn, "chunked.txt", 7)
+			sendChunkForTest(t, cmdHandler, 0, 1, []byte("chunked"))
+
+			for path, want := range map[string]os.FileMode{
+				clientDir:                       tt.dirMode | os.ModeDir,
+				filepath.Join(clientDir, "sub"): tt.dirMode | os.ModeDir,
+				filepath.Join(clientDir, "sub", "whole.txt"): tt.fileMode,
+				filepath.Join(clientDir, "chunked.txt"):      tt.fileMode,
+			} {
+				info, err := os.Stat(path)
+				if err != nil {
+					t.Fatalf("Stat failed: %v", err)
+				}
+				if info.Mode() != want {
+					t.Errorf("%s has mode %v, want %v", filepath.Base(path), info.Mode(), want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Defaults of the settings the server command needs before any layer sets them
+const (
+	DefaultHost         = "localhost"
+	DefaultPort         = "8080"
+	DefaultConfigFolder = "configs/server"
+	DefaultLogLevel     = "info"
+)
+
+// DefaultServerConfig returns the configuration used when no file, environment
+// variable or flag sets a value
+func DefaultServerConfig() *ServerConfig {
+	rootDir := defaultRootDir
+	return &ServerConfig{
+		Host:         DefaultHost,
+		Port:         DefaultPort,
+		ConfigFolder: DefaultConfigFolder,
+		RootDir:      &rootDir,
+		LogLevel:     DefaultLogLevel,
+	}
+}
+
+// configSettings are the ServerConfig fields that can be set by name, from a
+// configuration file (LoadServerConfig), the environment (ApplyEnv) or Set. Each
+// parses the value as written, e.g. "30s" for durations and "0600" for modes.
+var configSettings = map[string]func(config *ServerConfig, value string) error{
+	"host":          func(c *ServerConfig, v string) error { c.Host = v; return nil },
+	"port":          func(c *ServerConfig, v string) error { c.Port = v; return nil },
+	"config_folder": func(c *ServerConfig, v string) error { c.ConfigFolder = v; return nil },
+	"root_dir":      func(c *ServerConfig, v string) error { c.RootDir = &v; return nil },
+	"log_level":     func(c *ServerConfig, v string) error { c.LogLevel = v; return nil },
+
+	"max_upload_size":     intSetting(func(c *ServerConfig) *int64 { return &c.MaxUploadSize }),
+	"max_client_bytes":    intSetting(func(c *ServerConfig) *int64 { return &c.MaxClientBytes }),
+	"max_open_files":      intSetting(func(c *ServerConfig) *int { return &c.MaxOpenFiles }),
+	"max_connections":     intSetting(func(c *ServerConfig) *int { return &c.MaxConnections }),
+	"min_cipher_strength": intSetting(func(c *ServerConfig) *int { return &c.MinCipherStrength }),
+
+	"idle_timeout":            durationSetting(func(c *ServerConfig) *time.Duration { return &c.IdleTimeout }),
+	"handshake_timeout":       durationSetting(func(c *ServerConfig) *time.Duration { return &c.HandshakeTimeout }),
+	"max_session_duration":    durationSetting(func(c *ServerConfig) *time.Duration { return &c.MaxSessionDuration }),
+	"chunk_pacing":            durationSetting(func(c *ServerConfig) *time.Duration { return &c.ChunkPacing }),
+	"session_ticket_lifetime": durationSetting(func(c *ServerConfig) *time.Duration { return &c.SessionTicketLifetime }),
+
+	"mirror_strict":     boolSetting(func(c *ServerConfig) *bool { return &c.MirrorStrict }),
+	"normalize_unicode": boolSetting(func(c *ServerConfig) *bool { return &c.NormalizeUnicode }),
+
+	"file_mode": modeSetting(func(c *ServerConfig) *os.FileMode { return &c.FileMode }),
+	"dir_mode":  modeSetting(func(c *ServerConfig) *os.FileMode { return &c.DirMode }),
+
+	"mirror_dir":     func(c *ServerConfig, v string) error { c.MirrorDir = v; return nil },
+	"trash_dir":      func(c *ServerConfig, v string) error { c.TrashDir = v; return nil },
+	"metrics_addr":   func(c *ServerConfig, v string) error { c.MetricsAddr = v; return nil },
+	"audit_log_path": func(c *ServerConfig, v string) error { c.AuditLogPath = v; return nil },
+
+	"allowed_extensions": func(c *ServerConfig, v string) error { c.AllowedExtensions = listSetting(v); return nil },
+	"denied_patterns":    func(c *ServerConfig, v string) error { c.DeniedPatterns = listSetting(v); return nil },
+
+	"on_collision": func(c *ServerConfig, v string) error {
+		for _, policy := range []CollisionPolicy{CollisionOverwrite, CollisionReject, CollisionVersion} {
+			if v == policy.String() {
+				c.OnCollision = policy
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown collision policy %q, want overwrite, reject or version", v)
+	},
+}
+
+// LoadServerConfig reads a configuration file over DefaultServerConfig. The file is a
+// YAML or JSON mapping of setting names to values, e.g.
+//
+//	port: 9000
+//	root_dir: /var/lib/ssnproj
+//	idle_timeout: 5m
+//	denied_patterns: [".*", "*.exe"]
+//
+// Settings the file leaves out keep their defaults; unknown names are an error so
+// typos do not go unnoticed. An empty path returns the defaults. Callers layer the
+// environment (ApplyEnv) and explicit flags (Set) on top, in that order.
+func LoadServerConfig(path string) (*ServerConfig, error) {
+	config := DefaultServerConfig()
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	if len(document.Content) == 0 {
+		return config, nil
+	}
+	mapping := document.Content[0]
+	if mapping.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("config file %s must hold a mapping of settings", path)
+	}
+
+	// Values are taken as written, so "0600" stays octal and "30s" a duration
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		name, node := mapping.Content[i].Value, mapping.Content[i+1]
+		var value string
+		switch node.Kind {
+		case yaml.ScalarNode:
+			value = node.Value
+		case yaml.SequenceNode:
+			items := make([]string, 0, len(node.Content))
+			for _, item := range node.Content {
+				if item.Kind != yaml.ScalarNode {
+					return nil, fmt.Errorf("config file %s: %s must be a list of strings", path, name)
+				}
+				items = append(items, item.Value)
+			}
+			value = strings.Join(items, ",")
+		default:
+			return nil, fmt.Errorf("config file %s: %s must be a value or a list", path, name)
+		}
+		if err := config.Set(name, value); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+	return config, nil
+}
+
+// Set changes the setting called name, as written in a configuration file. Dashes
+// may stand in for underscores, so flag names such as "root-dir" work too. Lists are
+// comma-separated.
+func (config *ServerConfig) Set(name string, value string) error {
+	key := strings.ReplaceAll(strings.ToLower(name), "-", "_")
+	apply, ok := configSettings[key]
+	if !ok {
+		return fmt.Errorf("unknown setting %q", name)
+	}
+	if err := apply(config, strings.TrimSpace(value)); err != nil {
+		return fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return nil
+}
+
+// ApplyEnv sets every setting whose environment variable lookup finds: the setting's
+// name in upper case with a SERVER_ prefix, e.g. SERVER_ROOT_DIR or SERVER_IDLE_TIMEOUT.
+// Empty variables are ignored. Pass os.LookupEnv.
+func (config *ServerConfig) ApplyEnv(lookup func(key string) (string, bool)) error {
+	names := make([]string, 0, len(configSettings))
+	for name := range configSettings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		key := "SERVER_" + strings.ToUpper(name)
+		if value, ok := lookup(key); ok && value != "" {
+			if err := config.Set(name, value); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// intSetting parses a decimal integer into the field field returns
+func intSetting[T int | int64](field func(*ServerConfig) *T) func(*ServerConfig, string) error {
+	return func(c *ServerConfig, v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return err
+		}
+		*field(c) = T(n)
+		return nil
+	}
+}
+
+// durationSetting parses a duration such as "90s" or "5m"
+func durationSetting(field func(*ServerConfig) *time.Duration) func(*ServerConfig, string) error {
+	return func(c *ServerConfig, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+// boolSetting parses true/false, 1/0 and the other forms strconv.ParseBool accepts
+func boolSetting(field func(*ServerConfig) *bool) func(*ServerConfig, string) error {
+	return func(c *ServerConfig, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+// modeSetting parses permission bits written in octal, e.g. "0600" or "600"
+func modeSetting(field func(*ServerConfig) *os.FileMode) func(*ServerConfig, string) error {
+	return func(c *ServerConfig, v string) error {
+		mode, err := strconv.ParseUint(strings.TrimPrefix(v, "0o"), 8, 32)
+		if err != nil || mode > 0777 {
+			return fmt.Errorf("%q is not an octal permission mode", v)
+		}
+		*field(c) = os.FileMode(mode)
+		return nil
+	}
+}
+
+// listSetting splits a comma-separated list, dropping empty items
+func listSetting(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
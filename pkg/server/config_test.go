@@ -0,0 +1,142 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes content to a config file named name in a temporary directory
+func writeConfigFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+// envLookup stands in for os.LookupEnv
+func envLookup(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+func TestLoadServerConfig_Defaults(t *testing.T) {
+	config, err := LoadServerConfig("")
+	if err != nil {
+		t.Fatalf("LoadServerConfig failed: %v", err)
+	}
+	if config.Host != DefaultHost || config.Port != DefaultPort || config.ConfigFolder != DefaultConfigFolder ||
+		*config.RootDir != defaultRootDir || config.LogLevel != DefaultLogLevel {
+		t.Errorf("Unexpected defaults: %+v", config)
+	}
+}
+
+func TestLoadServerConfig_File(t *testing.T) {
+	path := writeConfigFile(t, "server.yaml", `
+port: 9000
+root_dir: /srv/files
+log_level: debug
+max_upload_size: 1048576
+idle_timeout: 5m
+denied_patterns: [".*", "*.exe"]
+allowed_extensions: txt, csv
+file_mode: 0600
+on_collision: version
+normalize_unicode: true
+`)
+	config, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("LoadServerConfig failed: %v", err)
+	}
+
+	if config.Port != "9000" || *config.RootDir != "/srv/files" || config.LogLevel != "debug" {
+		t.Errorf("Unexpected basic settings: port=%s root=%s level=%s", config.Port, *config.RootDir, config.LogLevel)
+	}
+	if config.MaxUploadSize != 1048576 || config.IdleTimeout != 5*time.Minute || config.FileMode != 0600 {
+		t.Errorf("Unexpected limits: size=%d idle=%v mode=%o", config.MaxUploadSize, config.IdleTimeout, config.FileMode)
+	}
+	if strings.Join(config.DeniedPatterns, " ") != ".* *.exe" || strings.Join(config.AllowedExtensions, " ") != "txt csv" {
+		t.Errorf("Unexpected lists: denied=%q allowed=%q", config.DeniedPatterns, config.AllowedExtensions)
+	}
+	if config.OnCollision != CollisionVersion || !config.NormalizeUnicode {
+		t.Errorf("Unexpected policy settings: %v %v", config.OnCollision, config.NormalizeUnicode)
+	}
+	// Settings the file leaves out keep their defaults
+	if config.Host != DefaultHost {
+		t.Errorf("Host = %q, want the default", config.Host)
+	}
+
+	// JSON is read the same way
+	path = writeConfigFile(t, "server.json", `{"port": "9100", "max_connections": 50, "chunk_pacing": "10ms"}`)
+	config, err = LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("LoadServerConfig failed for JSON: %v", err)
+	}
+	if config.Port != "9100" || config.MaxConnections != 50 || config.ChunkPacing != 10*time.Millisecond {
+		t.Errorf("Unexpected JSON settings: %+v", config)
+	}
+}
+
+func TestLoadServerConfig_Precedence(t *testing.T) {
+	path := writeConfigFile(t, "server.yaml", "host: file-host\nport: 9000\nroot_dir: /from/file\nidle_timeout: 1m\n")
+	config, err := LoadServerConfig(path)
+	if err != nil {
+		t.Fatalf("LoadServerConfig failed: %v", err)
+	}
+
+	// The environment overrides the file
+	env := map[string]string{"SERVER_PORT": "9001", "SERVER_ROOT_DIR": "/from/env", "SERVER_IDLE_TIMEOUT": ""}
+	if err := config.ApplyEnv(envLookup(env)); err != nil {
+		t.Fatalf("ApplyEnv failed: %v", err)
+	}
+	// Flags override the environment
+	if err := config.Set("root-dir", "/from/flag"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	if config.Host != "file-host" {
+		t.Errorf("Host = %q, want the file's value", config.Host)
+	}
+	if config.Port != "9001" {
+		t.Errorf("Port = %q, want the environment's value", config.Port)
+	}
+	if *config.RootDir != "/from/flag" {
+		t.Errorf("RootDir = %q, want the flag's value", *config.RootDir)
+	}
+	if config.IdleTimeout != time.Minute {
+		t.Errorf("IdleTimeout = %v; an empty variable should not override the file", config.IdleTimeout)
+	}
+	if config.LogLevel != DefaultLogLevel {
+		t.Errorf("LogLevel = %q, want the default", config.LogLevel)
+	}
+}
+
+func TestLoadServerConfig_Invalid(t *testing.T) {
+	for _, content := range []string{
+		"prot: 9000",             // unknown setting
+		"idle_timeout: soon",     // not a duration
+		"file_mode: 0999",        // not octal
+		"on_collision: merge",    // unknown policy
+		"mirror_strict: perhaps", // not a boolean
+		"- port",                 // not a mapping
+		"port: [9000, {a: b}]",   // nested value
+	} {
+		if _, err := LoadServerConfig(writeConfigFile(t, "server.yaml", content)); err == nil {
+			t.Errorf("Expected %q to be refused", content)
+		}
+	}
+
+	if _, err := LoadServerConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("Expected a missing file to be an error")
+	}
+	config := DefaultServerConfig()
+	if err := config.ApplyEnv(envLookup(map[string]string{"SERVER_MAX_UPLOAD_SIZE": "lots"})); err == nil || !strings.Contains(err.Error(), "SERVER_MAX_UPLOAD_SIZE") {
+		t.Errorf("Expected the bad variable to be named, got %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// sniffLen is how much of a file http.DetectContentType looks at
+const sniffLen = 512
+
+// defaultContentType is reported for empty files and for files whose type is unknown
+const defaultContentType = "application/octet-stream"
+
+// addContentTypes sets the ContentType of the file entries in files, whose names are
+// relative to dir, for peers that expect it. Only the first sniffLen bytes of each file
+// are read, so a listing never reads files whole.
+func (handler *CommandHandler) addContentTypes(dir string, files []protocol.FileInfo) {
+	if handler.wireVersion() < protocol.ProtocolVersionContentType {
+		return
+	}
+	for i := range files {
+		if !files[i].IsDir {
+			files[i].ContentType = handler.contentType(path.Join(dir, files[i].Name), files[i].Size)
+		}
+	}
+}
+
+// contentType sniffs the type of the stored file name of size bytes. Files encrypted at
+// rest cannot be read in part, so they are typed by their extension.
+func (handler *CommandHandler) contentType(name string, size int64) string {
+	if size == 0 {
+		return defaultContentType
+	}
+	if handler.encryptsAtRest() {
+		if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+			return contentType
+		}
+		return defaultContentType
+	}
+
+	head, err := handler.readHead(name)
+	if err != nil {
+		handler.logger.Warn("Failed to sniff content type", zap.String("filename", name), zap.Error(err))
+		return defaultContentType
+	}
+	return http.DetectContentType(head)
+}
+
+// readHead returns up to sniffLen bytes from the start of the stored file name. Other
+// backends have no partial reads, so the file is fetched and cut down.
+func (handler *CommandHandler) readHead(name string) ([]byte, error) {
+	storage, ok := handler.storage().(*FilesystemStorage)
+	if !ok {
+		data, err := handler.storage().Get(handler.storageClient(), name)
+		if err != nil {
+			return nil, err
+		}
+		return data[:min(len(data), sniffLen)], nil
+	}
+
+	filePath, err := storage.path(handler.storageClient(), name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// handleCopy duplicates a file within the client directory. The command uses the field
+// layout: the source, the destination and optionally a flags byte. An existing
+// destination is handled by the collision policy unless protocol.CopyFlagNoClobber
+// refuses it. The copy counts against the quota like an upload of the same size.
+func (handler *CommandHandler) handleCopy(command *protocol.CommandMessage) error {
+	if len(command.Fields) != 2 && len(command.Fields) != 3 {
+		return handler.sendFailure(protocol.ErrCodeInvalidRequest, "Copy requires a source and a destination")
+	}
+	source, destination := string(command.Fields[0]), string(command.Fields[1])
+	var flags byte
+	if len(command.Fields) == 3 {
+		if len(command.Fields[2]) != 1 || command.Fields[2][0]&^protocol.CopyFlagNoClobber != 0 {
+			return handler.sendFailure(protocol.ErrCodeInvalidRequest, "Invalid copy flags")
+		}
+		flags = command.Fields[2][0]
+	}
+	handler.logger.Info("Copy command received", zap.String("from", source), zap.String("to", destination))
+
+	if handler.tx != nil {
+		return handler.sendFailure(protocol.ErrCodeInvalidRequest, "Copy is not allowed inside a transaction")
+	}
+
+	sourcePath, err := handler.validatePath(source)
+	if err != nil {
+		handler.logger.Warn(errPathValidationFailed, zap.String("filename", source), zap.Error(err))
+		return handler.sendFailure(protocol.ErrCodeInvalidPath, errInvalidFilename)
+	}
+	destinationPath, err := handler.validatePath(destination)
+	if err != nil {
+		handler.logger.Warn(errPathValidationFailed, zap.String("filename", destination), zap.Error(err))
+		return handler.sendFailure(protocol.ErrCodeInvalidPath, "Invalid destination filename")
+	}
+	if err := handler.validateFilename(handler.clientRelativeName(destinationPath)); err != nil {
+		return handler.refuseFilename(destination, err)
+	}
+
+	info, err := os.Stat(sourcePath)
+	if os.IsNotExist(err) {
+		return handler.sendFailure(protocol.ErrCodeNotFound, protocol.FileNotFoundMessage)
+	}
+	if err != nil || info.IsDir() {
+		return handler.sendFailure(protocol.ErrCodeInvalidPath, "Source is not a file")
+	}
+	if refusal := handler.checkRegularFile(sourcePath); refusal != "" {
+		return handler.sendFailure(protocol.ErrCodeInvalidPath, refusal)
+	}
+	if sourcePath == destinationPath {
+		return handler.sendFailure(protocol.ErrCodeInvalidRequest, "Source and destination are the same file")
+	}
+
+	if refusal := handler.checkParentDir(destinationPath); refusal != "" {
+		return handler.sendFailure(protocol.ErrCodeNotFound, refusal)
+	}
+	if refusal := handler.checkRegularFile(destinationPath); refusal != "" {
+		return handler.sendFailure(protocol.ErrCodeInvalidPath, refusal)
+	}
+	if code, refusal := handler.checkQuota(destination, uint64(info.Size())); refusal != "" {
+		return handler.sendFailure(code, refusal)
+	}
+
+	destinationPath, err = handler.resolveCollision(destinationPath)
+	if err != nil {
+		return handler.sendFailure(collisionErrorCode(err), err.Error())
+	}
+	reserved := false
+	if flags&protocol.CopyFlagNoClobber != 0 {
+		if err := reserveTarget(destinationPath, handler.settings().fileMode()); err != nil {
+			if os.IsExist(err) {
+				return handler.sendFailure(protocol.ErrCodeExists, errFileExists.Error())
+			}
+			handler.sendFailure(protocol.ErrCodeIO, "Failed to copy file")
+			return err
+		}
+		reserved = true
+	}
+
+	unlock := handler.lockFiles(false, sourcePath, destinationPath)
+	copied, err := handler.copyFile(sourcePath, destinationPath)
+	unlock()
+	if err != nil {
+		if reserved {
+			os.Remove(destinationPath)
+		}
+		handler.logger.Error("Failed to copy file", zap.String("from", source), zap.String("to", destination), zap.Error(err))
+		return handler.sendFailure(protocol.ErrCodeIO, "Failed to copy file")
+	}
+	handler.auditBytes(uint64(copied))
+
+	if err := handler.mirrorFile(destinationPath); err != nil {
+		return handler.sendFailure(protocol.ErrCodeIO, errMirrorFailed)
+	}
+
+	responsePayload, err := protocol.SerializeResponse(true, "File copied successfully", []byte(handler.clientRelativeName(destinationPath)))
+	if err != nil {
+		return err
+	}
+	response := protocol.NewMessage(protocol.MessageTypeResponse, responsePayload)
+	return handler.conn.SendSecureMessage(response)
+}
+
+// copyFile streams sourcePath into a temporary file beside destinationPath and moves it
+// into place, so readers never see a partial copy. The bytes are copied as stored: a
+// file encrypted at rest keeps its ciphertext, which the same key decrypts.
+func (handler *CommandHandler) copyFile(sourcePath, destinationPath string) (int64, error) {
+	src, err := os.Open(sourcePath)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	dst, err := os.CreateTemp(filepath.Dir(destinationPath), uploadTempPrefix+"*")
+	if err != nil {
+		return 0, err
+	}
+	copied, err := io.Copy(dst, src)
+	if err == nil {
+		err = dst.Chmod(handler.settings().fileMode())
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(dst.Name(), destinationPath)
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return 0, err
+	}
+	return copied, nil
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+)
+
+// copyForTest sends a copy through handle and returns the response
+func copyForTest(t *testing.T, cmdHandler *CommandHandler, mockConn *MockConnectionHandler, from string, to string, noClobber bool) *protocol.ResponseMessage {
+	t.Helper()
+	mockConn.ClearSentMessages()
+
+	fields := [][]byte{[]byte(from), []byte(to)}
+	if noClobber {
+		fields = append(fields, []byte{protocol.CopyFlagNoClobber})
+	}
+	payload, err := protocol.SerializeCommandFields(protocol.CommandCopy, fields...)
+	if err != nil {
+		t.Fatalf("SerializeCommandFields failed: %v", err)
+	}
+	command, err := protocol.DeserializeCommand(payload)
+	if err != nil {
+		t.Fatalf("DeserializeCommand failed: %v", err)
+	}
+	if err := cmdHandler.handle(command); err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+
+	respMsg, err := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload)
+	if err != nil {
+		t.Fatalf("Failed to deserialize response: %v", err)
+	}
+	return respMsg
+}
+
+func TestHandleCopy(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      CollisionPolicy
+		quota       int64
+		existing    map[string]string
+		from        string
+		to          string
+		noClobber   bool
+		wantSuccess bool
+		wantMessage string
+		wantStored  string
+		wantFiles   map[string]string
+	}{
+		{
+			name:        "simple copy",
+			existing:    map[string]string{"a.txt": "A"},
+			from:        "a.txt",
+			to:          "b.txt",
+			wantSuccess: true,
+			wantStored:  "b.txt",
+			wantFiles:   map[string]string{"a.txt": "A", "b.txt": "A"},
+		},
+		{
+			name:        "overwrite existing destination",
+			existing:    map[string]string{"a.txt": "A", "b.txt": "B"},
+			from:        "a.txt",
+			to:          "b.txt",
+			wantSuccess: true,
+			wantStored:  "b.txt",
+			wantFiles:   map[string]string{"a.txt": "A", "b.txt": "A"},
+		},
+		{
+			name:        "no-clobber keeps existing destination",
+			existing:    map[string]string{"a.txt": "A", "b.txt": "B"},
+			from:        "a.txt",
+			to:          "b.txt",
+			noClobber:   true,
+			wantMessage: errFileExists.Error(),
+			wantFiles:   map[string]string{"a.txt": "A", "b.txt": "B"},
+		},
+		{
+			name:        "no-clobber to a new name",
+			existing:    map[string]string{"a.txt": "A"},
+			from:        "a.txt",
+			to:          "b.txt",
+			noClobber:   true,
+			wantSuccess: true,
+			wantStored:  "b.txt",
+			wantFiles:   map[string]string{"a.txt": "A", "b.txt": "A"},
+		},
+		{
+			name:        "version existing destination",
+			policy:      CollisionVersion,
+			existing:    map[string]string{"a.txt": "A", "b.txt": "B"},
+			from:        "a.txt",
+			to:          "b.txt",
+			wantSuccess: true,
+			wantStored:  "b (1).txt",
+			wantFiles:   map[string]string{"a.txt": "A", "b.txt": "B", "b (1).txt": "A"},
+		},
+		{
+			name:        "copy onto itself",
+			existing:    map[string]string{"a.txt": "A"},
+			from:        "a.txt",
+			to:          "a.txt",
+			wantMessage: "Source and destination are the same file",
+			wantFiles:   map[string]string{"a.txt": "A"},
+		},
+		{
+			name:        "source is a directory",
+			existing:    map[string]string{"dir/a.txt": "A"},
+			from:        "dir",
+			to:          "copy",
+			wantMessage: "Source is not a file",
+			wantFiles:   map[string]string{"dir/a.txt": "A"},
+		},
+		{
+			name:        "missing source",
+			from:        "missing.txt",
+			to:          "b.txt",
+			wantMessage: "File not found",
+			wantFiles:   map[string]string{},
+		},
+		{
+			name:        "destination escapes client directory",
+			existing:    map[string]string{"a.txt": "A"},
+			from:        "a.txt",
+			to:          "../escaped.txt",
+			wantMessage: "Invalid destination filename",
+			wantFiles:   map[string]string{"a.txt": "A"},
+		},
+		{
+			name:        "copy would exceed quota",
+			quota:       5,
+			existing:    map[string]string{"a.txt": "AAA"},
+			from:        "a.txt",
+			to:          "b.txt",
+			wantMessage: "Quota exceeded",
+			wantFiles:   map[string]string{"a.txt": "AAA"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := createTestTempDir(t)
+			defer cleanupTestTempDir(t, tempDir)
+
+			cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+			cmdHandler.config = &ServerConfig{RootDir: &tempDir, OnCollision: tt.policy, MaxClientBytes: tt.quota}
+			clientDir, _ := cmdHandler.getClientDir()
+			for name, content := range tt.existing {
+				os.MkdirAll(filepath.Dir(filepath.Join(clientDir, name)), 0755)
+				if resp := uploadForTest(t, cmdHandler, mockConn, name, []byte(content)); !resp.Success {
+					t.Fatalf("Upload of %s failed: %s", name, resp.Message)
+				}
+			}
+
+			resp := copyForTest(t, cmdHandler, mockConn, tt.from, tt.to, tt.noClobber)
+			if resp.Success != tt.wantSuccess {
+				t.Fatalf("Success = %v (%q), want %v", resp.Success, resp.Message, tt.wantSuccess)
+			}
+			if tt.wantMessage != "" && !strings.HasPrefix(resp.Message, tt.wantMessage) {
+				t.Errorf("Message = %q, want %q", resp.Message, tt.wantMessage)
+			}
+			if tt.wantSuccess && string(resp.Data) != tt.wantStored {
+				t.Errorf("Stored name = %q, want %q", resp.Data, tt.wantStored)
+			}
+
+			files, _ := listEntries(clientDir, true, nil)
+			var count int
+			for _, file := range files {
+				if !file.IsDir {
+					count++
+				}
+			}
+			if count != len(tt.wantFiles) {
+				t.Errorf("Client directory has %d files, want %d", count, len(tt.wantFiles))
+			}
+			for name, want := range tt.wantFiles {
+				got, err := os.ReadFile(filepath.Join(clientDir, name))
+				if err != nil || string(got) != want {
+					t.Errorf("%s = %q (%v), want %q", name, got, err, want)
+				}
+			}
+			if matches, _ := filepath.Glob(filepath.Join(clientDir, uploadTempPrefix+"*")); len(matches) > 0 {
+				t.Errorf("Temporary files left behind: %v", matches)
+			}
+			if _, err := os.Stat(filepath.Join(tempDir, "escaped.txt")); !os.IsNotExist(err) {
+				t.Errorf("Copy escaped the client directory")
+			}
+		})
+	}
+}
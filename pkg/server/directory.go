@@ -0,0 +1,192 @@
+package server
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+const errDirectoryNotFound = "Directory not found"
+
+const errNotRegularFile = "Not a regular file"
+
+// handleMkdir creates a directory, including any missing parents. Creating a
+// directory that already exists succeeds, like mkdir -p.
+func (handler *CommandHandler) handleMkdir(command *protocol.CommandMessage) error {
+	handler.logger.Info("Mkdir command received", zap.String("path", command.Filename))
+
+	dirPath, err := handler.validatePath(command.Filename)
+	if err != nil {
+		handler.logger.Warn(errPathValidationFailed, zap.String("filename", command.Filename), zap.Error(err))
+		return handler.sendFailure(protocol.ErrCodeInvalidPath, errInvalidFilename)
+	}
+	clientDir, err := handler.getClientDir()
+	if err != nil {
+		handler.sendFailure(protocol.ErrCodeIO, "Failed to get client directory")
+		return err
+	}
+	// Temporary upload names are reserved so unfinished uploads stay recognisable
+	rel, _ := filepath.Rel(clientDir, dirPath)
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if isUploadTemp(part) {
+			return handler.sendFailure(protocol.ErrCodeInvalidPath, errInvalidFilename)
+		}
+	}
+
+	if err := os.MkdirAll(dirPath, handler.settings().dirMode()); err != nil {
+		// A file somewhere along the path is the usual cause
+		handler.logger.Warn("Failed to create directory", zap.String("path", command.Filename), zap.Error(err))
+		return handler.sendFailure(protocol.ErrCodeExists, "Failed to create directory: a file is in the way")
+	}
+
+	return handler.sendStatus(true, "Directory created")
+}
+
+// checkParentDir returns the refusal message when the directory that should hold
+// filePath does not exist, or "" when it does. Uploads do not create directories;
+// clients use CommandMkdir first.
+func (handler *CommandHandler) checkParentDir(filePath string) string {
+	if !handler.onDisk() {
+		// Directories off disk exist implicitly while they hold a file
+		return ""
+	}
+	info, err := os.Stat(filepath.Dir(filePath))
+	if err == nil && info.IsDir() {
+		return ""
+	}
+	return fmt.Sprintf("%s: %s", errDirectoryNotFound, handler.clientRelativeName(filepath.Dir(filePath)))
+}
+
+// checkRegularFile returns the refusal message when filePath exists as anything but a
+// regular file, or "" when it is one or does not exist yet. Nothing along the way is
+// followed: a symbolic link, whether the file itself or one of the directories leading
+// to it, could point out of the client directory, and devices and FIFOs are no files
+// to store or serve.
+func (handler *CommandHandler) checkRegularFile(filePath string) string {
+	if !handler.onDisk() {
+		return ""
+	}
+	refusal := fmt.Sprintf("%s: %s", errNotRegularFile, handler.clientRelativeName(filePath))
+	clientDir, err := handler.getClientDir()
+	if err != nil {
+		return refusal
+	}
+	absRoot, err := filepath.Abs(clientDir)
+	if err != nil {
+		return refusal
+	}
+	rel, err := filepath.Rel(absRoot, filePath)
+	if err != nil || rel == "." {
+		return refusal
+	}
+
+	current := absRoot
+	parts := strings.Split(rel, string(filepath.Separator))
+	for i, part := range parts {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return ""
+		}
+		if err != nil {
+			return refusal
+		}
+		last := i == len(parts)-1
+		if (last && !info.Mode().IsRegular()) || (!last && !info.IsDir()) {
+			handler.logger.Warn("Refusing path that is not a regular file",
+				zap.String("path", handler.clientRelativeName(current)),
+				zap.Stringer("mode", info.Mode()))
+			return refusal
+		}
+	}
+	return ""
+}
+
+// clientRelativeName returns filePath relative to the client directory with forward
+// slashes, the form names take on the wire
+func (handler *CommandHandler) clientRelativeName(filePath string) string {
+	clientDir, err := handler.clientRoot()
+	if err != nil {
+		return filepath.Base(filePath)
+	}
+	absRoot, err := filepath.Abs(clientDir)
+	if err != nil {
+		return filepath.Base(filePath)
+	}
+	rel, err := filepath.Rel(absRoot, filePath)
+	if err != nil {
+		return filepath.Base(filePath)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// entryInfo stats a directory entry; tests replace it to remove entries mid-listing
+var entryInfo = fs.DirEntry.Info
+
+// listEntries describes the entries of dir, skipping unfinished uploads and entries
+// that vanish before they are stat'ed, which are logged to a non-nil logger.
+// Recursive listings include everything below dir, named by their slash-separated
+// path relative to dir, parents before their contents.
+func listEntries(dir string, recursive bool, logger *zap.Logger) ([]protocol.FileInfo, error) {
+	skip := func(path string, err error) {
+		if logger != nil {
+			logger.Warn("Skipping directory entry that cannot be stat'ed", zap.String("path", path), zap.Error(err))
+		}
+	}
+
+	if !recursive {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		infos := make([]protocol.FileInfo, 0, len(entries))
+		for _, entry := range entries {
+			if isUploadTemp(entry.Name()) {
+				continue
+			}
+			info, err := entryInfo(entry)
+			if err != nil {
+				// Removed between reading the directory and stat'ing the entry
+				skip(filepath.Join(dir, entry.Name()), err)
+				continue
+			}
+			infos = append(infos, fileInfoFrom(info))
+		}
+		return infos, nil
+	}
+
+	var infos []protocol.FileInfo
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path != dir {
+				return nil
+			}
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		if isUploadTemp(entry.Name()) {
+			return nil
+		}
+		info, err := entryInfo(entry)
+		if err != nil {
+			skip(path, err)
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		fileInfo := fileInfoFrom(info)
+		fileInfo.Name = filepath.ToSlash(rel)
+		infos = append(infos, fileInfo)
+		return nil
+	})
+	return infos, err
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// handleForTest runs one command and returns the handler's first response
+func handleForTest(t *testing.T, handler *CommandHandler, mockConn *MockConnectionHandler, command *protocol.CommandMessage) *protocol.ResponseMessage {
+	t.Helper()
+	mockConn.ClearSentMessages()
+	if err := handler.handle(command); err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+	resp, err := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload)
+	if err != nil {
+		t.Fatalf("Failed to deserialize response: %v", err)
+	}
+	return resp
+}
+
+func TestHandleMkdir(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+	clientDir, _ := cmdHandler.getClientDir()
+	mkdir := func(path string) *protocol.ResponseMessage {
+		return handleForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandMkdir, Filename: path})
+	}
+
+	// Missing parents are created, and repeating the command succeeds
+	for i := 0; i < 2; i++ {
+		if resp := mkdir("photos/2024"); !resp.Success {
+			t.Fatalf("Mkdir attempt %d failed: %s", i+1, resp.Message)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(clientDir, "photos", "2024")); err != nil || !info.IsDir() {
+		t.Fatalf("Expected photos/2024 to be a directory: %v", err)
+	}
+
+	// A file along the path cannot become a directory
+	if resp := uploadForTest(t, cmdHandler, mockConn, "notes.txt", []byte("x")); !resp.Success {
+		t.Fatalf("Upload failed: %s", resp.Message)
+	}
+	if resp := mkdir("notes.txt/sub"); resp.Success {
+		t.Error("Expected mkdir below a file to fail")
+	}
+
+	// Paths leaving the client directory and reserved temporary names are refused
+	for _, path := range []string{"../escape", "a/../../escape", ".upload-x/dir"} {
+		if resp := mkdir(path); resp.Success || resp.Message != errInvalidFilename {
+			t.Errorf("mkdir %q: got success=%v message=%q, want %q", path, resp.Success, resp.Message, errInvalidFilename)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(clientDir), "escape")); !os.IsNotExist(err) {
+		t.Error("Directory was created outside the client directory")
+	}
+}
+
+func TestHandleList_Subdirectories(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+	handleForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandMkdir, Filename: "docs/old"})
+	for _, name := range []string{"top.txt", "docs/a.txt", "docs/old/b.txt"} {
+		if resp := uploadForTest(t, cmdHandler, mockConn, name, []byte(name)); !resp.Success {
+			t.Fatalf("Upload of %s failed: %s", name, resp.Message)
+		}
+	}
+
+	list := func(dir string, flags byte) *protocol.ResponseMessage {
+		return handleForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandList, Filename: dir, Data: []byte{flags}})
+	}
+	names := func(resp *protocol.ResponseMessage) []string {
+		t.Helper()
+		if !resp.Success {
+			t.Fatalf("List failed: %s", resp.Message)
+		}
+		infos, err := protocol.DeserializeFileInfos(resp.Data)
+		if err != nil {
+			t.Fatalf("Failed to decode listing: %v", err)
+		}
+		var names []string
+		for _, info := range infos {
+			if info.IsDir {
+				names = append(names, info.Name+"/")
+			} else {
+				names = append(names, info.Name)
+			}
+		}
+		return names
+	}
+
+	// The plain listing of a subdirectory holds only its files
+	if resp := list("docs", 0); !resp.Success || resp.Message != "a.txt" {
+		t.Errorf("Plain listing of docs: success=%v message=%q, want %q", resp.Success, resp.Message, "a.txt")
+	}
+	if got := strings.Join(names(list("docs", protocol.ListFlagDetailed)), ","); got != "a.txt,old/" {
+		t.Errorf("Detailed listing of docs = %s, want a.txt,old/", got)
+	}
+
+	// Recursive listings name entries by their path, parents first
+	got := strings.Join(names(list("", protocol.ListFlagDetailed|protocol.ListFlagRecursive)), ",")
+	if want := "docs/,docs/a.txt,docs/old/,docs/old/b.txt,top.txt"; got != want {
+		t.Errorf("Recursive listing = %s, want %s", got, want)
+	}
+
+	if resp := list("missing", 0); resp.Success || resp.Message != errDirectoryNotFound {
+		t.Errorf("Listing a missing directory: success=%v message=%q", resp.Success, resp.Message)
+	}
+	if resp := list("top.txt", 0); resp.Success || resp.Message != "Not a directory" {
+		t.Errorf("Listing a file: success=%v message=%q", resp.Success, resp.Message)
+	}
+}
+
+func TestHandleList_EntryRemovedDuringListing(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	// Setup, with a logger that records warnings
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+	core, logs := observer.New(zapcore.WarnLevel)
+	cmdHandler.logger = zap.New(core)
+	clientDir, _ := cmdHandler.getClientDir()
+	for _, name := range []string{"a.txt", "gone.txt", "z.txt"} {
+		if resp := uploadForTest(t, cmdHandler, mockConn, name, []byte(name)); !resp.Success {
+			t.Fatalf("Upload of %s failed: %s", name, resp.Message)
+		}
+	}
+
+	// gone.txt disappears after the directory is read but before it is stat'ed
+	defer func(info func(fs.DirEntry) (fs.FileInfo, error)) { entryInfo = info }(entryInfo)
+	entryInfo = func(entry fs.DirEntry) (fs.FileInfo, error) {
+		if entry.Name() == "gone.txt" {
+			os.Remove(filepath.Join(clientDir, "gone.txt"))
+		}
+		return entry.Info()
+	}
+
+	for _, flags := range []byte{protocol.ListFlagDetailed, protocol.ListFlagDetailed | protocol.ListFlagRecursive} {
+		if resp := uploadForTest(t, cmdHandler, mockConn, "gone.txt", []byte("again")); !resp.Success {
+			t.Fatalf("Upload of gone.txt failed: %s", resp.Message)
+		}
+		logs.TakeAll()
+
+		resp := handleForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandList, Data: []byte{flags}})
+		if !resp.Success {
+			t.Fatalf("List with flags %#x failed: %s", flags, resp.Message)
+		}
+		infos, err := protocol.DeserializeFileInfos(resp.Data)
+		if err != nil {
+			t.Fatalf("Failed to decode listing: %v", err)
+		}
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name)
+		}
+		if got := strings.Join(names, ","); got != "a.txt,z.txt" {
+			t.Errorf("Listing with flags %#x = %s, want a.txt,z.txt", flags, got)
+		}
+		if skipped := logs.FilterMessage("Skipping directory entry that cannot be stat'ed").All(); len(skipped) != 1 {
+			t.Errorf("Expected one warning for the removed entry with flags %#x, got %d", flags, len(skipped))
+		} else if path := skipped[0].ContextMap()["path"]; path != filepath.Join(clientDir, "gone.txt") {
+			t.Errorf("Warning names %v, want the removed entry", path)
+		}
+	}
+}
+
+func TestUpload_MissingDirectory(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+
+	// Both upload paths refuse a directory that was never created
+	resp := uploadForTest(t, cmdHandler, mockConn, "nowhere/file.txt", []byte("data"))
+	if resp.Success || !strings.HasPrefix(resp.Message, errDirectoryNotFound) {
+		t.Errorf("Expected upload into a missing directory to fail, got success=%v message=%q", resp.Success, resp.Message)
+	}
+	resp = handleForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{
+		Command:  protocol.CommandUploadChunk,
+		Filename: "nowhere/file.txt",
+		Data:     binary.BigEndian.AppendUint64(nil, 4),
+	})
+	if resp.Success || !strings.HasPrefix(resp.Message, errDirectoryNotFound) {
+		t.Errorf("Expected chunked upload into a missing directory to fail, got success=%v message=%q", resp.Success, resp.Message)
+	}
+	if cmdHandler.upload != nil {
+		t.Error("Refused chunked upload should not leave an upload in progress")
+	}
+
+	// Once the directory exists the same uploads are stored there
+	handleForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandMkdir, Filename: "nowhere"})
+	if resp := uploadForTest(t, cmdHandler, mockConn, "nowhere/file.txt", []byte("data")); !resp.Success {
+		t.Fatalf("Upload into existing directory failed: %s", resp.Message)
+	}
+	beginUploadForTest(t, cmdHandler, mockConn, "nowhere/chunked.txt", 4)
+	sendChunkForTest(t, cmdHandler, 0, 1, []byte("more"))
+
+	clientDir, _ := cmdHandler.getClientDir()
+	for name, want := range map[string][]byte{"file.txt": []byte("data"), "chunked.txt": []byte("more")} {
+		got, err := os.ReadFile(filepath.Join(clientDir, "nowhere", name))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("nowhere/%s = %q (%v), want %q", name, got, err, want)
+		}
+	}
+}
+
+func TestSymlinksAndSpecialFilesRefused(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+	clientDir, _ := cmdHandler.getClientDir()
+
+	// A secret outside the client directory, reachable through links inside it
+	outsideDir := t.TempDir()
+	secret := filepath.Join(outsideDir, "secret.txt")
+	if err := os.WriteFile(secret, []byte("secret"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.Symlink(secret, filepath.Join(clientDir, "link.txt")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := os.Symlink(outsideDir, filepath.Join(clientDir, "linkdir")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(clientDir, "dir"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	for _, name := range []string{"link.txt", "linkdir/secret.txt", "linkdir/new.txt", "dir"} {
+		resp := uploadForTest(t, cmdHandler, mockConn, name, []byte("overwritten"))
+		if resp.Success || !strings.HasPrefix(resp.Message, errNotRegularFile) {
+			t.Errorf("Upload to %s: expected refusal, got %+v", name, resp)
+		}
+
+		resp = handleForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandDownload, Filename: name})
+		if resp.Success || !strings.HasPrefix(resp.Message, errNotRegularFile) {
+			t.Errorf("Download of %s: expected refusal, got %+v", name, resp)
+		}
+		if len(mockConn.sentMessages) != 1 {
+			t.Errorf("Download of %s sent %d messages, expected only the refusal", name, len(mockConn.sentMessages))
+		}
+	}
+
+	// Streamed uploads are refused before any chunk is accepted
+	resp := handleForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{
+		Command:  protocol.CommandUploadChunk,
+		Filename: "link.txt",
+		Data:     protocol.SerializeUploadRequest(&protocol.UploadRequest{Size: 11, Overwrite: true}),
+	})
+	if resp.Success || !strings.HasPrefix(resp.Message, errNotRegularFile) {
+		t.Errorf("Chunked upload to link.txt: expected refusal, got %+v", resp)
+	}
+
+	if data, err := os.ReadFile(secret); err != nil || string(data) != "secret" {
+		t.Errorf("File outside the client directory changed: %q (%v)", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(outsideDir, "new.txt")); !os.IsNotExist(err) {
+		t.Errorf("Upload created a file outside the client directory: %v", err)
+	}
+
+	// Regular files and new names are unaffected
+	if resp := uploadForTest(t, cmdHandler, mockConn, "dir/ok.txt", []byte("ok")); !resp.Success {
+		t.Errorf("Upload of a regular file failed: %s", resp.Message)
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	protocol "github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+const errFilenameNotAllowed = "Filename not allowed"
+
+// validateFilename applies the filename rules to a file about to be stored, after
+// validatePath has accepted it. Names containing NUL or an element made only of
+// whitespace are always refused. DeniedPatterns are matched against every element, so
+// ".*" also refuses files inside hidden directories, and AllowedExtensions against
+// the file's own name. Both comparisons ignore case.
+func (handler *CommandHandler) validateFilename(filename string) error {
+	if strings.ContainsRune(filename, 0) {
+		return errors.New("name contains NUL")
+	}
+
+	config := handler.settings()
+	elements := strings.Split(filepath.ToSlash(filename), "/")
+	for _, element := range elements {
+		if element == "" {
+			continue
+		}
+		if strings.TrimSpace(element) == "" {
+			return errors.New("name is only whitespace")
+		}
+		for _, pattern := range config.DeniedPatterns {
+			if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(element)); ok {
+				return fmt.Errorf("%q matches denied pattern %q", element, pattern)
+			}
+		}
+	}
+
+	if len(config.AllowedExtensions) > 0 {
+		ext := strings.TrimPrefix(path.Ext(elements[len(elements)-1]), ".")
+		if !containsExtension(config.AllowedExtensions, ext) {
+			if ext == "" {
+				return errors.New("files without an extension are not allowed")
+			}
+			return fmt.Errorf("extension %q is not allowed", ext)
+		}
+	}
+	return nil
+}
+
+// containsExtension reports whether ext is one of allowed, which may be written with
+// or without the leading dot
+func containsExtension(allowed []string, ext string) bool {
+	if ext == "" {
+		return false
+	}
+	for _, candidate := range allowed {
+		if strings.EqualFold(strings.TrimPrefix(candidate, "."), ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// refuseFilename tells the client why a name failed validateFilename
+func (handler *CommandHandler) refuseFilename(filename string, reason error) error {
+	handler.logger.Warn("Refusing filename", zap.String("filename", filename), zap.Error(reason))
+	return handler.sendFailure(protocol.ErrCodeInvalidPath, fmt.Sprintf("%s: %v", errFilenameNotAllowed, reason))
+}
+
+// checkDeniedPatterns reports the first malformed pattern in DeniedPatterns
+func checkDeniedPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid denied filename pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
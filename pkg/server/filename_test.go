@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+)
+
+func TestUpload_FilenameRules(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+	cmdHandler.config = &ServerConfig{
+		AllowedExtensions: []string{".txt", "csv"},
+		DeniedPatterns:    []string{".*", "secret*"},
+	}
+
+	allowed := []string{"notes.txt", "REPORT.TXT", "data.Csv", "sub/dir/notes.txt"}
+	clientDir, err := cmdHandler.getClientDir()
+	if err != nil {
+		t.Fatalf("Failed to get client directory: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(clientDir, "sub", "dir"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	for _, name := range allowed {
+		if resp := uploadForTest(t, cmdHandler, mockConn, name, []byte("ok")); !resp.Success {
+			t.Errorf("Upload of %q refused: %s", name, resp.Message)
+		}
+	}
+
+	denied := []string{
+		"program.exe",     // extension not allowed
+		"Makefile",        // no extension
+		".hidden.txt",     // leading dot
+		".git/config.txt", // hidden directory
+		"Secret-plan.txt", // denied pattern, any case
+		"   ",             // whitespace only
+		"bad\x00name.txt", // NUL
+	}
+	for _, name := range denied {
+		resp := uploadForTest(t, cmdHandler, mockConn, name, []byte("no"))
+		if resp.Success || !strings.HasPrefix(resp.Message, errFilenameNotAllowed) {
+			t.Errorf("Expected %q to be refused, got success=%v message=%q", name, resp.Success, resp.Message)
+		}
+	}
+
+	// The chunked upload and rename paths apply the same rules
+	mockConn.ClearSentMessages()
+	command := &protocol.CommandMessage{
+		Command:  protocol.CommandUploadChunk,
+		Filename: "program.exe",
+		Data:     binary.BigEndian.AppendUint64(nil, 2),
+	}
+	if err := cmdHandler.handle(command); err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+	if resp, _ := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload); resp.Success {
+		t.Error("Expected chunked upload of a denied extension to be refused")
+	}
+
+	if resp := renameForTest(t, cmdHandler, mockConn, "notes.txt", ".notes.txt"); resp.Success || !strings.HasPrefix(resp.Message, errFilenameNotAllowed) {
+		t.Errorf("Expected rename to a denied name to be refused, got success=%v message=%q", resp.Success, resp.Message)
+	}
+	if _, err := os.Stat(filepath.Join(clientDir, "notes.txt")); err != nil {
+		t.Errorf("Refused rename should leave the source in place: %v", err)
+	}
+}
+
+func TestNewServer_InvalidDeniedPattern(t *testing.T) {
+	rootDir := t.TempDir()
+	_, err := NewServer(&ServerConfig{RootDir: &rootDir, DeniedPatterns: []string{"[unclosed"}})
+	if err == nil || !strings.Contains(err.Error(), "[unclosed") {
+		t.Errorf("Expected NewServer to reject a malformed pattern, got %v", err)
+	}
+}
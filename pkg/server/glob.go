@@ -0,0 +1,108 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+const errInvalidPattern = "Invalid pattern"
+
+// errPatternDirectory rejects wildcards outside the last element of a pattern
+var errPatternDirectory = errors.New("wildcards are only allowed in the last path element")
+
+// splitGlob separates a /-separated pattern into the directory to search, "" for the
+// client directory, and the pattern names in it must match. The directory is still
+// validated like any path; wildcards never match a separator, so matches stay inside it.
+func splitGlob(pattern string) (dir, namePattern string, err error) {
+	dir, namePattern = path.Split(pattern)
+	if protocol.IsGlobPattern(dir) {
+		return "", "", errPatternDirectory
+	}
+	if _, err := path.Match(namePattern, ""); err != nil {
+		return "", "", err
+	}
+	return strings.TrimSuffix(dir, "/"), namePattern, nil
+}
+
+// filterEntries keeps the entries whose own name, the last element of their path in a
+// recursive listing, matches namePattern
+func filterEntries(infos []protocol.FileInfo, namePattern string) []protocol.FileInfo {
+	matched := infos[:0]
+	for _, info := range infos {
+		if ok, _ := path.Match(namePattern, path.Base(info.Name)); ok {
+			matched = append(matched, info)
+		}
+	}
+	return matched
+}
+
+// handleDeleteGlob deletes the files directly in a directory whose names match a
+// pattern. Subdirectories and unfinished uploads are never removed. The response
+// reports how many files were deleted, which may be none.
+func (handler *CommandHandler) handleDeleteGlob(command *protocol.CommandMessage) error {
+	handler.logger.Info("Delete glob command received", zap.String("pattern", command.Filename))
+
+	dir, namePattern, err := splitGlob(command.Filename)
+	if err != nil {
+		handler.logger.Warn("Invalid delete pattern", zap.String("pattern", command.Filename), zap.Error(err))
+		return handler.sendFailure(protocol.ErrCodeInvalidPath, errInvalidPattern)
+	}
+
+	dirPath, err := handler.getClientDir()
+	if err != nil {
+		handler.sendFailure(protocol.ErrCodeIO, "Failed to get client directory")
+		return err
+	}
+	if dir != "" {
+		dirPath, err = handler.validatePath(dir)
+		if err != nil {
+			handler.logger.Warn(errPathValidationFailed, zap.String("filename", dir), zap.Error(err))
+			return handler.sendFailure(protocol.ErrCodeInvalidPath, errInvalidFilename)
+		}
+	}
+
+	entries, err := os.ReadDir(dirPath)
+	if os.IsNotExist(err) {
+		return handler.sendFailure(protocol.ErrCodeNotFound, errDirectoryNotFound)
+	}
+	if err != nil {
+		handler.sendFailure(protocol.ErrCodeIO, "Failed to read directory")
+		return err
+	}
+
+	var deleted uint32
+	for _, entry := range entries {
+		if entry.IsDir() || isUploadTemp(entry.Name()) {
+			continue
+		}
+		if ok, _ := path.Match(namePattern, entry.Name()); !ok {
+			continue
+		}
+		filePath := filepath.Join(dirPath, entry.Name())
+		unlock := handler.lockFiles(false, filePath)
+		err := handler.removeFile(filePath)
+		unlock()
+		if err != nil {
+			handler.logger.Error("Failed to delete matching file", zap.String("path", filePath), zap.Error(err))
+			return handler.sendFailure(protocol.ErrCodeIO, fmt.Sprintf("Failed to delete %s after deleting %d files", entry.Name(), deleted))
+		}
+		deleted++
+		if err := handler.mirrorRemove(filePath); err != nil {
+			return handler.sendFailure(protocol.ErrCodeIO, errMirrorFailed)
+		}
+	}
+
+	handler.logger.Info("Deleted matching files", zap.String("pattern", command.Filename), zap.Uint32("deleted", deleted))
+	responsePayload, err := protocol.SerializeResponse(true, fmt.Sprintf("Deleted %d files", deleted), protocol.SerializeDeleteCount(deleted))
+	if err != nil {
+		return err
+	}
+	return handler.conn.SendSecureMessage(protocol.NewMessage(protocol.MessageTypeResponse, responsePayload))
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+)
+
+func TestHandleList_Glob(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+	handleForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandMkdir, Filename: "logs/old"})
+	for _, name := range []string{"a.log", "b.txt", "logs/app.log", "logs/app.txt", "logs/old/x.log"} {
+		if resp := uploadForTest(t, cmdHandler, mockConn, name, []byte(name)); !resp.Success {
+			t.Fatalf("Upload of %s failed: %s", name, resp.Message)
+		}
+	}
+
+	list := func(pattern string, flags byte) *protocol.ResponseMessage {
+		return handleForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandList, Filename: pattern, Data: []byte{flags}})
+	}
+
+	tests := []struct {
+		pattern string
+		flags   byte
+		want    string
+	}{
+		{"*.log", 0, "a.log"},
+		{"logs/*.log", 0, "logs/app.log"},
+		{"logs/app.???", 0, "logs/app.log,logs/app.txt"},
+		{"*.log", protocol.ListFlagRecursive, "a.log,logs/app.log,logs/old/x.log"},
+		{"*.none", 0, ""},
+	}
+	for _, tt := range tests {
+		resp := list(tt.pattern, tt.flags|protocol.ListFlagDetailed)
+		if !resp.Success {
+			t.Errorf("List %q failed: %s", tt.pattern, resp.Message)
+			continue
+		}
+		infos, err := protocol.DeserializeFileInfos(resp.Data)
+		if err != nil {
+			t.Fatalf("Failed to decode listing: %v", err)
+		}
+		var names []string
+		dir, _ := filepath.Split(tt.pattern)
+		for _, info := range infos {
+			names = append(names, dir+info.Name)
+		}
+		slices.Sort(names)
+		if got := strings.Join(names, ","); got != tt.want {
+			t.Errorf("List %q = %s, want %s", tt.pattern, got, tt.want)
+		}
+	}
+
+	// Plain listings are filtered the same way
+	if resp := list("b*", 0); !resp.Success || resp.Message != "b.txt" {
+		t.Errorf("Plain listing of b*: success=%v message=%q", resp.Success, resp.Message)
+	}
+
+	for _, pattern := range []string{"[", "*/app.log"} {
+		if resp := list(pattern, 0); resp.Success || resp.Message != errInvalidPattern {
+			t.Errorf("List %q: success=%v message=%q, want %q", pattern, resp.Success, resp.Message, errInvalidPattern)
+		}
+	}
+	if resp := list("../*", 0); resp.Success || resp.Message != errInvalidFilename {
+		t.Errorf("List ../*: success=%v message=%q, want %q", resp.Success, resp.Message, errInvalidFilename)
+	}
+}
+
+func TestHandleDeleteGlob(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+	clientDir, _ := cmdHandler.getClientDir()
+	handleForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandMkdir, Filename: "logs/keep.tmp"})
+	for _, name := range []string{"a.tmp", "b.tmp", "c.txt", "logs/d.tmp"} {
+		if resp := uploadForTest(t, cmdHandler, mockConn, name, []byte(name)); !resp.Success {
+			t.Fatalf("Upload of %s failed: %s", name, resp.Message)
+		}
+	}
+	// An unfinished upload is not the client's file to delete
+	tempUpload := filepath.Join(clientDir, ".upload-x.tmp")
+	if err := os.WriteFile(tempUpload, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	deleteGlob := func(pattern string) *protocol.ResponseMessage {
+		return handleForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandDeleteGlob, Filename: pattern})
+	}
+	expectDeleted := func(pattern string, want uint32) {
+		t.Helper()
+		resp := deleteGlob(pattern)
+		if !resp.Success {
+			t.Fatalf("Delete %q failed: %s", pattern, resp.Message)
+		}
+		if deleted, err := protocol.DeserializeDeleteCount(resp.Data); err != nil || deleted != want {
+			t.Errorf("Delete %q removed %d files (%v), want %d", pattern, deleted, err, want)
+		}
+	}
+
+	expectDeleted("*.tmp", 2)
+	expectDeleted("*.tmp", 0)
+	expectDeleted("logs/*.tmp", 1)
+
+	for name, want := range map[string]bool{"a.tmp": false, "b.tmp": false, "c.txt": true, "logs/d.tmp": false, "logs/keep.tmp": true} {
+		if _, err := os.Stat(filepath.Join(clientDir, name)); (err == nil) != want {
+			t.Errorf("%s exists=%v, want %v", name, err == nil, want)
+		}
+	}
+	if _, err := os.Stat(tempUpload); err != nil {
+		t.Errorf("Unfinished upload was deleted: %v", err)
+	}
+
+	for pattern, want := range map[string]string{
+		"[":         errInvalidPattern,
+		"*/d.tmp":   errInvalidPattern,
+		"../*":      errInvalidFilename,
+		"missing/*": errDirectoryNotFound,
+	} {
+		if resp := deleteGlob(pattern); resp.Success || resp.Message != want {
+			t.Errorf("Delete %q: success=%v message=%q, want %q", pattern, resp.Success, resp.Message, want)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	protocol "github.com/lcensies/ssnproj/pkg/protocol"
+	rsaUtil "github.com/lcensies/ssnproj/pkg/rsa"
+)
+
+// verifyClientIdentity checks that the client holds the private half of identityKey
+// (PKIX DER) by verifying its signature over the session's wrapped key
+func verifyClientIdentity(identityKey, signature, encryptedKey []byte) error {
+	parsed, err := x509.ParsePKIXPublicKey(identityKey)
+	if err != nil {
+		return fmt.Errorf("invalid client identity key: %w", err)
+	}
+	publicKey, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("client identity key is not an RSA key")
+	}
+
+	digest := protocol.ClientIdentityDigest(encryptedKey)
+	if err := rsa.VerifyPSS(publicKey, crypto.SHA256, digest, signature, rsaUtil.PSSOptions()); err != nil {
+		return errors.New("client identity signature is invalid")
+	}
+	return nil
+}
+
+// identityDirName maps a verified identity key to its storage directory name.
+// The "id-" prefix keeps these apart from per-session and namespace directories.
+func identityDirName(identityKey []byte) string {
+	hash := sha256.Sum256(identityKey)
+	return "id-" + hex.EncodeToString(hash[:])
+}
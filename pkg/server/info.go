@@ -0,0 +1,52 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// acceptedCipherSizes lists the AES key sizes a session may use, strongest first
+var acceptedCipherSizes = []int{256, 192, 128}
+
+// serverInfo reports the limits this handler enforces
+func (handler *CommandHandler) serverInfo() *protocol.ServerInfo {
+	config := handler.settings()
+
+	var ciphers []string
+	for _, bits := range acceptedCipherSizes {
+		if bits >= config.minCipherStrength() {
+			ciphers = append(ciphers, fmt.Sprintf("AES-%d-GCM", bits))
+		}
+	}
+
+	return &protocol.ServerInfo{
+		MaxUploadSize:     config.MaxUploadSize,
+		MinChunkSize:      protocol.SmallChunkSize,
+		MaxChunkSize:      protocol.MaxChunkSize,
+		Quota:             config.MaxClientBytes,
+		MaxFilenameLength: maxFilenameLength,
+		MaxPathLength:     maxPathLength,
+		Ciphers:           ciphers,
+		Compression:       []string{protocol.EncodingGzip},
+	}
+}
+
+func (handler *CommandHandler) handleInfo(command *protocol.CommandMessage) error {
+	handler.logger.Info("Info command received")
+
+	data, err := protocol.SerializeServerInfo(handler.serverInfo())
+	if err != nil {
+		return err
+	}
+
+	responsePayload, err := protocol.SerializeResponse(true, "", data)
+	if err != nil {
+		return err
+	}
+
+	handler.logger.Debug("Sending server info", zap.Int("size", len(data)))
+	response := protocol.NewMessage(protocol.MessageTypeResponse, responsePayload)
+	return handler.conn.SendSecureMessage(response)
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"path"
+	"sort"
+	"sync"
+)
+
+// fileLocks serialises operations on the same stored file across the server's
+// connections, which share a directory when they share a namespace or identity. A file
+// being written or deleted is not read at the same time, so a download never sees half
+// of an overwrite, and readers of the same file do not wait for each other.
+type fileLocks struct {
+	mu    sync.Mutex
+	locks map[string]*fileLock
+}
+
+// fileLock is the lock of one file; it is dropped from fileLocks once nobody holds or
+// waits for it, so the map only grows with the files in use
+type fileLock struct {
+	sync.RWMutex
+	holders int
+}
+
+func newFileLocks() *fileLocks {
+	return &fileLocks{locks: make(map[string]*fileLock)}
+}
+
+// acquire locks key, shared for readers and exclusively otherwise, and returns the
+// function that releases it
+func (locks *fileLocks) acquire(key string, shared bool) func() {
+	locks.mu.Lock()
+	lock, ok := locks.locks[key]
+	if !ok {
+		lock = &fileLock{}
+		locks.locks[key] = lock
+	}
+	lock.holders++
+	locks.mu.Unlock()
+
+	if shared {
+		lock.RLock()
+	} else {
+		lock.Lock()
+	}
+
+	return func() {
+		if shared {
+			lock.RUnlock()
+		} else {
+			lock.Unlock()
+		}
+		locks.mu.Lock()
+		lock.holders--
+		if lock.holders == 0 {
+			delete(locks.locks, key)
+		}
+		locks.mu.Unlock()
+	}
+}
+
+// lockFiles locks the files at filePaths, paths from validatePath, and returns the
+// function that unlocks them. Readers pass shared. The files are locked in order so two
+// commands locking the same pair cannot deadlock. Handlers running without a server
+// have no locks to take.
+func (handler *CommandHandler) lockFiles(shared bool, filePaths ...string) func() {
+	if handler.fileLocks == nil {
+		return func() {}
+	}
+
+	keys := make([]string, 0, len(filePaths))
+	for _, filePath := range filePaths {
+		keys = append(keys, path.Join(handler.storageClient(), handler.storedName(filePath)))
+	}
+	sort.Strings(keys)
+
+	unlocks := make([]func(), 0, len(keys))
+	for i, key := range keys {
+		if i > 0 && key == keys[i-1] {
+			continue
+		}
+		unlocks = append(unlocks, handler.fileLocks.acquire(key, shared))
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
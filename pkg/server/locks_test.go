@@ -0,0 +1,75 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+)
+
+func TestLockFiles_WriteBlocksRead(t *testing.T) {
+	tempDir := t.TempDir()
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+	cmdHandler.fileLocks = newFileLocks()
+	uploadForTest(t, cmdHandler, mockConn, "busy.txt", []byte("contents"))
+
+	filePath, err := cmdHandler.validatePath("busy.txt")
+	if err != nil {
+		t.Fatalf("validatePath failed: %v", err)
+	}
+	unlock := cmdHandler.lockFiles(false, filePath)
+
+	// A second connection's handler shares the locks, as handlers of one server do
+	reader, readerConn := createTestCommandHandler(t, tempDir)
+	reader.fileLocks = cmdHandler.fileLocks
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reader.handleDownload(&protocol.CommandMessage{Command: protocol.CommandDownload, Filename: "busy.txt"})
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Download read the file while it was locked for writing")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Download did not proceed once the file was unlocked")
+	}
+
+	respMsg, err := protocol.DeserializeResponse(readerConn.sentMessages[0].Payload)
+	if err != nil || !respMsg.Success {
+		t.Errorf("Expected the download to succeed after the lock, got %+v (%v)", respMsg, err)
+	}
+	if n := len(cmdHandler.fileLocks.locks); n != 0 {
+		t.Errorf("Expected released locks to be dropped, %d remain", n)
+	}
+}
+
+func TestLockFiles_OrderedPairs(t *testing.T) {
+	cmdHandler, _ := createTestCommandHandler(t, t.TempDir())
+	cmdHandler.fileLocks = newFileLocks()
+	a, _ := cmdHandler.validatePath("a.txt")
+	b, _ := cmdHandler.validatePath("b.txt")
+
+	// Opposite orders, as a rename a->b racing a rename b->a would take them
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			cmdHandler.lockFiles(false, a, b)()
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		cmdHandler.lockFiles(false, b, a)()
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Locking the same pair in opposite orders deadlocked")
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// LogSampling rate-limits repeated identical log lines (same level and message).
+// Entries at error level and above are never sampled.
+type LogSampling struct {
+	// Tick is the sampling window, defaults to one second
+	Tick time.Duration
+	// First identical entries per window are always logged
+	First int
+	// Thereafter every Nth identical entry is logged once First is reached; zero drops the rest
+	Thereafter int
+}
+
+// sampledLogger wraps logger with the configured sampler
+func sampledLogger(logger *zap.Logger, sampling *LogSampling) *zap.Logger {
+	tick := sampling.Tick
+	if tick <= 0 {
+		tick = time.Second
+	}
+
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &errorBypassCore{
+			Core: zapcore.NewSamplerWithOptions(core, tick, sampling.First, sampling.Thereafter),
+			base: core,
+		}
+	}))
+}
+
+// errorBypassCore samples entries below error level and sends the rest straight to base
+type errorBypassCore struct {
+	zapcore.Core
+	base zapcore.Core
+}
+
+func (c *errorBypassCore) With(fields []zapcore.Field) zapcore.Core {
+	return &errorBypassCore{
+		Core: c.Core.With(fields),
+		base: c.base.With(fields),
+	}
+}
+
+func (c *errorBypassCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if ent.Level >= zapcore.ErrorLevel {
+		return c.base.Check(ent, ce)
+	}
+	return c.Core.Check(ent, ce)
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	protocol "github.com/lcensies/ssnproj/pkg/protocol"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLogSampling(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	server, err := NewServer(&ServerConfig{
+		ConfigFolder: t.TempDir(),
+		RootDir:      &tempDir,
+		Logger:       zap.New(core),
+		LogSampling:  &LogSampling{Tick: time.Minute, First: 5, Thereafter: 0},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	mockConn := &MockConnectionHandler{}
+	testAESKey := make([]byte, 32) // 256-bit key
+	cmdHandler := NewCommandHandler(mockConn, server.logger, &tempDir, testAESKey)
+
+	const operations = 200
+	for i := 0; i < operations; i++ {
+		if err := cmdHandler.handleList(&protocol.CommandMessage{Command: protocol.CommandList}); err != nil {
+			t.Fatalf("handleList failed: %v", err)
+		}
+		server.logger.Error("Repeated failure")
+	}
+
+	if listed := logs.FilterMessage("List command received").Len(); listed != 5 {
+		t.Errorf("Expected sampler to keep 5 of %d identical info lines, got %d", operations, listed)
+	}
+	if failures := logs.FilterMessage("Repeated failure").Len(); failures != operations {
+		t.Errorf("Expected all %d errors to be logged, got %d", operations, failures)
+	}
+}
+
+func TestNewServer_UsesConfiguredLogger(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	// A warn-level logger must not be replaced by one that logs everything
+	core, logs := observer.New(zapcore.WarnLevel)
+	logger := zap.New(core)
+	server, err := NewServer(&ServerConfig{
+		ConfigFolder: t.TempDir(),
+		RootDir:      &tempDir,
+		Logger:       logger,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	if server.logger != logger {
+		t.Error("Expected the server to use the configured logger")
+	}
+	server.logger.Info("Filtered by level")
+	server.logger.Warn("Kept by level")
+	if logs.FilterMessage("Filtered by level").Len() != 0 || logs.FilterMessage("Server initialized successfully").Len() != 0 {
+		t.Error("Info lines reached a warn-level logger")
+	}
+	if logs.FilterMessage("Kept by level").Len() != 1 {
+		t.Error("Expected the warning to reach the configured logger")
+	}
+}
+
+func TestAuditRecord_Upload(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	mockConn := &MockConnectionHandler{}
+	testAESKey := bytes.Repeat([]byte{0xA5}, 32)
+	cmdHandler := NewCommandHandler(mockConn, zap.New(core), &tempDir, testAESKey)
+
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	audit, auditFile, err := openAuditLog(auditPath)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	cmdHandler.audit = audit
+
+	data := []byte("audited content")
+	if err := cmdHandler.handle(&protocol.CommandMessage{Command: protocol.CommandUpload, Filename: "audited.txt", Data: data}); err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+	// A refused download is recorded as a failure
+	if err := cmdHandler.handle(&protocol.CommandMessage{Command: protocol.CommandDownload, Filename: "missing.txt"}); err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+	auditFile.Close()
+
+	records := logs.FilterMessage(auditMessage).AllUntimed()
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 audit records, got %d", len(records))
+	}
+	upload := records[0].ContextMap()
+	assert.Equal(t, sessionDirName(testAESKey), upload["client"])
+	assert.Equal(t, "upload", upload["command"])
+	assert.Equal(t, "audited.txt", upload["filename"])
+	assert.Equal(t, uint64(len(data)), upload["bytes"])
+	assert.Equal(t, true, upload["success"])
+
+	download := records[1].ContextMap()
+	assert.Equal(t, "download", download["command"])
+	assert.Equal(t, false, download["success"])
+	assert.Contains(t, download, "error")
+
+	// The file holds the same records, one JSON object per line, without the session key
+	contents, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines in the audit log, got %d", len(lines))
+	}
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("Audit log line is not JSON: %v", err)
+	}
+	assert.Equal(t, "upload", record["command"])
+	assert.Equal(t, "audited.txt", record["filename"])
+	assert.NotContains(t, string(contents), hex.EncodeToString(testAESKey))
+}
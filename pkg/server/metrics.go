@@ -0,0 +1,53 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// startMetrics serves the metrics endpoint in the background, if metrics are enabled
+func (server *Server) startMetrics() error {
+	if server.metrics == nil {
+		return nil
+	}
+	listener, err := net.Listen("tcp", server.config.MetricsAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for metrics: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", server.metrics.Handler())
+	metricsServer := &http.Server{Handler: mux}
+
+	server.mu.Lock()
+	if server.closed {
+		server.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	server.metricsServer = metricsServer
+	server.mu.Unlock()
+
+	server.logger.Info("Serving metrics", zap.String("addr", listener.Addr().String()))
+	go func() {
+		if err := metricsServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			server.logger.Error("Metrics endpoint stopped", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// stopMetrics closes the metrics endpoint; scrapes in progress are cut off
+func (server *Server) stopMetrics() {
+	server.mu.Lock()
+	metricsServer := server.metricsServer
+	server.metricsServer = nil
+	server.mu.Unlock()
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+}
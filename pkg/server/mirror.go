@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// errMirrorFailed is reported to the client when MirrorStrict is set and the mirror could not be updated
+const errMirrorFailed = "Failed to update mirror"
+
+// mirrorPath maps a path under the root directory to the same relative path under MirrorDir
+func (handler *CommandHandler) mirrorPath(filePath string) (string, error) {
+	relPath := handler.clientRelativeName(filePath)
+	if strings.HasPrefix(relPath, "../") {
+		return "", fmt.Errorf("failed to compute mirror path: %s is outside the client directory", filePath)
+	}
+	return filepath.Join(handler.settings().MirrorDir, handler.storageClient(), filepath.FromSlash(relPath)), nil
+}
+
+// mirrorWrite copies data written to filePath into the mirror directory.
+// Failures are logged; they are only returned when MirrorStrict is set.
+func (handler *CommandHandler) mirrorWrite(filePath string, data []byte) error {
+	if handler.settings().MirrorDir == "" {
+		return nil
+	}
+
+	err := func() error {
+		mirrorPath, err := handler.mirrorPath(filePath)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(mirrorPath), handler.settings().dirMode()); err != nil {
+			return err
+		}
+		return os.WriteFile(mirrorPath, data, handler.settings().fileMode())
+	}()
+
+	return handler.mirrorResult("write", filePath, err)
+}
+
+// mirrorFile copies a file already in place at filePath into the mirror directory.
+// The copy is streamed so large uploads are not read into memory.
+func (handler *CommandHandler) mirrorFile(filePath string) error {
+	if handler.settings().MirrorDir == "" {
+		return nil
+	}
+
+	err := func() error {
+		mirrorPath, err := handler.mirrorPath(filePath)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(mirrorPath), handler.settings().dirMode()); err != nil {
+			return err
+		}
+
+		src, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		dst, err := os.OpenFile(mirrorPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, handler.settings().fileMode())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(dst, src); err != nil {
+			dst.Close()
+			return err
+		}
+		return dst.Close()
+	}()
+
+	return handler.mirrorResult("write", filePath, err)
+}
+
+// mirrorRemove deletes the mirrored copy of filePath. A copy that is already gone is not an error.
+func (handler *CommandHandler) mirrorRemove(filePath string) error {
+	if handler.settings().MirrorDir == "" {
+		return nil
+	}
+
+	err := func() error {
+		mirrorPath, err := handler.mirrorPath(filePath)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(mirrorPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}()
+
+	return handler.mirrorResult("remove", filePath, err)
+}
+
+func (handler *CommandHandler) mirrorResult(operation string, filePath string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	handler.logger.Warn("Failed to update mirror",
+		zap.String("operation", operation),
+		zap.String("path", filePath),
+		zap.Error(err))
+
+	if handler.settings().MirrorStrict {
+		return fmt.Errorf("mirror %s failed: %w", operation, err)
+	}
+	return nil
+}
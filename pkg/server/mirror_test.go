@@ -0,0 +1,117 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	protocol "github.com/lcensies/ssnproj/pkg/protocol"
+)
+
+// deleteForTest runs handleDelete and returns the decoded response
+func deleteForTest(t *testing.T, cmdHandler *CommandHandler, mockConn *MockConnectionHandler, filename string) *protocol.ResponseMessage {
+	mockConn.ClearSentMessages()
+
+	command := &protocol.CommandMessage{
+		Command:  protocol.CommandDelete,
+		Filename: filename,
+	}
+	if err := cmdHandler.handleDelete(command); err != nil {
+		t.Fatalf("handleDelete failed: %v", err)
+	}
+
+	if len(mockConn.sentMessages) != 1 {
+		t.Fatalf("Expected 1 sent message, got %d", len(mockConn.sentMessages))
+	}
+
+	respMsg, err := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload)
+	if err != nil {
+		t.Fatalf("Failed to deserialize response: %v", err)
+	}
+	return respMsg
+}
+
+func TestMirror_UploadAndDelete(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+	mirrorDir := t.TempDir()
+
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+	cmdHandler.config = &ServerConfig{RootDir: &tempDir, MirrorDir: mirrorDir}
+
+	clientDir, err := cmdHandler.getClientDir()
+	if err != nil {
+		t.Fatalf("Failed to get client directory: %v", err)
+	}
+	mirrorClientDir := filepath.Join(mirrorDir, filepath.Base(clientDir))
+
+	if resp := uploadForTest(t, cmdHandler, mockConn, "mirrored.txt", []byte("redundant")); !resp.Success {
+		t.Fatalf("Upload failed: %s", resp.Message)
+	}
+
+	for _, dir := range []string{clientDir, mirrorClientDir} {
+		content, err := os.ReadFile(filepath.Join(dir, "mirrored.txt"))
+		if err != nil {
+			t.Fatalf("File missing from %s: %v", dir, err)
+		}
+		if string(content) != "redundant" {
+			t.Errorf("Content mismatch in %s: got %q", dir, string(content))
+		}
+	}
+
+	if resp := deleteForTest(t, cmdHandler, mockConn, "mirrored.txt"); !resp.Success {
+		t.Fatalf("Delete failed: %s", resp.Message)
+	}
+
+	for _, dir := range []string{clientDir, mirrorClientDir} {
+		if _, err := os.Stat(filepath.Join(dir, "mirrored.txt")); !os.IsNotExist(err) {
+			t.Errorf("File still present in %s after delete", dir)
+		}
+	}
+}
+
+func TestMirror_Failure(t *testing.T) {
+	tests := []struct {
+		name          string
+		strict        bool
+		expectSuccess bool
+	}{
+		{name: "best effort", strict: false, expectSuccess: true},
+		{name: "strict", strict: true, expectSuccess: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := createTestTempDir(t)
+			defer cleanupTestTempDir(t, tempDir)
+
+			// A regular file where the mirror directory should be makes every mirror write fail
+			mirrorDir := filepath.Join(t.TempDir(), "not-a-dir")
+			if err := os.WriteFile(mirrorDir, nil, 0644); err != nil {
+				t.Fatalf("Failed to create mirror blocker: %v", err)
+			}
+
+			cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+			cmdHandler.config = &ServerConfig{RootDir: &tempDir, MirrorDir: mirrorDir, MirrorStrict: tt.strict}
+
+			clientDir, err := cmdHandler.getClientDir()
+			if err != nil {
+				t.Fatalf("Failed to get client directory: %v", err)
+			}
+
+			resp := uploadForTest(t, cmdHandler, mockConn, "primary.txt", []byte("primary"))
+			if resp.Success != tt.expectSuccess {
+				t.Errorf("Expected success=%v, got %v (%s)", tt.expectSuccess, resp.Success, resp.Message)
+			}
+
+			// The primary copy is written either way
+			content, err := os.ReadFile(filepath.Join(clientDir, "primary.txt"))
+			if err != nil {
+				t.Fatalf("Primary file missing: %v", err)
+			}
+			if string(content) != "primary" {
+				t.Errorf("Primary content mismatch: got %q", string(content))
+			}
+		})
+	}
+}
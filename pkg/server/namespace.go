@@ -0,0 +1,33 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+)
+
+// maxNamespaceLength bounds client-provided namespace names
+const maxNamespaceLength = 64
+
+// namespacePattern restricts namespaces to a portable, unambiguous character set
+var namespacePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// validateNamespace checks a client-provided namespace name
+func validateNamespace(namespace string) error {
+	if len(namespace) > maxNamespaceLength {
+		return fmt.Errorf("namespace exceeds %d characters", maxNamespaceLength)
+	}
+	if !namespacePattern.MatchString(namespace) {
+		return fmt.Errorf("invalid namespace %q", namespace)
+	}
+	return nil
+}
+
+// namespaceDirName maps a namespace of the identity with directory identityDir to its
+// storage directory name, so a namespace is only reachable with the identity's key.
+// Hashing keeps names uniform and the "ns-" prefix keeps them apart from per-key directories.
+func namespaceDirName(identityDir, namespace string) string {
+	hash := sha256.Sum256([]byte("namespace:" + identityDir + ":" + namespace))
+	return "ns-" + hex.EncodeToString(hash[:16])
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// sessionContext returns the context that ends with the connection, or Background
+// when the handler runs standalone
+func (handler *CommandHandler) sessionContext() context.Context {
+	if handler.ctx == nil {
+		return context.Background()
+	}
+	return handler.ctx
+}
+
+// paceChunk waits ChunkPacing before the next chunk is sent, smoothing bursts for
+// downstream buffers. The wait ends early with the transfer context's error.
+func (handler *CommandHandler) paceChunk() error {
+	pacing := handler.settings().ChunkPacing
+	if pacing <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(pacing)
+	defer timer.Stop()
+
+	ctx := handler.transferContext()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+)
+
+// timedSender records when each message was sent
+type timedSender struct {
+	mu    sync.Mutex
+	times []time.Time
+}
+
+func (s *timedSender) SendSecureMessage(message *protocol.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.times = append(s.times, time.Now())
+	return nil
+}
+
+func TestSendFileInChunks_Pacing(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	const pacing = 50 * time.Millisecond
+	sender := &timedSender{}
+	handler := NewCommandHandler(sender, createTestLogger(t), &tempDir, make([]byte, 32))
+	handler.config = &ServerConfig{ChunkPacing: pacing}
+
+	// Three small-file chunks
+	data := make([]byte, 3*protocol.SmallChunkSize)
+	if err := handler.sendFileInChunks("paced.bin", data, 0, 1, 0); err != nil {
+		t.Fatalf("sendFileInChunks failed: %v", err)
+	}
+
+	if len(sender.times) != 3 {
+		t.Fatalf("Expected 3 chunks, got %d", len(sender.times))
+	}
+	for i := 1; i < len(sender.times); i++ {
+		if gap := sender.times[i].Sub(sender.times[i-1]); gap < pacing {
+			t.Errorf("Chunk %d arrived %v after the previous one, want at least %v", i, gap, pacing)
+		}
+	}
+}
+
+func TestSendFileInChunks_PacingCancelled(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	sender := &timedSender{}
+	handler := NewCommandHandler(sender, createTestLogger(t), &tempDir, make([]byte, 32))
+	handler.config = &ServerConfig{ChunkPacing: 10 * time.Second}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	handler.ctx = ctx
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := handler.sendFileInChunks("paced.bin", make([]byte, 2*protocol.SmallChunkSize), 0, 1, 0)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Cancellation took %v to interrupt the pacing wait", elapsed)
+	}
+	if len(sender.times) != 1 {
+		t.Errorf("Expected only the first chunk before cancellation, got %d", len(sender.times))
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+
+	protocol "github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// storageUsage returns the bytes held by the client's files, including uploads staged
+// in an open transaction
+func (handler *CommandHandler) storageUsage() (int64, error) {
+	if !handler.onDisk() {
+		files, err := handler.storage().List(handler.storageClient(), "", true)
+		if err != nil {
+			return 0, err
+		}
+		var usage int64
+		for _, file := range files {
+			if !file.IsDir {
+				usage += file.Size
+			}
+		}
+		return usage, nil
+	}
+
+	clientDir, err := handler.getClientDir()
+	if err != nil {
+		return 0, err
+	}
+
+	usage, err := directorySize(clientDir)
+	if err != nil {
+		return 0, err
+	}
+	if handler.tx != nil {
+		staged, err := directorySize(handler.tx.dir)
+		if err != nil {
+			return 0, err
+		}
+		usage += staged
+	}
+	return usage, nil
+}
+
+// directorySize sums the sizes of the regular files below dir. Symbolic links are
+// neither followed nor counted, so a link cannot pull files outside dir into the total.
+func directorySize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// checkQuota returns the refusal message and its error code when storing incoming more
+// bytes would take the client past MaxClientBytes, or "" when the upload fits
+func (handler *CommandHandler) checkQuota(filename string, incoming uint64) (protocol.ErrorCode, string) {
+	limit := handler.settings().MaxClientBytes
+	if limit <= 0 {
+		return protocol.ErrCodeNone, ""
+	}
+
+	usage, err := handler.storageUsage()
+	if err != nil {
+		handler.logger.Error("Failed to measure storage usage", zap.Error(err))
+		return protocol.ErrCodeIO, "Failed to check storage quota"
+	}
+
+	if incoming > uint64(limit) || uint64(usage)+incoming > uint64(limit) {
+		handler.logger.Warn("Upload exceeds storage quota",
+			zap.String("filename", filename),
+			zap.Uint64("size", incoming),
+			zap.Int64("usage", usage),
+			zap.Int64("limit", limit))
+		return protocol.ErrCodeQuotaExceeded, fmt.Sprintf("Quota exceeded: %d bytes used, %d more would exceed the limit of %d", usage, incoming, limit)
+	}
+	return protocol.ErrCodeNone, ""
+}
+
+// handleUsage reports the bytes the client stores, counted the way the quota counts
+// them, and the quota itself
+func (handler *CommandHandler) handleUsage(command *protocol.CommandMessage) error {
+	handler.logger.Info("Usage command received")
+
+	usage, err := handler.storageUsage()
+	if err != nil {
+		handler.logger.Error("Failed to measure storage usage", zap.Error(err))
+		return handler.sendFailure(protocol.ErrCodeIO, "Failed to measure storage usage")
+	}
+	quota := handler.settings().MaxClientBytes
+
+	responsePayload, err := protocol.SerializeResponse(true, "", protocol.SerializeUsage(usage, quota))
+	if err != nil {
+		return err
+	}
+	handler.logger.Debug("Sending usage", zap.Int64("usage", usage), zap.Int64("quota", quota))
+	response := protocol.NewMessage(protocol.MessageTypeResponse, responsePayload)
+	return handler.conn.SendSecureMessage(response)
+}
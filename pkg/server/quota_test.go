@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+)
+
+func TestUpload_Quota(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+	cmdHandler.config = &ServerConfig{MaxClientBytes: 100}
+
+	// Uploads up to exactly the quota are accepted
+	if resp := uploadForTest(t, cmdHandler, mockConn, "first.bin", bytes.Repeat([]byte("a"), 60)); !resp.Success {
+		t.Fatalf("Upload within quota failed: %s", resp.Message)
+	}
+	beginUploadForTest(t, cmdHandler, mockConn, "second.bin", 40)
+	sendChunkForTest(t, cmdHandler, 0, 1, bytes.Repeat([]byte("b"), 40))
+	if resp, _ := protocol.DeserializeResponse(mockConn.sentMessages[1].Payload); !resp.Success {
+		t.Fatalf("Chunked upload filling the quota failed: %s", resp.Message)
+	}
+
+	// One byte more is refused on both upload paths
+	resp := uploadForTest(t, cmdHandler, mockConn, "over.bin", []byte("c"))
+	if resp.Success || !strings.HasPrefix(resp.Message, "Quota exceeded") {
+		t.Errorf("Expected quota refusal, got success=%v message=%q", resp.Success, resp.Message)
+	}
+
+	mockConn.ClearSentMessages()
+	command := &protocol.CommandMessage{
+		Command:  protocol.CommandUploadChunk,
+		Filename: "over.bin",
+		Data:     binary.BigEndian.AppendUint64(nil, 1),
+	}
+	if err := cmdHandler.handle(command); err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+	resp, _ = protocol.DeserializeResponse(mockConn.sentMessages[0].Payload)
+	if resp.Success || !strings.HasPrefix(resp.Message, "Quota exceeded") {
+		t.Errorf("Expected chunked upload to be refused before any chunk, got success=%v message=%q", resp.Success, resp.Message)
+	}
+	if cmdHandler.upload != nil {
+		t.Error("Refused chunked upload should not leave an upload in progress")
+	}
+	assertNoUploadLeftovers(t, cmdHandler, "over.bin")
+
+	// Deleting a file frees its space again
+	mockConn.ClearSentMessages()
+	if err := cmdHandler.handle(&protocol.CommandMessage{Command: protocol.CommandDelete, Filename: "first.bin"}); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if resp := uploadForTest(t, cmdHandler, mockConn, "after-delete.bin", []byte("d")); !resp.Success {
+		t.Errorf("Upload after freeing space failed: %s", resp.Message)
+	}
+}
+
+func TestHandleUsage(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+	cmdHandler.config = &ServerConfig{MaxClientBytes: 1000}
+	clientDir, _ := cmdHandler.getClientDir()
+
+	if resp := uploadForTest(t, cmdHandler, mockConn, "a.bin", bytes.Repeat([]byte("a"), 60)); !resp.Success {
+		t.Fatalf("Upload failed: %s", resp.Message)
+	}
+	if err := os.MkdirAll(filepath.Join(clientDir, "sub"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(clientDir, "sub", "b.bin"), bytes.Repeat([]byte("b"), 40), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	// Links, even to large files outside the client directory, are not counted
+	outside := filepath.Join(tempDir, "outside.bin")
+	if err := os.WriteFile(outside, bytes.Repeat([]byte("x"), 500), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(clientDir, "link.bin")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := os.Symlink(tempDir, filepath.Join(clientDir, "linkdir")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	mockConn.ClearSentMessages()
+	if err := cmdHandler.handle(&protocol.CommandMessage{Command: protocol.CommandUsage}); err != nil {
+		t.Fatalf("Usage failed: %v", err)
+	}
+	resp, err := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload)
+	if err != nil || !resp.Success {
+		t.Fatalf("Expected usage to succeed, got %+v (%v)", resp, err)
+	}
+	used, quota, err := protocol.DeserializeUsage(resp.Data)
+	if err != nil {
+		t.Fatalf("DeserializeUsage failed: %v", err)
+	}
+	if used != 100 || quota != 1000 {
+		t.Errorf("Usage = %d / %d, want 100 / 1000", used, quota)
+	}
+}
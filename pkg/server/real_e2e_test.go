@@ -3,17 +3,42 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	clientpkg "github.com/lcensies/ssnproj/pkg/client"
+	protocol "github.com/lcensies/ssnproj/pkg/protocol"
 	rsaUtil "github.com/lcensies/ssnproj/pkg/rsa"
+	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 // TestServer represents a test server instance
@@ -35,6 +60,11 @@ type TestClient struct {
 
 // setupTestServer creates and starts a test server
 func setupTestServer(t *testing.T) *TestServer {
+	return setupTestServerWithConfig(t, nil)
+}
+
+// setupTestServerWithConfig creates and starts a test server, letting configure adjust the config first
+func setupTestServerWithConfig(t *testing.T, configure func(config *ServerConfig)) *TestServer {
 	// Create temporary directory for server data
 	tempDir := createTestTempDir(t)
 
@@ -80,6 +110,9 @@ func setupTestServer(t *testing.T) *TestServer {
 		ConfigFolder: keyDir,
 		RootDir:      &tempDir,
 	}
+	if configure != nil {
+		configure(config)
+	}
 
 	// Create server
 	server, err := NewServer(config)
@@ -115,8 +148,25 @@ func (ts *TestServer) cleanupTestServer(t *testing.T) {
 	ts.logger.Sync()
 }
 
+// restartTestServer shuts the test server down, closing its connections, and starts a
+// new one with the same config and key pair on the same port
+func (ts *TestServer) restartTestServer(t *testing.T) {
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	ts.server.Shutdown(shutdownCtx)
+
+	server, err := NewServer(ts.server.config)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	server.SetRSAKeyPair(ts.server.rsaKeyPair)
+	go server.Run()
+	time.Sleep(100 * time.Millisecond)
+	ts.server = server
+}
+
 // setupTestClient creates a test client connected to the server
-func setupTestClient(t *testing.T, server *TestServer) *TestClient {
+func setupTestClient(t *testing.T, server *TestServer, opts ...clientpkg.ClientOption) *TestClient {
 	logger, err := zap.NewDevelopment()
 	if err != nil {
 		t.Fatalf("Failed to create client logger: %v", err)
@@ -126,7 +176,7 @@ func setupTestClient(t *testing.T, server *TestServer) *TestClient {
 
 	// Use the server's public key file
 	serverPubKeyPath := filepath.Join(server.keyDir, "public.pem")
-	client, err := clientpkg.NewClientWithServerPubKey(ctx, server.host, server.port, serverPubKeyPath, logger)
+	client, err := clientpkg.NewClientWithServerPubKey(ctx, server.host, server.port, serverPubKeyPath, logger, opts...)
 	if err != nil {
 		t.Fatalf("Failed to create client: %v", err)
 	}
@@ -237,7 +287,7 @@ func TestRealE2E_UploadFile(t *testing.T) {
 	downloadFile := createTestTempFile(t, "")
 	defer os.Remove(downloadFile)
 
-	err = client.client.DownloadFile(ctx, expectedFilename, downloadFile)
+	err = client.client.DownloadFile(ctx, expectedFilename, downloadFile, nil)
 	if err != nil {
 		t.Fatalf("Failed to download uploaded file: %v", err)
 	}
@@ -281,7 +331,7 @@ func TestRealE2E_DownloadFile(t *testing.T) {
 	defer os.Remove(downloadFile)
 
 	// Test download
-	err = client.client.DownloadFile(ctx, testFilename, downloadFile)
+	err = client.client.DownloadFile(ctx, testFilename, downloadFile, nil)
 	if err != nil {
 		t.Fatalf("DownloadFile failed: %v", err)
 	}
@@ -297,6 +347,95 @@ func TestRealE2E_DownloadFile(t *testing.T) {
 	}
 }
 
+func TestRealE2E_TransferStats(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+	ctx := context.Background()
+
+	// Several chunks, the last one short
+	content := strings.Repeat("stats", 3*protocol.SmallChunkSize/5+100)
+	size := uint64(len(content))
+	wantChunks := protocol.ChunkCount(size, protocol.ChunkSizeFor(size))
+	uploadFile := createTestTempFile(t, content)
+	defer os.Remove(uploadFile)
+
+	stats, err := client.client.UploadFileWithStats(ctx, uploadFile, "stats.bin", nil)
+	if err != nil {
+		t.Fatalf("UploadFileWithStats failed: %v", err)
+	}
+	if stats.Bytes != size || stats.Chunks != wantChunks {
+		t.Errorf("Upload reported %d bytes in %d chunks, want %d in %d", stats.Bytes, stats.Chunks, size, wantChunks)
+	}
+	if stats.Duration <= 0 || stats.ThroughputMBps <= 0 {
+		t.Errorf("Upload reported no timing: %+v", stats)
+	}
+
+	downloadFile := filepath.Join(t.TempDir(), "stats.bin")
+	stats, err = client.client.DownloadFileWithStats(ctx, "stats.bin", downloadFile, nil)
+	if err != nil {
+		t.Fatalf("DownloadFileWithStats failed: %v", err)
+	}
+	if stats.Bytes != size || stats.Chunks != wantChunks {
+		t.Errorf("Download reported %d bytes in %d chunks, want %d in %d", stats.Bytes, stats.Chunks, size, wantChunks)
+	}
+	if stats.Duration <= 0 || stats.ThroughputMBps <= 0 || stats.RTT <= 0 {
+		t.Errorf("Download reported no timing: %+v", stats)
+	}
+	if want := protocol.ChunkSizeFor(size); stats.ChunkSize != want {
+		t.Errorf("Download reported %d byte chunks, want %d", stats.ChunkSize, want)
+	}
+}
+
+func TestRealE2E_AdaptiveChunkSize(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	const delay = 10 * time.Millisecond
+	port := startLatencyProxy(t, net.JoinHostPort(server.host, server.port), delay)
+	viaProxy := &TestServer{host: "127.0.0.1", port: port, keyDir: server.keyDir}
+	client := setupTestClient(t, viaProxy, clientpkg.WithAdaptiveChunkSize())
+	defer client.cleanupTestClient(t)
+	ctx := context.Background()
+
+	content := generateRandomData(2 * 1024 * 1024)
+	source := createTestTempFile(t, string(content))
+	defer os.Remove(source)
+	if err := client.client.UploadFileTo(ctx, source, "adaptive.bin", nil); err != nil {
+		t.Fatalf("UploadFileTo failed: %v", err)
+	}
+
+	// Every frame costs the same delay, so each larger chunk size pays off and the
+	// client keeps growing it up to the protocol's maximum
+	var sizes []uint32
+	dir := t.TempDir()
+	for i := 0; i < 10; i++ {
+		output := filepath.Join(dir, fmt.Sprintf("adaptive-%d.bin", i))
+		stats, err := client.client.DownloadFileWithStats(ctx, "adaptive.bin", output, nil)
+		if err != nil {
+			t.Fatalf("Download %d failed: %v", i, err)
+		}
+		if stats.RTT < delay {
+			t.Errorf("Download %d reported a %v round trip through a %v link", i, stats.RTT, delay)
+		}
+		downloaded, err := os.ReadFile(output)
+		if err != nil || !bytes.Equal(downloaded, content) {
+			t.Fatalf("Download %d does not match the upload: %v", i, err)
+		}
+		sizes = append(sizes, stats.ChunkSize)
+	}
+
+	t.Logf("Chunk sizes: %v", sizes)
+	if sizes[0] != protocol.SmallChunkSize {
+		t.Errorf("First download used %d byte chunks, want %d", sizes[0], protocol.SmallChunkSize)
+	}
+	if last := sizes[len(sizes)-1]; last != protocol.MaxChunkSize {
+		t.Errorf("Chunk size reached %d after %d downloads, want %d", last, len(sizes), protocol.MaxChunkSize)
+	}
+}
+
 // TestRealE2E_DownloadLargeFile tests downloading a large file with chunked transfer
 func TestRealE2E_DownloadLargeFile(t *testing.T) {
 	// Setup server
@@ -335,7 +474,7 @@ func TestRealE2E_DownloadLargeFile(t *testing.T) {
 	defer os.Remove(downloadFile)
 
 	// Test download
-	err = client.client.DownloadFile(ctx, testFilename, downloadFile)
+	err = client.client.DownloadFile(ctx, testFilename, downloadFile, nil)
 	if err != nil {
 		t.Fatalf("DownloadFile failed: %v", err)
 	}
@@ -400,7 +539,7 @@ func TestRealE2E_DownloadVeryLargeFile(t *testing.T) {
 	ctx2, cancel2 := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel2()
 
-	err = client.client.DownloadFile(ctx2, testFilename, downloadFile)
+	err = client.client.DownloadFile(ctx2, testFilename, downloadFile, nil)
 	if err != nil {
 		t.Fatalf("DownloadFile failed: %v", err)
 	}
@@ -529,7 +668,7 @@ func TestRealE2E_CompleteWorkflow(t *testing.T) {
 	downloadFile := createTestTempFile(t, "")
 	defer os.Remove(downloadFile)
 
-	err = client.client.DownloadFile(ctx, expectedFilename, downloadFile)
+	err = client.client.DownloadFile(ctx, expectedFilename, downloadFile, nil)
 	if err != nil {
 		t.Fatalf("DownloadFile failed: %v", err)
 	}
@@ -574,10 +713,13 @@ func TestRealE2E_ErrorHandling(t *testing.T) {
 	ctx := context.Background()
 
 	// Test downloading non-existent file
-	err := client.client.DownloadFile(ctx, "nonexistent.txt", "output.txt")
+	err := client.client.DownloadFile(ctx, "nonexistent.txt", "output.txt", nil)
 	if err == nil {
 		t.Error("Expected error when downloading non-existent file")
 	}
+	if _, err := os.Stat("output.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the failed download to leave no output file, got %v", err)
+	}
 
 	// Test deleting non-existent file
 	err = client.client.DeleteFile(ctx, "nonexistent.txt")
@@ -631,7 +773,7 @@ func TestRealE2E_MultipleClients(t *testing.T) {
 	downloadFile := createTestTempFile(t, "")
 	defer os.Remove(downloadFile)
 
-	err = client2.client.DownloadFile(ctx, expectedFilename, downloadFile)
+	err = client2.client.DownloadFile(ctx, expectedFilename, downloadFile, nil)
 	if err == nil {
 		t.Errorf("Client 2 should NOT be able to download client 1's file (isolated storage)")
 	}
@@ -685,3 +827,3356 @@ func saveTestKeyPair(keyPair *rsaUtil.RSAKeyPair, keyDir string) error {
 
 	return nil
 }
+
+// TestRealE2E_UploadAsync fires several uploads without waiting and collects their acknowledgements
+func TestRealE2E_UploadAsync(t *testing.T) {
+	// Setup server
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	// Setup client
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+
+	// Fire off several uploads back to back
+	contents := make(map[string]string)
+	results := make([]<-chan error, 0, 5)
+	for i := 0; i < 5; i++ {
+		content := fmt.Sprintf("async upload content %d %s", i, strings.Repeat("x", i*1024))
+		tempFile := createTestTempFile(t, content)
+		defer os.Remove(tempFile)
+
+		contents[filepath.Base(tempFile)] = content
+		results = append(results, client.client.UploadAsync(ctx, tempFile))
+	}
+
+	// Collect every acknowledgement
+	for i, result := range results {
+		select {
+		case err := <-result:
+			if err != nil {
+				t.Errorf("Async upload %d failed: %v", i, err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for async upload %d", i)
+		}
+	}
+
+	// Verify server-side state through the regular synchronous API
+	fileList, err := client.client.ListFiles(ctx)
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+
+	for name, content := range contents {
+		if !strings.Contains(fileList, name) {
+			t.Errorf("File list does not contain %s. List: %s", name, fileList)
+			continue
+		}
+
+		outputPath := filepath.Join(t.TempDir(), name)
+		if err := client.client.DownloadFile(ctx, name, outputPath, nil); err != nil {
+			t.Fatalf("DownloadFile failed for %s: %v", name, err)
+		}
+
+		downloaded, err := os.ReadFile(outputPath)
+		if err != nil {
+			t.Fatalf("Failed to read downloaded file: %v", err)
+		}
+		if string(downloaded) != content {
+			t.Errorf("Content mismatch for %s", name)
+		}
+	}
+}
+
+// TestRealE2E_ForgedHandshakeConfirmation ensures a plaintext confirmation from an impostor is rejected
+func TestRealE2E_ForgedHandshakeConfirmation(t *testing.T) {
+	refusal, _ := protocol.SerializeResponse(false, "invalid session key size: 20 bytes", nil)
+	tests := []struct {
+		name    string
+		payload []byte
+		wantErr string
+	}{
+		// The impostor swallows the encrypted key and answers with the old plaintext confirmation
+		{"plaintext confirmation", []byte("handshake complete"), "failed verification"},
+		// Plaintext refusals are reported, they cannot make the handshake succeed
+		{"plaintext refusal", refusal, "handshake rejected: invalid session key size"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to create listener: %v", err)
+			}
+			defer listener.Close()
+
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+
+				header := make([]byte, 5)
+				if _, err := io.ReadFull(conn, header); err != nil {
+					return
+				}
+				payload := make([]byte, binary.BigEndian.Uint32(header[1:5]))
+				if _, err := io.ReadFull(conn, payload); err != nil {
+					return
+				}
+
+				forged, _ := protocol.NewMessage(protocol.MessageTypeResponse, tt.payload).Serialize()
+				conn.Write(forged)
+			}()
+
+			_, pubKey := rsaUtil.GenerateKeyPair(2048)
+			_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+			ctx := context.Background()
+			client, err := clientpkg.NewClient(ctx, "127.0.0.1", port, pubKey, zap.NewNop())
+			if err != nil {
+				t.Fatalf("Failed to create client: %v", err)
+			}
+			defer client.Close(ctx)
+
+			err = client.PerformHandshake(ctx)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected handshake to fail with %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// TestRealE2E_HandshakeBadKeyLength verifies a session key of the wrong size is refused
+// during the handshake with a readable reason
+func TestRealE2E_HandshakeBadKeyLength(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	pubKeyBytes, err := os.ReadFile(filepath.Join(server.keyDir, "public.pem"))
+	if err != nil {
+		t.Fatalf("Failed to read server public key: %v", err)
+	}
+	pubKey := rsaUtil.BytesToPublicKey(pubKeyBytes)
+
+	for _, keyLen := range []int{0, 20, 31, 33} {
+		t.Run(fmt.Sprintf("%d bytes", keyLen), func(t *testing.T) {
+			conn, err := net.Dial("tcp", net.JoinHostPort(server.host, server.port))
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer conn.Close()
+
+			payload, err := protocol.SerializeHandshakeRequest(&protocol.HandshakeRequest{
+				EncryptedKey: rsaUtil.EncryptWithPublicKey(make([]byte, keyLen), pubKey),
+			})
+			if err != nil {
+				t.Fatalf("Failed to serialize handshake: %v", err)
+			}
+			frame, _ := protocol.NewMessage(protocol.MessageTypeHandshake, payload).Serialize()
+			if _, err := conn.Write(frame); err != nil {
+				t.Fatalf("Failed to send handshake: %v", err)
+			}
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			header := make([]byte, 5)
+			if _, err := io.ReadFull(conn, header); err != nil {
+				t.Fatalf("Expected a rejection, got %v", err)
+			}
+			body := make([]byte, binary.BigEndian.Uint32(header[1:5]))
+			if _, err := io.ReadFull(conn, body); err != nil {
+				t.Fatalf("Failed to read rejection: %v", err)
+			}
+			resp, err := protocol.DeserializeResponse(body)
+			if err != nil {
+				t.Fatalf("Rejection is not a plaintext response: %v", err)
+			}
+			want := fmt.Sprintf("invalid session key size: %d bytes", keyLen)
+			if resp.Success || resp.Message != want {
+				t.Errorf("Got success=%v message=%q, want refusal %q", resp.Success, resp.Message, want)
+			}
+
+			// The server hangs up after refusing
+			if _, err := io.ReadFull(conn, header); err == nil {
+				t.Error("Expected the connection to be closed after the rejection")
+			}
+		})
+	}
+}
+
+// countingDecrypter wraps a private key and records every handshake decryption
+type countingDecrypter struct {
+	key   *rsa.PrivateKey
+	calls atomic.Int32
+}
+
+func (d *countingDecrypter) Public() crypto.PublicKey {
+	return d.key.Public()
+}
+
+func (d *countingDecrypter) Decrypt(rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	d.calls.Add(1)
+	return d.key.Decrypt(rand, msg, opts)
+}
+
+func (d *countingDecrypter) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return d.key.Sign(rand, digest, opts)
+}
+
+// substitutedKey decrypts with the trusted key but signs with another one, standing in
+// for a server whose key does not match the one the client pinned
+type substitutedKey struct {
+	decryptKey *rsa.PrivateKey
+	signKey    *rsa.PrivateKey
+}
+
+func (k *substitutedKey) Public() crypto.PublicKey {
+	return k.decryptKey.Public()
+}
+
+func (k *substitutedKey) Decrypt(rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	return k.decryptKey.Decrypt(rand, msg, opts)
+}
+
+func (k *substitutedKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.signKey.Sign(rand, digest, opts)
+}
+
+// decryptOnlyKey is a decrypter that cannot sign
+type decryptOnlyKey struct {
+	key *rsa.PrivateKey
+}
+
+func (k *decryptOnlyKey) Public() crypto.PublicKey {
+	return k.key.Public()
+}
+
+func (k *decryptOnlyKey) Decrypt(rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	return k.key.Decrypt(rand, msg, opts)
+}
+
+// TestRealE2E_HandshakeSignature verifies the client only accepts a handshake signed with the pinned key
+func TestRealE2E_HandshakeSignature(t *testing.T) {
+	privKey, pubKey := rsaUtil.GenerateKeyPair(2048)
+	otherKey, _ := rsaUtil.GenerateKeyPair(2048)
+
+	tests := []struct {
+		name      string
+		decrypter crypto.Decrypter
+		wantErr   string
+	}{
+		{"signed with a different key", &substitutedKey{decryptKey: privKey, signKey: otherKey}, "signature verification failed"},
+		{"key cannot sign", &decryptOnlyKey{key: privKey}, "server key cannot sign"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := setupTestServerWithConfig(t, func(config *ServerConfig) {
+				config.Decrypter = tt.decrypter
+			})
+			defer server.cleanupTestServer(t)
+
+			ctx := context.Background()
+			client, err := clientpkg.NewClient(ctx, server.host, server.port, pubKey, zap.NewNop())
+			if err != nil {
+				t.Fatalf("Failed to create client: %v", err)
+			}
+			defer client.Close(ctx)
+
+			err = client.PerformHandshake(ctx)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected handshake to fail with %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// TestRealE2E_HandshakeUsesConfiguredDecrypter verifies the handshake routes through ServerConfig.Decrypter
+func TestRealE2E_HandshakeUsesConfiguredDecrypter(t *testing.T) {
+	privKey, pubKey := rsaUtil.GenerateKeyPair(2048)
+	decrypter := &countingDecrypter{key: privKey}
+
+	server := setupTestServerWithConfig(t, func(config *ServerConfig) {
+		config.Decrypter = decrypter
+	})
+	defer server.cleanupTestServer(t)
+
+	ctx := context.Background()
+	client, err := clientpkg.NewClient(ctx, server.host, server.port, pubKey, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close(ctx)
+
+	if err := client.PerformHandshake(ctx); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+
+	if calls := decrypter.calls.Load(); calls != 1 {
+		t.Errorf("Expected 1 decrypter call, got %d", calls)
+	}
+
+	// The session established through the decrypter must be usable
+	if _, err := client.ListFiles(ctx); err != nil {
+		t.Errorf("ListFiles failed after handshake: %v", err)
+	}
+}
+
+// TestRealE2E_MaxSessionDuration verifies expired sessions are closed and clients can reconnect
+func TestRealE2E_MaxSessionDuration(t *testing.T) {
+	server := setupTestServerWithConfig(t, func(config *ServerConfig) {
+		config.MaxSessionDuration = 300 * time.Millisecond
+	})
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+
+	// Operations inside the session window work normally
+	if _, err := client.client.ListFiles(ctx); err != nil {
+		t.Fatalf("ListFiles failed within session window: %v", err)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	// The server has closed the session, leaving only the expiry notice
+	_, err := client.client.ListFiles(ctx)
+	if err == nil {
+		t.Fatal("Expected ListFiles to fail after the session expired")
+	}
+	if !strings.Contains(err.Error(), "Session expired") {
+		t.Errorf("Expected session expiry notice, got: %v", err)
+	}
+
+	// A fresh connection re-handshakes and works again
+	reconnected := setupTestClient(t, server)
+	defer reconnected.cleanupTestClient(t)
+
+	if _, err := reconnected.client.ListFiles(ctx); err != nil {
+		t.Errorf("ListFiles failed after reconnecting: %v", err)
+	}
+}
+
+// testIdentity returns the option giving a client a fresh long-lived identity
+func testIdentity(t *testing.T) clientpkg.ClientOption {
+	identity, err := clientpkg.LoadOrCreateClientIdentity(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create client identity: %v", err)
+	}
+	return clientpkg.WithIdentity(identity)
+}
+
+// TestRealE2E_Namespace checks that clients sharing an identity and namespace see the
+// same files and others do not
+func TestRealE2E_Namespace(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	ctx := context.Background()
+	team := testIdentity(t)
+
+	writer := setupTestClient(t, server, team, clientpkg.WithNamespace("team-a"))
+	defer writer.cleanupTestClient(t)
+
+	content := "shared namespace content"
+	tempFile := createTestTempFile(t, content)
+	defer os.Remove(tempFile)
+	fileName := filepath.Base(tempFile)
+
+	if err := writer.client.UploadFile(ctx, tempFile); err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+
+	// A second connection with the same namespace gets a new session key but the same directory
+	reader := setupTestClient(t, server, team, clientpkg.WithNamespace("team-a"))
+	defer reader.cleanupTestClient(t)
+
+	outputPath := filepath.Join(t.TempDir(), fileName)
+	if err := reader.client.DownloadFile(ctx, fileName, outputPath, nil); err != nil {
+		t.Fatalf("DownloadFile from shared namespace failed: %v", err)
+	}
+	downloaded, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("Failed to read downloaded file: %v", err)
+	}
+	if string(downloaded) != content {
+		t.Errorf("Downloaded content mismatch. Expected: %s, Got: %s", content, string(downloaded))
+	}
+
+	// Other namespaces, namespace-less clients and other identities naming the same
+	// namespace stay isolated
+	other := setupTestClient(t, server, team, clientpkg.WithNamespace("team-b"))
+	defer other.cleanupTestClient(t)
+	plain := setupTestClient(t, server, team)
+	defer plain.cleanupTestClient(t)
+	intruder := setupTestClient(t, server, testIdentity(t), clientpkg.WithNamespace("team-a"))
+	defer intruder.cleanupTestClient(t)
+
+	for name, tc := range map[string]*TestClient{"team-b": other, "no namespace": plain, "another identity": intruder} {
+		fileList, err := tc.client.ListFiles(ctx)
+		if err != nil {
+			t.Fatalf("ListFiles failed for %s: %v", name, err)
+		}
+		if strings.Contains(fileList, fileName) {
+			t.Errorf("Client with %s can see %s. List: %s", name, fileName, fileList)
+		}
+	}
+
+	// Without an identity a namespace is refused outright, so knowing a team's
+	// namespace is not enough to reach its files
+	unauthenticated, err := clientpkg.NewClientWithServerPubKey(ctx, server.host, server.port, filepath.Join(server.keyDir, "public.pem"), zap.NewNop(), clientpkg.WithNamespace("team-a"))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer unauthenticated.Close(ctx)
+	if err := unauthenticated.PerformHandshake(ctx); err == nil || !strings.Contains(err.Error(), "namespace requires a client identity") {
+		t.Errorf("Expected a namespace without an identity to be refused, got %v", err)
+	}
+}
+
+// TestRealE2E_DeleteDuringDownload deletes a file from one connection while another
+// connection in the same namespace is downloading it slowly. The download either
+// completes with the whole file or fails leaving at most a prefix of it to resume.
+func TestRealE2E_DeleteDuringDownload(t *testing.T) {
+	server := setupTestServerWithConfig(t, func(config *ServerConfig) {
+		config.ChunkPacing = 50 * time.Millisecond
+	})
+	defer server.cleanupTestServer(t)
+
+	ctx := context.Background()
+
+	identity := testIdentity(t)
+	reader := setupTestClient(t, server, identity, clientpkg.WithNamespace("race"))
+	defer reader.cleanupTestClient(t)
+	deleter := setupTestClient(t, server, identity, clientpkg.WithNamespace("race"))
+	defer deleter.cleanupTestClient(t)
+
+	content := strings.Repeat("delete during download ", 30*1024) // ~690 KB, several paced chunks
+	testFile := createTestTempFile(t, content)
+	defer os.Remove(testFile)
+	fileName := filepath.Base(testFile)
+	if err := reader.client.UploadFile(ctx, testFile); err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+
+	// Delete once the first chunk has arrived, while the rest are still paced
+	started := make(chan struct{})
+	var once sync.Once
+	progress := func(transferred, total uint64) {
+		if transferred > 0 && transferred < total {
+			once.Do(func() { close(started) })
+		}
+	}
+
+	outputPath := filepath.Join(t.TempDir(), fileName)
+	downloaded := make(chan error, 1)
+	go func() {
+		downloaded <- reader.client.DownloadFile(ctx, fileName, outputPath, progress)
+	}()
+
+	select {
+	case <-started:
+	case err := <-downloaded:
+		t.Fatalf("Download finished before the delete could race it: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Download did not start")
+	}
+	if err := deleter.client.DeleteFile(ctx, fileName); err != nil {
+		t.Fatalf("DeleteFile during download failed: %v", err)
+	}
+
+	downloadErr := <-downloaded
+	data, err := os.ReadFile(outputPath)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("Failed to read downloaded file: %v", err)
+	}
+	if downloadErr == nil && string(data) != content {
+		t.Errorf("Download succeeded with %d bytes that differ from the %d uploaded", len(data), len(content))
+	}
+	if downloadErr != nil && !strings.HasPrefix(content, string(data)) {
+		t.Errorf("Failed download (%v) left %d bytes that are not a prefix of the file", downloadErr, len(data))
+	}
+
+	if _, err := deleter.client.StatFile(ctx, fileName); !errors.Is(err, clientpkg.ErrFileNotFound) {
+		t.Errorf("Expected the file to be gone after the delete, got %v", err)
+	}
+}
+
+// TestRealE2E_InvalidNamespace checks that the server refuses namespaces that could escape the root directory
+func TestRealE2E_InvalidNamespace(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	ctx := context.Background()
+	serverPubKeyPath := filepath.Join(server.keyDir, "public.pem")
+
+	identity := testIdentity(t)
+	for _, namespace := range []string{"..", "../escape", "a/b", ".hidden", strings.Repeat("n", 65)} {
+		client, err := clientpkg.NewClientWithServerPubKey(ctx, server.host, server.port, serverPubKeyPath, zap.NewNop(), identity, clientpkg.WithNamespace(namespace))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+
+		err = client.PerformHandshake(ctx)
+		client.Close(ctx)
+		if err == nil {
+			t.Errorf("Handshake with namespace %q should have been rejected", namespace)
+		} else if !strings.Contains(err.Error(), "handshake rejected") {
+			t.Errorf("Unexpected error for namespace %q: %v", namespace, err)
+		}
+	}
+}
+
+// TestRealE2E_MinCipherStrength checks that weaker session keys are refused unless the server allows them
+func TestRealE2E_MinCipherStrength(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	ctx := context.Background()
+	serverPubKeyPath := filepath.Join(server.keyDir, "public.pem")
+
+	client, err := clientpkg.NewClientWithServerPubKey(ctx, server.host, server.port, serverPubKeyPath, zap.NewNop(), clientpkg.WithSessionKeySize(128))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	err = client.PerformHandshake(ctx)
+	client.Close(ctx)
+	if err == nil {
+		t.Fatal("AES-128 handshake should be rejected by a 256-only server")
+	}
+	if !strings.Contains(err.Error(), "AES-128") || !strings.Contains(err.Error(), "AES-256") {
+		t.Errorf("Rejection should name the offered and required strength, got: %v", err)
+	}
+
+	relaxed := setupTestServerWithConfig(t, func(cfg *ServerConfig) {
+		cfg.MinCipherStrength = 128
+	})
+	defer relaxed.cleanupTestServer(t)
+
+	tc := setupTestClient(t, relaxed, clientpkg.WithSessionKeySize(128))
+	defer tc.cleanupTestClient(t)
+
+	if _, err := tc.client.ListFiles(ctx); err != nil {
+		t.Errorf("AES-128 session should work when allowed: %v", err)
+	}
+}
+
+// TestRealE2E_ConcurrentClientUse shares one client between goroutines and checks no exchange is corrupted
+func TestRealE2E_ConcurrentClientUse(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+
+	const workers = 8
+	contents := make(map[string]string)
+	files := make([]string, workers)
+	for i := range files {
+		content := fmt.Sprintf("concurrent content %d %s", i, strings.Repeat("y", i*4096))
+		files[i] = createTestTempFile(t, content)
+		defer os.Remove(files[i])
+		contents[filepath.Base(files[i])] = content
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*3)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+
+			if err := client.client.UploadFile(ctx, path); err != nil {
+				errs <- fmt.Errorf("upload %s: %w", filepath.Base(path), err)
+				return
+			}
+			if _, err := client.client.ListFiles(ctx); err != nil {
+				errs <- fmt.Errorf("list: %w", err)
+			}
+
+			outputPath := filepath.Join(t.TempDir(), filepath.Base(path))
+			if err := client.client.DownloadFile(ctx, filepath.Base(path), outputPath, nil); err != nil {
+				errs <- fmt.Errorf("download %s: %w", filepath.Base(path), err)
+				return
+			}
+			downloaded, err := os.ReadFile(outputPath)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if string(downloaded) != contents[filepath.Base(path)] {
+				errs <- fmt.Errorf("content mismatch for %s", filepath.Base(path))
+			}
+		}(files[i])
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestRealE2E_ServerVersion checks that the server reports its build version
+func TestRealE2E_ServerVersion(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	version, err := client.client.ServerVersion(context.Background())
+	if err != nil {
+		t.Fatalf("ServerVersion failed: %v", err)
+	}
+	if version == "" {
+		t.Error("Expected a non-empty server version")
+	}
+	if version != protocol.Version {
+		t.Errorf("Expected version %q, got %q", protocol.Version, version)
+	}
+}
+
+// TestRealE2E_Ping checks that a ping succeeds on a live session and fails once the server is gone
+func TestRealE2E_Ping(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if err := client.client.Ping(ctx); err != nil {
+			t.Fatalf("Ping %d failed: %v", i+1, err)
+		}
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	server.server.Shutdown(shutdownCtx)
+	if err := client.client.Ping(ctx); err == nil {
+		t.Error("Expected ping to fail after the server shut down")
+	}
+}
+
+// TestRealE2E_UploadMemoryBounded checks that a chunked upload is streamed to disk
+// rather than held in memory, on either side
+func TestRealE2E_UploadMemoryBounded(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping large upload in short mode")
+	}
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	// Write the file in blocks so the test itself does not hold it in memory
+	const size = 64 * 1024 * 1024
+	testFile := filepath.Join(t.TempDir(), "large.bin")
+	file, err := os.Create(testFile)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	block := generateRandomData(1024 * 1024)
+	for written := 0; written < size; written += len(block) {
+		if _, err := file.Write(block); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	file.Close()
+
+	// Collect aggressively so per-chunk garbage does not count as growth
+	defer debug.SetGCPercent(debug.SetGCPercent(10))
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	baseline := stats.HeapInuse
+
+	// Sample the heap while the upload runs
+	var peak atomic.Uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var stats runtime.MemStats
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapInuse > peak.Load() {
+				peak.Store(stats.HeapInuse)
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}()
+
+	err = client.client.UploadFile(context.Background(), testFile)
+	close(done)
+	<-sampled
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	growth := int64(peak.Load()) - int64(baseline)
+	t.Logf("Peak heap growth during a %d MB upload: %.1f MB", size>>20, float64(growth)/(1<<20))
+	if growth > size/4 {
+		t.Errorf("Heap grew by %d bytes during a %d byte upload, the file is being buffered", growth, size)
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(server.tempDir, "*", "large.bin"))
+	if len(matches) != 1 {
+		t.Fatalf("Expected the stored file, found %v", matches)
+	}
+	if info, err := os.Stat(matches[0]); err != nil || info.Size() != size {
+		t.Errorf("Stored file is wrong: %v, %v", info, err)
+	}
+}
+
+// TestRealE2E_UploadAsyncLargeFile checks that asynchronous uploads are streamed in
+// chunks, so files larger than one frame go through alongside small ones
+func TestRealE2E_UploadAsyncLargeFile(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	// Larger than any frame the server buffers while an upload is open
+	large := make([]byte, 2*(protocol.MaxChunkSize+frameOverhead)+123)
+	rand.Read(large)
+	files := map[string][]byte{
+		"small-before.txt": []byte("before the large file"),
+		"large.bin":        large,
+		"small-after.txt":  []byte("after the large file"),
+	}
+	var results []<-chan error
+	for _, name := range []string{"small-before.txt", "large.bin", "small-after.txt"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, files[name], 0644); err != nil {
+			t.Fatalf("Failed to write local file: %v", err)
+		}
+		results = append(results, client.client.UploadAsync(ctx, path))
+	}
+
+	for i, result := range results {
+		select {
+		case err := <-result:
+			if err != nil {
+				t.Fatalf("Async upload %d failed: %v", i, err)
+			}
+		case <-time.After(30 * time.Second):
+			t.Fatalf("Timed out waiting for async upload %d", i)
+		}
+	}
+
+	for name, content := range files {
+		downloaded, err := client.client.DownloadBytes(ctx, name)
+		if err != nil {
+			t.Fatalf("DownloadBytes failed for %s: %v", name, err)
+		}
+		if !bytes.Equal(downloaded, content) {
+			t.Errorf("Content mismatch for %s: got %d bytes, want %d", name, len(downloaded), len(content))
+		}
+	}
+}
+
+// uploadSingleFrame uploads data as name in one CommandUpload frame, the whole-file
+// path the client no longer uses but servers still accept
+func uploadSingleFrame(ctx context.Context, client *clientpkg.Client, name string, data []byte) error {
+	cmdPayload, err := protocol.SerializeCommand(protocol.CommandUpload, name, data)
+	if err != nil {
+		return err
+	}
+	if err := client.SendSecureMessage(protocol.NewMessage(protocol.MessageTypeCommand, cmdPayload)); err != nil {
+		return err
+	}
+	response, err := client.ReceiveSecureMessage(ctx)
+	if err != nil {
+		return err
+	}
+	respMsg, err := protocol.DeserializeResponse(response.Payload)
+	if err != nil {
+		return err
+	}
+	if !respMsg.Success {
+		return errors.New(respMsg.Message)
+	}
+	return nil
+}
+
+// TestRealE2E_OversizedFrame checks that a frame beyond the upload limit is refused
+// without being buffered, and the connection closed
+func TestRealE2E_OversizedFrame(t *testing.T) {
+	server := setupTestServerWithConfig(t, func(config *ServerConfig) {
+		config.MaxUploadSize = 1024
+	})
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	// A whole-file upload travels as one frame
+	if err := uploadSingleFrame(context.Background(), client.client, "big.txt", bytes.Repeat([]byte("x"), 2*frameOverhead)); err == nil {
+		t.Fatal("Expected the oversized upload frame to be refused")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for server.server.ActiveConnections() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := server.server.ActiveConnections(); n != 0 {
+		t.Errorf("ActiveConnections = %d after an oversized frame, want 0", n)
+	}
+}
+
+// TestRealE2E_ErrorCodes checks that failed commands match the client's typed errors
+func TestRealE2E_ErrorCodes(t *testing.T) {
+	server := setupTestServerWithConfig(t, func(config *ServerConfig) {
+		config.MaxClientBytes = 64
+		config.OnCollision = CollisionReject
+	})
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+	small := createTestTempFile(t, "small")
+	defer os.Remove(small)
+	if err := client.client.UploadFile(ctx, small); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	if err := client.client.UploadFile(ctx, small); !errors.Is(err, clientpkg.ErrFileExists) {
+		t.Errorf("Expected ErrFileExists uploading over an existing file, got %v", err)
+	}
+	large := createTestTempFile(t, strings.Repeat("x", 128))
+	defer os.Remove(large)
+	if err := client.client.UploadFile(ctx, large); !errors.Is(err, clientpkg.ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+	}
+	if err := client.client.DeleteFile(ctx, "missing.txt"); !errors.Is(err, clientpkg.ErrFileNotFound) {
+		t.Errorf("Expected ErrFileNotFound deleting a missing file, got %v", err)
+	}
+	err := client.client.DownloadFile(ctx, "missing.txt", filepath.Join(t.TempDir(), "out"), nil)
+	if !errors.Is(err, clientpkg.ErrFileNotFound) {
+		t.Errorf("Expected ErrFileNotFound downloading a missing file, got %v", err)
+	}
+	if _, err := client.client.StatFile(ctx, "../escape.txt"); !errors.Is(err, clientpkg.ErrInvalidPath) {
+		t.Errorf("Expected ErrInvalidPath, got %v", err)
+	}
+}
+
+// TestRealE2E_UploadNoClobber uploads over an existing file with and without overwriting
+func TestRealE2E_UploadNoClobber(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	local := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(local, []byte("first"), 0644); err != nil {
+		t.Fatalf("Failed to write local file: %v", err)
+	}
+	if err := client.client.UploadFileNoClobber(ctx, local); err != nil {
+		t.Fatalf("No-clobber upload of a new file failed: %v", err)
+	}
+
+	if err := os.WriteFile(local, []byte("second"), 0644); err != nil {
+		t.Fatalf("Failed to write local file: %v", err)
+	}
+	if err := client.client.UploadFileNoClobber(ctx, local); !errors.Is(err, clientpkg.ErrFileExists) {
+		t.Fatalf("Expected ErrFileExists uploading over an existing file, got %v", err)
+	}
+	content, err := client.client.DownloadBytes(ctx, "notes.txt")
+	if err != nil || string(content) != "first" {
+		t.Fatalf("Expected the stored file to be untouched, got %q (%v)", content, err)
+	}
+
+	// UploadFile still overwrites
+	if err := client.client.UploadFile(ctx, local); err != nil {
+		t.Fatalf("Overwriting upload failed: %v", err)
+	}
+	content, err = client.client.DownloadBytes(ctx, "notes.txt")
+	if err != nil || string(content) != "second" {
+		t.Fatalf("Expected the stored file to be replaced, got %q (%v)", content, err)
+	}
+
+	// Inside a transaction the check happens when the upload is committed
+	if err := client.client.BeginTransaction(ctx); err != nil {
+		t.Fatalf("BeginTransaction failed: %v", err)
+	}
+	if err := client.client.UploadFileNoClobber(ctx, local); err != nil {
+		t.Fatalf("Staging no-clobber upload failed: %v", err)
+	}
+	if err := client.client.CommitTransaction(ctx); !errors.Is(err, clientpkg.ErrFileExists) {
+		t.Fatalf("Expected commit to fail with ErrFileExists, got %v", err)
+	}
+	content, err = client.client.DownloadBytes(ctx, "notes.txt")
+	if err != nil || string(content) != "second" {
+		t.Errorf("Expected the rolled back commit to leave the file, got %q (%v)", content, err)
+	}
+}
+
+// TestRealE2E_ValidateUpload checks names through the client without storing anything
+func TestRealE2E_ValidateUpload(t *testing.T) {
+	server := setupTestServerWithConfig(t, func(config *ServerConfig) {
+		config.DeniedPatterns = []string{"secret*"}
+	})
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	for _, name := range []string{"secret.txt", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("content"), 0644); err != nil {
+			t.Fatalf("Failed to write local file: %v", err)
+		}
+	}
+
+	if err := client.client.ValidateUpload(ctx, filepath.Join(dir, "secret.txt")); !errors.Is(err, clientpkg.ErrInvalidPath) {
+		t.Errorf("Expected ErrInvalidPath validating a denied name, got %v", err)
+	}
+	if err := client.client.ValidateUpload(ctx, filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("Expected an acceptable upload to validate, got %v", err)
+	}
+
+	files, err := client.client.ListFilesDetailed(ctx)
+	if err != nil {
+		t.Fatalf("ListFilesDetailed failed: %v", err)
+	}
+	if len(files) != 0 {
+		t.Errorf("Validation stored files: %+v", files)
+	}
+}
+
+// TestRealE2E_EncryptionAtRest checks stored bytes are ciphertext while clients see plaintext
+func TestRealE2E_EncryptionAtRest(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	server := setupTestServerWithConfig(t, func(config *ServerConfig) {
+		config.AtRestKey = key
+	})
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	plaintext := bytes.Repeat([]byte("attack at dawn "), 100)
+	chunked := filepath.Join(dir, "chunked.txt")
+	if err := os.WriteFile(chunked, plaintext, 0644); err != nil {
+		t.Fatalf("Failed to write local file: %v", err)
+	}
+
+	// Both the chunked and the single-message upload paths encrypt
+	if err := client.client.UploadFile(ctx, chunked); err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+	if err := uploadSingleFrame(ctx, client.client, "single.txt", plaintext); err != nil {
+		t.Fatalf("Single-frame upload failed: %v", err)
+	}
+
+	for _, name := range []string{"chunked.txt", "single.txt"} {
+		matches, _ := filepath.Glob(filepath.Join(server.tempDir, "*", name))
+		if len(matches) != 1 {
+			t.Fatalf("Expected one stored %s, found %v", name, matches)
+		}
+		raw, err := os.ReadFile(matches[0])
+		if err != nil {
+			t.Fatalf("Failed to read stored file: %v", err)
+		}
+		if bytes.Contains(raw, []byte("attack at dawn")) {
+			t.Errorf("%s is stored in plaintext", name)
+		}
+
+		content, err := client.client.DownloadBytes(ctx, name)
+		if err != nil {
+			t.Fatalf("DownloadBytes failed: %v", err)
+		}
+		if !bytes.Equal(content, plaintext) {
+			t.Errorf("%s did not round-trip", name)
+		}
+		info, err := client.client.StatFile(ctx, name)
+		if err != nil {
+			t.Fatalf("StatFile failed: %v", err)
+		}
+		if info.Size != int64(len(plaintext)) {
+			t.Errorf("%s reported as %d bytes, want %d", name, info.Size, len(plaintext))
+		}
+	}
+
+	// Each file has a nonce of its own, so identical contents encrypt differently
+	chunkedRaw, _ := filepath.Glob(filepath.Join(server.tempDir, "*", "chunked.txt"))
+	singleRaw, _ := filepath.Glob(filepath.Join(server.tempDir, "*", "single.txt"))
+	a, _ := os.ReadFile(chunkedRaw[0])
+	b, _ := os.ReadFile(singleRaw[0])
+	if bytes.Equal(a, b) {
+		t.Error("Identical files were stored as identical ciphertext")
+	}
+}
+
+// connectTestClient connects to the server without performing the handshake
+func connectTestClient(t *testing.T, server *TestServer) *TestClient {
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		t.Fatalf("Failed to create client logger: %v", err)
+	}
+	serverPubKeyPath := filepath.Join(server.keyDir, "public.pem")
+	client, err := clientpkg.NewClientWithServerPubKey(context.Background(), server.host, server.port, serverPubKeyPath, logger)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	return &TestClient{client: client, logger: logger}
+}
+
+// TestRealE2E_SessionResume saves a session and resumes it from new connections
+func TestRealE2E_SessionResume(t *testing.T) {
+	server := setupTestServerWithConfig(t, func(config *ServerConfig) {
+		config.SessionTicketLifetime = time.Hour
+	})
+	defer server.cleanupTestServer(t)
+
+	ctx := context.Background()
+	sessionPath := filepath.Join(t.TempDir(), "session")
+	const passphrase = "correct horse"
+
+	first := setupTestClient(t, server)
+	tempFile := createTestTempFile(t, "saved session content")
+	defer os.Remove(tempFile)
+	if err := first.client.UploadFile(ctx, tempFile); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if err := first.client.SaveSession(ctx, sessionPath, passphrase); err != nil {
+		t.Fatalf("SaveSession failed: %v", err)
+	}
+	first.cleanupTestClient(t)
+
+	info, err := os.Stat(sessionPath)
+	if err != nil {
+		t.Fatalf("Session file missing: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected session file mode 0600, got %v", info.Mode().Perm())
+	}
+	usedTicket, err := os.ReadFile(sessionPath)
+	if err != nil {
+		t.Fatalf("Failed to read session file: %v", err)
+	}
+
+	// A resumed session sees the files of the one that was saved
+	resumed := connectTestClient(t, server)
+	if err := resumed.client.ResumeSession(ctx, sessionPath, "wrong passphrase"); err == nil || errors.Is(err, clientpkg.ErrSessionTicketRejected) {
+		t.Errorf("Expected a wrong passphrase to fail locally, got %v", err)
+	}
+	if err := resumed.client.ResumeSession(ctx, sessionPath, passphrase); err != nil {
+		t.Fatalf("ResumeSession failed: %v", err)
+	}
+	listing, err := resumed.client.ListFiles(ctx)
+	if err != nil {
+		t.Fatalf("List after resume failed: %v", err)
+	}
+	if !strings.Contains(listing, filepath.Base(tempFile)) {
+		t.Errorf("Expected resumed session to list %s, got %q", filepath.Base(tempFile), listing)
+	}
+	resumed.cleanupTestClient(t)
+
+	// Tickets are single-use: the copy taken before resuming is refused, and the
+	// connection still accepts a full handshake
+	stalePath := filepath.Join(t.TempDir(), "stale")
+	if err := os.WriteFile(stalePath, usedTicket, 0600); err != nil {
+		t.Fatalf("Failed to write stale session: %v", err)
+	}
+	replay := connectTestClient(t, server)
+	defer replay.cleanupTestClient(t)
+	if err := replay.client.ResumeSession(ctx, stalePath, passphrase); !errors.Is(err, clientpkg.ErrSessionTicketRejected) {
+		t.Fatalf("Expected reused ticket to be rejected, got %v", err)
+	}
+	if err := replay.client.PerformHandshake(ctx); err != nil {
+		t.Fatalf("Handshake after rejected ticket failed: %v", err)
+	}
+	if _, err := replay.client.ListFiles(ctx); err != nil {
+		t.Errorf("List after fallback handshake failed: %v", err)
+	}
+
+	// The rewritten file holds a fresh ticket until the server revokes them all
+	if err := server.server.RevokeSessionTickets(); err != nil {
+		t.Fatalf("RevokeSessionTickets failed: %v", err)
+	}
+	revoked := connectTestClient(t, server)
+	defer revoked.cleanupTestClient(t)
+	if err := revoked.client.ResumeSession(ctx, sessionPath, passphrase); !errors.Is(err, clientpkg.ErrSessionTicketRejected) {
+		t.Errorf("Expected revoked ticket to be rejected, got %v", err)
+	}
+}
+
+// TestRealE2E_SessionTicketExpiry checks that expired tickets and disabled servers refuse resumption
+func TestRealE2E_SessionTicketExpiry(t *testing.T) {
+	server := setupTestServerWithConfig(t, func(config *ServerConfig) {
+		config.SessionTicketLifetime = time.Second
+	})
+	defer server.cleanupTestServer(t)
+
+	ctx := context.Background()
+	sessionPath := filepath.Join(t.TempDir(), "session")
+
+	client := setupTestClient(t, server)
+	if err := client.client.SaveSession(ctx, sessionPath, "passphrase"); err != nil {
+		t.Fatalf("SaveSession failed: %v", err)
+	}
+	client.cleanupTestClient(t)
+
+	time.Sleep(1100 * time.Millisecond)
+	expired := connectTestClient(t, server)
+	defer expired.cleanupTestClient(t)
+	if err := expired.client.ResumeSession(ctx, sessionPath, "passphrase"); !errors.Is(err, clientpkg.ErrSessionTicketRejected) {
+		t.Errorf("Expected expired ticket to be rejected, got %v", err)
+	}
+
+	disabled := setupTestServer(t)
+	defer disabled.cleanupTestServer(t)
+	plain := setupTestClient(t, disabled)
+	defer plain.cleanupTestClient(t)
+	if err := plain.client.SaveSession(ctx, filepath.Join(t.TempDir(), "session"), "passphrase"); err == nil {
+		t.Error("Expected SaveSession to fail when the server has tickets disabled")
+	}
+}
+
+// TestRealE2E_SessionResumeChainLimit checks that chaining resumes cannot keep a session
+// alive past MaxSessionDuration from its full handshake, though every ticket would
+// otherwise last an hour
+func TestRealE2E_SessionResumeChainLimit(t *testing.T) {
+	const maxDuration = 2 * time.Second
+	server := setupTestServerWithConfig(t, func(config *ServerConfig) {
+		config.SessionTicketLifetime = time.Hour
+		config.MaxSessionDuration = maxDuration
+	})
+	defer server.cleanupTestServer(t)
+
+	ctx := context.Background()
+	sessionPath := filepath.Join(t.TempDir(), "session")
+
+	handshake := time.Now()
+	client := setupTestClient(t, server)
+	if err := client.client.SaveSession(ctx, sessionPath, "passphrase"); err != nil {
+		t.Fatalf("SaveSession failed: %v", err)
+	}
+	client.cleanupTestClient(t)
+
+	// Each resume saves the next ticket; the chain ends once the limit is reached
+	var resumes int
+	for {
+		resumed := connectTestClient(t, server)
+		err := resumed.client.ResumeSession(ctx, sessionPath, "passphrase")
+		resumed.cleanupTestClient(t)
+		if errors.Is(err, clientpkg.ErrSessionTicketRejected) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Resume %d failed: %v", resumes+1, err)
+		}
+		if time.Since(handshake) > maxDuration {
+			t.Fatalf("Resume %d succeeded %v after the full handshake", resumes+1, time.Since(handshake))
+		}
+		resumes++
+		time.Sleep(200 * time.Millisecond)
+	}
+	if resumes == 0 {
+		t.Error("Expected the session to resume before the limit")
+	}
+	if elapsed := time.Since(handshake); elapsed > maxDuration+time.Second {
+		t.Errorf("Chain of resumes ended %v after the full handshake, want about %v", elapsed, maxDuration)
+	}
+}
+
+// TestNewServer_MalformedKeys checks that key loading problems are reported rather than panicking
+func TestNewServer_MalformedKeys(t *testing.T) {
+	configDir := t.TempDir()
+	rootDir := t.TempDir()
+
+	// A private key with no matching public key file
+	if err := os.WriteFile(filepath.Join(configDir, "private.pem"), []byte("garbage"), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	_, err := NewServer(&ServerConfig{ConfigFolder: configDir, RootDir: &rootDir, Logger: zap.NewNop()})
+	if !errors.Is(err, rsaUtil.ErrKeyMissing) {
+		t.Fatalf("Expected ErrKeyMissing, got %v", err)
+	}
+	if !strings.Contains(err.Error(), configDir) {
+		t.Errorf("Expected error to name the config folder, got %v", err)
+	}
+}
+
+// TestRealE2E_DownloadBytes downloads small files straight into memory
+// TestRealE2E_DownloadToWriter streams a multi-chunk download into a buffer
+func TestRealE2E_DownloadToWriter(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+	content := generateRandomData(3*protocol.MediumChunkSize + 123)
+	source := createTestTempFile(t, string(content))
+	defer os.Remove(source)
+	if err := client.client.UploadFile(ctx, source); err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := client.client.DownloadToWriter(ctx, filepath.Base(source), &buf); err != nil {
+		t.Fatalf("DownloadToWriter failed: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("Downloaded %d bytes that do not match the %d uploaded", buf.Len(), len(content))
+	}
+
+	if err := client.client.DownloadToWriter(ctx, "missing.bin", &buf); !errors.Is(err, clientpkg.ErrFileNotFound) {
+		t.Errorf("Expected ErrFileNotFound, got %v", err)
+	}
+}
+
+func TestRealE2E_DownloadRange(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+	content := generateRandomData(2*protocol.MediumChunkSize + 500)
+	source := createTestTempFile(t, string(content))
+	defer os.Remove(source)
+	if err := client.client.UploadFile(ctx, source); err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+	filename := filepath.Base(source)
+	size := int64(len(content))
+
+	tests := []struct {
+		name           string
+		offset, length int64
+		want           []byte
+	}{
+		{"middle spanning chunks", 1000, int64(protocol.MediumChunkSize) + 10, content[1000 : 1010+protocol.MediumChunkSize]},
+		{"zero length reads to end", size - 300, 0, content[size-300:]},
+		{"past end is cut short", size - 20, 100, content[size-20:]},
+		{"empty at end", size, 0, []byte{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := client.client.DownloadRange(ctx, filename, tt.offset, tt.length, &buf); err != nil {
+				t.Fatalf("DownloadRange failed: %v", err)
+			}
+			if !bytes.Equal(buf.Bytes(), tt.want) {
+				t.Errorf("Got %d bytes, want %d matching the file", buf.Len(), len(tt.want))
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := client.client.DownloadRange(ctx, filename, size+1, 10, &buf); !errors.Is(err, clientpkg.ErrInvalidRequest) {
+		t.Errorf("Expected ErrInvalidRequest for a range beyond EOF, got %v", err)
+	}
+	if err := client.client.DownloadRange(ctx, filename, -1, 10, &buf); err == nil {
+		t.Error("Expected a negative offset to fail")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Failed ranges wrote %d bytes", buf.Len())
+	}
+
+	// The connection is still usable after the refusal
+	if err := client.client.DownloadRange(ctx, filename, 0, 10, &buf); err != nil || !bytes.Equal(buf.Bytes(), content[:10]) {
+		t.Errorf("DownloadRange after a refusal = %v, %d bytes", err, buf.Len())
+	}
+}
+
+func TestRealE2E_DownloadBytes(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server, clientpkg.WithMaxDownloadBytes(1024))
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+
+	content := "key = value\n"
+	smallFile := createTestTempFile(t, content)
+	defer os.Remove(smallFile)
+	largeFile := createTestTempFile(t, strings.Repeat("z", 4096))
+	defer os.Remove(largeFile)
+
+	for _, path := range []string{smallFile, largeFile} {
+		if err := client.client.UploadFile(ctx, path); err != nil {
+			t.Fatalf("UploadFile failed: %v", err)
+		}
+	}
+
+	data, err := client.client.DownloadBytes(ctx, filepath.Base(smallFile))
+	if err != nil {
+		t.Fatalf("DownloadBytes failed: %v", err)
+	}
+	if string(data) != content {
+		t.Errorf("Downloaded content mismatch. Expected: %q, Got: %q", content, string(data))
+	}
+
+	// Files over the limit are refused and the connection stays in sync
+	if _, err := client.client.DownloadBytes(ctx, filepath.Base(largeFile)); !errors.Is(err, clientpkg.ErrDownloadTooLarge) {
+		t.Errorf("Expected ErrDownloadTooLarge, got %v", err)
+	}
+	data, err = client.client.DownloadBytes(ctx, filepath.Base(smallFile))
+	if err != nil {
+		t.Fatalf("DownloadBytes after refusal failed: %v", err)
+	}
+	if string(data) != content {
+		t.Errorf("Downloaded content mismatch after refusal. Got: %q", string(data))
+	}
+}
+
+// TestRealE2E_ServerInfo checks that reported limits match the configuration and that
+// the client uses them to refuse oversized uploads before sending
+// TestRealE2E_Usage reports storage used against the quota as files come and go
+func TestRealE2E_Usage(t *testing.T) {
+	server := setupTestServerWithConfig(t, func(cfg *ServerConfig) {
+		cfg.MaxClientBytes = 4096
+	})
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+	used, quota, err := client.client.Usage(ctx)
+	if err != nil || used != 0 || quota != 4096 {
+		t.Fatalf("Usage before uploading = %d / %d (%v), want 0 / 4096", used, quota, err)
+	}
+
+	file := createTestTempFile(t, strings.Repeat("x", 1500))
+	defer os.Remove(file)
+	if err := client.client.UploadFile(ctx, file); err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+	if used, _, err = client.client.Usage(ctx); err != nil || used != 1500 {
+		t.Errorf("Usage after upload = %d (%v), want 1500", used, err)
+	}
+
+	if err := client.client.DeleteFile(ctx, filepath.Base(file)); err != nil {
+		t.Fatalf("DeleteFile failed: %v", err)
+	}
+	if used, _, err = client.client.Usage(ctx); err != nil || used != 0 {
+		t.Errorf("Usage after delete = %d (%v), want 0", used, err)
+	}
+}
+
+func TestRealE2E_ServerInfo(t *testing.T) {
+	server := setupTestServerWithConfig(t, func(cfg *ServerConfig) {
+		cfg.MaxUploadSize = 1024
+		cfg.MinCipherStrength = 192
+	})
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+
+	info, err := client.client.ServerInfo(ctx)
+	if err != nil {
+		t.Fatalf("ServerInfo failed: %v", err)
+	}
+	if info.MaxUploadSize != 1024 {
+		t.Errorf("MaxUploadSize = %d, want 1024", info.MaxUploadSize)
+	}
+	if info.MinChunkSize != protocol.SmallChunkSize || info.MaxChunkSize != protocol.MaxChunkSize {
+		t.Errorf("Chunk bounds = %d..%d, want %d..%d", info.MinChunkSize, info.MaxChunkSize, protocol.SmallChunkSize, protocol.MaxChunkSize)
+	}
+	if info.MaxFilenameLength != maxFilenameLength || info.MaxPathLength != maxPathLength {
+		t.Errorf("Name limits = %d and %d, want %d and %d", info.MaxFilenameLength, info.MaxPathLength, maxFilenameLength, maxPathLength)
+	}
+	if got := strings.Join(info.Ciphers, ","); got != "AES-256-GCM,AES-192-GCM" {
+		t.Errorf("Ciphers = %q", got)
+	}
+	if got := strings.Join(info.Compression, ","); got != protocol.EncodingGzip {
+		t.Errorf("Compression = %q", got)
+	}
+
+	smallFile := createTestTempFile(t, "fits")
+	defer os.Remove(smallFile)
+	largeFile := createTestTempFile(t, strings.Repeat("x", 2048))
+	defer os.Remove(largeFile)
+
+	if err := client.client.UploadFile(ctx, smallFile); err != nil {
+		t.Fatalf("UploadFile within the limit failed: %v", err)
+	}
+	if err := client.client.UploadFile(ctx, largeFile); !errors.Is(err, clientpkg.ErrExceedsServerLimit) {
+		t.Errorf("Expected local ErrExceedsServerLimit, got %v", err)
+	}
+
+	// The name limit applies to each path element, so a long nested path of short
+	// names passes the local check
+	dir := strings.TrimSuffix(strings.Repeat("a-directory-name-of-modest-length/", 10), "/")
+	if err := client.client.UploadFileTo(ctx, smallFile, dir+"/", nil); err != nil {
+		t.Errorf("UploadFileTo a %d byte nested path failed: %v", len(dir), err)
+	}
+	longName := dir + "/" + strings.Repeat("n", maxFilenameLength+1)
+	if err := client.client.UploadFileAs(ctx, smallFile, longName, nil); !errors.Is(err, clientpkg.ErrExceedsServerLimit) {
+		t.Errorf("Expected local ErrExceedsServerLimit for a long element, got %v", err)
+	}
+
+	// A client that never asked for the limits is still stopped by the server
+	uninformed := setupTestClient(t, server)
+	defer uninformed.cleanupTestClient(t)
+
+	err = uninformed.client.UploadFile(ctx, largeFile)
+	if err == nil || errors.Is(err, clientpkg.ErrExceedsServerLimit) || !strings.Contains(err.Error(), "File too large") {
+		t.Errorf("Expected server-side size rejection, got %v", err)
+	}
+	if _, err := uninformed.client.ListFiles(ctx); err != nil {
+		t.Errorf("Session should survive a size rejection: %v", err)
+	}
+}
+
+// openFileCount returns the number of open descriptors, or -1 where /proc is unavailable
+func openFileCount() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
+
+// TestRealE2E_ManySmallFiles runs a high-count small-file workload over one connection
+// and checks that no goroutines or file descriptors accumulate per operation
+func TestRealE2E_ManySmallFiles(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping many-small-files test in short mode")
+	}
+
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+	const fileCount = 1000
+	const tolerance = 5
+
+	sourceDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, sourceDir)
+
+	names := make([]string, fileCount)
+	for i := range names {
+		names[i] = fmt.Sprintf("small-%04d.txt", i)
+		if err := os.WriteFile(filepath.Join(sourceDir, names[i]), []byte(names[i]), 0644); err != nil {
+			t.Fatalf("Failed to create source file: %v", err)
+		}
+	}
+
+	// Warm up so lazily started goroutines and descriptors are part of the baseline
+	if _, err := client.client.ListFiles(ctx); err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	goroutinesBefore := runtime.NumGoroutine()
+	filesBefore := openFileCount()
+
+	for _, name := range names {
+		if err := client.client.UploadFile(ctx, filepath.Join(sourceDir, name)); err != nil {
+			t.Fatalf("UploadFile %s failed: %v", name, err)
+		}
+	}
+
+	listing, err := client.client.ListFiles(ctx)
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	if listed := strings.Split(listing, "\n"); len(listed) != fileCount {
+		t.Fatalf("Expected %d listed files, got %d", fileCount, len(listed))
+	}
+
+	for _, name := range names {
+		data, err := client.client.DownloadBytes(ctx, name)
+		if err != nil {
+			t.Fatalf("DownloadBytes %s failed: %v", name, err)
+		}
+		if string(data) != name {
+			t.Fatalf("Content mismatch for %s: %q", name, data)
+		}
+	}
+
+	for _, name := range names {
+		if err := client.client.DeleteFile(ctx, name); err != nil {
+			t.Fatalf("DeleteFile %s failed: %v", name, err)
+		}
+	}
+
+	listing, err = client.client.ListFiles(ctx)
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	if listing != "" {
+		t.Errorf("Expected an empty listing after deleting everything, got %d bytes", len(listing))
+	}
+
+	// Give finished goroutines a moment to exit before comparing
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > goroutinesBefore+tolerance && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > goroutinesBefore+tolerance {
+		t.Errorf("Goroutines grew from %d to %d over %d files", goroutinesBefore, after, fileCount)
+	}
+	if filesBefore >= 0 {
+		if after := openFileCount(); after > filesBefore+tolerance {
+			t.Errorf("Open file descriptors grew from %d to %d over %d files", filesBefore, after, fileCount)
+		}
+	}
+}
+
+// TestRealE2E_StreamedUpload uploads a multi-chunk file and an empty one through the
+// chunked flow and checks memory stays bounded while the large file is sent
+func TestRealE2E_StreamedUpload(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping streamed upload test in short mode")
+	}
+
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	tc := setupTestClient(t, server)
+	defer tc.cleanupTestClient(t)
+
+	ctx := context.Background()
+	const fileSize = 64 * 1024 * 1024
+
+	// Deterministic, non-repeating content so misordered chunks are caught
+	sourceDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, sourceDir)
+	largePath := filepath.Join(sourceDir, "large.bin")
+	largeFile, err := os.Create(largePath)
+	if err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+	block := make([]byte, 1024*1024)
+	for i := 0; i < fileSize/len(block); i++ {
+		for j := 0; j < len(block); j += 8 {
+			binary.BigEndian.PutUint64(block[j:], uint64(i*len(block)+j))
+		}
+		if _, err := largeFile.Write(block); err != nil {
+			t.Fatalf("Failed to write source file: %v", err)
+		}
+	}
+	largeFile.Close()
+	emptyPath := filepath.Join(sourceDir, "empty.bin")
+	if err := os.WriteFile(emptyPath, nil, 0644); err != nil {
+		t.Fatalf("Failed to create empty file: %v", err)
+	}
+
+	// Sample the heap while uploading; reading the file into memory would add at least fileSize.
+	// Collect aggressively so per-chunk garbage does not count as growth.
+	defer debug.SetGCPercent(debug.SetGCPercent(10))
+	runtime.GC()
+	var baseline runtime.MemStats
+	runtime.ReadMemStats(&baseline)
+	var peak atomic.Uint64
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var stats runtime.MemStats
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+				runtime.ReadMemStats(&stats)
+				if stats.HeapInuse > peak.Load() {
+					peak.Store(stats.HeapInuse)
+				}
+			}
+		}
+	}()
+
+	err = tc.client.UploadFile(ctx, largePath)
+	close(stop)
+	<-sampled
+	if err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+	if growth := int64(peak.Load()) - int64(baseline.HeapInuse); growth > fileSize/2 {
+		t.Errorf("Heap grew by %d bytes while uploading a %d byte file", growth, fileSize)
+	}
+
+	if err := tc.client.UploadFile(ctx, emptyPath); err != nil {
+		t.Fatalf("UploadFile of an empty file failed: %v", err)
+	}
+
+	clientDirs, err := os.ReadDir(server.tempDir)
+	if err != nil || len(clientDirs) != 1 {
+		t.Fatalf("Expected one client directory, got %v (%v)", clientDirs, err)
+	}
+	clientDir := filepath.Join(server.tempDir, clientDirs[0].Name())
+
+	for _, name := range []string{"large.bin", "empty.bin"} {
+		want, _ := os.ReadFile(filepath.Join(sourceDir, name))
+		got, err := os.ReadFile(filepath.Join(clientDir, name))
+		if err != nil {
+			t.Fatalf("Uploaded %s missing: %v", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Uploaded %s differs from the source (%d vs %d bytes)", name, len(got), len(want))
+		}
+	}
+
+	// No temporary files are left behind
+	entries, _ := os.ReadDir(clientDir)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".upload-") {
+			t.Errorf("Temporary upload file left behind: %s", entry.Name())
+		}
+	}
+}
+
+// TestRealE2E_RenameFile renames an uploaded file and checks only the new name remains
+func TestRealE2E_RenameFile(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+	content := "renamed content"
+	testFile := createTestTempFile(t, content)
+	defer os.Remove(testFile)
+
+	if err := client.client.UploadFile(ctx, testFile); err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+	if err := client.client.RenameFile(ctx, filepath.Base(testFile), "renamed.txt"); err != nil {
+		t.Fatalf("RenameFile failed: %v", err)
+	}
+
+	listing, err := client.client.ListFiles(ctx)
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	if listing != "renamed.txt" {
+		t.Errorf("Expected only renamed.txt, got %q", listing)
+	}
+	data, err := client.client.DownloadBytes(ctx, "renamed.txt")
+	if err != nil || string(data) != content {
+		t.Errorf("Downloaded %q (%v), want %q", data, err, content)
+	}
+
+	if err := client.client.RenameFile(ctx, "renamed.txt", "../outside.txt"); err == nil {
+		t.Error("Expected rename outside the client directory to fail")
+	}
+	if err := client.client.RenameFile(ctx, "missing.txt", "other.txt"); err == nil || !strings.Contains(err.Error(), "File not found") {
+		t.Errorf("Expected File not found, got %v", err)
+	}
+}
+
+func TestRealE2E_CopyFile(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+	content := "copied content"
+	testFile := createTestTempFile(t, content)
+	defer os.Remove(testFile)
+
+	if err := client.client.UploadFile(ctx, testFile); err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+	if err := client.client.CopyFile(ctx, filepath.Base(testFile), "copy.txt"); err != nil {
+		t.Fatalf("CopyFile failed: %v", err)
+	}
+	for _, name := range []string{filepath.Base(testFile), "copy.txt"} {
+		data, err := client.client.DownloadBytes(ctx, name)
+		if err != nil || string(data) != content {
+			t.Errorf("Downloaded %s as %q (%v), want %q", name, data, err, content)
+		}
+	}
+
+	if err := client.client.CopyFileNoClobber(ctx, filepath.Base(testFile), "copy.txt"); !errors.Is(err, clientpkg.ErrFileExists) {
+		t.Errorf("Expected ErrFileExists copying over an existing file, got %v", err)
+	}
+	if err := client.client.CopyFile(ctx, "missing.txt", "other.txt"); !errors.Is(err, clientpkg.ErrFileNotFound) {
+		t.Errorf("Expected ErrFileNotFound, got %v", err)
+	}
+}
+
+func TestRealE2E_ResumeDownload(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+	content := strings.Repeat("0123456789abcdef", 64*1024) // 1 MB, several chunks
+	testFile := createTestTempFile(t, content)
+	defer os.Remove(testFile)
+	if err := client.client.UploadFile(ctx, testFile); err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+	filename := filepath.Base(testFile)
+
+	outputDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, outputDir)
+	outputPath := filepath.Join(outputDir, "resumed.txt")
+
+	download := func(name string) {
+		t.Helper()
+		if err := client.client.DownloadFile(ctx, filename, outputPath, nil); err != nil {
+			t.Fatalf("%s: DownloadFile failed: %v", name, err)
+		}
+		data, err := os.ReadFile(outputPath)
+		if err != nil {
+			t.Fatalf("%s: failed to read output: %v", name, err)
+		}
+		// Resending from zero would append the whole file after the kept prefix
+		if string(data) != content {
+			t.Errorf("%s: downloaded %d bytes, want %d identical bytes", name, len(data), len(content))
+		}
+	}
+
+	// An interrupted download left the first part of the file behind
+	if err := os.WriteFile(outputPath, []byte(content[:300*1024]), 0644); err != nil {
+		t.Fatalf("Failed to write partial download: %v", err)
+	}
+	download("partial prefix")
+
+	// A complete file needs nothing more
+	download("complete file")
+
+	// A prefix that is not the start of the file is discarded and the download starts over
+	if err := os.WriteFile(outputPath, []byte("stale data from another file"), 0644); err != nil {
+		t.Fatalf("Failed to write stale output: %v", err)
+	}
+	download("mismatched prefix")
+
+	// An empty file downloads without waiting for chunks that never come
+	emptyFile := createTestTempFile(t, "")
+	defer os.Remove(emptyFile)
+	if err := client.client.UploadFile(ctx, emptyFile); err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+	emptyOutput := filepath.Join(outputDir, "empty.txt")
+	if err := client.client.DownloadFile(ctx, filepath.Base(emptyFile), emptyOutput, nil); err != nil {
+		t.Fatalf("Empty DownloadFile failed: %v", err)
+	}
+	if info, err := os.Stat(emptyOutput); err != nil || info.Size() != 0 {
+		t.Errorf("Expected empty output file, got %v (%v)", info, err)
+	}
+}
+
+// TestRealE2E_PreferredChunkSize downloads with a client-chosen chunk size over one and several streams
+func TestRealE2E_PreferredChunkSize(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	ctx := context.Background()
+	content := string(generateRandomData(700*1024 + 123))
+	testFile := createTestTempFile(t, content)
+	defer os.Remove(testFile)
+	filename := filepath.Base(testFile)
+	outputDir := t.TempDir()
+
+	for _, streams := range []int{1, 3} {
+		client := setupTestClient(t, server, clientpkg.WithDownloadStreams(streams))
+		defer client.cleanupTestClient(t)
+		client.client.SetPreferredChunkSize(96 * 1024)
+
+		// Each client has its own session directory
+		if err := client.client.UploadFile(ctx, testFile); err != nil {
+			t.Fatalf("UploadFile failed: %v", err)
+		}
+		outputPath := filepath.Join(outputDir, fmt.Sprintf("streams-%d.bin", streams))
+		if err := client.client.DownloadFile(ctx, filename, outputPath, nil); err != nil {
+			t.Fatalf("%d streams: DownloadFile failed: %v", streams, err)
+		}
+		data, err := os.ReadFile(outputPath)
+		if err != nil {
+			t.Fatalf("Failed to read output: %v", err)
+		}
+		if string(data) != content {
+			t.Errorf("%d streams: downloaded %d bytes, want %d identical bytes", streams, len(data), len(content))
+		}
+	}
+}
+
+func TestRealE2E_ParallelDownload(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server, clientpkg.WithDownloadStreams(3))
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+	content := string(generateRandomData(1024*1024 + 1000)) // 9 chunks, the last one short
+	testFile := createTestTempFile(t, content)
+	defer os.Remove(testFile)
+	if err := client.client.UploadFile(ctx, testFile); err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+	filename := filepath.Base(testFile)
+
+	outputDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, outputDir)
+	outputPath := filepath.Join(outputDir, "parallel.bin")
+
+	download := func(name string) {
+		t.Helper()
+		if err := client.client.DownloadFile(ctx, filename, outputPath, nil); err != nil {
+			t.Fatalf("%s: DownloadFile failed: %v", name, err)
+		}
+		data, err := os.ReadFile(outputPath)
+		if err != nil {
+			t.Fatalf("%s: failed to read output: %v", name, err)
+		}
+		if string(data) != content {
+			t.Errorf("%s: downloaded %d bytes, want %d identical bytes", name, len(data), len(content))
+		}
+	}
+
+	download("fresh download")
+
+	// The remainder of an interrupted download is split between the streams too
+	if err := os.WriteFile(outputPath, []byte(content[:300*1024]), 0644); err != nil {
+		t.Fatalf("Failed to write partial download: %v", err)
+	}
+	download("partial prefix")
+
+	// The main connection is left ready for further commands
+	files, err := client.client.ListFiles(ctx)
+	if err != nil {
+		t.Fatalf("ListFiles after parallel download failed: %v", err)
+	}
+	if !strings.Contains(files, filename) {
+		t.Errorf("Expected %s in listing, got %q", filename, files)
+	}
+
+	// More streams than chunks leaves some streams idle
+	smallFile := createTestTempFile(t, "tiny")
+	defer os.Remove(smallFile)
+	if err := client.client.UploadFile(ctx, smallFile); err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+	smallOutput := filepath.Join(outputDir, "tiny.txt")
+	if err := client.client.DownloadFile(ctx, filepath.Base(smallFile), smallOutput, nil); err != nil {
+		t.Fatalf("Small DownloadFile failed: %v", err)
+	}
+	if data, err := os.ReadFile(smallOutput); err != nil || string(data) != "tiny" {
+		t.Errorf("Expected tiny, got %q (%v)", data, err)
+	}
+}
+
+func TestRealE2E_UploadStream(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+	content := generateRandomData(600 * 1024) // several chunks either way
+
+	assertStored := func(name string, want []byte) {
+		t.Helper()
+		data, err := client.client.DownloadBytes(ctx, name)
+		if err != nil {
+			t.Fatalf("DownloadBytes(%s) failed: %v", name, err)
+		}
+		if !bytes.Equal(data, want) {
+			t.Errorf("%s: stored %d bytes, want %d identical bytes", name, len(data), len(want))
+		}
+	}
+
+	// Readers returning a byte at a time still fill whole chunks
+	if err := client.client.UploadStream(ctx, "known.bin", iotest.OneByteReader(bytes.NewReader(content)), int64(len(content)), nil); err != nil {
+		t.Fatalf("UploadStream with known size failed: %v", err)
+	}
+	assertStored("known.bin", content)
+
+	// Without a size the total is counted as the data goes
+	if err := client.client.UploadStream(ctx, "unknown.bin", iotest.HalfReader(bytes.NewReader(content)), -1, nil); err != nil {
+		t.Fatalf("UploadStream with unknown size failed: %v", err)
+	}
+	assertStored("unknown.bin", content)
+
+	// Exactly one chunk's worth, and nothing at all
+	exact := content[:protocol.LargeChunkSize]
+	if err := client.client.UploadStream(ctx, "exact.bin", bytes.NewReader(exact), -1, nil); err != nil {
+		t.Fatalf("UploadStream of one full chunk failed: %v", err)
+	}
+	assertStored("exact.bin", exact)
+	if err := client.client.UploadStream(ctx, "empty.bin", strings.NewReader(""), -1, nil); err != nil {
+		t.Fatalf("UploadStream of empty stream failed: %v", err)
+	}
+	assertStored("empty.bin", []byte{})
+
+	// A reader that disagrees with the declared size fails and leaves nothing behind
+	if err := client.client.UploadStream(ctx, "short.bin", bytes.NewReader(content[:1000]), int64(len(content)), nil); err == nil {
+		t.Error("Expected a reader shorter than the declared size to fail")
+	}
+	if err := client.client.UploadStream(ctx, "long.bin", bytes.NewReader(content), 1000, nil); err == nil {
+		t.Error("Expected a reader longer than the declared size to fail")
+	}
+	if err := client.client.UploadStream(ctx, "broken.bin", iotest.TimeoutReader(bytes.NewReader(content)), -1, nil); err == nil {
+		t.Error("Expected a failing reader to fail the upload")
+	}
+	files, err := client.client.ListFiles(ctx)
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	for _, name := range []string{"short.bin", "long.bin", "broken.bin"} {
+		if strings.Contains(files, name) {
+			t.Errorf("Failed upload %s was stored", name)
+		}
+	}
+}
+
+func TestRealE2E_Directories(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+	content := generateRandomData(300 * 1024)
+
+	if err := client.client.UploadStream(ctx, "reports/q1.bin", bytes.NewReader(content), int64(len(content)), nil); err == nil {
+		t.Fatal("Expected upload into a missing directory to fail")
+	}
+	if err := client.client.MakeDir(ctx, "reports/2024"); err != nil {
+		t.Fatalf("MakeDir failed: %v", err)
+	}
+	if err := client.client.UploadStream(ctx, "reports/2024/q1.bin", bytes.NewReader(content), int64(len(content)), nil); err != nil {
+		t.Fatalf("Upload into directory failed: %v", err)
+	}
+	data, err := client.client.DownloadBytes(ctx, "reports/2024/q1.bin")
+	if err != nil {
+		t.Fatalf("Download from directory failed: %v", err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Errorf("Downloaded %d bytes, want %d identical bytes", len(data), len(content))
+	}
+
+	files, err := client.client.ListDir(ctx, "reports", true)
+	if err != nil {
+		t.Fatalf("ListDir failed: %v", err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	if got, want := strings.Join(names, ","), "2024,2024/q1.bin"; got != want {
+		t.Errorf("Recursive listing of reports = %s, want %s", got, want)
+	}
+	if _, err := client.client.ListDir(ctx, "missing", false); err == nil {
+		t.Error("Expected listing a missing directory to fail")
+	}
+}
+
+// TestRealE2E_UploadFileTo uploads into nested directories that do not exist yet
+func TestRealE2E_UploadFileTo(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+	content := generateRandomData(600 * 1024)
+	testFile := createTestTempFile(t, string(content))
+	defer os.Remove(testFile)
+	name := filepath.Base(testFile)
+
+	var progress progressRecorder
+	if err := client.client.UploadFileTo(ctx, testFile, "projects/2024/report.bin", progress.record); err != nil {
+		t.Fatalf("UploadFileTo failed: %v", err)
+	}
+	progress.check(t, "nested upload", uint64(len(content)), 2)
+
+	// A trailing slash keeps the local name
+	if err := client.client.UploadFileTo(ctx, testFile, "projects/archive/", nil); err != nil {
+		t.Fatalf("UploadFileTo a directory failed: %v", err)
+	}
+
+	for _, remotePath := range []string{"projects/2024/report.bin", "projects/archive/" + name} {
+		matches, _ := filepath.Glob(filepath.Join(server.tempDir, "*", filepath.FromSlash(remotePath)))
+		if len(matches) != 1 {
+			t.Fatalf("Expected %s to be stored once, found %v", remotePath, matches)
+		}
+		data, err := os.ReadFile(matches[0])
+		if err != nil || !bytes.Equal(data, content) {
+			t.Errorf("%s holds %d bytes (%v), want the %d uploaded", remotePath, len(data), err, len(content))
+		}
+	}
+
+	// Paths leaving the client directory are still refused
+	if err := client.client.UploadFileTo(ctx, testFile, "../escape/", nil); !errors.Is(err, clientpkg.ErrInvalidPath) {
+		t.Errorf("Expected an escaping path to be refused, got %v", err)
+	}
+}
+
+// TestRealE2E_DeleteFiles lists and deletes files by pattern
+func TestRealE2E_DeleteFiles(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+	for _, name := range []string{"one.log", "two.log", "notes.txt"} {
+		if err := client.client.UploadStream(ctx, name, strings.NewReader(name), int64(len(name)), nil); err != nil {
+			t.Fatalf("Upload of %s failed: %v", name, err)
+		}
+	}
+
+	logs, err := client.client.ListDir(ctx, "*.log", false)
+	if err != nil {
+		t.Fatalf("ListDir with a pattern failed: %v", err)
+	}
+	if len(logs) != 2 {
+		t.Errorf("Expected 2 files matching *.log, got %v", logs)
+	}
+
+	deleted, err := client.client.DeleteFiles(ctx, "*.log")
+	if err != nil || deleted != 2 {
+		t.Fatalf("DeleteFiles(*.log) = %d, %v; want 2", deleted, err)
+	}
+	if deleted, err := client.client.DeleteFiles(ctx, "*.log"); err != nil || deleted != 0 {
+		t.Errorf("DeleteFiles with no matches = %d, %v; want 0", deleted, err)
+	}
+	if _, err := client.client.DeleteFiles(ctx, "[a-"); err == nil {
+		t.Error("Expected an invalid pattern to be refused")
+	}
+
+	files, err := client.client.ListFiles(ctx)
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	if files != "notes.txt" {
+		t.Errorf("Remaining files = %q, want notes.txt", files)
+	}
+}
+
+// TestRealE2E_UploadFiles uploads a batch over one session, continuing past a failed file
+func TestRealE2E_UploadFiles(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+	first := createTestTempFile(t, "first batch file")
+	defer os.Remove(first)
+	second := createTestTempFile(t, "second batch file")
+	defer os.Remove(second)
+	missing := filepath.Join(t.TempDir(), "missing.txt")
+
+	results, err := client.client.UploadFiles(ctx, []string{first, missing, second})
+	if err != nil {
+		t.Fatalf("UploadFiles failed: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(results))
+	}
+	for i, wantErr := range []bool{false, true, false} {
+		if (results[i].Err != nil) != wantErr {
+			t.Errorf("Result %d (%s): err = %v, want error %v", i, results[i].Filename, results[i].Err, wantErr)
+		}
+	}
+
+	files, err := client.client.ListFiles(ctx)
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	for _, name := range []string{filepath.Base(first), filepath.Base(second)} {
+		if !strings.Contains(files, name) {
+			t.Errorf("Expected %s in listing, got %q", name, files)
+		}
+	}
+
+	// A cancelled batch reports every file it did not attempt
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	results, err = client.client.UploadFiles(cancelled, []string{first, second})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	for _, result := range results {
+		if !errors.Is(result.Err, context.Canceled) {
+			t.Errorf("%s: expected context.Canceled, got %v", result.Filename, result.Err)
+		}
+	}
+}
+
+// progressRecorder collects ProgressFunc calls for inspection
+type progressRecorder struct {
+	calls [][2]uint64
+}
+
+func (r *progressRecorder) record(transferred, total uint64) {
+	r.calls = append(r.calls, [2]uint64{transferred, total})
+}
+
+// check asserts the reports never went backwards and ended with size of size
+func (r *progressRecorder) check(t *testing.T, name string, size uint64, minCalls int) {
+	t.Helper()
+	if len(r.calls) < minCalls {
+		t.Fatalf("%s: got %d progress reports, want at least %d", name, len(r.calls), minCalls)
+	}
+	for i := 1; i < len(r.calls); i++ {
+		if r.calls[i][0] < r.calls[i-1][0] {
+			t.Errorf("%s: progress went backwards: %v", name, r.calls)
+			break
+		}
+	}
+	if last := r.calls[len(r.calls)-1]; last != [2]uint64{size, size} {
+		t.Errorf("%s: final report %v, want [%d %d]", name, last, size, size)
+	}
+}
+
+func TestRealE2E_Progress(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+	parallel := setupTestClient(t, server, clientpkg.WithDownloadStreams(3))
+	defer parallel.cleanupTestClient(t)
+
+	ctx := context.Background()
+	content := generateRandomData(600 * 1024)
+	size := uint64(len(content))
+	outputDir := t.TempDir()
+
+	var known progressRecorder
+	if err := client.client.UploadStream(ctx, "known.bin", bytes.NewReader(content), int64(len(content)), known.record); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	known.check(t, "known-size upload", size, 2)
+	for _, call := range known.calls {
+		if call[1] != size {
+			t.Errorf("Known-size upload reported total %d, want %d", call[1], size)
+		}
+	}
+
+	// The total stays unknown until the last chunk
+	var unknown progressRecorder
+	if err := client.client.UploadStream(ctx, "unknown.bin", bytes.NewReader(content), -1, unknown.record); err != nil {
+		t.Fatalf("Streamed upload failed: %v", err)
+	}
+	unknown.check(t, "unknown-size upload", size, 2)
+	if unknown.calls[0][1] != 0 {
+		t.Errorf("Streamed upload reported total %d before the end", unknown.calls[0][1])
+	}
+
+	var download progressRecorder
+	if err := client.client.DownloadFile(ctx, "known.bin", filepath.Join(outputDir, "single.bin"), download.record); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	download.check(t, "download", size, 2)
+
+	// Reports from several streams are delivered one at a time
+	var concurrent progressRecorder
+	if err := parallel.client.UploadStream(ctx, "known.bin", bytes.NewReader(content), int64(len(content)), nil); err != nil {
+		t.Fatalf("Upload without progress failed: %v", err)
+	}
+	if err := parallel.client.DownloadFile(ctx, "known.bin", filepath.Join(outputDir, "parallel.bin"), concurrent.record); err != nil {
+		t.Fatalf("Parallel download failed: %v", err)
+	}
+	concurrent.check(t, "parallel download", size, 3)
+
+	// Empty files still report completion
+	var empty progressRecorder
+	if err := client.client.UploadStream(ctx, "empty.bin", strings.NewReader(""), 0, empty.record); err != nil {
+		t.Fatalf("Empty upload failed: %v", err)
+	}
+	empty.check(t, "empty upload", 0, 1)
+	empty = progressRecorder{}
+	if err := client.client.DownloadFile(ctx, "empty.bin", filepath.Join(outputDir, "empty.bin"), empty.record); err != nil {
+		t.Fatalf("Empty download failed: %v", err)
+	}
+	empty.check(t, "empty download", 0, 1)
+}
+
+// selfSignedTLSForTest returns a server TLS config with a fresh self-signed certificate
+// for 127.0.0.1 and a client config trusting only that certificate
+func selfSignedTLSForTest(t *testing.T) (serverConfig *tls.Config, clientConfig *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ssnproj test server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	serverConfig = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	clientConfig = &tls.Config{RootCAs: pool}
+	return serverConfig, clientConfig
+}
+
+// TestRealE2E_TLS verifies files round-trip over TLS with the RSA/AES handshake unused
+func TestRealE2E_TLS(t *testing.T) {
+	serverTLS, clientTLS := selfSignedTLSForTest(t)
+	privKey, _ := rsaUtil.GenerateKeyPair(2048)
+	decrypter := &countingDecrypter{key: privKey}
+	server := setupTestServerWithConfig(t, func(config *ServerConfig) {
+		config.TLSConfig = serverTLS
+		config.Decrypter = decrypter
+	})
+	defer server.cleanupTestServer(t)
+
+	ctx := context.Background()
+	// No server RSA key: the client would fail if it tried the handshake
+	client, err := clientpkg.NewClient(ctx, server.host, server.port, nil, zap.NewNop(), clientpkg.WithTLS(clientTLS))
+	if err != nil {
+		t.Fatalf("Failed to connect over TLS: %v", err)
+	}
+	defer client.Close(ctx)
+	if err := client.PerformHandshake(ctx); err != nil {
+		t.Fatalf("PerformHandshake over TLS failed: %v", err)
+	}
+
+	content := generateRandomData(300 * 1024)
+	if err := client.UploadStream(ctx, "tls.bin", bytes.NewReader(content), int64(len(content)), nil); err != nil {
+		t.Fatalf("Upload over TLS failed: %v", err)
+	}
+	outputPath := filepath.Join(t.TempDir(), "tls.bin")
+	if err := client.DownloadFile(ctx, "tls.bin", outputPath, nil); err != nil {
+		t.Fatalf("Download over TLS failed: %v", err)
+	}
+	downloaded, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("Failed to read download: %v", err)
+	}
+	if !bytes.Equal(downloaded, content) {
+		t.Errorf("Downloaded %d bytes, want %d identical bytes", len(downloaded), len(content))
+	}
+
+	if calls := decrypter.calls.Load(); calls != 0 {
+		t.Errorf("RSA handshake ran %d times over TLS", calls)
+	}
+
+	// A client that does not trust the certificate cannot connect
+	if _, err := clientpkg.NewClient(ctx, server.host, server.port, nil, zap.NewNop(), clientpkg.WithTLS(&tls.Config{})); err == nil {
+		t.Error("Expected an untrusted certificate to be refused")
+	}
+
+	// Session options that need the RSA handshake are refused rather than ignored
+	namespaced, err := clientpkg.NewClient(ctx, server.host, server.port, nil, zap.NewNop(),
+		clientpkg.WithTLS(clientTLS), clientpkg.WithNamespace("shared"))
+	if err != nil {
+		t.Fatalf("Failed to connect over TLS: %v", err)
+	}
+	defer namespaced.Close(ctx)
+	if err := namespaced.PerformHandshake(ctx); err == nil {
+		t.Error("Expected a namespace over TLS to be refused")
+	}
+}
+
+func TestRealE2E_MaxConnections(t *testing.T) {
+	server := setupTestServerWithConfig(t, func(config *ServerConfig) {
+		config.MaxConnections = 2
+	})
+	defer server.cleanupTestServer(t)
+
+	first := setupTestClient(t, server)
+	second := setupTestClient(t, server)
+	defer second.cleanupTestClient(t)
+	if active := server.server.ActiveConnections(); active != 2 {
+		t.Errorf("ActiveConnections = %d, want 2", active)
+	}
+
+	// The connection over the limit is refused with a reason
+	ctx := context.Background()
+	serverPubKeyPath := filepath.Join(server.keyDir, "public.pem")
+	extra, err := clientpkg.NewClientWithServerPubKey(ctx, server.host, server.port, serverPubKeyPath, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	err = extra.PerformHandshake(ctx)
+	extra.Close(ctx)
+	if err == nil || !strings.Contains(err.Error(), "too many connections") {
+		t.Fatalf("Expected the extra connection to be refused, got %v", err)
+	}
+
+	// Closing a session frees its slot
+	first.cleanupTestClient(t)
+	deadline := time.Now().Add(2 * time.Second)
+	for server.server.ActiveConnections() > 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	third := setupTestClient(t, server)
+	defer third.cleanupTestClient(t)
+	if _, err := third.client.ListFiles(ctx); err != nil {
+		t.Errorf("Client after a slot was freed failed: %v", err)
+	}
+}
+
+// TestRealE2E_IdleTimeout verifies silent connections are closed while slow transfers are not
+func TestRealE2E_IdleTimeout(t *testing.T) {
+	server := setupTestServerWithConfig(t, func(config *ServerConfig) {
+		config.IdleTimeout = 300 * time.Millisecond
+		config.ChunkPacing = 100 * time.Millisecond
+	})
+	defer server.cleanupTestServer(t)
+
+	ctx := context.Background()
+
+	// A download paced to outlast the timeout completes, and the session stays usable
+	active := setupTestClient(t, server)
+	defer active.cleanupTestClient(t)
+	content := strings.Repeat("idle timeout ", 50*1024) // 650 KB, several paced chunks
+	testFile := createTestTempFile(t, content)
+	defer os.Remove(testFile)
+	if err := active.client.UploadFile(ctx, testFile); err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+	outputPath := filepath.Join(t.TempDir(), "downloaded.txt")
+	start := time.Now()
+	if err := active.client.DownloadFile(ctx, filepath.Base(testFile), outputPath, nil); err != nil {
+		t.Fatalf("Paced download failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("Download took %v, too short to outlast the idle timeout", elapsed)
+	}
+	if _, err := active.client.ListFiles(ctx); err != nil {
+		t.Errorf("ListFiles right after the download failed: %v", err)
+	}
+
+	// A client that handshakes and then stays silent is disconnected
+	silent := setupTestClient(t, server)
+	defer silent.cleanupTestClient(t)
+	deadline := time.Now().Add(2 * time.Second)
+	for server.server.ActiveConnections() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := server.server.ActiveConnections(); n != 0 {
+		t.Errorf("ActiveConnections = %d after both clients went quiet, want 0", n)
+	}
+	if _, err := silent.client.ListFiles(ctx); err == nil {
+		t.Error("Expected the idle connection to be closed")
+	}
+}
+
+// TestRealE2E_HandshakeTimeout verifies connections that never handshake are dropped
+// while authenticated sessions outlive the timeout
+func TestRealE2E_HandshakeTimeout(t *testing.T) {
+	server := setupTestServerWithConfig(t, func(config *ServerConfig) {
+		config.HandshakeTimeout = 200 * time.Millisecond
+	})
+	defer server.cleanupTestServer(t)
+
+	ctx := context.Background()
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(server.host, server.port))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	// The server closes the silent connection; the test gives up well after the timeout
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the server to close the silent connection, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Connection closed after %v, before the handshake timeout", elapsed)
+	}
+
+	if _, err := client.client.ListFiles(ctx); err != nil {
+		t.Errorf("Authenticated client was dropped by the handshake timeout: %v", err)
+	}
+}
+
+func TestRealE2E_GracefulShutdown(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.logger.Sync()
+
+	ctx := context.Background()
+	content := strings.Repeat("graceful shutdown ", 2*1024*1024) // 36 MB, many chunks
+	testFile := createTestTempFile(t, content)
+	defer os.Remove(testFile)
+
+	uploadErr := make(chan error, 1)
+	go func() {
+		uploadErr <- client.client.UploadFile(ctx, testFile)
+	}()
+
+	// Shut down only once the upload is streaming into its temporary file
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if matches, _ := filepath.Glob(filepath.Join(server.tempDir, "*", ".upload-*")); len(matches) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Upload never started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		shutdownErr <- server.server.Shutdown(shutdownCtx)
+	}()
+
+	if err := <-uploadErr; err != nil {
+		t.Fatalf("Upload in flight during shutdown failed: %v", err)
+	}
+	// The session stays usable until the client is done with it
+	if _, err := client.client.ListFiles(ctx); err != nil {
+		t.Fatalf("Session ended before the client was done: %v", err)
+	}
+
+	// New connections are refused while the existing session is still open
+	if conn, err := net.DialTimeout("tcp", net.JoinHostPort(server.host, server.port), time.Second); err == nil {
+		conn.Close()
+		t.Error("Expected the listener to be closed during shutdown")
+	}
+
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned before the session ended: %v", err)
+	default:
+	}
+
+	client.client.Close(ctx)
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(server.tempDir, "*", filepath.Base(testFile)))
+	if len(matches) != 1 {
+		t.Fatalf("Expected the upload to be stored once, found %v", matches)
+	}
+	if info, err := os.Stat(matches[0]); err != nil || info.Size() != int64(len(content)) {
+		t.Errorf("Expected the whole upload to be stored, got %v (%v)", info, err)
+	}
+}
+
+func TestRealE2E_ShutdownDeadline(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.logger.Sync()
+
+	// An idle session that never disconnects is closed once the deadline passes
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := server.server.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	if _, err := client.client.ListFiles(context.Background()); err == nil {
+		t.Error("Expected the idle session to be closed")
+	}
+}
+
+// TestRealE2E_ShutdownFlushesAuditLog verifies every operation performed before Shutdown
+// returns, including those of a session still draining, is in the audit log
+func TestRealE2E_ShutdownFlushesAuditLog(t *testing.T) {
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	server := setupTestServerWithConfig(t, func(config *ServerConfig) {
+		config.AuditLogPath = auditPath
+	})
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.logger.Sync()
+
+	ctx := context.Background()
+	testFile := createTestTempFile(t, "audited before shutdown")
+	defer os.Remove(testFile)
+	name := filepath.Base(testFile)
+
+	if err := client.client.UploadFile(ctx, testFile); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if _, err := client.client.DownloadBytes(ctx, name); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		shutdownErr <- server.server.Shutdown(shutdownCtx)
+	}()
+
+	// The open session keeps working while the server drains
+	if _, err := client.client.ListFiles(ctx); err != nil {
+		t.Fatalf("List during shutdown failed: %v", err)
+	}
+	if err := client.client.DeleteFile(ctx, name); err != nil {
+		t.Fatalf("Delete during shutdown failed: %v", err)
+	}
+	client.client.Close(ctx)
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	contents, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	var commands []string
+	for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Audit log line is not JSON: %v", err)
+		}
+		commands = append(commands, record["command"].(string))
+	}
+	assert.Equal(t, []string{"upload", "download", "list", "delete"}, commands)
+}
+
+// TestRealE2E_ClientIdentity verifies files follow a long-lived client identity across reconnects
+func TestRealE2E_ClientIdentity(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	identity, err := clientpkg.LoadOrCreateClientIdentity(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create client identity: %v", err)
+	}
+
+	ctx := context.Background()
+	testFile := createTestTempFile(t, "kept across sessions")
+	defer os.Remove(testFile)
+	filename := filepath.Base(testFile)
+
+	first := setupTestClient(t, server, clientpkg.WithIdentity(identity))
+	if err := first.client.UploadFile(ctx, testFile); err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+	first.cleanupTestClient(t)
+
+	// A new session with a fresh session key but the same identity sees the file
+	second := setupTestClient(t, server, clientpkg.WithIdentity(identity))
+	defer second.cleanupTestClient(t)
+	listing, err := second.client.ListFiles(ctx)
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	if listing != filename {
+		t.Errorf("Expected %s after reconnecting, got %q", filename, listing)
+	}
+
+	// Without the identity the session has its own empty directory
+	anonymous := setupTestClient(t, server)
+	defer anonymous.cleanupTestClient(t)
+	listing, err = anonymous.client.ListFiles(ctx)
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	if strings.Contains(listing, filename) {
+		t.Errorf("Session without the identity saw %q", listing)
+	}
+}
+
+func TestRealE2E_ListFilesDetailed(t *testing.T) {
+	for _, compressed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compressed=%v", compressed), func(t *testing.T) {
+			server := setupTestServer(t)
+			defer server.cleanupTestServer(t)
+
+			client := setupTestClient(t, server)
+			defer client.cleanupTestClient(t)
+			client.client.SetCompression(compressed)
+
+			ctx := context.Background()
+			infos, err := client.client.ListFilesDetailed(ctx)
+			if err != nil {
+				t.Fatalf("ListFilesDetailed failed: %v", err)
+			}
+			if len(infos) != 0 {
+				t.Errorf("Expected no files, got %+v", infos)
+			}
+
+			content := "detailed listing"
+			testFile := createTestTempFile(t, content)
+			defer os.Remove(testFile)
+			before := time.Now().Add(-time.Second).Unix()
+			if err := client.client.UploadFile(ctx, testFile); err != nil {
+				t.Fatalf("UploadFile failed: %v", err)
+			}
+
+			infos, err = client.client.ListFilesDetailed(ctx)
+			if err != nil {
+				t.Fatalf("ListFilesDetailed failed: %v", err)
+			}
+			if len(infos) != 1 {
+				t.Fatalf("Expected one file, got %+v", infos)
+			}
+			info := infos[0]
+			if info.Name != filepath.Base(testFile) || info.Size != int64(len(content)) || info.IsDir || info.ModTime < before {
+				t.Errorf("Unexpected entry %+v", info)
+			}
+		})
+	}
+}
+
+// TestRealE2E_ListFilesPage walks a listing page by page and checks that the pages
+// cover every file once, in name order
+func TestRealE2E_UploadKeepsModTime(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+	ctx := context.Background()
+
+	testFile := createTestTempFile(t, "synced a long time ago")
+	defer os.Remove(testFile)
+	modTime := time.Date(2001, time.February, 3, 4, 5, 6, 0, time.UTC)
+	if err := os.Chtimes(testFile, modTime, modTime); err != nil {
+		t.Fatalf("Failed to set modification time: %v", err)
+	}
+
+	if err := client.client.UploadFile(ctx, testFile); err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+	info, err := client.client.StatFile(ctx, filepath.Base(testFile))
+	if err != nil {
+		t.Fatalf("StatFile failed: %v", err)
+	}
+	if got := time.Unix(info.ModTime, 0); !got.Equal(modTime) {
+		t.Errorf("Stored file modified %v, want %v", got.UTC(), modTime)
+	}
+
+	// Streams have no modification time of their own
+	if err := client.client.UploadStream(ctx, "stream.txt", strings.NewReader("now"), 3, nil); err != nil {
+		t.Fatalf("UploadStream failed: %v", err)
+	}
+	info, err = client.client.StatFile(ctx, "stream.txt")
+	if err != nil {
+		t.Fatalf("StatFile failed: %v", err)
+	}
+	if since := time.Since(time.Unix(info.ModTime, 0)); since > time.Minute {
+		t.Errorf("Streamed file modified %v ago, want the time of the upload", since)
+	}
+}
+
+func TestRealE2E_ContentType(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+	ctx := context.Background()
+
+	files := map[string]struct {
+		content string
+		want    string
+	}{
+		// Only the signature is needed; the name says nothing about the type
+		"logo.dat":  {"\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 1024), "image/png"},
+		"notes.dat": {"plain text notes\n", "text/plain; charset=utf-8"},
+		"empty.txt": {"", "application/octet-stream"},
+	}
+	for name, file := range files {
+		if err := client.client.UploadStream(ctx, name, strings.NewReader(file.content), int64(len(file.content)), nil); err != nil {
+			t.Fatalf("UploadStream(%s) failed: %v", name, err)
+		}
+		info, err := client.client.StatFile(ctx, name)
+		if err != nil {
+			t.Fatalf("StatFile(%s) failed: %v", name, err)
+		}
+		if info.ContentType != file.want {
+			t.Errorf("StatFile(%s) reported %q, want %q", name, info.ContentType, file.want)
+		}
+	}
+
+	infos, err := client.client.ListFilesDetailed(ctx)
+	if err != nil {
+		t.Fatalf("ListFilesDetailed failed: %v", err)
+	}
+	if len(infos) != len(files) {
+		t.Fatalf("Listed %d entries, want %d", len(infos), len(files))
+	}
+	for _, info := range infos {
+		if want := files[info.Name].want; info.ContentType != want {
+			t.Errorf("Listing reported %q for %s, want %q", info.ContentType, info.Name, want)
+		}
+	}
+}
+
+func TestRealE2E_ListFilesPage(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+	ctx := context.Background()
+
+	var want []string
+	for i := 7; i > 0; i-- {
+		name := fmt.Sprintf("page-%02d.txt", i)
+		want = append([]string{name}, want...)
+		if err := client.client.UploadStream(ctx, name, strings.NewReader(name), int64(len(name)), nil); err != nil {
+			t.Fatalf("UploadStream failed: %v", err)
+		}
+	}
+
+	var got []string
+	pages := 0
+	for offset := 0; ; {
+		pages++
+		infos, next, err := client.client.ListFilesPage(ctx, offset, 3)
+		if err != nil {
+			t.Fatalf("ListFilesPage(%d) failed: %v", offset, err)
+		}
+		if len(infos) > 3 {
+			t.Fatalf("Page at %d has %d entries, limit 3", offset, len(infos))
+		}
+		for _, info := range infos {
+			got = append(got, info.Name)
+		}
+		if next == 0 {
+			break
+		}
+		offset = next
+	}
+	if pages != 3 {
+		t.Errorf("Listing took %d pages, want 3", pages)
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Pages listed %v, want %v", got, want)
+	}
+
+	if _, _, err := client.client.ListFilesPage(ctx, 0, 0); err == nil {
+		t.Error("Expected a zero limit to be refused")
+	}
+}
+
+func TestRealE2E_StatFile(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+	content := strings.Repeat("s", 70000)
+	testFile := createTestTempFile(t, content)
+	defer os.Remove(testFile)
+	if err := client.client.UploadFile(ctx, testFile); err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+
+	info, err := client.client.StatFile(ctx, filepath.Base(testFile))
+	if err != nil {
+		t.Fatalf("StatFile failed: %v", err)
+	}
+	if info.Size != int64(len(content)) || info.Name != filepath.Base(testFile) {
+		t.Errorf("Unexpected file info %+v", info)
+	}
+
+	if _, err := client.client.StatFile(ctx, "missing.txt"); !errors.Is(err, clientpkg.ErrFileNotFound) {
+		t.Errorf("Expected ErrFileNotFound, got %v", err)
+	}
+
+	// A failed stat leaves the session usable
+	if _, err := client.client.ListFiles(ctx); err != nil {
+		t.Errorf("ListFiles after failed stat: %v", err)
+	}
+}
+
+// scrapeMetric fetches url and returns the value of the sample whose name and labels
+// read exactly series, or 0 when it is absent
+func scrapeMetric(t *testing.T, url string, series string) float64 {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Failed to scrape metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read metrics: %v", err)
+	}
+	for _, line := range strings.Split(string(body), "\n") {
+		if value, ok := strings.CutPrefix(line, series+" "); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("Bad value for %s: %q", series, value)
+			}
+			return parsed
+		}
+	}
+	return 0
+}
+
+func TestRealE2E_Metrics(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve metrics port: %v", err)
+	}
+	metricsAddr := listener.Addr().String()
+	listener.Close()
+
+	server := setupTestServerWithConfig(t, func(cfg *ServerConfig) {
+		cfg.MetricsAddr = metricsAddr
+	})
+	defer server.cleanupTestServer(t)
+	defer server.server.Shutdown(context.Background())
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	url := "http://" + metricsAddr + "/metrics"
+	assert.Equal(t, 1.0, scrapeMetric(t, url, `ssn_handshakes_total{result="success"}`))
+	assert.Equal(t, 1.0, scrapeMetric(t, url, "ssn_active_connections"))
+
+	ctx := context.Background()
+	content := strings.Repeat("m", 3000)
+	file := createTestTempFile(t, content)
+	defer os.Remove(file)
+	if err := client.client.UploadFile(ctx, file); err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+	if _, err := client.client.DownloadBytes(ctx, filepath.Base(file)); err != nil {
+		t.Fatalf("DownloadBytes failed: %v", err)
+	}
+	if _, err := client.client.DownloadBytes(ctx, "missing.txt"); err == nil {
+		t.Fatal("Expected downloading a missing file to fail")
+	}
+
+	assert.Equal(t, 3000.0, scrapeMetric(t, url, `ssn_transfer_bytes_total{direction="upload"}`))
+	assert.Equal(t, 3000.0, scrapeMetric(t, url, `ssn_transfer_bytes_total{direction="download"}`))
+	assert.Equal(t, 1.0, scrapeMetric(t, url, `ssn_transfer_duration_seconds_count{direction="download"}`))
+	assert.Equal(t, 2.0, scrapeMetric(t, url, `ssn_commands_total{command="0x02"}`))
+	assert.Equal(t, 1.0, scrapeMetric(t, url, `ssn_command_errors_total{command="0x02"}`))
+}
+
+// flakyProxy forwards connections to target and can cut the open ones, standing in for
+// a network blip between client and server, or silently stop forwarding
+type flakyProxy struct {
+	listener net.Listener
+	target   string
+	accepted atomic.Int32
+	stalled  atomic.Bool
+	// cutAfter, when positive, is how many more bytes are forwarded before every
+	// connection is dropped, once
+	cutAfter atomic.Int64
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func startFlakyProxy(t *testing.T, target string) *flakyProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	proxy := &flakyProxy{listener: listener, target: target}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			proxy.accepted.Add(1)
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			proxy.mu.Lock()
+			proxy.conns = append(proxy.conns, conn, upstream)
+			proxy.mu.Unlock()
+			go proxy.forward(upstream, conn)
+			go proxy.forward(conn, upstream)
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		proxy.drop()
+	})
+	return proxy
+}
+
+// forward copies src to dst, discarding the data while the proxy is stalled
+func (proxy *flakyProxy) forward(dst, src net.Conn) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 && !proxy.stalled.Load() {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return
+			}
+			if proxy.cutAfter.Load() > 0 {
+				// Only the write that uses up the budget drops the connections
+				if left := proxy.cutAfter.Add(-int64(n)); left <= 0 && left+int64(n) > 0 {
+					proxy.drop()
+					return
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// stall keeps every connection open but stops delivering data, like a path that
+// drops packets without resetting anything
+func (proxy *flakyProxy) stall() {
+	proxy.stalled.Store(true)
+}
+
+// drop closes every connection made through the proxy so far
+func (proxy *flakyProxy) drop() {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	for _, conn := range proxy.conns {
+		conn.Close()
+	}
+	proxy.conns = nil
+}
+
+// startLatencyProxy forwards connections to target, holding back every frame the
+// server sends by delay before passing it on, one at a time. It stands in for a link
+// where each message costs a round trip, so fewer, larger chunks move data faster.
+func startLatencyProxy(t *testing.T, target string, delay time.Duration) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go func() {
+				defer conn.Close()
+				defer upstream.Close()
+				io.Copy(upstream, conn)
+			}()
+			go func() {
+				defer conn.Close()
+				defer upstream.Close()
+				header := make([]byte, 5)
+				for {
+					if _, err := io.ReadFull(upstream, header); err != nil {
+						return
+					}
+					frame := make([]byte, 5+binary.BigEndian.Uint32(header[1:]))
+					copy(frame, header)
+					if _, err := io.ReadFull(upstream, frame[5:]); err != nil {
+						return
+					}
+					time.Sleep(delay)
+					if _, err := conn.Write(frame); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+func TestRealE2E_RetryAfterDroppedConnection(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	proxy := startFlakyProxy(t, net.JoinHostPort(server.host, server.port))
+	_, proxyPort, _ := net.SplitHostPort(proxy.listener.Addr().String())
+	viaProxy := &TestServer{host: "127.0.0.1", port: proxyPort, keyDir: server.keyDir}
+
+	client := setupTestClient(t, viaProxy, clientpkg.WithRetryPolicy(clientpkg.RetryPolicy{MaxRetries: 3, Backoff: 10 * time.Millisecond}))
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+	content := generateRandomData(protocol.MediumChunkSize + 77)
+	source := createTestTempFile(t, string(content))
+	defer os.Remove(source)
+	if err := client.client.UploadFile(ctx, source); err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+	name := filepath.Base(source)
+
+	// The retry reconnects into the same session, so the uploaded file is still there
+	proxy.drop()
+	files, err := client.client.ListFiles(ctx)
+	if err != nil {
+		t.Fatalf("ListFiles after a dropped connection failed: %v", err)
+	}
+	if files != name {
+		t.Errorf("Listed %q after reconnecting, want %q", files, name)
+	}
+	if got := proxy.accepted.Load(); got != 2 {
+		t.Errorf("Expected the client to reconnect once, proxy accepted %d connections", got)
+	}
+
+	proxy.drop()
+	downloaded, err := client.client.DownloadBytes(ctx, name)
+	if err != nil {
+		t.Fatalf("DownloadBytes after a dropped connection failed: %v", err)
+	}
+	if !bytes.Equal(downloaded, content) {
+		t.Errorf("Downloaded %d bytes that do not match the %d uploaded", len(downloaded), len(content))
+	}
+
+	// Without a retry policy the failure reaches the caller
+	plain := setupTestClient(t, viaProxy)
+	defer plain.cleanupTestClient(t)
+	proxy.drop()
+	if _, err := plain.client.ListFiles(ctx); err == nil {
+		t.Error("Expected ListFiles to fail on a dropped connection without a retry policy")
+	}
+}
+
+func TestRealE2E_DownloadFileResilient(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	proxy := startFlakyProxy(t, net.JoinHostPort(server.host, server.port))
+	_, proxyPort, _ := net.SplitHostPort(proxy.listener.Addr().String())
+	viaProxy := &TestServer{host: "127.0.0.1", port: proxyPort, keyDir: server.keyDir}
+
+	// The client has no retry policy of its own, and its log shows whether it resumed
+	core, logs := observer.New(zapcore.InfoLevel)
+	ctx := context.Background()
+	client, err := clientpkg.NewClientWithServerPubKey(ctx, viaProxy.host, viaProxy.port, filepath.Join(server.keyDir, "public.pem"), zap.New(core))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close(ctx)
+	if err := client.PerformHandshake(ctx); err != nil {
+		t.Fatalf("Failed to perform handshake: %v", err)
+	}
+
+	content := generateRandomData(8 * 1024 * 1024)
+	if err := client.UploadStream(ctx, "large.bin", bytes.NewReader(content), int64(len(content)), nil); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	// The connection drops a quarter of the way through the download
+	proxy.cutAfter.Store(int64(len(content) / 4))
+	output := filepath.Join(t.TempDir(), "large.bin")
+	if err := client.DownloadFileResilient(ctx, "large.bin", output); err != nil {
+		t.Fatalf("DownloadFileResilient failed: %v", err)
+	}
+
+	if got := proxy.accepted.Load(); got != 2 {
+		t.Errorf("Expected the client to reconnect once, proxy accepted %d connections", got)
+	}
+	if logs.FilterMessage("Resuming download").Len() != 1 {
+		t.Error("Expected the download to resume from the data already written")
+	}
+	downloaded, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read the downloaded file: %v", err)
+	}
+	if sha256.Sum256(downloaded) != sha256.Sum256(content) || !bytes.Equal(downloaded, content) {
+		t.Errorf("Downloaded %d bytes that do not match the %d uploaded", len(downloaded), len(content))
+	}
+}
+
+// TestRealE2E_TransferV2DropAndResume moves a large file in transfer v2 mode: a
+// streamed upload of checksummed chunks, then a download that loses its connection
+// halfway, resumes from the data already written and is checked against the server's
+// whole-file digest
+func TestRealE2E_TransferV2DropAndResume(t *testing.T) {
+	size := int64(100 * 1024 * 1024)
+	if testing.Short() {
+		size = 16 * 1024 * 1024
+	}
+
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	proxy := startFlakyProxy(t, net.JoinHostPort(server.host, server.port))
+	_, proxyPort, _ := net.SplitHostPort(proxy.listener.Addr().String())
+	viaProxy := &TestServer{host: "127.0.0.1", port: proxyPort, keyDir: server.keyDir}
+
+	// The client's log shows whether it resumed
+	core, logs := observer.New(zapcore.InfoLevel)
+	ctx := context.Background()
+	client, err := clientpkg.NewClientWithServerPubKey(ctx, viaProxy.host, viaProxy.port, filepath.Join(server.keyDir, "public.pem"), zap.New(core),
+		clientpkg.WithRetryPolicy(clientpkg.RetryPolicy{MaxRetries: 3, Backoff: 10 * time.Millisecond}))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close(ctx)
+	if err := client.PerformHandshake(ctx); err != nil {
+		t.Fatalf("Failed to perform handshake: %v", err)
+	}
+	if !client.TransferV2() {
+		t.Fatal("Expected the handshake to agree on transfer v2")
+	}
+
+	// The source is streamed from disk, never held in memory whole
+	source := filepath.Join(t.TempDir(), "large.bin")
+	file, err := os.Create(source)
+	if err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+	sourceHash := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(file, sourceHash), rand.Reader, size); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+	file.Close()
+	if err := client.UploadFileTo(ctx, source, "large.bin", nil); err != nil {
+		t.Fatalf("UploadFileTo failed: %v", err)
+	}
+
+	// The connection drops halfway through the download
+	proxy.cutAfter.Store(size / 2)
+	output := filepath.Join(t.TempDir(), "large.bin")
+	if err := client.DownloadFile(ctx, "large.bin", output, nil); err != nil {
+		t.Fatalf("DownloadFile failed: %v", err)
+	}
+
+	if got := proxy.accepted.Load(); got != 2 {
+		t.Errorf("Expected the client to reconnect once, proxy accepted %d connections", got)
+	}
+	if logs.FilterMessage("Resuming download").Len() != 1 {
+		t.Error("Expected the download to resume from the data already written")
+	}
+	downloaded, err := os.Open(output)
+	if err != nil {
+		t.Fatalf("Failed to open the downloaded file: %v", err)
+	}
+	defer downloaded.Close()
+	outputHash := sha256.New()
+	if _, err := io.Copy(outputHash, downloaded); err != nil {
+		t.Fatalf("Failed to read the downloaded file: %v", err)
+	}
+	if !bytes.Equal(outputHash.Sum(nil), sourceHash.Sum(nil)) {
+		t.Error("Downloaded file digest does not match the uploaded file")
+	}
+}
+
+func TestRealE2E_KeepAliveDetectsDeadConnection(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	proxy := startFlakyProxy(t, net.JoinHostPort(server.host, server.port))
+	_, proxyPort, _ := net.SplitHostPort(proxy.listener.Addr().String())
+	viaProxy := &TestServer{host: "127.0.0.1", port: proxyPort, keyDir: server.keyDir}
+
+	const interval = 100 * time.Millisecond
+	client := setupTestClient(t, viaProxy, clientpkg.WithKeepAliveInterval(interval))
+	defer client.cleanupTestClient(t)
+
+	// Heartbeats keep an idle connection usable
+	time.Sleep(3 * interval)
+	ctx := context.Background()
+	if _, err := client.client.ListFiles(ctx); err != nil {
+		t.Fatalf("ListFiles after idling failed: %v", err)
+	}
+
+	// Once the server stops answering, the next heartbeat notices within an interval
+	// of being sent and closes the connection, so calls fail at once instead of after
+	// the read timeout
+	proxy.stall()
+	time.Sleep(4 * interval)
+	start := time.Now()
+	_, err := client.client.ListFiles(ctx)
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Expected the connection to have been closed, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > interval {
+		t.Errorf("ListFiles took %v to fail on a dead connection", elapsed)
+	}
+}
+
+func TestRealE2E_CloseEndsSessionCleanly(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	server := setupTestServerWithConfig(t, func(cfg *ServerConfig) {
+		cfg.Logger = zap.New(core)
+	})
+	defer server.cleanupTestServer(t)
+
+	const (
+		graceful = "Client closed the session"
+		abrupt   = "Client disconnected without closing the session"
+	)
+	waitForLog := func(message string) {
+		t.Helper()
+		assert.Eventually(t, func() bool { return logs.FilterMessage(message).Len() == 1 },
+			2*time.Second, 10*time.Millisecond, "expected the server to log %q", message)
+	}
+
+	client := setupTestClient(t, server)
+	if _, err := client.client.ListFiles(context.Background()); err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	if err := client.client.Close(context.Background()); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	waitForLog(graceful)
+	assert.Equal(t, 0, logs.FilterMessage(abrupt).Len())
+	assert.Eventually(t, func() bool { return server.server.ActiveConnections() == 0 }, time.Second, 10*time.Millisecond)
+
+	// A connection that just goes away is still cleaned up, and reported as such
+	proxy := startFlakyProxy(t, net.JoinHostPort(server.host, server.port))
+	_, proxyPort, _ := net.SplitHostPort(proxy.listener.Addr().String())
+	dropped := setupTestClient(t, &TestServer{host: "127.0.0.1", port: proxyPort, keyDir: server.keyDir})
+	defer dropped.cleanupTestClient(t)
+	proxy.drop()
+	waitForLog(abrupt)
+	assert.Equal(t, 1, logs.FilterMessage(graceful).Len())
+}
+
+// TestRealE2E_ReconnectAfterServerRestart checks that a ReconnectingClient carries on
+// after the server restarts, landing in the same directory
+func TestRealE2E_ReconnectAfterServerRestart(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+	defer func() { server.server.Shutdown(context.Background()) }()
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+	reconnecting := clientpkg.NewReconnectingClient(client.client)
+
+	ctx := context.Background()
+	localFile := createTestTempFile(t, "survives restarts")
+	if _, err := reconnecting.UploadFileWithStats(ctx, localFile, "kept.txt", nil); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	server.restartTestServer(t)
+
+	files, err := reconnecting.ListDir(ctx, "", false)
+	if err != nil {
+		t.Fatalf("List after restart failed: %v", err)
+	}
+	if len(files) != 1 || files[0].Name != "kept.txt" {
+		t.Errorf("Expected the file uploaded before the restart, got %v", files)
+	}
+
+	outputPath := filepath.Join(t.TempDir(), "kept.txt")
+	if _, err := reconnecting.DownloadFileWithStats(ctx, "kept.txt", outputPath, nil); err != nil {
+		t.Fatalf("Download after restart failed: %v", err)
+	}
+	if data, err := os.ReadFile(outputPath); err != nil || string(data) != "survives restarts" {
+		t.Errorf("Downloaded %q (%v), want %q", data, err, "survives restarts")
+	}
+}
+
+// TestRealE2E_AbortDownload cancels a download after its first chunk: the server stops
+// sending the rest, the partial file is discarded and the connection carries on
+func TestRealE2E_AbortDownload(t *testing.T) {
+	server := setupTestServerWithConfig(t, func(config *ServerConfig) {
+		config.ChunkPacing = 100 * time.Millisecond
+	})
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+	content := strings.Repeat("aborted download ", 80*1024) // ~1.4 MB, over 2s of paced chunks
+	testFile := createTestTempFile(t, content)
+	if err := client.client.UploadFileAs(ctx, testFile, "large.txt", nil); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	smallFile := createTestTempFile(t, "still usable")
+	if err := client.client.UploadFileAs(ctx, smallFile, "small.txt", nil); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	downloadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var cancelled time.Time
+	progress := func(transferred, total uint64) {
+		if cancelled.IsZero() && transferred > 0 {
+			cancelled = time.Now()
+			cancel()
+		}
+	}
+
+	outputPath := filepath.Join(t.TempDir(), "large.txt")
+	err := client.client.DownloadFile(downloadCtx, "large.txt", outputPath, progress)
+	if !errors.Is(err, clientpkg.ErrDownloadAborted) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected an aborted download, got %v", err)
+	}
+	// Had the server sent every chunk, the client would have waited for all of them
+	if elapsed := time.Since(cancelled); elapsed > time.Second {
+		t.Errorf("Download took %v to stop after cancellation", elapsed)
+	}
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the partial download to be removed, got %v", err)
+	}
+
+	files, err := client.client.ListDir(ctx, "", false)
+	if err != nil || len(files) != 2 {
+		t.Fatalf("List after abort returned %v (%v), want both files", files, err)
+	}
+	smallPath := filepath.Join(t.TempDir(), "small.txt")
+	if err := client.client.DownloadFile(ctx, "small.txt", smallPath, nil); err != nil {
+		t.Fatalf("Download after abort failed: %v", err)
+	}
+	if data, err := os.ReadFile(smallPath); err != nil || string(data) != "still usable" {
+		t.Errorf("Downloaded %q (%v), want %q", data, err, "still usable")
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"os"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// handleRename moves a file within the client directory. The command uses the field
+// layout: the current name, then the new name. An existing destination is handled by
+// the collision policy, like any other write.
+func (handler *CommandHandler) handleRename(command *protocol.CommandMessage) error {
+	if len(command.Fields) != 2 {
+		return handler.sendFailure(protocol.ErrCodeInvalidRequest, "Rename requires a source and a destination")
+	}
+	source, destination := string(command.Fields[0]), string(command.Fields[1])
+	handler.logger.Info("Rename command received", zap.String("from", source), zap.String("to", destination))
+
+	if handler.tx != nil {
+		return handler.sendFailure(protocol.ErrCodeInvalidRequest, "Rename is not allowed inside a transaction")
+	}
+
+	sourcePath, err := handler.validatePath(source)
+	if err != nil {
+		handler.logger.Warn(errPathValidationFailed, zap.String("filename", source), zap.Error(err))
+		return handler.sendFailure(protocol.ErrCodeInvalidPath, errInvalidFilename)
+	}
+	destinationPath, err := handler.validatePath(destination)
+	if err != nil {
+		handler.logger.Warn(errPathValidationFailed, zap.String("filename", destination), zap.Error(err))
+		return handler.sendFailure(protocol.ErrCodeInvalidPath, "Invalid destination filename")
+	}
+	if err := handler.validateFilename(handler.clientRelativeName(destinationPath)); err != nil {
+		return handler.refuseFilename(destination, err)
+	}
+
+	info, err := os.Stat(sourcePath)
+	if os.IsNotExist(err) {
+		return handler.sendFailure(protocol.ErrCodeNotFound, protocol.FileNotFoundMessage)
+	}
+	if err != nil || info.IsDir() {
+		return handler.sendFailure(protocol.ErrCodeInvalidPath, "Source is not a file")
+	}
+
+	if refusal := handler.checkParentDir(destinationPath); refusal != "" {
+		return handler.sendFailure(protocol.ErrCodeNotFound, refusal)
+	}
+
+	// Renaming a file onto itself is a no-op rather than a collision
+	if sourcePath != destinationPath {
+		destinationPath, err = handler.resolveCollision(destinationPath)
+		if err != nil {
+			return handler.sendFailure(collisionErrorCode(err), err.Error())
+		}
+
+		unlock := handler.lockFiles(false, sourcePath, destinationPath)
+		err := os.Rename(sourcePath, destinationPath)
+		unlock()
+		if err != nil {
+			handler.logger.Error("Failed to rename file", zap.String("from", source), zap.String("to", destination), zap.Error(err))
+			return handler.sendFailure(protocol.ErrCodeIO, "Failed to rename file")
+		}
+
+		if err := handler.mirrorRemove(sourcePath); err != nil {
+			return handler.sendFailure(protocol.ErrCodeIO, errMirrorFailed)
+		}
+		if err := handler.mirrorFile(destinationPath); err != nil {
+			return handler.sendFailure(protocol.ErrCodeIO, errMirrorFailed)
+		}
+	}
+
+	responsePayload, err := protocol.SerializeResponse(true, "File renamed successfully", []byte(handler.clientRelativeName(destinationPath)))
+	if err != nil {
+		return err
+	}
+	response := protocol.NewMessage(protocol.MessageTypeResponse, responsePayload)
+	return handler.conn.SendSecureMessage(response)
+}
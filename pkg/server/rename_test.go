@@ -0,0 +1,184 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+)
+
+// renameForTest sends a rename through handle and returns the response
+func renameForTest(t *testing.T, cmdHandler *CommandHandler, mockConn *MockConnectionHandler, from string, to string) *protocol.ResponseMessage {
+	t.Helper()
+	mockConn.ClearSentMessages()
+
+	payload, err := protocol.SerializeCommandFields(protocol.CommandRename, []byte(from), []byte(to))
+	if err != nil {
+		t.Fatalf("SerializeCommandFields failed: %v", err)
+	}
+	command, err := protocol.DeserializeCommand(payload)
+	if err != nil {
+		t.Fatalf("DeserializeCommand failed: %v", err)
+	}
+	if err := cmdHandler.handle(command); err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+
+	respMsg, err := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload)
+	if err != nil {
+		t.Fatalf("Failed to deserialize response: %v", err)
+	}
+	return respMsg
+}
+
+func TestHandleRename(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      CollisionPolicy
+		existing    map[string]string
+		from        string
+		to          string
+		wantSuccess bool
+		wantMessage string
+		wantStored  string
+		wantFiles   map[string]string
+	}{
+		{
+			name:        "simple rename",
+			existing:    map[string]string{"a.txt": "A"},
+			from:        "a.txt",
+			to:          "b.txt",
+			wantSuccess: true,
+			wantStored:  "b.txt",
+			wantFiles:   map[string]string{"b.txt": "A"},
+		},
+		{
+			name:        "overwrite existing destination",
+			policy:      CollisionOverwrite,
+			existing:    map[string]string{"a.txt": "A", "b.txt": "B"},
+			from:        "a.txt",
+			to:          "b.txt",
+			wantSuccess: true,
+			wantStored:  "b.txt",
+			wantFiles:   map[string]string{"b.txt": "A"},
+		},
+		{
+			name:        "reject existing destination",
+			policy:      CollisionReject,
+			existing:    map[string]string{"a.txt": "A", "b.txt": "B"},
+			from:        "a.txt",
+			to:          "b.txt",
+			wantMessage: errFileExists.Error(),
+			wantFiles:   map[string]string{"a.txt": "A", "b.txt": "B"},
+		},
+		{
+			name:        "version existing destination",
+			policy:      CollisionVersion,
+			existing:    map[string]string{"a.txt": "A", "b.txt": "B"},
+			from:        "a.txt",
+			to:          "b.txt",
+			wantSuccess: true,
+			wantStored:  "b (1).txt",
+			wantFiles:   map[string]string{"b.txt": "B", "b (1).txt": "A"},
+		},
+		{
+			name:        "rename onto itself",
+			policy:      CollisionReject,
+			existing:    map[string]string{"a.txt": "A"},
+			from:        "a.txt",
+			to:          "a.txt",
+			wantSuccess: true,
+			wantStored:  "a.txt",
+			wantFiles:   map[string]string{"a.txt": "A"},
+		},
+		{
+			name:        "destination escapes client directory",
+			existing:    map[string]string{"a.txt": "A"},
+			from:        "a.txt",
+			to:          "../escaped.txt",
+			wantMessage: "Invalid destination filename",
+			wantFiles:   map[string]string{"a.txt": "A"},
+		},
+		{
+			name:        "empty destination",
+			existing:    map[string]string{"a.txt": "A"},
+			from:        "a.txt",
+			to:          "",
+			wantMessage: "Invalid destination filename",
+			wantFiles:   map[string]string{"a.txt": "A"},
+		},
+		{
+			name:        "missing source",
+			from:        "missing.txt",
+			to:          "b.txt",
+			wantMessage: "File not found",
+			wantFiles:   map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := createTestTempDir(t)
+			defer cleanupTestTempDir(t, tempDir)
+
+			cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+			cmdHandler.config = &ServerConfig{RootDir: &tempDir, OnCollision: tt.policy}
+			for name, content := range tt.existing {
+				if resp := uploadForTest(t, cmdHandler, mockConn, name, []byte(content)); !resp.Success {
+					t.Fatalf("Upload of %s failed: %s", name, resp.Message)
+				}
+			}
+
+			resp := renameForTest(t, cmdHandler, mockConn, tt.from, tt.to)
+			if resp.Success != tt.wantSuccess {
+				t.Fatalf("Success = %v (%q), want %v", resp.Success, resp.Message, tt.wantSuccess)
+			}
+			if tt.wantMessage != "" && resp.Message != tt.wantMessage {
+				t.Errorf("Message = %q, want %q", resp.Message, tt.wantMessage)
+			}
+			if tt.wantSuccess && string(resp.Data) != tt.wantStored {
+				t.Errorf("Stored name = %q, want %q", resp.Data, tt.wantStored)
+			}
+
+			clientDir, _ := cmdHandler.getClientDir()
+			entries, _ := os.ReadDir(clientDir)
+			if len(entries) != len(tt.wantFiles) {
+				t.Errorf("Client directory has %d entries, want %d", len(entries), len(tt.wantFiles))
+			}
+			for name, want := range tt.wantFiles {
+				got, err := os.ReadFile(filepath.Join(clientDir, name))
+				if err != nil || string(got) != want {
+					t.Errorf("%s = %q (%v), want %q", name, got, err, want)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(tempDir, "escaped.txt")); !os.IsNotExist(err) {
+				t.Errorf("Rename escaped the client directory")
+			}
+		})
+	}
+}
+
+func TestHandleRename_RequiresFieldLayout(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+	if resp := uploadForTest(t, cmdHandler, mockConn, "a.txt", []byte("A")); !resp.Success {
+		t.Fatalf("Upload failed: %s", resp.Message)
+	}
+
+	// The classic layout cannot carry the destination
+	mockConn.ClearSentMessages()
+	if err := cmdHandler.handle(&protocol.CommandMessage{Command: protocol.CommandRename, Filename: "a.txt", Data: []byte("b.txt")}); err != nil {
+		t.Fatalf("Expected refusal without closing the session, got %v", err)
+	}
+	respMsg, _ := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload)
+	if respMsg.Success || respMsg.Message != "Command 0x05 requires the field layout" {
+		t.Errorf("Unexpected response: success=%v message=%q", respMsg.Success, respMsg.Message)
+	}
+
+	if resp := renameForTest(t, cmdHandler, mockConn, "a.txt", "b.txt"); !resp.Success {
+		t.Errorf("Rename after refusal failed: %s", resp.Message)
+	}
+}
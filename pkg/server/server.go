@@ -2,13 +2,22 @@ package server
 
 import (
 	"bufio"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"net/http"
 	"os"
+	"sync"
+	"time"
 
 	aesUtil "github.com/lcensies/ssnproj/pkg/aes"
+	"github.com/lcensies/ssnproj/pkg/metrics"
 	protocol "github.com/lcensies/ssnproj/pkg/protocol"
 	rsaUtil "github.com/lcensies/ssnproj/pkg/rsa"
 	"go.uber.org/zap"
@@ -18,18 +27,166 @@ type ServerConfig struct {
 	Host         string
 	Port         string
 	ConfigFolder string
-	RootDir      *string
-	Logger       *zap.Logger
+	// RootDir holds the clients' directories. When it is nil, empty or MemoryRootDir
+	// and no Storage is set, files are kept in a MemoryStorage and nothing is written
+	// to disk.
+	RootDir *string
+	Logger  *zap.Logger
+
+	// LogLevel is the level the server command builds Logger with (debug, info, warn or
+	// error), as read by LoadServerConfig. NewServer uses Logger as given.
+	LogLevel string
+
+	// OnCollision decides what happens when a write targets an existing file
+	OnCollision CollisionPolicy
+
+	// Decrypter performs the private-key operation of the handshake, allowing the key
+	// to live in an HSM/KMS. When nil the PEM key pair from ConfigFolder is used.
+	// Clients that ask the server to sign the handshake need it to be a crypto.Signer too.
+	Decrypter crypto.Decrypter
+
+	// MaxSessionDuration forces clients to reconnect and re-handshake once a session
+	// has lasted this long. Zero disables the limit.
+	MaxSessionDuration time.Duration
+
+	// IdleTimeout closes connections that send nothing for this long. The clock restarts
+	// whenever data arrives or a command finishes, and is paused while a follow-mode tail
+	// streams to the client. Zero disables the limit.
+	IdleTimeout time.Duration
+
+	// HandshakeTimeout closes connections that have not completed the handshake this long
+	// after connecting, so clients that connect and then stall cannot hold connections.
+	// Zero disables the limit.
+	HandshakeTimeout time.Duration
+
+	// MirrorDir, when set, receives a copy of every upload and delete for simple redundancy.
+	// Mirror failures are logged and ignored unless MirrorStrict is set, in which case the
+	// client is told the operation failed (the primary copy is still updated).
+	MirrorDir    string
+	MirrorStrict bool
+
+	// TrashDir, when set, makes deletes recoverable: deleted files are moved into a
+	// directory per client below it, their names suffixed with the time of the delete,
+	// until CommandRestore brings the newest copy back or CommandEmptyTrash purges them.
+	// It should be on the same filesystem as RootDir so files are moved, not copied.
+	// It needs the default FilesystemStorage.
+	TrashDir string
+
+	// NormalizeUnicode applies NFC normalization to client filenames so NFC and NFD
+	// spellings of the same name refer to the same file
+	NormalizeUnicode bool
+
+	// LogSampling, when set, rate-limits repeated identical log lines so high request
+	// rates cannot flood the log pipeline. Errors are always logged.
+	LogSampling *LogSampling
+
+	// MinCipherStrength is the smallest AES session key, in bits, a client may choose.
+	// Zero means 256, so only AES-256 is accepted unless lowered to 192 or 128.
+	MinCipherStrength int
+
+	// MaxUploadSize rejects uploads larger than this many bytes. Zero means no limit.
+	MaxUploadSize int64
+
+	// MaxClientBytes caps the total size of the files each client directory may hold,
+	// counting uploads staged in a transaction. Zero means no quota.
+	MaxClientBytes int64
+
+	// ChunkPacing inserts a delay between download chunks to smooth out bursts.
+	// Zero sends chunks back to back.
+	ChunkPacing time.Duration
+
+	// MaxOpenFiles bounds how many files downloads may hold open at once across all
+	// connections. Downloads beyond it are refused as busy. Zero means no limit.
+	MaxOpenFiles int
+
+	// MaxConnections bounds how many clients may be connected at once. Connections beyond
+	// it are refused with a short failure response and closed. Zero means no limit.
+	MaxConnections int
+
+	// TLSConfig, when set, serves connections over TLS instead of the RSA/AES handshake.
+	// TLS protects the stream, so frames travel unencrypted inside it and each connection
+	// starts its session at once, with its own directory. No RSA key pair is needed.
+	TLSConfig *tls.Config
+
+	// SessionTicketLifetime enables session tickets, which let a client skip the RSA
+	// handshake on a later connection, and sets how long each ticket stays valid. Tickets
+	// are single-use and do not survive a restart. Zero disables them. Resuming issues
+	// the next ticket, but no chain of resumes outlasts MaxSessionDuration, or when that
+	// is zero SessionTicketLifetime, from the full handshake.
+	SessionTicketLifetime time.Duration
+
+	// AllowedExtensions, when set, limits stored files to these extensions, written with
+	// or without the dot and compared ignoring case. Files without an extension are refused.
+	AllowedExtensions []string
+	// DeniedPatterns refuses stored files with any path element matching one of these
+	// patterns (see path.Match), ignoring case, e.g. ".*" for hidden files or "*.exe"
+	DeniedPatterns []string
+
+	// MetricsAddr, when set, serves Prometheus metrics at /metrics on this address while
+	// the server runs, e.g. ":9100". Metrics are not collected otherwise.
+	MetricsAddr string
+
+	// FileMode and DirMode are the permissions of the files and directories the server
+	// creates under RootDir, e.g. 0600 and 0700 to keep them from other local users.
+	// Zero means 0644 and 0755.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+
+	// Storage, when set, keeps the clients' files instead of directories under RootDir.
+	// Commands that need a directory tree, such as transactions and Tail, are refused
+	// with ErrCodeUnsupported unless it is a FilesystemStorage.
+	Storage Storage
+
+	// AtRestKey, when set, encrypts stored files with AES-GCM under this 16, 24 or 32 byte
+	// key, each with a nonce of its own written before the ciphertext. Clients see
+	// plaintext as before; names are not encrypted. Files stored without the key, or
+	// under another, cannot be downloaded, and tailing is refused.
+	AtRestKey []byte
+
+	// AuditLogPath, when set, appends an audit record of every file operation to this file
+	// as JSON lines, besides logging it. Records name the client's directory, never its key.
+	AuditLogPath string
 }
 
 const defaultRootDir = "data"
 
+// MemoryRootDir is the RootDir that keeps files in memory instead of on disk
+const MemoryRootDir = ":memory:"
+
+const handshakeCompleteMessage = "handshake complete"
+
+const errTooManyConnections = "Server busy, too many connections; try again later"
+
 type Server struct {
 	config     *ServerConfig
 	rsaKeyPair *rsaUtil.RSAKeyPair
 	logger     *zap.Logger
+	// openFiles is a semaphore of MaxOpenFiles slots, nil when unlimited
+	openFiles chan struct{}
+	// connSlots is a semaphore of MaxConnections slots, nil when unlimited
+	connSlots chan struct{}
+	// tickets issues and redeems session tickets, nil when they are disabled
+	tickets *ticketStore
+	// fileLocks serialises operations on the same file across connections
+	fileLocks *fileLocks
+	// audit writes to auditFile, both nil unless AuditLogPath is set
+	audit     *zap.Logger
+	auditFile *os.File
+	// metrics is nil unless MetricsAddr is set; metricsServer serves it once Run starts
+	metrics       *metrics.Metrics
+	metricsServer *http.Server
+
+	// mu guards the listener and connection tracking used by Shutdown
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	handlers sync.WaitGroup
+	closed   bool
 }
 
+// ErrServerClosed is returned by Run once Shutdown has been called
+var ErrServerClosed = errors.New("server closed")
+
 type ConnectionState int
 
 const (
@@ -48,17 +205,49 @@ type ConnectionHandler struct {
 	logger        *zap.Logger
 	cmdHandler    *CommandHandler
 	rootDir       *string
+	config        *ServerConfig
+	decrypter     crypto.Decrypter
+	sessionStart  time.Time
+	lastActivity  time.Time
+	sendMu        sync.Mutex
+	openFiles     chan struct{}
+	tickets       *ticketStore
+	fileLocks     *fileLocks
+	audit         *zap.Logger
+	metrics       *metrics.Metrics
+
+	// secureTransport is set for TLS connections, whose frames need no AES layer
+	secureTransport bool
+
+	// ctx is cancelled when the connection ends, interrupting waits such as chunk pacing
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// reader reads the connection for the request loop and, during downloads, for
+	// watchAbort, which queues the messages it reads in pending and a read error in
+	// readAheadErr
+	reader       *bufio.Reader
+	pending      []*protocol.Message
+	readAheadErr error
 }
 
 func (c *ConnectionHandler) SendSecureMessage(message *protocol.Message) error {
-	// Encrypt the payload with AES
-	encryptedPayload, err := aesUtil.Encrypt(message.Payload, c.aesKey)
-	if err != nil {
-		return err
-	}
+	// Background senders (follow-mode tail) share the connection with the request loop
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	// TLS already protects the stream
+	encryptedMsg := message
+	if !c.secureTransport {
+		// Encrypt the payload with AES
+		encryptedPayload, err := aesUtil.Encrypt(message.Payload, c.aesKey)
+		if err != nil {
+			return err
+		}
 
-	// Create message with encrypted payload
-	encryptedMsg := protocol.NewMessage(message.Type, encryptedPayload)
+		// Create message with encrypted payload
+		encryptedMsg = protocol.NewMessage(message.Type, encryptedPayload)
+	}
 	serializedMsg, err := encryptedMsg.Serialize()
 
 	if err != nil {
@@ -77,7 +266,10 @@ func NewConnectionHandler(
 	logger *zap.Logger,
 	rootDir *string) *ConnectionHandler {
 
+	ctx, cancel := context.WithCancel(context.Background())
 	handler := &ConnectionHandler{
+		ctx:           ctx,
+		cancel:        cancel,
 		conn:          conn,
 		state:         ConnectionStateNew,
 		messageBuffer: protocol.NewMessageBuffer(),
@@ -91,44 +283,190 @@ func NewConnectionHandler(
 	return handler
 }
 
-func (handler *ConnectionHandler) handleHandshake(m *protocol.Message, rootDir *string) error {
+// keyDecrypter returns the configured decrypter, falling back to the file-based private key
+func (handler *ConnectionHandler) keyDecrypter() crypto.Decrypter {
+	if handler.decrypter != nil {
+		return handler.decrypter
+	}
+	return handler.rsaKeyPair.Private
+}
+
+// keySigner returns the signer for the server's private key, or nil when the configured
+// decrypter cannot sign
+func (handler *ConnectionHandler) keySigner() crypto.Signer {
+	if signer, ok := handler.keyDecrypter().(crypto.Signer); ok {
+		return signer
+	}
+	return nil
+}
+
+func (handler *ConnectionHandler) handleHandshake(m *protocol.Message, rootDir *string) (err error) {
 	handler.state = ConnectionStateHandshake
+	defer func() { handler.metrics.Handshake(err == nil) }()
+
+	request, err := protocol.DeserializeHandshakeRequest(m.Payload)
+	if err != nil {
+		return fmt.Errorf("error deserializing handshake: %w", err)
+	}
 
 	// Decrypt the AES key sent by the client
-	aesKey := rsaUtil.DecryptWithPrivateKey(m.Payload, handler.rsaKeyPair.Private)
+	aesKey, err := handler.keyDecrypter().Decrypt(rand.Reader, request.EncryptedKey, rsaUtil.OAEPOptions())
+	if err != nil {
+		return fmt.Errorf("error decrypting session key: %w", err)
+	}
+
+	// A key of the wrong size would only fail later, when the first message is encrypted.
+	// It cannot protect a reply either, so this refusal goes out in the clear.
+	keyBits := len(aesKey) * 8
+	if keyBits != 128 && keyBits != 192 && keyBits != 256 {
+		return handler.rejectHandshakePlain(fmt.Errorf("invalid session key size: %d bytes", len(aesKey)))
+	}
 	handler.aesKey = aesKey
+	if minBits := handler.settings().minCipherStrength(); keyBits < minBits {
+		return handler.rejectHandshake(fmt.Errorf("AES-%d session key rejected: server requires at least AES-%d", keyBits, minBits))
+	}
+
+	// Optional session parameters are encrypted with the session key
+	options := &protocol.HandshakeOptions{}
+	if len(request.Options) > 0 {
+		optionBytes, err := aesUtil.Decrypt(request.Options, aesKey)
+		if err != nil {
+			return fmt.Errorf("error decrypting handshake options: %w", err)
+		}
+		options, err = protocol.DeserializeHandshakeOptions(optionBytes)
+		if err != nil {
+			return fmt.Errorf("error deserializing handshake options: %w", err)
+		}
+	}
+
+	if options.Namespace != "" {
+		if err := validateNamespace(options.Namespace); err != nil {
+			return handler.rejectHandshake(err)
+		}
+		// Anyone could claim a namespace by name; only the holder of an identity key
+		// can open that identity's namespaces
+		if len(options.IdentityKey) == 0 {
+			return handler.rejectHandshake(errors.New("namespace requires a client identity"))
+		}
+	}
+
+	// A client with a long-lived identity keeps its storage across sessions
+	var identityDir string
+	if len(options.IdentityKey) > 0 {
+		if err := verifyClientIdentity(options.IdentityKey, options.IdentitySignature, request.EncryptedKey); err != nil {
+			return handler.rejectHandshake(err)
+		}
+		identityDir = identityDirName(options.IdentityKey)
+	}
+
+	// Sign the client's nonce so it can tell this server from one holding a different key
+	version := protocol.NegotiateProtocolVersion(options.ProtocolVersion)
+	var signature []byte
+	if len(options.Nonce) > 0 {
+		signer := handler.keySigner()
+		if signer == nil {
+			return handler.rejectHandshake(errors.New("server key cannot sign the handshake"))
+		}
+		digest := protocol.HandshakeSignatureDigest(options.Nonce, request.EncryptedKey, version)
+		signature, err = signer.Sign(rand.Reader, digest, rsaUtil.PSSOptions())
+		if err != nil {
+			return fmt.Errorf("error signing handshake: %w", err)
+		}
+	}
 
 	// Now that we have the AES key, initialize the command handler with it
-	handler.cmdHandler = NewCommandHandler(handler, handler.logger, rootDir, aesKey)
+	handler.startSession(aesKey, options.Namespace, identityDir, version)
 
-	// Send confirmation response
-	response, err := protocol.NewMessage(protocol.MessageTypeResponse, []byte("handshake complete")).Serialize()
+	// Send confirmation encrypted with the new session key, proving we hold it.
+	// Data carries the negotiated protocol version (2 bytes) and the handshake signature, if any.
+	responseData := append(binary.BigEndian.AppendUint16(nil, version), signature...)
+	responsePayload, err := protocol.SerializeResponse(true, handshakeCompleteMessage, responseData)
 	if err != nil {
 		return fmt.Errorf("error serializing handshake response: %v", err)
 	}
-	_, err = handler.conn.Write(response)
+	err = handler.SendSecureMessage(protocol.NewMessage(protocol.MessageTypeResponse, responsePayload))
 	if err != nil {
 		return fmt.Errorf("error sending handshake response: %v", err)
 	}
 
 	handler.state = ConnectionStateAuthenticated
-	handler.logger.Info("Client authenticated", zap.String("remote_addr", handler.conn.RemoteAddr().String()))
+	handler.logger.Info("Client authenticated",
+		zap.String("remote_addr", handler.conn.RemoteAddr().String()),
+		zap.String("namespace", options.Namespace),
+		zap.Bool("identity", identityDir != ""),
+		zap.Uint16("protocol_version", handler.cmdHandler.protocolVersion))
 	return nil
 }
 
+// startSession creates the command handler for an authenticated session. sessionKey
+// names the session's directory unless a namespace or identity directory is given.
+func (handler *ConnectionHandler) startSession(sessionKey []byte, namespace string, identityDir string, version uint16) {
+	handler.cmdHandler = NewCommandHandler(handler, handler.logger, handler.rootDir, sessionKey)
+	handler.cmdHandler.config = handler.config
+	handler.cmdHandler.namespace = namespace
+	handler.cmdHandler.identityDir = identityDir
+	handler.cmdHandler.ctx = handler.ctx
+	handler.cmdHandler.protocolVersion = version
+	handler.cmdHandler.openFiles = handler.openFiles
+	handler.cmdHandler.fileLocks = handler.fileLocks
+	handler.cmdHandler.audit = handler.audit
+	handler.cmdHandler.metrics = handler.metrics
+	handler.cmdHandler.authenticated = handler.sessionStart
+	// A TLS session has no key the client could resume with
+	if !handler.secureTransport {
+		handler.cmdHandler.tickets = handler.tickets
+	}
+}
+
+// rejectHandshake sends an encrypted refusal and returns an error so the connection is closed
+func (handler *ConnectionHandler) rejectHandshake(reason error) error {
+	responsePayload, _ := protocol.SerializeResponse(false, reason.Error(), nil)
+	if err := handler.SendSecureMessage(protocol.NewMessage(protocol.MessageTypeResponse, responsePayload)); err != nil {
+		handler.logger.Debug("Failed to send handshake rejection", zap.Error(err))
+	}
+	return fmt.Errorf("handshake rejected: %w", reason)
+}
+
+// rejectHandshakePlain refuses a handshake whose session key is unusable with an
+// unencrypted failure response
+func (handler *ConnectionHandler) rejectHandshakePlain(reason error) error {
+	responsePayload, _ := protocol.SerializeResponse(false, reason.Error(), nil)
+	serialized, err := protocol.NewMessage(protocol.MessageTypeResponse, responsePayload).Serialize()
+	if err == nil {
+		handler.sendMu.Lock()
+		_, err = handler.conn.Write(serialized)
+		handler.sendMu.Unlock()
+	}
+	if err != nil {
+		handler.logger.Debug("Failed to send handshake rejection", zap.Error(err))
+	}
+	return fmt.Errorf("handshake rejected: %w", reason)
+}
+
 func (handler *ConnectionHandler) handleCommand(message *protocol.Message) error {
 	command, err := protocol.DeserializeCommand(message.Payload)
 	if err != nil {
 		return err
 	}
 
+	// A download keeps the request loop busy, so the connection is watched for an abort
+	if command.Command == protocol.CommandDownload && handler.cmdHandler.wireVersion() >= protocol.ProtocolVersionAbort {
+		defer handler.watchAbort()()
+	}
 	return handler.cmdHandler.handle(command)
 }
 
 func (handler *ConnectionHandler) handleMessage(message *protocol.Message, rootDir *string) error {
+	if handler.secureTransport {
+		return handler.handleTLSMessage(message)
+	}
+
 	if message.Type == protocol.MessageTypeHandshake {
 		return handler.handleHandshake(message, rootDir)
 	}
+	if message.Type == protocol.MessageTypeResume {
+		return handler.handleResume(message)
+	}
 
 	// Only decrypt if we have an AES key (after handshake)
 	if handler.aesKey == nil {
@@ -143,38 +481,85 @@ func (handler *ConnectionHandler) handleMessage(message *protocol.Message, rootD
 	switch message.Type {
 	case protocol.MessageTypeCommand:
 		return handler.handleCommand(message)
+	case protocol.MessageTypeData:
+		return handler.cmdHandler.handleUploadData(message.Payload)
 	default:
 		return fmt.Errorf("unexpected message type: %v", message.Type)
 	}
 }
 
 func (handler *ConnectionHandler) HandleRawRequest() {
-	reader := bufio.NewReader(handler.conn)
+	handler.reader = bufio.NewReader(handler.conn)
 	buffer := make([]byte, 1024)
+	handler.sessionStart = time.Now()
+	handler.lastActivity = handler.sessionStart
+
+	handler.metrics.ConnectionOpened()
+	defer handler.metrics.ConnectionClosed()
+
+	// Uncommitted transactions are discarded however the connection ends
+	defer func() {
+		handler.cancel()
+		if handler.cmdHandler != nil {
+			handler.cmdHandler.stopTail()
+			handler.cmdHandler.abortUpload()
+			handler.cmdHandler.abortTransaction()
+		}
+	}()
 
 	for {
-		// Read data from connection
-		n, err := reader.Read(buffer)
+		// Read data from connection, unless a download's watchAbort already failed to
+		var n int
+		err := handler.readAheadErr
+		handler.readAheadErr = nil
+		if err == nil {
+			handler.conn.SetReadDeadline(handler.readDeadline())
+			n, err = handler.reader.Read(buffer)
+		}
 		if err != nil {
+			if handler.sessionExpired() {
+				handler.endExpiredSession()
+				return
+			}
+			if handler.handshakeExpired() {
+				handler.endStalledHandshake()
+				return
+			}
+			if handler.idleExpired() {
+				handler.endIdleSession()
+				return
+			}
 			if err != io.EOF {
 				handler.logger.Error("Error reading from connection", zap.Error(err))
+			} else if handler.cmdHandler != nil {
+				handler.logger.Info("Client disconnected without closing the session",
+					zap.String("remote_addr", handler.conn.RemoteAddr().String()))
 			}
 			handler.conn.Close()
 			return
 		}
 
+		handler.lastActivity = time.Now()
+
 		// Add received data to message buffer
 		handler.messageBuffer.AddData(buffer[:n])
 
 		// Try to deserialize complete messages from the buffer
 		for {
-			message, err := handler.messageBuffer.TryDeserialize()
+			handler.messageBuffer.SetMaxPayload(handler.maxFramePayload())
+			message, err := handler.nextMessage()
 			if err != nil {
 				// Check if it's a "not ready" error - this is expected for partial messages
 				if err == protocol.ErrInsufficientData || err == protocol.ErrIncompletePayload {
 					// Message not complete yet, wait for more data
 					break
 				}
+				// An undefined message type means the peer speaks a different protocol, and
+				// an oversized frame is refused unread
+				if errors.Is(err, protocol.ErrUnknownMessageType) || errors.Is(err, protocol.ErrPayloadTooLarge) {
+					handler.rejectFrame(err)
+					return
+				}
 				// Other errors are actual problems
 				handler.logger.Error("Error deserializing message", zap.Error(err))
 				handler.conn.Close()
@@ -190,46 +575,131 @@ func (handler *ConnectionHandler) HandleRawRequest() {
 				handler.conn.Close()
 				return
 			}
+			if handler.cmdHandler != nil && handler.cmdHandler.closed {
+				handler.endClosedSession()
+				return
+			}
+			// A long download counts as activity, so idleness is measured from its end
+			handler.lastActivity = time.Now()
 
+			// The current operation has finished, so an expired session can end cleanly
+			if handler.sessionExpired() {
+				handler.endExpiredSession()
+				return
+			}
 		}
 	}
 }
 
 func NewServer(config *ServerConfig) (*Server, error) {
-	// Use the logger from config
+	// Use the logger from config, keeping whatever level and encoding the caller chose
 	logger := config.Logger
 	if logger == nil {
-		// Fallback to production logger if none provided
+		// Fallback to development logger if none provided
 		var err error
-		logger, err = zap.NewProduction()
+		logger, err = zap.NewDevelopment()
 		if err != nil {
 			return nil, err
 		}
 	}
+	if config.LogSampling != nil {
+		logger = sampledLogger(logger, config.LogSampling)
+	}
+
+	if err := checkDeniedPatterns(config.DeniedPatterns); err != nil {
+		return nil, err
+	}
+	if err := checkAtRestKey(config.AtRestKey); err != nil {
+		return nil, err
+	}
+
+	// Keep files in memory when there is no root directory, without changing the
+	// caller's config
+	if config.Storage == nil && config.inMemory() {
+		memoryConfig := *config
+		memoryConfig.Storage = NewMemoryStorage()
+		config = &memoryConfig
+	}
+
+	if config.TrashDir != "" {
+		if _, ok := config.Storage.(*FilesystemStorage); config.Storage != nil && !ok {
+			return nil, fmt.Errorf("trash directory requires filesystem storage")
+		}
+		if err := os.MkdirAll(config.TrashDir, config.dirMode()); err != nil {
+			return nil, fmt.Errorf("failed to create trash directory: %w", err)
+		}
+	}
 
 	// Create root directory if it doesn't exist
-	if config.RootDir != nil {
-		if err := os.MkdirAll(*config.RootDir, 0755); err != nil {
+	if !config.inMemory() {
+		if err := os.MkdirAll(*config.RootDir, config.dirMode()); err != nil {
 			return nil, fmt.Errorf("failed to create root directory: %w", err)
 		}
 	}
 
-	// Load or generate RSA key pair
-	rsaKeyPair, err := rsaUtil.LoadKeypair(config.ConfigFolder)
-	if err != nil {
-		return nil, err
+	// Load or generate RSA key pair, unless the private key lives behind an external
+	// decrypter or TLS replaces the handshake
+	var rsaKeyPair *rsaUtil.RSAKeyPair
+	if config.Decrypter == nil && config.TLSConfig == nil {
+		var err error
+		rsaKeyPair, err = rsaUtil.LoadKeypair(config.ConfigFolder)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load server key pair from %s: %w", config.ConfigFolder, err)
+		}
 	}
 
 	logger.Info("Server initialized successfully",
+		zap.String("version", protocol.Version),
 		zap.String("config_folder", config.ConfigFolder),
-		zap.String("root_dir", *config.RootDir),
+		zap.Stringp("root_dir", config.RootDir),
 	)
 
-	return &Server{
+	server := &Server{
 		config:     config,
 		rsaKeyPair: rsaKeyPair,
 		logger:     logger,
-	}, nil
+		fileLocks:  newFileLocks(),
+	}
+	if config.MaxOpenFiles > 0 {
+		server.openFiles = make(chan struct{}, config.MaxOpenFiles)
+	}
+	if config.MaxConnections > 0 {
+		server.connSlots = make(chan struct{}, config.MaxConnections)
+	}
+	if config.SessionTicketLifetime > 0 {
+		// Resumed sessions end where MaxSessionDuration, or failing that one ticket
+		// lifetime, after their full handshake
+		maxAge := config.MaxSessionDuration
+		if maxAge <= 0 {
+			maxAge = config.SessionTicketLifetime
+		}
+		tickets, err := newTicketStore(config.SessionTicketLifetime, maxAge)
+		if err != nil {
+			return nil, err
+		}
+		server.tickets = tickets
+	}
+	if config.AuditLogPath != "" {
+		audit, auditFile, err := openAuditLog(config.AuditLogPath)
+		if err != nil {
+			return nil, err
+		}
+		server.audit = audit
+		server.auditFile = auditFile
+	}
+	if config.MetricsAddr != "" {
+		server.metrics = metrics.New()
+	}
+	return server, nil
+}
+
+// RevokeSessionTickets makes every session ticket issued so far invalid. Sessions that
+// are already connected continue.
+func (server *Server) RevokeSessionTickets() error {
+	if server.tickets == nil {
+		return nil
+	}
+	return server.tickets.revoke()
 }
 
 // SetRSAKeyPair sets the RSA key pair for testing purposes
@@ -237,20 +707,218 @@ func (server *Server) SetRSAKeyPair(keyPair *rsaUtil.RSAKeyPair) {
 	server.rsaKeyPair = keyPair
 }
 
-func (server *Server) Run() {
+// Run accepts connections until Shutdown is called, then returns ErrServerClosed.
+// Any other listen or accept failure is returned as is.
+func (server *Server) Run() error {
 	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%s", server.config.Host, server.config.Port))
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	server.mu.Lock()
+	if server.closed {
+		server.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	if server.config.TLSConfig != nil {
+		listener = tls.NewListener(listener, server.config.TLSConfig)
 	}
+	server.listener = listener
+	server.mu.Unlock()
 	defer listener.Close()
 
+	if err := server.startMetrics(); err != nil {
+		return err
+	}
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Fatal(err)
+			if server.isClosed() {
+				return ErrServerClosed
+			}
+			return fmt.Errorf("failed to accept connection: %w", err)
 		}
 
-		client := NewConnectionHandler(conn, server.rsaKeyPair, server.logger, server.config.RootDir)
-		go client.HandleRawRequest()
+		if !server.acquireConnSlot() {
+			go server.refuseConnection(conn)
+			continue
+		}
+		if !server.trackConn(conn) {
+			server.releaseConnSlot()
+			conn.Close()
+			return ErrServerClosed
+		}
+		client := server.newConnectionHandler(conn)
+		if server.config.TLSConfig != nil {
+			if err := client.startTLSSession(); err != nil {
+				server.logger.Error("Failed to start TLS session", zap.Error(err))
+				conn.Close()
+				server.untrackConn(conn)
+				server.releaseConnSlot()
+				continue
+			}
+		}
+		go func() {
+			// The slot is free before the connection stops counting as active
+			defer server.untrackConn(conn)
+			defer server.releaseConnSlot()
+			client.HandleRawRequest()
+		}()
 	}
 }
+
+// Shutdown stops accepting connections and waits for connected sessions to end, so
+// in-flight uploads can complete. When ctx is done first the remaining connections
+// are closed and ctx's error is returned. Only once every session has ended are the
+// metrics endpoint stopped and the audit log and logger flushed, so nothing a session
+// recorded is lost.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.mu.Lock()
+	server.closed = true
+	if server.listener != nil {
+		server.listener.Close()
+	}
+	server.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		server.handlers.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		server.mu.Lock()
+		server.logger.Warn("Shutdown deadline reached, closing remaining connections", zap.Int("connections", len(server.conns)))
+		for conn := range server.conns {
+			conn.Close()
+		}
+		server.mu.Unlock()
+		<-done
+		err = ctx.Err()
+	}
+
+	server.flush()
+	return err
+}
+
+// flush stops the metrics endpoint and flushes the audit log and the logger once no
+// session is left to write to them
+func (server *Server) flush() {
+	server.stopMetrics()
+	server.closeAuditLog()
+	server.logger.Info("Server shut down")
+	server.logger.Sync()
+}
+
+// closeAuditLog flushes and closes the audit log once no session can write to it
+func (server *Server) closeAuditLog() {
+	if server.auditFile == nil {
+		return
+	}
+	if err := server.audit.Sync(); err != nil {
+		server.logger.Error("Failed to flush audit log", zap.Error(err))
+	}
+	if err := server.auditFile.Close(); err != nil {
+		server.logger.Error("Failed to close audit log", zap.Error(err))
+	}
+	server.auditFile = nil
+}
+
+func (server *Server) isClosed() bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.closed
+}
+
+// trackConn registers an accepted connection, reporting false once shutdown has begun
+func (server *Server) trackConn(conn net.Conn) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.closed {
+		return false
+	}
+	if server.conns == nil {
+		server.conns = make(map[net.Conn]struct{})
+	}
+	server.conns[conn] = struct{}{}
+	server.handlers.Add(1)
+	return true
+}
+
+func (server *Server) untrackConn(conn net.Conn) {
+	server.mu.Lock()
+	delete(server.conns, conn)
+	server.mu.Unlock()
+	server.handlers.Done()
+}
+
+// ActiveConnections returns the number of clients currently connected
+func (server *Server) ActiveConnections() int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return len(server.conns)
+}
+
+// acquireConnSlot takes a connection slot, reporting false when none is free
+func (server *Server) acquireConnSlot() bool {
+	if server.connSlots == nil {
+		return true
+	}
+	select {
+	case server.connSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseConnSlot returns a slot taken by acquireConnSlot
+func (server *Server) releaseConnSlot() {
+	if server.connSlots != nil {
+		<-server.connSlots
+	}
+}
+
+// refuseConnection tells a client over the connection limit to retry later and closes
+// the connection. No session key exists yet, so the response is not encrypted.
+func (server *Server) refuseConnection(conn net.Conn) {
+	defer conn.Close()
+	server.logger.Warn("Connection limit reached, refusing connection",
+		zap.String("remote_addr", conn.RemoteAddr().String()),
+		zap.Int("max_connections", server.config.MaxConnections))
+
+	// Don't let a client that never reads hold the goroutine
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	responsePayload, _ := protocol.SerializeResponse(false, errTooManyConnections, nil)
+	frame, _ := protocol.NewMessage(protocol.MessageTypeResponse, responsePayload).Serialize()
+	if _, err := conn.Write(frame); err != nil {
+		server.logger.Debug("Failed to send connection refusal", zap.Error(err))
+		return
+	}
+
+	// Closing with the client's handshake unread would reset the connection and could
+	// discard the refusal, so finish sending and drain briefly first
+	if closer, ok := conn.(interface{ CloseWrite() error }); ok {
+		closer.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	io.Copy(io.Discard, conn)
+}
+
+// newConnectionHandler creates a handler for conn that shares the server's configuration
+func (server *Server) newConnectionHandler(conn net.Conn) *ConnectionHandler {
+	handler := NewConnectionHandler(conn, server.rsaKeyPair, server.logger, server.config.RootDir)
+	handler.config = server.config
+	handler.decrypter = server.config.Decrypter
+	handler.openFiles = server.openFiles
+	handler.fileLocks = server.fileLocks
+	handler.tickets = server.tickets
+	handler.audit = server.audit
+	handler.metrics = server.metrics
+	return handler
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"math"
+	"os"
+	"time"
+
+	protocol "github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+const errSessionExpired = "Session expired, please reconnect"
+
+// settings returns the server configuration, or defaults when the handler runs standalone
+func (handler *ConnectionHandler) settings() *ServerConfig {
+	if handler.config == nil {
+		return &ServerConfig{}
+	}
+	return handler.config
+}
+
+// defaultMinCipherStrength keeps the historical AES-256-only behaviour
+const defaultMinCipherStrength = 256
+
+// minCipherStrength returns the smallest accepted session key size in bits
+func (config *ServerConfig) minCipherStrength() int {
+	if config.MinCipherStrength > 0 {
+		return config.MinCipherStrength
+	}
+	return defaultMinCipherStrength
+}
+
+// Modes of created files and directories unless FileMode and DirMode are set
+const (
+	defaultFileMode os.FileMode = 0644
+	defaultDirMode  os.FileMode = 0755
+)
+
+// fileMode returns the permissions of files the server creates
+func (config *ServerConfig) fileMode() os.FileMode {
+	if config.FileMode != 0 {
+		return config.FileMode
+	}
+	return defaultFileMode
+}
+
+// dirMode returns the permissions of directories the server creates
+func (config *ServerConfig) dirMode() os.FileMode {
+	if config.DirMode != 0 {
+		return config.DirMode
+	}
+	return defaultDirMode
+}
+
+// inMemory reports whether RootDir names no directory, so files are kept in memory
+func (config *ServerConfig) inMemory() bool {
+	return config.RootDir == nil || *config.RootDir == "" || *config.RootDir == MemoryRootDir
+}
+
+// readDeadline returns the deadline for the next read, or the zero time for none
+func (handler *ConnectionHandler) readDeadline() time.Time {
+	var deadline time.Time
+	if maxDuration := handler.settings().MaxSessionDuration; maxDuration > 0 {
+		deadline = handler.sessionStart.Add(maxDuration)
+	}
+	if idle, ok := handler.idleDeadline(); ok && (deadline.IsZero() || idle.Before(deadline)) {
+		deadline = idle
+	}
+	if handshake, ok := handler.handshakeDeadline(); ok && (deadline.IsZero() || handshake.Before(deadline)) {
+		deadline = handshake
+	}
+	return deadline
+}
+
+// handshakeDeadline returns when an unfinished handshake times out, if HandshakeTimeout
+// applies right now
+func (handler *ConnectionHandler) handshakeDeadline() (time.Time, bool) {
+	timeout := handler.settings().HandshakeTimeout
+	if timeout <= 0 || handler.state == ConnectionStateAuthenticated {
+		return time.Time{}, false
+	}
+	return handler.sessionStart.Add(timeout), true
+}
+
+// handshakeExpired reports whether the client has not completed the handshake within
+// HandshakeTimeout of connecting
+func (handler *ConnectionHandler) handshakeExpired() bool {
+	deadline, ok := handler.handshakeDeadline()
+	return ok && !time.Now().Before(deadline)
+}
+
+// endStalledHandshake closes a connection that did not complete the handshake in time
+func (handler *ConnectionHandler) endStalledHandshake() {
+	handler.logger.Warn("Handshake timed out, closing connection",
+		zap.String("remote_addr", handler.conn.RemoteAddr().String()),
+		zap.Duration("timeout", handler.settings().HandshakeTimeout))
+
+	handler.state = ConnectionStateClosed
+	handler.conn.Close()
+}
+
+// idleDeadline returns when the connection counts as idle, if IdleTimeout applies right now
+func (handler *ConnectionHandler) idleDeadline() (time.Time, bool) {
+	idleTimeout := handler.settings().IdleTimeout
+	if idleTimeout <= 0 {
+		return time.Time{}, false
+	}
+	// A follow-mode tail keeps the client listening without sending anything
+	if handler.cmdHandler != nil && handler.cmdHandler.tail != nil {
+		return time.Time{}, false
+	}
+	return handler.lastActivity.Add(idleTimeout), true
+}
+
+// idleExpired reports whether the client has sent nothing for IdleTimeout
+func (handler *ConnectionHandler) idleExpired() bool {
+	deadline, ok := handler.idleDeadline()
+	return ok && !time.Now().Before(deadline)
+}
+
+// endIdleSession closes a connection that has been silent for IdleTimeout
+func (handler *ConnectionHandler) endIdleSession() {
+	handler.logger.Info("Connection idle, closing",
+		zap.String("remote_addr", handler.conn.RemoteAddr().String()),
+		zap.Duration("idle", time.Since(handler.lastActivity)))
+
+	handler.state = ConnectionStateClosed
+	handler.conn.Close()
+}
+
+// endClosedSession closes the connection of a client that sent CommandClose
+func (handler *ConnectionHandler) endClosedSession() {
+	handler.logger.Info("Client closed the session",
+		zap.String("remote_addr", handler.conn.RemoteAddr().String()),
+		zap.Duration("duration", time.Since(handler.sessionStart)))
+
+	handler.state = ConnectionStateClosed
+	handler.conn.Close()
+}
+
+// sessionExpired reports whether the session has outlived MaxSessionDuration
+func (handler *ConnectionHandler) sessionExpired() bool {
+	maxDuration := handler.settings().MaxSessionDuration
+	return maxDuration > 0 && time.Since(handler.sessionStart) >= maxDuration
+}
+
+// endExpiredSession notifies an authenticated client that it must reconnect and closes the connection
+func (handler *ConnectionHandler) endExpiredSession() {
+	handler.logger.Info("Session duration exceeded, closing connection",
+		zap.String("remote_addr", handler.conn.RemoteAddr().String()),
+		zap.Duration("session_duration", time.Since(handler.sessionStart)))
+
+	if handler.aesKey != nil || handler.secureTransport {
+		// Don't let a client that stopped reading hold the goroutine
+		handler.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		responsePayload, _ := protocol.SerializeResponse(false, errSessionExpired, nil)
+		response := protocol.NewMessage(protocol.MessageTypeResponse, responsePayload)
+		if err := handler.SendSecureMessage(response); err != nil {
+			handler.logger.Debug("Failed to send session expiry notice", zap.Error(err))
+		}
+	}
+
+	handler.state = ConnectionStateClosed
+	handler.conn.Close()
+}
+
+// frameOverhead is the room allowed around a frame's file data for its headers, name
+// and encryption
+const frameOverhead = 64 * 1024
+
+// maxFramePayload bounds the message the connection buffers before handling it. While
+// a chunked upload is open only its data chunks are expected, so nothing much larger
+// than a chunk is accepted and an upload never sits in memory whole. Otherwise a
+// whole-file upload may need up to MaxUploadSize. Zero means no limit.
+func (handler *ConnectionHandler) maxFramePayload() uint32 {
+	if handler.cmdHandler != nil && handler.cmdHandler.upload != nil {
+		return protocol.MaxChunkSize + frameOverhead
+	}
+	if maxSize := handler.settings().MaxUploadSize; maxSize > 0 && maxSize <= math.MaxUint32-frameOverhead {
+		return uint32(maxSize) + frameOverhead
+	}
+	return 0
+}
+
+// rejectFrame tells an authenticated client why its stream was rejected and closes the connection.
+// The framing can no longer be trusted after an undefined type or a frame that was not read,
+// so the session cannot continue.
+func (handler *ConnectionHandler) rejectFrame(err error) {
+	handler.logger.Warn("Rejecting frame",
+		zap.String("remote_addr", handler.conn.RemoteAddr().String()),
+		zap.Error(err))
+
+	if handler.aesKey != nil || handler.secureTransport {
+		responsePayload, _ := protocol.SerializeResponse(false, err.Error(), nil)
+		response := protocol.NewMessage(protocol.MessageTypeResponse, responsePayload)
+		if sendErr := handler.SendSecureMessage(response); sendErr != nil {
+			handler.logger.Debug("Failed to send rejection notice", zap.Error(sendErr))
+		}
+	}
+
+	handler.state = ConnectionStateClosed
+	handler.conn.Close()
+}
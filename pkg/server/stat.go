@@ -0,0 +1,44 @@
+package server
+
+import (
+	"errors"
+	"io/fs"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// handleStat reports a file's metadata in the response Data as a serialized FileInfo
+func (handler *CommandHandler) handleStat(command *protocol.CommandMessage) error {
+	handler.logger.Info("Stat command received", zap.String("filename", command.Filename))
+
+	filePath, err := handler.validatePath(command.Filename)
+	if err != nil {
+		handler.logger.Warn(errPathValidationFailed, zap.String("filename", command.Filename), zap.Error(err))
+		return handler.sendFailure(protocol.ErrCodeInvalidPath, errInvalidFilename)
+	}
+
+	fileInfo, err := handler.storage().Stat(handler.storageClient(), handler.storedName(filePath))
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && isUploadTemp(fileInfo.Name)) {
+		return handler.sendFailure(protocol.ErrCodeNotFound, protocol.FileNotFoundMessage)
+	}
+	if err != nil {
+		handler.logger.Error("Failed to stat file", zap.String("filename", command.Filename), zap.Error(err))
+		return handler.sendFailure(protocol.ErrCodeIO, "Failed to read file")
+	}
+
+	handler.reportPlainSize(&fileInfo)
+	if !fileInfo.IsDir && handler.wireVersion() >= protocol.ProtocolVersionContentType {
+		fileInfo.ContentType = handler.contentType(handler.storedName(filePath), fileInfo.Size)
+	}
+	data, err := protocol.SerializeFileInfo(&fileInfo)
+	if err != nil {
+		return err
+	}
+
+	responsePayload, err := protocol.SerializeResponse(true, "File found", data)
+	if err != nil {
+		return err
+	}
+	return handler.conn.SendSecureMessage(protocol.NewMessage(protocol.MessageTypeResponse, responsePayload))
+}
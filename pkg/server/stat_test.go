@@ -0,0 +1,70 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+)
+
+func TestHandleStat(t *testing.T) {
+	// Setup
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+	if resp := uploadForTest(t, cmdHandler, mockConn, "stat.txt", []byte("twelve bytes")); !resp.Success {
+		t.Fatalf("Upload failed: %s", resp.Message)
+	}
+	clientDir, err := cmdHandler.getClientDir()
+	if err != nil {
+		t.Fatalf("Failed to get client directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(clientDir, uploadTempPrefix+"1"), []byte("partial"), 0644); err != nil {
+		t.Fatalf("Failed to create temp upload: %v", err)
+	}
+
+	stat := func(filename string) *protocol.ResponseMessage {
+		mockConn.ClearSentMessages()
+		if err := cmdHandler.handle(&protocol.CommandMessage{Command: protocol.CommandStat, Filename: filename}); err != nil {
+			t.Fatalf("handle failed: %v", err)
+		}
+		respMsg, err := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload)
+		if err != nil {
+			t.Fatalf("Failed to deserialize response: %v", err)
+		}
+		return respMsg
+	}
+
+	respMsg := stat("stat.txt")
+	if !respMsg.Success {
+		t.Fatalf("Expected stat to succeed, got %q", respMsg.Message)
+	}
+	info, err := protocol.DeserializeFileInfo(respMsg.Data)
+	if err != nil {
+		t.Fatalf("Failed to parse file info: %v", err)
+	}
+	if info.Name != "stat.txt" || info.Size != 12 || info.IsDir || info.ModTime == 0 {
+		t.Errorf("Unexpected file info %+v", info)
+	}
+
+	tests := []struct {
+		name     string
+		filename string
+		want     string
+	}{
+		{"missing file", "missing.txt", protocol.FileNotFoundMessage},
+		{"unfinished upload", uploadTempPrefix + "1", protocol.FileNotFoundMessage},
+		{"outside client directory", "../stat.txt", errInvalidFilename},
+		{"empty name", "", errInvalidFilename},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			respMsg := stat(tt.filename)
+			if respMsg.Success || respMsg.Message != tt.want || len(respMsg.Data) != 0 {
+				t.Errorf("Expected failure %q, got success=%v message=%q data=%x", tt.want, respMsg.Success, respMsg.Message, respMsg.Data)
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// Storage keeps the clients' files. Each client has an area of its own, named by
+// client ("" for the root itself); names within it are slash-separated paths that
+// validatePath has already checked, "" standing for the area's top. Missing files are
+// reported with errors matching fs.ErrNotExist.
+//
+// Upload, Download, List, Stat, Delete and Usage go through Storage; chunked uploads to
+// other backends are buffered in memory and put once complete. Commands that need a real
+// directory tree (transactions, Tail, Mkdir, Rename, Copy and glob deletes) are only
+// available with FilesystemStorage.
+type Storage interface {
+	// Put stores data under name, replacing any file already there
+	Put(client, name string, data []byte) error
+	// Get returns the data stored under name
+	Get(client, name string) ([]byte, error)
+	// Delete removes the file stored under name
+	Delete(client, name string) error
+	// List describes the entries of the directory dir. Recursive listings include
+	// everything below dir, named by their path relative to dir, parents first.
+	List(client, dir string, recursive bool) ([]protocol.FileInfo, error)
+	// Stat describes the file or directory stored under name
+	Stat(client, name string) (protocol.FileInfo, error)
+}
+
+// errStorageUnsupported refuses commands the configured Storage cannot serve
+const errStorageUnsupported = "Not available with this storage backend"
+
+// FilesystemStorage stores each client's files in a directory of its own under Root,
+// created on first use. It is the default Storage.
+type FilesystemStorage struct {
+	Root string
+	// FileMode and DirMode are the permissions of created files and directories;
+	// zero means 0644 and 0755, as in ServerConfig
+	FileMode os.FileMode
+	DirMode  os.FileMode
+	// Logger, when set, is told about directory entries a listing skips
+	Logger *zap.Logger
+}
+
+// NewFilesystemStorage returns a FilesystemStorage rooted at root
+func NewFilesystemStorage(root string) *FilesystemStorage {
+	return &FilesystemStorage{Root: root}
+}
+
+// clientDir returns the client's directory, creating it if it doesn't exist
+func (storage *FilesystemStorage) clientDir(client string) (string, error) {
+	if client == "" {
+		return storage.Root, nil
+	}
+	dir := filepath.Join(storage.Root, client)
+	if err := os.MkdirAll(dir, storage.dirMode()); err != nil {
+		return "", fmt.Errorf("failed to create client directory: %w", err)
+	}
+	return dir, nil
+}
+
+// path returns the local path of name in the client's directory
+func (storage *FilesystemStorage) path(client, name string) (string, error) {
+	dir, err := storage.clientDir(client)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.FromSlash(name)), nil
+}
+
+func (storage *FilesystemStorage) fileMode() os.FileMode {
+	if storage.FileMode != 0 {
+		return storage.FileMode
+	}
+	return defaultFileMode
+}
+
+func (storage *FilesystemStorage) dirMode() os.FileMode {
+	if storage.DirMode != 0 {
+		return storage.DirMode
+	}
+	return defaultDirMode
+}
+
+func (storage *FilesystemStorage) Put(client, name string, data []byte) error {
+	filePath, err := storage.path(client, name)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, data, storage.fileMode())
+}
+
+func (storage *FilesystemStorage) Get(client, name string) ([]byte, error) {
+	filePath, err := storage.path(client, name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filePath)
+}
+
+func (storage *FilesystemStorage) Delete(client, name string) error {
+	filePath, err := storage.path(client, name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filePath)
+}
+
+func (storage *FilesystemStorage) List(client, dir string, recursive bool) ([]protocol.FileInfo, error) {
+	dirPath, err := storage.path(client, dir)
+	if err != nil {
+		return nil, err
+	}
+	return listEntries(dirPath, recursive, storage.Logger)
+}
+
+func (storage *FilesystemStorage) Stat(client, name string) (protocol.FileInfo, error) {
+	filePath, err := storage.path(client, name)
+	if err != nil {
+		return protocol.FileInfo{}, err
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return protocol.FileInfo{}, err
+	}
+	return fileInfoFrom(info), nil
+}
+
+// MemoryStorage keeps files in memory, for tests and short-lived servers. Directories
+// exist implicitly while they hold a file.
+type MemoryStorage struct {
+	mu    sync.Mutex
+	files map[string]memoryFile
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemoryStorage returns an empty MemoryStorage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{files: make(map[string]memoryFile)}
+}
+
+// memoryKey names a file across all clients
+func memoryKey(client, name string) string {
+	return path.Join(client, name)
+}
+
+func (storage *MemoryStorage) Put(client, name string, data []byte) error {
+	key := memoryKey(client, name)
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if storage.isDir(key) {
+		return fmt.Errorf("%s is a directory", name)
+	}
+	storage.files[key] = memoryFile{data: append([]byte(nil), data...), modTime: time.Now()}
+	return nil
+}
+
+func (storage *MemoryStorage) Get(client, name string) ([]byte, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	file, ok := storage.files[memoryKey(client, name)]
+	if !ok {
+		return nil, &fs.PathError{Op: "get", Path: name, Err: fs.ErrNotExist}
+	}
+	return append([]byte(nil), file.data...), nil
+}
+
+func (storage *MemoryStorage) Delete(client, name string) error {
+	key := memoryKey(client, name)
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if _, ok := storage.files[key]; !ok {
+		if storage.isDir(key) {
+			return fmt.Errorf("%s is a directory", name)
+		}
+		return &fs.PathError{Op: "delete", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(storage.files, key)
+	return nil
+}
+
+func (storage *MemoryStorage) List(client, dir string, recursive bool) ([]protocol.FileInfo, error) {
+	prefix := memoryKey(client, dir) + "/"
+	if prefix == "/" {
+		prefix = ""
+	}
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if dir != "" && !storage.isDir(memoryKey(client, dir)) {
+		return nil, &fs.PathError{Op: "list", Path: dir, Err: fs.ErrNotExist}
+	}
+
+	entries := make(map[string]protocol.FileInfo)
+	for key, file := range storage.files {
+		rel, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		parts := strings.Split(rel, "/")
+		// Every directory leading to the file is an entry of its own
+		for i := 1; i < len(parts); i++ {
+			name := strings.Join(parts[:i], "/")
+			if !recursive && i > 1 {
+				break
+			}
+			if existing, seen := entries[name]; !seen || existing.ModTime < file.modTime.Unix() {
+				entries[name] = protocol.FileInfo{Name: name, ModTime: file.modTime.Unix(), IsDir: true}
+			}
+		}
+		if recursive || len(parts) == 1 {
+			entries[rel] = protocol.FileInfo{Name: rel, Size: int64(len(file.data)), ModTime: file.modTime.Unix()}
+		}
+	}
+
+	infos := make([]protocol.FileInfo, 0, len(entries))
+	for _, info := range entries {
+		if !recursive {
+			info.Name = path.Base(info.Name)
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func (storage *MemoryStorage) Stat(client, name string) (protocol.FileInfo, error) {
+	key := memoryKey(client, name)
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if file, ok := storage.files[key]; ok {
+		return protocol.FileInfo{Name: path.Base(name), Size: int64(len(file.data)), ModTime: file.modTime.Unix()}, nil
+	}
+	if storage.isDir(key) {
+		return protocol.FileInfo{Name: path.Base(name), IsDir: true}, nil
+	}
+	return protocol.FileInfo{}, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+// isDir reports whether any file is stored below key. The caller holds mu.
+func (storage *MemoryStorage) isDir(key string) bool {
+	for existing := range storage.files {
+		if strings.HasPrefix(existing, key+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// errNotOnDisk is returned by getClientDir when files are not kept in local directories
+var errNotOnDisk = errors.New("storage backend has no local directories")
+
+// storage returns the configured Storage, a FilesystemStorage under the root
+// directory by default. It is set up on first use and kept for the session.
+func (handler *CommandHandler) storage() Storage {
+	if handler.store != nil {
+		return handler.store
+	}
+	if storage := handler.settings().Storage; storage != nil {
+		handler.store = storage
+	} else {
+		handler.store = &FilesystemStorage{
+			Root:     *handler.rootDir,
+			FileMode: handler.settings().FileMode,
+			DirMode:  handler.settings().DirMode,
+			Logger:   handler.logger,
+		}
+	}
+	return handler.store
+}
+
+// onDisk reports whether files are kept in local directories, which the commands that
+// work on the directory tree itself need
+func (handler *CommandHandler) onDisk() bool {
+	_, ok := handler.storage().(*FilesystemStorage)
+	return ok
+}
+
+// storageClient names the client's area in Storage: "" before the handshake, when
+// there is no key to derive one from, otherwise clientID
+func (handler *CommandHandler) storageClient() string {
+	if len(handler.aesKey) == 0 {
+		return ""
+	}
+	return handler.clientID()
+}
+
+// storedName returns the name of a path from validatePath within the client's area
+func (handler *CommandHandler) storedName(filePath string) string {
+	name := handler.clientRelativeName(filePath)
+	if name == "." {
+		return ""
+	}
+	return name
+}
+
+// requiresDisk reports whether command works on the directory tree itself and so needs
+// FilesystemStorage
+func requiresDisk(command protocol.CommandType) bool {
+	switch command {
+	case protocol.CommandBeginTx, protocol.CommandCommitTx,
+		protocol.CommandRollbackTx, protocol.CommandTail, protocol.CommandMkdir,
+		protocol.CommandRename, protocol.CommandCopy, protocol.CommandDeleteGlob,
+		protocol.CommandRestore, protocol.CommandEmptyTrash:
+		return true
+	}
+	return false
+}
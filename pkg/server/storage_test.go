@@ -0,0 +1,226 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+)
+
+// createMemoryCommandHandler returns a handler whose files live in a MemoryStorage.
+// Its root directory is checked to stay empty when the test ends.
+func createMemoryCommandHandler(t *testing.T) (*CommandHandler, *MockConnectionHandler, *MemoryStorage) {
+	rootDir := t.TempDir()
+	cmdHandler, mockConn := createTestCommandHandler(t, rootDir)
+	storage := NewMemoryStorage()
+	cmdHandler.config = &ServerConfig{RootDir: &rootDir, Storage: storage}
+
+	t.Cleanup(func() {
+		entries, err := os.ReadDir(rootDir)
+		if err != nil || len(entries) != 0 {
+			t.Errorf("Expected the root directory to stay empty, got %v (%v)", entries, err)
+		}
+	})
+	return cmdHandler, mockConn, storage
+}
+
+// runForTest runs command through the handler and returns its first response
+func runForTest(t *testing.T, cmdHandler *CommandHandler, mockConn *MockConnectionHandler, command *protocol.CommandMessage) *protocol.ResponseMessage {
+	mockConn.ClearSentMessages()
+	if err := cmdHandler.handle(command); err != nil {
+		t.Fatalf("Command 0x%02x failed: %v", byte(command.Command), err)
+	}
+	respMsg, err := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload)
+	if err != nil {
+		t.Fatalf("Failed to deserialize response: %v", err)
+	}
+	return respMsg
+}
+
+func TestMemoryStorage_Commands(t *testing.T) {
+	cmdHandler, mockConn, storage := createMemoryCommandHandler(t)
+
+	if resp := uploadForTest(t, cmdHandler, mockConn, "notes.txt", []byte("hello")); !resp.Success {
+		t.Fatalf("Upload failed: %s", resp.Message)
+	}
+	if err := storage.Put(cmdHandler.storageClient(), "docs/a.txt", []byte("nested")); err != nil {
+		t.Fatalf("Failed to store nested file: %v", err)
+	}
+
+	resp, data := downloadForTest(t, cmdHandler, mockConn, "notes.txt")
+	if !resp.Success || string(data) != "hello" {
+		t.Fatalf("Download returned success=%v data=%q: %s", resp.Success, data, resp.Message)
+	}
+
+	resp = runForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandList})
+	if !resp.Success || resp.Message != "notes.txt" {
+		t.Errorf("Expected listing of notes.txt, got success=%v %q", resp.Success, resp.Message)
+	}
+	resp = runForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandList, Filename: "docs"})
+	if !resp.Success || resp.Message != "a.txt" {
+		t.Errorf("Expected listing of docs/a.txt, got success=%v %q", resp.Success, resp.Message)
+	}
+
+	resp = runForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandStat, Filename: "notes.txt"})
+	if !resp.Success {
+		t.Fatalf("Stat failed: %s", resp.Message)
+	}
+	info, err := protocol.DeserializeFileInfo(resp.Data)
+	if err != nil || info.Size != 5 || info.IsDir {
+		t.Errorf("Unexpected stat of notes.txt: %+v (%v)", info, err)
+	}
+
+	resp = runForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandDelete, Filename: "notes.txt"})
+	if !resp.Success {
+		t.Fatalf("Delete failed: %s", resp.Message)
+	}
+	if resp, _ := downloadForTest(t, cmdHandler, mockConn, "notes.txt"); resp.Success || resp.Message != "File not found or failed to read" {
+		t.Errorf("Expected deleted file to be missing, got success=%v %q", resp.Success, resp.Message)
+	}
+	resp = runForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandDelete, Filename: "notes.txt"})
+	if resp.Success || resp.Message != protocol.FileNotFoundMessage {
+		t.Errorf("Expected second delete to find nothing, got success=%v %q", resp.Success, resp.Message)
+	}
+}
+
+func TestMemoryStorage_Policies(t *testing.T) {
+	cmdHandler, mockConn, _ := createMemoryCommandHandler(t)
+	cmdHandler.config.OnCollision = CollisionVersion
+	cmdHandler.config.MaxClientBytes = 10
+
+	uploadForTest(t, cmdHandler, mockConn, "report.txt", []byte("one"))
+	resp := uploadForTest(t, cmdHandler, mockConn, "report.txt", []byte("two"))
+	if !resp.Success || string(resp.Data) != "report (1).txt" {
+		t.Errorf("Expected a versioned name, got success=%v %q", resp.Success, resp.Data)
+	}
+
+	resp = uploadForTest(t, cmdHandler, mockConn, "big.txt", []byte("too much"))
+	if resp.Success {
+		t.Error("Expected the upload to exceed the quota")
+	}
+
+	resp = runForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandUsage})
+	if usage, _, err := protocol.DeserializeUsage(resp.Data); err != nil || usage != 6 {
+		t.Errorf("Expected usage of 6 bytes, got %d (%v)", usage, err)
+	}
+}
+
+func TestMemoryStorage_ChunkedUpload(t *testing.T) {
+	cmdHandler, mockConn, storage := createMemoryCommandHandler(t)
+
+	beginUploadForTest(t, cmdHandler, mockConn, "chunked.txt", 11)
+	sendChunkForTest(t, cmdHandler, 0, 2, []byte("hello "))
+	if _, err := storage.Get(cmdHandler.storageClient(), "chunked.txt"); err == nil {
+		t.Error("Expected nothing stored before the last chunk")
+	}
+	sendChunkForTest(t, cmdHandler, 1, 2, []byte("world"))
+	resp, err := protocol.DeserializeResponse(mockConn.sentMessages[len(mockConn.sentMessages)-1].Payload)
+	if err != nil || !resp.Success {
+		t.Fatalf("Chunked upload failed: %+v (%v)", resp, err)
+	}
+	if data, err := storage.Get(cmdHandler.storageClient(), "chunked.txt"); err != nil || string(data) != "hello world" {
+		t.Errorf("Stored %q (%v), want %q", data, err, "hello world")
+	}
+
+	// A no-clobber upload is refused before any chunk is sent
+	resp = runForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{
+		Command:  protocol.CommandUploadChunk,
+		Filename: "chunked.txt",
+		Data:     protocol.SerializeUploadRequest(&protocol.UploadRequest{Size: 3}),
+	})
+	if resp.Success || resp.Message != errFileExists.Error() {
+		t.Errorf("Expected no-clobber upload to be refused, got success=%v %q", resp.Success, resp.Message)
+	}
+
+	// An abandoned upload leaves nothing behind
+	beginUploadForTest(t, cmdHandler, mockConn, "partial.txt", 10)
+	sendChunkForTest(t, cmdHandler, 0, 2, []byte("part"))
+	cmdHandler.abortUpload()
+	if _, err := storage.Stat(cmdHandler.storageClient(), "partial.txt"); err == nil {
+		t.Error("Expected the abandoned upload not to be stored")
+	}
+}
+
+func TestMemoryStorage_RefusesDirectoryCommands(t *testing.T) {
+	cmdHandler, mockConn, _ := createMemoryCommandHandler(t)
+
+	for _, command := range []*protocol.CommandMessage{
+		{Command: protocol.CommandMkdir, Filename: "docs"},
+		{Command: protocol.CommandBeginTx},
+		{Command: protocol.CommandTail, Filename: "log.txt"},
+	} {
+		resp := runForTest(t, cmdHandler, mockConn, command)
+		if resp.Success || resp.Message != errStorageUnsupported {
+			t.Errorf("Expected command 0x%02x to be refused, got success=%v %q", byte(command.Command), resp.Success, resp.Message)
+		}
+	}
+}
+
+func TestMemoryRootDir_Workflow(t *testing.T) {
+	for _, rootDir := range []string{MemoryRootDir, ""} {
+		t.Run(fmt.Sprintf("%q", rootDir), func(t *testing.T) {
+			before, err := os.ReadDir(".")
+			if err != nil {
+				t.Fatalf("Failed to read working directory: %v", err)
+			}
+
+			var config *ServerConfig
+			server := setupTestServerWithConfig(t, func(c *ServerConfig) {
+				c.RootDir = &rootDir
+				config = c
+			})
+			defer server.cleanupTestServer(t)
+			if config.Storage != nil {
+				t.Error("Expected NewServer to leave the caller's config unchanged")
+			}
+
+			client := setupTestClient(t, server)
+			defer client.cleanupTestClient(t)
+
+			ctx := context.Background()
+			content := strings.Repeat("in memory ", protocol.SmallFileThreshold/5)
+			testFile := createTestTempFile(t, content)
+			defer os.Remove(testFile)
+			name := filepath.Base(testFile)
+
+			if err := client.client.UploadFile(ctx, testFile); err != nil {
+				t.Fatalf("Upload failed: %v", err)
+			}
+			list, err := client.client.ListFiles(ctx)
+			if err != nil || !strings.Contains(list, name) {
+				t.Fatalf("Expected %s to be listed, got %q (%v)", name, list, err)
+			}
+			data, err := client.client.DownloadBytes(ctx, name)
+			if err != nil || string(data) != content {
+				t.Fatalf("Download returned %d bytes (%v), want the uploaded content", len(data), err)
+			}
+			if err := client.client.DeleteFile(ctx, name); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+			if list, err := client.client.ListFiles(ctx); err != nil || strings.Contains(list, name) {
+				t.Errorf("Expected %s to be gone, got %q (%v)", name, list, err)
+			}
+
+			// Directories need no mkdir in memory, so uploading into one just works
+			if err := client.client.UploadFileTo(ctx, testFile, "nested/dir/", nil); err != nil {
+				t.Fatalf("UploadFileTo failed: %v", err)
+			}
+			if data, err := client.client.DownloadBytes(ctx, "nested/dir/"+name); err != nil || string(data) != content {
+				t.Errorf("Download from nested/dir returned %d bytes (%v), want the uploaded content", len(data), err)
+			}
+
+			// Nothing reached the disk: no directory was created for RootDir
+			if after, err := os.ReadDir("."); err != nil || len(after) != len(before) {
+				t.Errorf("Expected the working directory to be unchanged, got %v (%v)", after, err)
+			}
+			if _, err := os.Stat(MemoryRootDir); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Expected no %s directory, got %v", MemoryRootDir, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	protocol "github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// tailPollInterval is how often a followed file is checked for appended data
+const tailPollInterval = 200 * time.Millisecond
+
+// tailSession is a follow-mode tail streaming from a background goroutine
+type tailSession struct {
+	stop chan struct{}
+	done chan struct{}
+	// acked is set when the goroutine ended because of stop and sent the final response
+	acked bool
+}
+
+// parseTailRequest decodes CommandTail data: [8B last N bytes][1B flags]
+func parseTailRequest(data []byte) (lastN int64, follow bool, err error) {
+	if len(data) < 9 {
+		return 0, false, fmt.Errorf("tail request too short")
+	}
+	lastN = int64(binary.BigEndian.Uint64(data[:8]))
+	if lastN < 0 {
+		return 0, false, fmt.Errorf("invalid tail length")
+	}
+	return lastN, data[8]&protocol.TailFlagFollow != 0, nil
+}
+
+func (handler *CommandHandler) handleTail(command *protocol.CommandMessage) error {
+	handler.logger.Info("Tail command received", zap.String("filename", command.Filename))
+
+	lastN, follow, err := parseTailRequest(command.Data)
+	if err != nil {
+		return handler.sendFailure(protocol.ErrCodeInvalidRequest, err.Error())
+	}
+
+	filePath, err := handler.validatePath(command.Filename)
+	if err != nil {
+		handler.sendFailure(protocol.ErrCodeInvalidPath, errInvalidFilename)
+		return err
+	}
+	if refusal := handler.checkRegularFile(filePath); refusal != "" {
+		return handler.sendFailure(protocol.ErrCodeInvalidPath, refusal)
+	}
+	// Encrypted files cannot be read from an offset or followed as they grow
+	if handler.encryptsAtRest() {
+		return handler.sendFailure(protocol.ErrCodeUnsupported, errAtRestUnavailable)
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return handler.sendFailure(readErrorCode(err), "File not found or failed to read")
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return handler.sendFailure(protocol.ErrCodeIO, "File not found or failed to read")
+	}
+
+	offset := info.Size() - lastN
+	if offset < 0 {
+		offset = 0
+	}
+
+	if err := handler.sendStatus(true, "Starting tail"); err != nil {
+		file.Close()
+		return err
+	}
+
+	var index uint32
+	if err := handler.sendTailData(command.Filename, file, &offset, &index); err != nil {
+		file.Close()
+		return err
+	}
+
+	if !follow {
+		file.Close()
+		return handler.sendStatus(true, "Tail complete")
+	}
+
+	session := &tailSession{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	handler.tail = session
+	go handler.followTail(session, command.Filename, file, offset, index)
+	return nil
+}
+
+// followTail pushes data appended to file until the session is stopped or reading fails
+func (handler *CommandHandler) followTail(session *tailSession, filename string, file *os.File, offset int64, index uint32) {
+	defer close(session.done)
+	defer file.Close()
+
+	ticker := time.NewTicker(tailPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-session.stop:
+			session.acked = true
+			handler.sendStatus(true, "Tail stopped")
+			return
+		case <-ticker.C:
+			info, err := file.Stat()
+			if err != nil {
+				handler.sendFailure(protocol.ErrCodeIO, "Failed to read file")
+				return
+			}
+			// A truncated file (e.g. log rotation in place) is followed from its new start
+			if info.Size() < offset {
+				offset = 0
+			}
+			if err := handler.sendTailData(filename, file, &offset, &index); err != nil {
+				handler.logger.Warn("Tail stopped", zap.String("filename", filename), zap.Error(err))
+				handler.sendFailure(protocol.ErrCodeIO, "Failed to read file")
+				return
+			}
+		}
+	}
+}
+
+// sendTailData sends everything from offset to the current end of file as data chunks
+func (handler *CommandHandler) sendTailData(filename string, file *os.File, offset *int64, index *uint32) error {
+	buffer := make([]byte, protocol.SmallChunkSize)
+	for {
+		n, err := file.ReadAt(buffer, *offset)
+		if n > 0 {
+			chunk := &protocol.ChunkDataMessage{
+				Filename:   filename,
+				ChunkIndex: *index,
+				ChunkSize:  uint32(n),
+				TotalSize:  uint64(*offset) + uint64(n),
+				Data:       buffer[:n],
+			}
+			chunkPayload, serializeErr := protocol.SerializeChunkDataVersion(chunk, handler.wireVersion())
+			if serializeErr != nil {
+				return fmt.Errorf("failed to serialize tail chunk: %w", serializeErr)
+			}
+			if sendErr := handler.conn.SendSecureMessage(protocol.NewMessage(protocol.MessageTypeData, chunkPayload)); sendErr != nil {
+				return fmt.Errorf("failed to send tail chunk: %w", sendErr)
+			}
+			*offset += int64(n)
+			*index++
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (handler *CommandHandler) handleTailStop(command *protocol.CommandMessage) error {
+	handler.logger.Info("Tail stop command received")
+
+	// The follow goroutine sends the final response itself when it is still running
+	if handler.tail == nil || !handler.stopTail() {
+		return handler.sendFailure(protocol.ErrCodeInvalidRequest, "No tail in progress")
+	}
+	return nil
+}
+
+// stopTail ends a follow-mode tail and reports whether it was still running
+func (handler *CommandHandler) stopTail() bool {
+	if handler.tail == nil {
+		return false
+	}
+
+	session := handler.tail
+	handler.tail = nil
+	close(session.stop)
+	<-session.done
+	return session.acked
+}
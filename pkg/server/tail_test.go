@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for a writer and a polling reader
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// waitForContent polls buf until it contains want
+func waitForContent(t *testing.T, buf *syncBuffer, want string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(buf.String(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %q, got %q", want, buf.String())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestRealE2E_TailFollow(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+
+	tempFile := createTestTempFile(t, "first line\n")
+	defer os.Remove(tempFile)
+	fileName := filepath.Base(tempFile)
+
+	if err := client.client.UploadFile(ctx, tempFile); err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+
+	tailCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	output := &syncBuffer{}
+	tailDone := make(chan error, 1)
+	go func() {
+		tailDone <- client.client.Tail(tailCtx, fileName, output)
+	}()
+
+	waitForContent(t, output, "first line\n")
+
+	// Grow the file on the server side
+	matches, _ := filepath.Glob(filepath.Join(server.tempDir, "*", fileName))
+	if len(matches) != 1 {
+		t.Fatalf("Expected the upload to be stored once, found %v", matches)
+	}
+	serverFile, err := os.OpenFile(matches[0], os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open server file: %v", err)
+	}
+	if _, err := serverFile.WriteString("appended line\n"); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	serverFile.Close()
+
+	waitForContent(t, output, "appended line\n")
+
+	cancel()
+	select {
+	case err := <-tailDone:
+		if err != nil {
+			t.Fatalf("Tail returned error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Tail did not return after cancellation")
+	}
+
+	if output.String() != "first line\nappended line\n" {
+		t.Errorf("Unexpected tail output %q", output.String())
+	}
+
+	// The connection must be usable after the tail ends
+	fileList, err := client.client.ListFiles(ctx)
+	if err != nil {
+		t.Fatalf("ListFiles after tail failed: %v", err)
+	}
+	if !strings.Contains(fileList, fileName) {
+		t.Errorf("File list does not contain %s. List: %s", fileName, fileList)
+	}
+}
+
+func TestRealE2E_TailLastBytes(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.cleanupTestServer(t)
+
+	client := setupTestClient(t, server)
+	defer client.cleanupTestClient(t)
+
+	ctx := context.Background()
+
+	tempFile := createTestTempFile(t, "0123456789")
+	defer os.Remove(tempFile)
+
+	if err := client.client.UploadFile(ctx, tempFile); err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+
+	var output bytes.Buffer
+	if err := client.client.TailN(ctx, filepath.Base(tempFile), 4, false, &output); err != nil {
+		t.Fatalf("TailN failed: %v", err)
+	}
+	if output.String() != "6789" {
+		t.Errorf("Expected last 4 bytes %q, got %q", "6789", output.String())
+	}
+
+	if err := client.client.TailN(ctx, "missing.txt", 4, false, &output); err == nil {
+		t.Error("Expected tailing a missing file to fail")
+	}
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	aesUtil "github.com/lcensies/ssnproj/pkg/aes"
+	protocol "github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+var (
+	errTicketInvalid = errors.New("ticket not issued by this server or revoked")
+	errTicketExpired = errors.New("ticket expired")
+	errTicketUsed    = errors.New("ticket already used")
+	errSessionTooOld = errors.New("session is past its maximum age, a full handshake is needed")
+)
+
+// ticketSession is the session state a ticket restores
+type ticketSession struct {
+	key         []byte
+	namespace   string
+	identityDir string
+	// authenticated is when the full handshake the session descends from took place
+	authenticated time.Time
+	expires       time.Time
+}
+
+// ticketStore issues and redeems session tickets. A ticket is the session state
+// encrypted and authenticated with a key only the server knows, so it cannot be read
+// or forged. Each ticket is accepted once; redeeming it issues the next. However the
+// tickets are chained, none outlives maxAge from the session's full handshake.
+type ticketStore struct {
+	lifetime time.Duration
+	maxAge   time.Duration
+
+	mu  sync.Mutex
+	key []byte
+	// used holds the hashes of redeemed tickets until they expire
+	used map[[sha256.Size]byte]time.Time
+}
+
+func newTicketStore(lifetime, maxAge time.Duration) (*ticketStore, error) {
+	store := &ticketStore{lifetime: lifetime, maxAge: maxAge}
+	if err := store.revoke(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// revoke replaces the ticket key, so every ticket issued so far is rejected
+func (store *ticketStore) revoke() error {
+	key, err := aesUtil.GenerateKey()
+	if err != nil {
+		return fmt.Errorf("failed to generate ticket key: %w", err)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.key = key
+	store.used = make(map[[sha256.Size]byte]time.Time)
+	return nil
+}
+
+// issue returns a ticket restoring session, valid for the store's lifetime from now but
+// never past maxAge from the session's full handshake
+func (store *ticketStore) issue(session *ticketSession) (*protocol.SessionTicket, error) {
+	now := time.Now()
+	expires := now.Add(store.lifetime)
+	if limit := session.authenticated.Add(store.maxAge); limit.Before(expires) {
+		expires = limit
+	}
+	expires = expires.Truncate(time.Second)
+	if !now.Before(expires) {
+		return nil, errSessionTooOld
+	}
+
+	// [expiry (8)][authenticated (8)][key length (1)][key][namespace length (2)][namespace]
+	// [identity length (2)][identity]
+	plain := binary.BigEndian.AppendUint64(nil, uint64(expires.Unix()))
+	plain = binary.BigEndian.AppendUint64(plain, uint64(session.authenticated.UnixNano()))
+	plain = append(plain, byte(len(session.key)))
+	plain = append(plain, session.key...)
+	plain = binary.BigEndian.AppendUint16(plain, uint16(len(session.namespace)))
+	plain = append(plain, session.namespace...)
+	plain = binary.BigEndian.AppendUint16(plain, uint16(len(session.identityDir)))
+	plain = append(plain, session.identityDir...)
+
+	store.mu.Lock()
+	key := store.key
+	store.mu.Unlock()
+	ticket, err := aesUtil.Encrypt(plain, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to seal session ticket: %w", err)
+	}
+	return &protocol.SessionTicket{Ticket: ticket, Expires: expires}, nil
+}
+
+// open decodes a ticket without using it up
+func (store *ticketStore) open(ticket []byte) (*ticketSession, error) {
+	store.mu.Lock()
+	key := store.key
+	store.mu.Unlock()
+	plain, err := aesUtil.Decrypt(ticket, key)
+	if err != nil {
+		return nil, errTicketInvalid
+	}
+
+	reader := bytes.NewReader(plain)
+	var expires, authenticated uint64
+	var keyLen uint8
+	session := &ticketSession{}
+	readString := func() (string, error) {
+		var n uint16
+		if err := binary.Read(reader, binary.BigEndian, &n); err != nil {
+			return "", err
+		}
+		value := make([]byte, n)
+		_, err := io.ReadFull(reader, value)
+		return string(value), err
+	}
+	err = binary.Read(reader, binary.BigEndian, &expires)
+	if err == nil {
+		err = binary.Read(reader, binary.BigEndian, &authenticated)
+	}
+	if err == nil {
+		err = binary.Read(reader, binary.BigEndian, &keyLen)
+	}
+	if err == nil {
+		session.key = make([]byte, keyLen)
+		_, err = io.ReadFull(reader, session.key)
+	}
+	if err == nil {
+		session.namespace, err = readString()
+	}
+	if err == nil {
+		session.identityDir, err = readString()
+	}
+	if err != nil {
+		return nil, errTicketInvalid
+	}
+
+	session.authenticated = time.Unix(0, int64(authenticated))
+	session.expires = time.Unix(int64(expires), 0)
+	if !time.Now().Before(session.expires) {
+		return nil, errTicketExpired
+	}
+	return session, nil
+}
+
+// consume marks an opened ticket as used, failing if it already was
+func (store *ticketStore) consume(ticket []byte, expires time.Time) error {
+	hash := sha256.Sum256(ticket)
+	now := time.Now()
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for used, usedExpiry := range store.used {
+		if !now.Before(usedExpiry) {
+			delete(store.used, used)
+		}
+	}
+	if _, ok := store.used[hash]; ok {
+		return errTicketUsed
+	}
+	store.used[hash] = expires
+	return nil
+}
+
+// handleSessionTicket issues a ticket that resumes the current session
+func (handler *CommandHandler) handleSessionTicket(command *protocol.CommandMessage) error {
+	if handler.tickets == nil {
+		return handler.sendFailure(protocol.ErrCodeUnsupported, "Session tickets are not enabled")
+	}
+
+	ticket, err := handler.tickets.issue(&ticketSession{
+		key:           handler.aesKey,
+		namespace:     handler.namespace,
+		identityDir:   handler.identityDir,
+		authenticated: handler.authenticated,
+	})
+	if errors.Is(err, errSessionTooOld) {
+		return handler.sendFailure(protocol.ErrCodeInvalidRequest, "Session is too old for a ticket; reconnect with a full handshake")
+	}
+	if err != nil {
+		handler.sendStatus(false, "Failed to issue session ticket")
+		return err
+	}
+	handler.logger.Info("Issued session ticket", zap.Time("expires", ticket.Expires))
+
+	responsePayload, err := protocol.SerializeResponse(true, "Session ticket issued", protocol.SerializeSessionTicket(ticket))
+	if err != nil {
+		return err
+	}
+	return handler.conn.SendSecureMessage(protocol.NewMessage(protocol.MessageTypeResponse, responsePayload))
+}
+
+// handleResume restores the session a ticket describes instead of running the RSA
+// handshake. A ticket that cannot be used is refused in the clear and the connection
+// stays open, so the client can fall back to a full handshake.
+func (handler *ConnectionHandler) handleResume(m *protocol.Message) error {
+	handler.state = ConnectionStateHandshake
+
+	request, err := protocol.DeserializeResumeRequest(m.Payload)
+	if err != nil {
+		return fmt.Errorf("error deserializing session resumption: %w", err)
+	}
+	if handler.tickets == nil {
+		return handler.refuseResume(errors.New("session tickets are not enabled"))
+	}
+	session, err := handler.tickets.open(request.Ticket)
+	if err != nil {
+		return handler.refuseResume(err)
+	}
+
+	// Only the holder of the session key can encrypt the options, so a ticket seen on the
+	// wire is useless on its own
+	optionBytes, err := aesUtil.Decrypt(request.Options, session.key)
+	if err != nil {
+		return handler.refuseResume(errors.New("options not encrypted with the ticket's session key"))
+	}
+	options, err := protocol.DeserializeHandshakeOptions(optionBytes)
+	if err != nil || len(options.Nonce) == 0 {
+		return handler.refuseResume(errors.New("resumption needs a nonce"))
+	}
+	if err := handler.tickets.consume(request.Ticket, session.expires); err != nil {
+		return handler.refuseResume(err)
+	}
+
+	// The next ticket expires no later than the chain allows, and the session clock
+	// keeps running from the full handshake so MaxSessionDuration holds across resumes
+	next, err := handler.tickets.issue(session)
+	if errors.Is(err, errSessionTooOld) {
+		return handler.refuseResume(err)
+	}
+	if err != nil {
+		return err
+	}
+	version := protocol.NegotiateProtocolVersion(options.ProtocolVersion)
+	handler.aesKey = session.key
+	handler.sessionStart = session.authenticated
+	handler.startSession(session.key, session.namespace, session.identityDir, version)
+
+	confirmation := protocol.SerializeResumeConfirmation(&protocol.ResumeConfirmation{
+		Version: version,
+		Nonce:   options.Nonce,
+		Next:    next,
+	})
+	responsePayload, err := protocol.SerializeResponse(true, handshakeCompleteMessage, confirmation)
+	if err != nil {
+		return fmt.Errorf("error serializing resume response: %v", err)
+	}
+	if err := handler.SendSecureMessage(protocol.NewMessage(protocol.MessageTypeResponse, responsePayload)); err != nil {
+		return fmt.Errorf("error sending resume response: %v", err)
+	}
+
+	handler.state = ConnectionStateAuthenticated
+	handler.logger.Info("Client resumed session",
+		zap.String("remote_addr", handler.conn.RemoteAddr().String()),
+		zap.String("namespace", session.namespace),
+		zap.Bool("identity", session.identityDir != ""),
+		zap.Uint16("protocol_version", version))
+	return nil
+}
+
+// refuseResume sends an unencrypted refusal of a session ticket and leaves the
+// connection waiting for a handshake
+func (handler *ConnectionHandler) refuseResume(reason error) error {
+	handler.logger.Info("Refusing session resumption",
+		zap.String("remote_addr", handler.conn.RemoteAddr().String()),
+		zap.Error(reason))
+	handler.rejectHandshakePlain(fmt.Errorf("%s: %w", protocol.SessionTicketRejectedMessage, reason))
+	handler.state = ConnectionStateNew
+	return nil
+}
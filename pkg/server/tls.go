@@ -0,0 +1,46 @@
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	protocol "github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// sessionSecretSize is the size of the random secret naming a TLS session's directory
+const sessionSecretSize = 32
+
+// startTLSSession authenticates a connection accepted with ServerConfig.TLSConfig. TLS
+// has already proven the server's identity and protects the stream, so the RSA/AES
+// handshake is skipped and the session starts at the current protocol version.
+func (handler *ConnectionHandler) startTLSSession() error {
+	// There is no session key to derive the directory from, so a random secret stands in
+	secret := make([]byte, sessionSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return fmt.Errorf("failed to generate session secret: %w", err)
+	}
+
+	handler.secureTransport = true
+	handler.startSession(secret, "", "", protocol.ProtocolVersion)
+	handler.state = ConnectionStateAuthenticated
+	handler.logger.Info("TLS client connected",
+		zap.String("remote_addr", handler.conn.RemoteAddr().String()),
+		zap.Uint16("protocol_version", protocol.ProtocolVersion))
+	return nil
+}
+
+// handleTLSMessage dispatches a frame received over TLS, where payloads are not encrypted
+func (handler *ConnectionHandler) handleTLSMessage(message *protocol.Message) error {
+	switch message.Type {
+	case protocol.MessageTypeCommand:
+		return handler.handleCommand(message)
+	case protocol.MessageTypeData:
+		return handler.cmdHandler.handleUploadData(message.Payload)
+	case protocol.MessageTypeHandshake:
+		return errors.New("received handshake on a TLS connection")
+	default:
+		return fmt.Errorf("unexpected message type: %v", message.Type)
+	}
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	protocol "github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// stagingDirName holds in-progress transactions under the root directory, outside any client directory
+const stagingDirName = ".staging"
+
+// transaction tracks uploads staged between CommandBeginTx and CommandCommitTx
+type transaction struct {
+	dir       string
+	staged    map[string]string // final path -> staged path
+	order     []string          // final paths in upload order
+	noClobber map[string]bool   // final paths that must not replace an existing file
+}
+
+// stagedPath returns where an upload targeting finalPath is written while the transaction is open
+func (tx *transaction) stagedPath(finalPath string) string {
+	if stagedPath, ok := tx.staged[finalPath]; ok {
+		return stagedPath
+	}
+
+	stagedPath := filepath.Join(tx.dir, fmt.Sprintf("%d", len(tx.order)))
+	tx.staged[finalPath] = stagedPath
+	tx.order = append(tx.order, finalPath)
+	return stagedPath
+}
+
+// sendStatus sends a response with no data
+func (handler *CommandHandler) sendStatus(success bool, message string) error {
+	responsePayload, err := protocol.SerializeResponse(success, message, nil)
+	if err != nil {
+		return err
+	}
+	response := protocol.NewMessage(protocol.MessageTypeResponse, responsePayload)
+	return handler.conn.SendSecureMessage(response)
+}
+
+// sendFailure sends a failed response classified by code. Peers older than
+// ProtocolVersionErrorCodes receive the message alone.
+func (handler *CommandHandler) sendFailure(code protocol.ErrorCode, message string) error {
+	return handler.sendFailureData(code, message, nil)
+}
+
+// sendFailureData is sendFailure with data after the code
+func (handler *CommandHandler) sendFailureData(code protocol.ErrorCode, message string, data []byte) error {
+	handler.auditFailure(code, message)
+	handler.commandFailed = true
+	var responsePayload []byte
+	var err error
+	if handler.wireVersion() >= protocol.ProtocolVersionErrorCodes {
+		responsePayload, err = protocol.SerializeErrorResponse(code, message, data)
+	} else {
+		responsePayload, err = protocol.SerializeResponse(false, message, data)
+	}
+	if err != nil {
+		return err
+	}
+	response := protocol.NewMessage(protocol.MessageTypeResponse, responsePayload)
+	return handler.conn.SendSecureMessage(response)
+}
+
+func (handler *CommandHandler) handleBeginTx(command *protocol.CommandMessage) error {
+	handler.logger.Info("Begin transaction command received")
+
+	if handler.tx != nil {
+		return handler.sendFailure(protocol.ErrCodeInvalidRequest, "Transaction already in progress")
+	}
+
+	clientDir, err := handler.getClientDir()
+	if err != nil {
+		handler.sendFailure(protocol.ErrCodeIO, "Failed to get client directory")
+		return err
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+
+	txDir := filepath.Join(*handler.rootDir, stagingDirName, filepath.Base(clientDir)+"-"+hex.EncodeToString(suffix))
+	if err := os.MkdirAll(txDir, 0700); err != nil {
+		handler.sendFailure(protocol.ErrCodeIO, "Failed to create staging area")
+		return err
+	}
+
+	handler.tx = &transaction{
+		dir:       txDir,
+		staged:    make(map[string]string),
+		noClobber: make(map[string]bool),
+	}
+
+	return handler.sendStatus(true, "Transaction started")
+}
+
+func (handler *CommandHandler) handleCommitTx(command *protocol.CommandMessage) error {
+	handler.logger.Info("Commit transaction command received")
+
+	if handler.tx == nil {
+		return handler.sendFailure(protocol.ErrCodeInvalidRequest, "No transaction in progress")
+	}
+
+	tx := handler.tx
+	handler.tx = nil
+	defer os.RemoveAll(tx.dir)
+
+	if err := handler.commitTransaction(tx); err != nil {
+		handler.logger.Warn("Transaction commit failed", zap.Error(err))
+		return handler.sendFailure(collisionErrorCode(err), fmt.Sprintf("Transaction rolled back: %v", err))
+	}
+
+	return handler.sendStatus(true, fmt.Sprintf("Transaction committed %d file(s)", len(tx.order)))
+}
+
+func (handler *CommandHandler) handleRollbackTx(command *protocol.CommandMessage) error {
+	handler.logger.Info("Rollback transaction command received")
+
+	if handler.tx == nil {
+		return handler.sendFailure(protocol.ErrCodeInvalidRequest, "No transaction in progress")
+	}
+
+	handler.abortTransaction()
+	return handler.sendStatus(true, "Transaction rolled back")
+}
+
+// abortTransaction discards any open transaction, e.g. on rollback or disconnect
+func (handler *CommandHandler) abortTransaction() {
+	if handler.tx == nil {
+		return
+	}
+
+	if err := os.RemoveAll(handler.tx.dir); err != nil {
+		handler.logger.Warn("Failed to remove staging area", zap.String("path", handler.tx.dir), zap.Error(err))
+	}
+	handler.tx = nil
+}
+
+// commitTransaction moves every staged file into place, or none of them.
+// Files replaced by the commit are set aside first so a failure part-way through can restore them.
+func (handler *CommandHandler) commitTransaction(tx *transaction) error {
+	// Resolve every target up front so a rejected collision aborts before anything moves
+	targets := make([]string, len(tx.order))
+	for i, finalPath := range tx.order {
+		target, err := handler.resolveCollision(finalPath)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(finalPath), err)
+		}
+		targets[i] = target
+	}
+	defer handler.lockFiles(false, targets...)()
+
+	type applied struct {
+		target string
+		staged string
+		backup string
+	}
+	var done []applied
+
+	undo := func() {
+		for i := len(done) - 1; i >= 0; i-- {
+			os.Rename(done[i].target, done[i].staged)
+			if done[i].backup != "" {
+				os.Rename(done[i].backup, done[i].target)
+			}
+		}
+	}
+
+	for i, finalPath := range tx.order {
+		step := applied{target: targets[i], staged: tx.staged[finalPath]}
+
+		if tx.noClobber[finalPath] {
+			// Unlike a rename, a link fails when the target exists, however recently it appeared
+			if err := os.Link(step.staged, step.target); err != nil {
+				undo()
+				if os.IsExist(err) {
+					return fmt.Errorf("%s: %w", filepath.Base(step.target), errFileExists)
+				}
+				return fmt.Errorf("failed to move %s into place: %w", filepath.Base(step.target), err)
+			}
+			os.Remove(step.staged)
+			done = append(done, step)
+			continue
+		}
+
+		if _, err := os.Stat(step.target); err == nil {
+			step.backup = step.staged + ".orig"
+			if err := os.Rename(step.target, step.backup); err != nil {
+				undo()
+				return fmt.Errorf("failed to set aside %s: %w", filepath.Base(step.target), err)
+			}
+		}
+
+		if err := os.Rename(step.staged, step.target); err != nil {
+			if step.backup != "" {
+				os.Rename(step.backup, step.target)
+			}
+			undo()
+			return fmt.Errorf("failed to move %s into place: %w", filepath.Base(step.target), err)
+		}
+
+		done = append(done, step)
+	}
+
+	for _, step := range done {
+		if err := handler.mirrorFile(step.target); err != nil {
+			undo()
+			return err
+		}
+	}
+
+	return nil
+}
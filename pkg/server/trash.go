@@ -0,0 +1,203 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// trashStampLayout timestamps a file moved to the trash. Its fixed width makes the
+// newest copy of a name sort last.
+const trashStampLayout = "20060102T150405.000000000Z"
+
+// trashSeparator joins a deleted file's name and its timestamp in the trash
+const trashSeparator = "~"
+
+const errTrashDisabled = "Trash is not enabled on this server"
+
+// trashEnabled reports whether deletes move files to ServerConfig.TrashDir. Without a
+// client area, before the handshake, the client's trash would be the whole TrashDir.
+func (handler *CommandHandler) trashEnabled() bool {
+	return handler.settings().TrashDir != "" && handler.onDisk() && handler.storageClient() != ""
+}
+
+// trashDir returns the client's directory in the trash
+func (handler *CommandHandler) trashDir() string {
+	return filepath.Join(handler.settings().TrashDir, handler.storageClient())
+}
+
+// trashPath returns where the file at filePath, a path from validatePath, goes when
+// deleted at stamp
+func (handler *CommandHandler) trashPath(filePath string, stamp time.Time) (string, error) {
+	relPath := handler.clientRelativeName(filePath)
+	if strings.HasPrefix(relPath, "../") {
+		return "", fmt.Errorf("failed to compute trash path: %s is outside the client directory", filePath)
+	}
+	name := relPath + trashSeparator + stamp.UTC().Format(trashStampLayout)
+	return filepath.Join(handler.trashDir(), filepath.FromSlash(name)), nil
+}
+
+// removeFile deletes the file at filePath, moving it to the trash when that is enabled.
+// Directories, which only go when empty, are removed outright.
+func (handler *CommandHandler) removeFile(filePath string) error {
+	if !handler.trashEnabled() {
+		return handler.storage().Delete(handler.storageClient(), handler.storedName(filePath))
+	}
+	if info, err := os.Lstat(filePath); err != nil {
+		return err
+	} else if info.IsDir() {
+		return os.Remove(filePath)
+	}
+
+	// Deleting the same name twice in one tick must not overwrite the first copy
+	stamp := time.Now()
+	for {
+		trashPath, err := handler.trashPath(filePath, stamp)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(trashPath); err == nil {
+			stamp = stamp.Add(time.Nanosecond)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(trashPath), handler.settings().dirMode()); err != nil {
+			return err
+		}
+		return os.Rename(filePath, trashPath)
+	}
+}
+
+// latestTrashed returns the trash path of the most recently deleted copy of the file at
+// filePath, failing with fs.ErrNotExist when there is none
+func (handler *CommandHandler) latestTrashed(filePath string) (string, error) {
+	trashPath, err := handler.trashPath(filePath, time.Time{})
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Dir(trashPath)
+	prefix := filepath.Base(filePath) + trashSeparator
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	latest := ""
+	for _, entry := range entries {
+		stamp, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(trashStampLayout, stamp); err != nil {
+			continue
+		}
+		if entry.Name() > latest {
+			latest = entry.Name()
+		}
+	}
+	if latest == "" {
+		return "", fs.ErrNotExist
+	}
+	return filepath.Join(dir, latest), nil
+}
+
+// handleRestore moves the most recently deleted copy of a file back from the trash
+func (handler *CommandHandler) handleRestore(command *protocol.CommandMessage) error {
+	handler.logger.Info("Restore command received", zap.String("filename", command.Filename))
+
+	if !handler.trashEnabled() {
+		return handler.sendFailure(protocol.ErrCodeUnsupported, errTrashDisabled)
+	}
+
+	filePath, err := handler.validatePath(command.Filename)
+	if err != nil {
+		handler.logger.Warn(errPathValidationFailed, zap.String("filename", command.Filename), zap.Error(err))
+		return handler.sendFailure(protocol.ErrCodeInvalidPath, errInvalidFilename)
+	}
+
+	unlock := handler.lockFiles(false, filePath)
+	defer unlock()
+
+	trashPath, err := handler.latestTrashed(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return handler.sendFailure(protocol.ErrCodeNotFound, "File not found in trash")
+	}
+	if err != nil {
+		handler.sendFailure(protocol.ErrCodeIO, "Failed to read trash")
+		return err
+	}
+	info, err := os.Stat(trashPath)
+	if err != nil {
+		handler.sendFailure(protocol.ErrCodeIO, "Failed to read trash")
+		return err
+	}
+
+	// A file stored under the name since it was deleted is not replaced
+	if _, err := os.Lstat(filePath); err == nil {
+		return handler.sendFailure(protocol.ErrCodeExists, errFileExists.Error())
+	}
+	if code, refusal := handler.checkQuota(command.Filename, uint64(info.Size())); refusal != "" {
+		return handler.sendFailure(code, refusal)
+	}
+
+	// The directory may have gone since the delete
+	if err := os.MkdirAll(filepath.Dir(filePath), handler.settings().dirMode()); err != nil {
+		handler.sendFailure(protocol.ErrCodeIO, "Failed to restore file")
+		return err
+	}
+	if err := os.Rename(trashPath, filePath); err != nil {
+		handler.logger.Error("Failed to restore file", zap.String("filename", command.Filename), zap.Error(err))
+		return handler.sendFailure(protocol.ErrCodeIO, "Failed to restore file")
+	}
+
+	if err := handler.mirrorFile(filePath); err != nil {
+		return handler.sendFailure(protocol.ErrCodeIO, errMirrorFailed)
+	}
+
+	responsePayload, err := protocol.SerializeResponse(true, "File restored successfully", nil)
+	if err != nil {
+		return err
+	}
+	return handler.conn.SendSecureMessage(protocol.NewMessage(protocol.MessageTypeResponse, responsePayload))
+}
+
+// handleEmptyTrash permanently deletes everything in the client's trash
+func (handler *CommandHandler) handleEmptyTrash(command *protocol.CommandMessage) error {
+	handler.logger.Info("Empty trash command received")
+
+	if !handler.trashEnabled() {
+		return handler.sendFailure(protocol.ErrCodeUnsupported, errTrashDisabled)
+	}
+
+	var purged uint32
+	err := filepath.WalkDir(handler.trashDir(), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			purged++
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		handler.sendFailure(protocol.ErrCodeIO, "Failed to read trash")
+		return err
+	}
+	if err := os.RemoveAll(handler.trashDir()); err != nil {
+		handler.logger.Error("Failed to empty trash", zap.Error(err))
+		return handler.sendFailure(protocol.ErrCodeIO, "Failed to empty trash")
+	}
+
+	handler.logger.Info("Emptied trash", zap.Uint32("purged", purged))
+	responsePayload, err := protocol.SerializeResponse(true, fmt.Sprintf("Purged %d files", purged), protocol.SerializeDeleteCount(purged))
+	if err != nil {
+		return err
+	}
+	return handler.conn.SendSecureMessage(protocol.NewMessage(protocol.MessageTypeResponse, responsePayload))
+}
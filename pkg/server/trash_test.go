@@ -0,0 +1,92 @@
+package server
+
+import (
+	"os"
+	"testing"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+)
+
+// createTrashCommandHandler returns a handler whose deletes go to a trash directory
+func createTrashCommandHandler(t *testing.T) (*CommandHandler, *MockConnectionHandler) {
+	rootDir := t.TempDir()
+	cmdHandler, mockConn := createTestCommandHandler(t, rootDir)
+	cmdHandler.config = &ServerConfig{RootDir: &rootDir, TrashDir: t.TempDir()}
+	return cmdHandler, mockConn
+}
+
+func TestTrash_DeleteThenRestore(t *testing.T) {
+	cmdHandler, mockConn := createTrashCommandHandler(t)
+
+	// The same name deleted twice keeps both copies; the newest comes back
+	uploadForTest(t, cmdHandler, mockConn, "report.txt", []byte("first"))
+	runForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandDelete, Filename: "report.txt"})
+	uploadForTest(t, cmdHandler, mockConn, "report.txt", []byte("second"))
+	resp := runForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandDelete, Filename: "report.txt"})
+	if !resp.Success {
+		t.Fatalf("Delete failed: %s", resp.Message)
+	}
+	if resp, _ := downloadForTest(t, cmdHandler, mockConn, "report.txt"); resp.Success {
+		t.Fatal("Expected the deleted file to be gone")
+	}
+
+	resp = runForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandRestore, Filename: "report.txt"})
+	if !resp.Success {
+		t.Fatalf("Restore failed: %s", resp.Message)
+	}
+	resp, data := downloadForTest(t, cmdHandler, mockConn, "report.txt")
+	if !resp.Success || string(data) != "second" {
+		t.Errorf("Restored file holds %q (success=%v), want %q", data, resp.Success, "second")
+	}
+
+	// The older copy stays in the trash, but does not replace the restored file
+	resp = runForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandRestore, Filename: "report.txt"})
+	if resp.Success || resp.Message != errFileExists.Error() {
+		t.Errorf("Expected restoring over a stored file to be refused, got success=%v %q", resp.Success, resp.Message)
+	}
+	entries, err := os.ReadDir(cmdHandler.trashDir())
+	if err != nil || len(entries) != 1 {
+		t.Errorf("Expected the older copy in the trash, got %v (%v)", entries, err)
+	}
+}
+
+func TestTrash_EmptyThenRestoreFails(t *testing.T) {
+	cmdHandler, mockConn := createTrashCommandHandler(t)
+
+	uploadForTest(t, cmdHandler, mockConn, "a.txt", []byte("a"))
+	uploadForTest(t, cmdHandler, mockConn, "b.txt", []byte("b"))
+	resp := runForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandDeleteGlob, Filename: "*.txt"})
+	if !resp.Success {
+		t.Fatalf("Delete glob failed: %s", resp.Message)
+	}
+
+	resp = runForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandEmptyTrash})
+	if !resp.Success {
+		t.Fatalf("Empty trash failed: %s", resp.Message)
+	}
+	if purged, err := protocol.DeserializeDeleteCount(resp.Data); err != nil || purged != 2 {
+		t.Errorf("Expected 2 purged files, got %d (%v)", purged, err)
+	}
+	if _, err := os.Stat(cmdHandler.trashDir()); !os.IsNotExist(err) {
+		t.Errorf("Expected the client's trash to be gone, got %v", err)
+	}
+
+	resp = runForTest(t, cmdHandler, mockConn, &protocol.CommandMessage{Command: protocol.CommandRestore, Filename: "a.txt"})
+	if resp.Success || resp.Message != "File not found in trash" {
+		t.Errorf("Expected restore after emptying the trash to fail, got success=%v %q", resp.Success, resp.Message)
+	}
+}
+
+func TestTrash_Disabled(t *testing.T) {
+	cmdHandler, mockConn := createTestCommandHandler(t, t.TempDir())
+
+	for _, command := range []*protocol.CommandMessage{
+		{Command: protocol.CommandRestore, Filename: "a.txt"},
+		{Command: protocol.CommandEmptyTrash},
+	} {
+		resp := runForTest(t, cmdHandler, mockConn, command)
+		if resp.Success || resp.Message != errTrashDisabled {
+			t.Errorf("Expected command 0x%02x to be refused, got success=%v %q", byte(command.Command), resp.Success, resp.Message)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	protocol "github.com/lcensies/ssnproj/pkg/protocol"
+)
+
+// "café.txt" spelled with a precomposed é (NFC) and with e + combining acute accent (NFD)
+const (
+	cafeNFC = "caf\u00e9.txt"
+	cafeNFD = "cafe\u0301.txt"
+)
+
+// downloadForTest runs handleDownload and returns the initial response and the reassembled data
+func downloadForTest(t *testing.T, cmdHandler *CommandHandler, mockConn *MockConnectionHandler, filename string) (*protocol.ResponseMessage, []byte) {
+	mockConn.ClearSentMessages()
+
+	command := &protocol.CommandMessage{
+		Command:  protocol.CommandDownload,
+		Filename: filename,
+	}
+	if err := cmdHandler.handleDownload(command); err != nil {
+		t.Fatalf("handleDownload failed: %v", err)
+	}
+
+	respMsg, err := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload)
+	if err != nil {
+		t.Fatalf("Failed to deserialize response: %v", err)
+	}
+
+	var data []byte
+	for _, msg := range mockConn.sentMessages[1:] {
+		if msg.Type != protocol.MessageTypeData {
+			continue
+		}
+		chunk, err := protocol.DeserializeChunkData(msg.Payload)
+		if err != nil {
+			t.Fatalf("Failed to deserialize chunk: %v", err)
+		}
+		data = append(data, chunk.Data...)
+	}
+	return respMsg, data
+}
+
+func TestNormalizeUnicode(t *testing.T) {
+	tests := []struct {
+		name     string
+		upload   string
+		download string
+	}{
+		{name: "upload NFD download NFC", upload: cafeNFD, download: cafeNFC},
+		{name: "upload NFC download NFD", upload: cafeNFC, download: cafeNFD},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := createTestTempDir(t)
+			defer cleanupTestTempDir(t, tempDir)
+
+			cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+			cmdHandler.config = &ServerConfig{RootDir: &tempDir, NormalizeUnicode: true}
+
+			if resp := uploadForTest(t, cmdHandler, mockConn, tt.upload, []byte("bonjour")); !resp.Success {
+				t.Fatalf("Upload failed: %s", resp.Message)
+			}
+
+			resp, data := downloadForTest(t, cmdHandler, mockConn, tt.download)
+			if !resp.Success {
+				t.Fatalf("Download failed: %s", resp.Message)
+			}
+			if string(data) != "bonjour" {
+				t.Errorf("Expected content %q, got %q", "bonjour", string(data))
+			}
+
+			// Only the NFC name exists on disk
+			clientDir, err := cmdHandler.getClientDir()
+			if err != nil {
+				t.Fatalf("Failed to get client directory: %v", err)
+			}
+			entries, err := os.ReadDir(clientDir)
+			if err != nil {
+				t.Fatalf("Failed to read client directory: %v", err)
+			}
+			if len(entries) != 1 || entries[0].Name() != cafeNFC {
+				t.Errorf("Expected a single NFC file, got %v", entries)
+			}
+		})
+	}
+}
+
+func TestNormalizeUnicode_Disabled(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+
+	if resp := uploadForTest(t, cmdHandler, mockConn, cafeNFD, []byte("bonjour")); !resp.Success {
+		t.Fatalf("Upload failed: %s", resp.Message)
+	}
+
+	// Without normalization the byte-wise different name is a different file
+	resp, _ := downloadForTest(t, cmdHandler, mockConn, cafeNFC)
+	if resp.Success {
+		t.Error("Expected NFC lookup of an NFD upload to miss when normalization is disabled")
+	}
+}
+
+func TestValidatePath_FilenameTooLong(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+	cmdHandler.config = &ServerConfig{RootDir: &tempDir, NormalizeUnicode: true}
+
+	longest := strings.Repeat("a", maxFilenameLength-4) + ".txt"
+	if resp := uploadForTest(t, cmdHandler, mockConn, longest, []byte("ok")); !resp.Success {
+		t.Errorf("Upload of a %d byte name refused: %s", len(longest), resp.Message)
+	}
+
+	tooLong := "a" + longest
+	mockConn.ClearSentMessages()
+	if err := cmdHandler.handleUpload(&protocol.CommandMessage{Command: protocol.CommandUpload, Filename: tooLong, Data: []byte("no")}); err == nil {
+		t.Error("Expected handleUpload to report the refused name")
+	}
+	if resp, _ := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload); resp.Success || resp.Message != errInvalidFilename {
+		t.Errorf("Expected a %d byte name to be refused, got success=%v message=%q", len(tooLong), resp.Success, resp.Message)
+	}
+
+	// The limit applies to the normalized name: the NFD spelling is a byte longer than
+	// the limit, its NFC form fits
+	nfd := strings.Repeat("a", maxFilenameLength-len(cafeNFD)+1) + cafeNFD
+	if resp := uploadForTest(t, cmdHandler, mockConn, nfd, []byte("ok")); !resp.Success {
+		t.Errorf("Upload of a name fitting once normalized refused: %s", resp.Message)
+	}
+
+	clientDir, _ := cmdHandler.getClientDir()
+	entries, _ := os.ReadDir(clientDir)
+	if len(entries) != 2 {
+		t.Errorf("Client directory has %d entries, want 2", len(entries))
+	}
+}
+
+func TestValidatePath_NestedPathLength(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+	clientDir, _ := cmdHandler.getClientDir()
+
+	// Every element is short, the whole path is not
+	dir := strings.TrimSuffix(strings.Repeat("segment-of-forty-bytes-in-total-length/", 8), "/")
+	nested := dir + "/file.txt"
+	if err := os.MkdirAll(filepath.Join(clientDir, dir), 0755); err != nil {
+		t.Fatalf("Failed to create directories: %v", err)
+	}
+	if len(nested) <= maxFilenameLength {
+		t.Fatalf("Test path is only %d bytes", len(nested))
+	}
+	if resp := uploadForTest(t, cmdHandler, mockConn, nested, []byte("ok")); !resp.Success {
+		t.Errorf("Upload of a %d byte nested path refused: %s", len(nested), resp.Message)
+	}
+
+	// A single long element, or a path over the total limit, is still refused
+	for _, name := range []string{
+		dir + "/" + strings.Repeat("a", maxFilenameLength+1),
+		strings.Repeat("a/", maxPathLength/2) + "b",
+	} {
+		if _, err := cmdHandler.validatePath(name); err == nil {
+			t.Errorf("Expected a %d byte path to be refused", len(name))
+		}
+	}
+}
@@ -0,0 +1,468 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+	"go.uber.org/zap"
+)
+
+// uploadTempPrefix names the temporary files chunked uploads are written to
+const uploadTempPrefix = ".upload-"
+
+// isUploadTemp reports whether name is an unfinished upload's temporary file
+func isUploadTemp(name string) bool {
+	return strings.HasPrefix(name, uploadTempPrefix)
+}
+
+// uploadStream is a chunked upload in progress. Chunks are appended to a temporary
+// file next to the target, which replaces the target once the last chunk arrives.
+// When the Storage keeps no local files they are buffered in memory instead and put
+// as a whole.
+type uploadStream struct {
+	filename   string
+	file       *os.File
+	buffered   *bytes.Buffer
+	target     string
+	storedName string
+	total      uint64
+	received   uint64
+	nextIndex  uint32
+
+	// sizeUnknown marks an upload announced without a size; total is taken from the
+	// last chunk and allowance, when non-zero, bounds the bytes it may grow to
+	sizeUnknown bool
+	allowance   uint64
+
+	// modTime, in Unix nanoseconds, is given to the file once complete unless zero.
+	// Storage.Put has no way to carry it, so buffered uploads keep the time of the put.
+	modTime int64
+
+	// record is the audit record of the command that started the upload
+	record *auditRecord
+
+	// reserved marks a target created empty with O_EXCL for a no-clobber upload; it is
+	// removed if the upload fails and replaced by the upload otherwise
+	reserved bool
+	// noClobber marks a buffered no-clobber upload, whose target is checked again when
+	// it is put
+	noClobber bool
+
+	// failure is the reason sent to the client once the last chunk arrives; after a
+	// failure the remaining chunks are read and discarded to keep the stream in sync
+	failure     string
+	failureCode protocol.ErrorCode
+}
+
+// fail records why the upload cannot complete
+func (upload *uploadStream) fail(code protocol.ErrorCode, reason string) {
+	upload.failure = reason
+	upload.failureCode = code
+}
+
+// write appends chunk data to the temporary file or the buffer
+func (upload *uploadStream) write(data []byte) error {
+	if upload.buffered != nil {
+		_, err := upload.buffered.Write(data)
+		return err
+	}
+	_, err := upload.file.Write(data)
+	return err
+}
+
+// discard removes the temporary file and any reserved target
+func (upload *uploadStream) discard() {
+	if upload.file == nil {
+		return
+	}
+	os.Remove(upload.file.Name())
+	if upload.reserved {
+		os.Remove(upload.target)
+	}
+}
+
+// reserveTarget creates filePath empty, failing with an os.IsExist error if it already
+// exists. Creating it with O_EXCL claims the name atomically, where checking for it
+// first would race with another writer.
+func reserveTarget(filePath string, mode os.FileMode) error {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// handleUploadChunk starts a chunked upload. Data holds the total size (8 bytes), or is
+// empty when the client does not know it yet, optionally followed by a flags byte and a
+// modification time; the file contents follow as MessageTypeData chunks.
+func (handler *CommandHandler) handleUploadChunk(command *protocol.CommandMessage) error {
+	handler.logger.Info("Chunked upload command received", zap.String("filename", command.Filename))
+
+	request, err := protocol.DeserializeUploadRequest(command.Data)
+	if err != nil {
+		return handler.sendFailure(protocol.ErrCodeInvalidRequest, "Chunked upload requires the total size")
+	}
+	sizeUnknown := request.SizeUnknown
+	total := request.Size
+
+	filePath, err := handler.validatePath(command.Filename)
+	if err != nil {
+		handler.sendFailure(protocol.ErrCodeInvalidPath, errInvalidFilename)
+		return err
+	}
+	if err := handler.validateFilename(handler.clientRelativeName(filePath)); err != nil {
+		return handler.refuseFilename(command.Filename, err)
+	}
+
+	if refusal := handler.checkParentDir(filePath); refusal != "" {
+		return handler.sendFailure(protocol.ErrCodeNotFound, refusal)
+	}
+	if refusal := handler.checkRegularFile(filePath); refusal != "" {
+		return handler.sendFailure(protocol.ErrCodeInvalidPath, refusal)
+	}
+
+	if maxSize := handler.settings().MaxUploadSize; maxSize > 0 && total > uint64(maxSize) {
+		handler.logger.Warn("Upload exceeds size limit",
+			zap.String("filename", command.Filename),
+			zap.Uint64("size", total),
+			zap.Int64("limit", maxSize))
+		return handler.sendFailure(protocol.ErrCodeQuotaExceeded, fmt.Sprintf("File too large: %d bytes exceeds limit of %d", total, maxSize))
+	}
+	// The declared size is checked against the quota before any chunk is accepted. An
+	// unknown size needs room for at least one byte; its chunks are bounded as they arrive.
+	incoming := total
+	if sizeUnknown {
+		incoming = 1
+	}
+	if code, refusal := handler.checkQuota(command.Filename, incoming); refusal != "" {
+		return handler.sendFailure(code, refusal)
+	}
+	var allowance uint64
+	if sizeUnknown {
+		if allowance, err = handler.uploadAllowance(); err != nil {
+			handler.logger.Error("Failed to measure storage usage", zap.Error(err))
+			return handler.sendFailure(protocol.ErrCodeIO, "Failed to check storage quota")
+		}
+	}
+
+	if request.ValidateOnly {
+		return handler.answerValidation(filePath, request.Overwrite)
+	}
+
+	storedName := handler.clientRelativeName(filePath)
+	reserved, noClobber := false, false
+	if handler.tx != nil {
+		// Inside a transaction the file is staged; collisions are resolved on commit
+		finalPath := filePath
+		filePath = handler.tx.stagedPath(finalPath)
+		handler.tx.noClobber[finalPath] = !request.Overwrite
+	} else {
+		filePath, err = handler.resolveCollision(filePath)
+		if err != nil {
+			return handler.sendFailure(collisionErrorCode(err), err.Error())
+		}
+		storedName = handler.clientRelativeName(filePath)
+
+		if !request.Overwrite && !handler.onDisk() {
+			if _, err := handler.storage().Stat(handler.storageClient(), storedName); err == nil {
+				return handler.sendFailure(protocol.ErrCodeExists, errFileExists.Error())
+			}
+			noClobber = true
+		} else if !request.Overwrite {
+			if err := reserveTarget(filePath, handler.settings().fileMode()); err != nil {
+				if os.IsExist(err) {
+					return handler.sendFailure(protocol.ErrCodeExists, errFileExists.Error())
+				}
+				handler.sendFailure(protocol.ErrCodeIO, "Failed to write file")
+				return err
+			}
+			reserved = true
+		}
+	}
+
+	upload := &uploadStream{
+		filename:    command.Filename,
+		target:      filePath,
+		storedName:  storedName,
+		total:       total,
+		sizeUnknown: sizeUnknown,
+		allowance:   allowance,
+		reserved:    reserved,
+		noClobber:   noClobber,
+		modTime:     request.ModTime,
+		record:      handler.record,
+	}
+	if handler.onDisk() {
+		file, err := os.CreateTemp(filepath.Dir(filePath), uploadTempPrefix+"*")
+		if err == nil {
+			// The temporary file becomes the stored file, so it takes the stored files' mode
+			if err = file.Chmod(handler.settings().fileMode()); err != nil {
+				file.Close()
+				os.Remove(file.Name())
+			}
+		}
+		if err != nil {
+			if reserved {
+				os.Remove(filePath)
+			}
+			handler.sendFailure(protocol.ErrCodeIO, "Failed to write file")
+			return err
+		}
+		upload.file = file
+	} else {
+		// The size limits above bound how much is held in memory
+		upload.buffered = &bytes.Buffer{}
+	}
+	handler.upload = upload
+
+	if err := handler.sendStatus(true, "Ready for chunks"); err != nil {
+		return err
+	}
+
+	// An empty file has no chunks to wait for
+	if total == 0 && !sizeUnknown {
+		return handler.finishUpload()
+	}
+	return nil
+}
+
+// answerValidation ends a validate-only upload that passed the checks so far. Outside a
+// transaction it also resolves the name the file would be stored under, which the
+// response carries, and applies no-clobber; nothing is written either way.
+func (handler *CommandHandler) answerValidation(filePath string, overwrite bool) error {
+	// Nothing is stored, so the command leaves no audit record
+	handler.record = nil
+
+	if handler.tx == nil {
+		var err error
+		if filePath, err = handler.resolveCollision(filePath); err != nil {
+			return handler.sendFailure(collisionErrorCode(err), err.Error())
+		}
+		if _, err := handler.storage().Stat(handler.storageClient(), handler.storedName(filePath)); err == nil && !overwrite {
+			return handler.sendFailure(protocol.ErrCodeExists, errFileExists.Error())
+		}
+	}
+
+	responsePayload, err := protocol.SerializeResponse(true, "Upload would be accepted", []byte(handler.clientRelativeName(filePath)))
+	if err != nil {
+		return err
+	}
+	return handler.conn.SendSecureMessage(protocol.NewMessage(protocol.MessageTypeResponse, responsePayload))
+}
+
+// handleUploadData appends one chunk to the upload in progress
+func (handler *CommandHandler) handleUploadData(payload []byte) error {
+	upload := handler.upload
+	if upload == nil {
+		return fmt.Errorf("data message received without an upload in progress")
+	}
+
+	version := handler.wireVersion()
+	chunk, err := protocol.DeserializeChunkDataVersion(payload, version)
+	if err != nil {
+		return err
+	}
+
+	if upload.failure == "" {
+		switch {
+		case version >= protocol.ProtocolVersionChunkChecksums && chunk.VerifyChecksum() != nil:
+			upload.fail(protocol.ErrCodeInvalidRequest, fmt.Sprintf("Chunk %d failed checksum verification", chunk.ChunkIndex))
+		case chunk.ChunkIndex != upload.nextIndex:
+			upload.fail(protocol.ErrCodeInvalidRequest, fmt.Sprintf("Unexpected chunk %d, expected %d", chunk.ChunkIndex, upload.nextIndex))
+		case !upload.sizeUnknown && upload.received+uint64(len(chunk.Data)) > upload.total:
+			upload.fail(protocol.ErrCodeInvalidRequest, fmt.Sprintf("Upload exceeds declared size of %d bytes", upload.total))
+		case upload.allowance > 0 && upload.received+uint64(len(chunk.Data)) > upload.allowance:
+			upload.fail(protocol.ErrCodeQuotaExceeded, fmt.Sprintf("File too large: upload exceeds the %d bytes allowed", upload.allowance))
+		default:
+			if err := upload.write(chunk.Data); err != nil {
+				handler.logger.Error("Failed to write upload chunk", zap.String("filename", upload.filename), zap.Error(err))
+				upload.fail(protocol.ErrCodeIO, "Failed to write file")
+			}
+		}
+		upload.received += uint64(len(chunk.Data))
+	}
+	upload.nextIndex++
+
+	handler.logger.Debug("Received chunk",
+		zap.String("filename", upload.filename),
+		zap.Uint32("chunkIndex", chunk.ChunkIndex),
+		zap.Uint64("received", upload.received))
+
+	// The client marks the end of the stream with the last chunk index
+	if chunk.ChunkIndex+1 < chunk.TotalChunks {
+		return nil
+	}
+	if upload.sizeUnknown {
+		// Only the last chunk knows how much was sent
+		upload.total = chunk.TotalSize
+	}
+	return handler.finishUpload()
+}
+
+// finishUpload moves a complete upload into place and reports the outcome
+func (handler *CommandHandler) finishUpload() (err error) {
+	upload := handler.upload
+	handler.upload = nil
+
+	// The upload's outcome completes the audit record of the command that started it
+	handler.record = upload.record
+	defer func() { handler.endAudit(err) }()
+	handler.auditBytes(upload.received)
+
+	if upload.failure == "" && upload.sizeUnknown && upload.total == protocol.UploadAbortedSize {
+		upload.fail(protocol.ErrCodeNone, "Upload aborted by client")
+	}
+	if upload.failure == "" && upload.received != upload.total {
+		upload.fail(protocol.ErrCodeInvalidRequest, fmt.Sprintf("Upload incomplete: received %d of %d bytes", upload.received, upload.total))
+	}
+
+	// Buffered uploads are put as a whole; the stored data is kept for the mirror
+	var stored []byte
+	if upload.buffered != nil {
+		stored = handler.putBufferedUpload(upload)
+	} else {
+		handler.placeUploadFile(upload)
+	}
+
+	if upload.failure != "" {
+		upload.discard()
+		handler.logger.Warn("Chunked upload failed", zap.String("filename", upload.filename), zap.String("reason", upload.failure))
+		return handler.sendFailure(upload.failureCode, upload.failure)
+	}
+
+	message := "File uploaded successfully"
+	if handler.tx != nil {
+		message = "File staged for commit"
+	} else if upload.buffered != nil {
+		err = handler.mirrorWrite(upload.target, stored)
+	} else {
+		err = handler.mirrorFile(upload.target)
+	}
+	if err != nil {
+		return handler.sendFailure(protocol.ErrCodeIO, errMirrorFailed)
+	}
+
+	handler.logger.Info("Chunked upload completed",
+		zap.String("filename", upload.filename),
+		zap.Uint64("size", upload.total))
+
+	responsePayload, err := protocol.SerializeResponse(true, message, []byte(upload.storedName))
+	if err != nil {
+		return err
+	}
+	response := protocol.NewMessage(protocol.MessageTypeResponse, responsePayload)
+	return handler.conn.SendSecureMessage(response)
+}
+
+// placeUploadFile closes a complete upload's temporary file and moves it over the target
+func (handler *CommandHandler) placeUploadFile(upload *uploadStream) {
+	if err := upload.file.Close(); err != nil && upload.failure == "" {
+		handler.logger.Error("Failed to close upload", zap.String("filename", upload.filename), zap.Error(err))
+		upload.fail(protocol.ErrCodeIO, "Failed to write file")
+	}
+
+	if upload.failure == "" {
+		if err := handler.sealStoredFile(upload.file.Name()); err != nil {
+			handler.logger.Error("Failed to encrypt upload", zap.String("filename", upload.filename), zap.Error(err))
+			upload.fail(protocol.ErrCodeIO, "Failed to write file")
+		}
+	}
+	// Set once the contents are final; moving the file into place keeps it
+	if upload.failure == "" && upload.modTime != 0 {
+		if err := os.Chtimes(upload.file.Name(), time.Time{}, time.Unix(0, upload.modTime)); err != nil {
+			handler.logger.Error("Failed to set modification time", zap.String("filename", upload.filename), zap.Error(err))
+			upload.fail(protocol.ErrCodeIO, "Failed to write file")
+		}
+	}
+	if upload.failure == "" {
+		// A staged upload is locked when the transaction commits
+		unlock := func() {}
+		if handler.tx == nil {
+			unlock = handler.lockFiles(false, upload.target)
+		}
+		if err := os.Rename(upload.file.Name(), upload.target); err != nil {
+			handler.logger.Error("Failed to move upload into place", zap.String("filename", upload.filename), zap.Error(err))
+			upload.fail(protocol.ErrCodeIO, "Failed to write file")
+		}
+		unlock()
+	}
+}
+
+// putBufferedUpload puts a complete upload buffered in memory into Storage and returns the
+// data stored, sealed if files are encrypted at rest
+func (handler *CommandHandler) putBufferedUpload(upload *uploadStream) []byte {
+	if upload.failure != "" {
+		return nil
+	}
+	stored, err := handler.sealForStorage(upload.buffered.Bytes())
+	if err != nil {
+		handler.logger.Error("Failed to encrypt upload", zap.String("filename", upload.filename), zap.Error(err))
+		upload.fail(protocol.ErrCodeIO, "Failed to write file")
+		return nil
+	}
+
+	unlock := handler.lockFiles(false, upload.target)
+	defer unlock()
+	// Another client may have stored the file since the upload began
+	if upload.noClobber {
+		if _, err := handler.storage().Stat(handler.storageClient(), upload.storedName); err == nil {
+			upload.fail(protocol.ErrCodeExists, errFileExists.Error())
+			return nil
+		}
+	}
+	if err := handler.storage().Put(handler.storageClient(), upload.storedName, stored); err != nil {
+		handler.logger.Error("Failed to store upload", zap.String("filename", upload.filename), zap.Error(err))
+		upload.fail(protocol.ErrCodeIO, "Failed to write file")
+		return nil
+	}
+	return stored
+}
+
+// uploadAllowance returns how large an upload of unknown size may grow under
+// MaxUploadSize and the client's remaining quota, zero when neither applies
+func (handler *CommandHandler) uploadAllowance() (uint64, error) {
+	var allowance uint64
+	if maxSize := handler.settings().MaxUploadSize; maxSize > 0 {
+		allowance = uint64(maxSize)
+	}
+	if limit := handler.settings().MaxClientBytes; limit > 0 {
+		usage, err := handler.storageUsage()
+		if err != nil {
+			return 0, err
+		}
+		// checkQuota has already refused clients without room for a single byte
+		left := uint64(max(limit-usage, 1))
+		if allowance == 0 || left < allowance {
+			allowance = left
+		}
+	}
+	return allowance, nil
+}
+
+// abortUpload discards an unfinished upload, e.g. when the connection ends mid-stream
+func (handler *CommandHandler) abortUpload() {
+	if handler.upload == nil {
+		return
+	}
+	upload := handler.upload
+	handler.upload = nil
+
+	handler.record = upload.record
+	handler.auditBytes(upload.received)
+	handler.auditFailure(protocol.ErrCodeNone, "Upload abandoned")
+	handler.endAudit(nil)
+
+	if upload.file != nil {
+		upload.file.Close()
+	}
+	upload.discard()
+	handler.logger.Warn("Discarded unfinished upload",
+		zap.String("filename", upload.filename),
+		zap.Uint64("received", upload.received),
+		zap.Uint64("total", upload.total))
+}
@@ -0,0 +1,371 @@
+package server
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lcensies/ssnproj/pkg/protocol"
+)
+
+// beginUploadForTest starts a chunked upload of totalSize bytes and checks the server is ready
+func beginUploadForTest(t *testing.T, handler *CommandHandler, mockConn *MockConnectionHandler, filename string, totalSize uint64) {
+	t.Helper()
+	mockConn.ClearSentMessages()
+
+	command := &protocol.CommandMessage{
+		Command:  protocol.CommandUploadChunk,
+		Filename: filename,
+		Data:     binary.BigEndian.AppendUint64(nil, totalSize),
+	}
+	if err := handler.handle(command); err != nil {
+		t.Fatalf("Begin upload failed: %v", err)
+	}
+	respMsg, err := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload)
+	if err != nil || !respMsg.Success {
+		t.Fatalf("Expected server to be ready for chunks, got %+v (%v)", respMsg, err)
+	}
+}
+
+// sendChunkForTest delivers one upload chunk to the handler
+func sendChunkForTest(t *testing.T, handler *CommandHandler, index uint32, totalChunks uint32, data []byte) {
+	t.Helper()
+	payload, err := protocol.SerializeChunkData(&protocol.ChunkDataMessage{
+		Filename:    "ignored",
+		ChunkIndex:  index,
+		TotalChunks: totalChunks,
+		ChunkSize:   uint32(len(data)),
+		Data:        data,
+	})
+	if err != nil {
+		t.Fatalf("Failed to serialize chunk: %v", err)
+	}
+	if err := handler.handleUploadData(payload); err != nil {
+		t.Fatalf("handleUploadData failed: %v", err)
+	}
+}
+
+// assertNoUploadLeftovers checks that neither the target nor a temporary file exists
+func assertNoUploadLeftovers(t *testing.T, handler *CommandHandler, filename string) {
+	t.Helper()
+	clientDir, _ := handler.getClientDir()
+	entries, _ := os.ReadDir(clientDir)
+	for _, entry := range entries {
+		if entry.Name() == filename || strings.HasPrefix(entry.Name(), ".upload-") {
+			t.Errorf("Unexpected file left behind: %s", entry.Name())
+		}
+	}
+}
+
+func TestUploadStream_Chunks(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+	beginUploadForTest(t, cmdHandler, mockConn, "joined.txt", 11)
+
+	sendChunkForTest(t, cmdHandler, 0, 2, []byte("hello "))
+	if len(mockConn.sentMessages) != 1 {
+		t.Fatalf("No response expected before the last chunk, got %d messages", len(mockConn.sentMessages))
+	}
+	sendChunkForTest(t, cmdHandler, 1, 2, []byte("world"))
+
+	respMsg, err := protocol.DeserializeResponse(mockConn.sentMessages[1].Payload)
+	if err != nil || !respMsg.Success || string(respMsg.Data) != "joined.txt" {
+		t.Fatalf("Expected upload success naming the stored file, got %+v (%v)", respMsg, err)
+	}
+
+	clientDir, _ := cmdHandler.getClientDir()
+	content, err := os.ReadFile(filepath.Join(clientDir, "joined.txt"))
+	if err != nil || string(content) != "hello world" {
+		t.Errorf("Uploaded content = %q (%v)", content, err)
+	}
+}
+
+func TestUploadStream_FailuresDiscardPartialFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks [][]byte
+		// indexes defaults to 0..n-1
+		indexes []uint32
+		reason  string
+	}{
+		{name: "out of order", chunks: [][]byte{[]byte("ab"), []byte("cd"), []byte("ef")}, indexes: []uint32{0, 0, 2}, reason: "Unexpected chunk"},
+		{name: "too much data", chunks: [][]byte{[]byte("abcdefgh")}, reason: "exceeds declared size"},
+		{name: "stream cut short", chunks: [][]byte{[]byte("abc"), nil}, reason: "Upload incomplete"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := createTestTempDir(t)
+			defer cleanupTestTempDir(t, tempDir)
+
+			cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+			beginUploadForTest(t, cmdHandler, mockConn, "partial.txt", 6)
+
+			total := uint32(len(tt.chunks))
+			for i, chunk := range tt.chunks {
+				index := uint32(i)
+				if tt.indexes != nil {
+					index = tt.indexes[i]
+				}
+				sendChunkForTest(t, cmdHandler, index, total, chunk)
+			}
+
+			respMsg, err := protocol.DeserializeResponse(mockConn.sentMessages[len(mockConn.sentMessages)-1].Payload)
+			if err != nil || respMsg.Success || !strings.Contains(respMsg.Message, tt.reason) {
+				t.Errorf("Expected failure mentioning %q, got %+v (%v)", tt.reason, respMsg, err)
+			}
+			assertNoUploadLeftovers(t, cmdHandler, "partial.txt")
+		})
+	}
+}
+
+func TestUploadStream_AbortedByDisconnectOrCommand(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+
+	// Connection ends mid-stream
+	beginUploadForTest(t, cmdHandler, mockConn, "dropped.txt", 6)
+	sendChunkForTest(t, cmdHandler, 0, 2, []byte("abc"))
+	cmdHandler.abortUpload()
+	assertNoUploadLeftovers(t, cmdHandler, "dropped.txt")
+
+	// Client moves on to another command
+	beginUploadForTest(t, cmdHandler, mockConn, "abandoned.txt", 6)
+	if err := cmdHandler.handle(&protocol.CommandMessage{Command: protocol.CommandList}); err != nil {
+		t.Fatalf("List after abandoned upload failed: %v", err)
+	}
+	assertNoUploadLeftovers(t, cmdHandler, "abandoned.txt")
+
+	// Stray data with no upload in progress is a protocol error
+	payload, _ := protocol.SerializeChunkData(&protocol.ChunkDataMessage{TotalChunks: 1, Data: []byte("x")})
+	if err := cmdHandler.handleUploadData(payload); err == nil {
+		t.Error("Expected an error for data without an upload in progress")
+	}
+}
+
+func TestUploadStream_ChunkChecksum(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+	cmdHandler.protocolVersion = protocol.ProtocolVersionChunkChecksums
+	beginUploadForTest(t, cmdHandler, mockConn, "corrupt.txt", 5)
+
+	payload, err := protocol.SerializeChunkDataVersion(&protocol.ChunkDataMessage{
+		ChunkIndex:  0,
+		TotalChunks: 1,
+		ChunkSize:   5,
+		Data:        []byte("hello"),
+	}, protocol.ProtocolVersionChunkChecksums)
+	if err != nil {
+		t.Fatalf("Failed to serialize chunk: %v", err)
+	}
+	payload[len(payload)-1] ^= 0xff
+	if err := cmdHandler.handleUploadData(payload); err != nil {
+		t.Fatalf("handleUploadData failed: %v", err)
+	}
+
+	respMsg, err := protocol.DeserializeResponse(mockConn.sentMessages[len(mockConn.sentMessages)-1].Payload)
+	if err != nil || respMsg.Success || respMsg.Message != "Chunk 0 failed checksum verification" {
+		t.Errorf("Expected checksum failure for chunk 0, got %+v (%v)", respMsg, err)
+	}
+	assertNoUploadLeftovers(t, cmdHandler, "corrupt.txt")
+}
+
+func TestUploadStream_UnknownSize(t *testing.T) {
+	// sendSizedChunk delivers a chunk carrying the running TotalSize, as a client of unknown size does
+	sendSizedChunk := func(t *testing.T, handler *CommandHandler, index, totalChunks uint32, totalSize uint64, data []byte) {
+		t.Helper()
+		payload, err := protocol.SerializeChunkData(&protocol.ChunkDataMessage{
+			ChunkIndex:  index,
+			TotalChunks: totalChunks,
+			ChunkSize:   uint32(len(data)),
+			TotalSize:   totalSize,
+			Data:        data,
+		})
+		if err != nil {
+			t.Fatalf("Failed to serialize chunk: %v", err)
+		}
+		if err := handler.handleUploadData(payload); err != nil {
+			t.Fatalf("handleUploadData failed: %v", err)
+		}
+	}
+	begin := func(t *testing.T, handler *CommandHandler, mockConn *MockConnectionHandler, filename string) {
+		t.Helper()
+		mockConn.ClearSentMessages()
+		command := &protocol.CommandMessage{Command: protocol.CommandUploadChunk, Filename: filename}
+		if err := handler.handle(command); err != nil {
+			t.Fatalf("Begin upload failed: %v", err)
+		}
+		if respMsg, _ := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload); !respMsg.Success {
+			t.Fatalf("Expected server to be ready for chunks, got %q", respMsg.Message)
+		}
+	}
+	lastResponse := func(mockConn *MockConnectionHandler) *protocol.ResponseMessage {
+		respMsg, _ := protocol.DeserializeResponse(mockConn.sentMessages[len(mockConn.sentMessages)-1].Payload)
+		return respMsg
+	}
+
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+	cmdHandler.config = &ServerConfig{MaxUploadSize: 8}
+
+	// The size is only known from the last chunk
+	begin(t, cmdHandler, mockConn, "piped.txt")
+	sendSizedChunk(t, cmdHandler, 0, 2, 4, []byte("pipe"))
+	sendSizedChunk(t, cmdHandler, 1, 2, 7, []byte("ful"))
+	if respMsg := lastResponse(mockConn); !respMsg.Success {
+		t.Fatalf("Expected upload of unknown size to succeed, got %q", respMsg.Message)
+	}
+	clientDir, _ := cmdHandler.getClientDir()
+	if content, err := os.ReadFile(filepath.Join(clientDir, "piped.txt")); err != nil || string(content) != "pipeful" {
+		t.Errorf("Expected pipeful, got %q (%v)", content, err)
+	}
+
+	// Limits apply as the data arrives
+	begin(t, cmdHandler, mockConn, "big.txt")
+	sendSizedChunk(t, cmdHandler, 0, 2, 6, []byte("123456"))
+	sendSizedChunk(t, cmdHandler, 1, 2, 12, []byte("789012"))
+	if respMsg := lastResponse(mockConn); respMsg.Success || !strings.HasPrefix(respMsg.Message, "File too large") {
+		t.Errorf("Expected size limit refusal, got success=%v message=%q", respMsg.Success, respMsg.Message)
+	}
+	assertNoUploadLeftovers(t, cmdHandler, "big.txt")
+
+	// A client that gives up says so with the aborted size
+	begin(t, cmdHandler, mockConn, "aborted.txt")
+	sendSizedChunk(t, cmdHandler, 0, 2, 3, []byte("abc"))
+	sendSizedChunk(t, cmdHandler, 1, 2, protocol.UploadAbortedSize, nil)
+	if respMsg := lastResponse(mockConn); respMsg.Success || respMsg.Message != "Upload aborted by client" {
+		t.Errorf("Expected aborted upload, got success=%v message=%q", respMsg.Success, respMsg.Message)
+	}
+	assertNoUploadLeftovers(t, cmdHandler, "aborted.txt")
+
+	// The final size must match what was sent
+	begin(t, cmdHandler, mockConn, "miscounted.txt")
+	sendSizedChunk(t, cmdHandler, 0, 1, 5, []byte("abc"))
+	if respMsg := lastResponse(mockConn); respMsg.Success || !strings.HasPrefix(respMsg.Message, "Upload incomplete") {
+		t.Errorf("Expected incomplete upload, got success=%v message=%q", respMsg.Success, respMsg.Message)
+	}
+	assertNoUploadLeftovers(t, cmdHandler, "miscounted.txt")
+}
+
+func TestUploadStream_NoClobber(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+	clientDir, _ := cmdHandler.getClientDir()
+	noClobber := func(filename string, size uint64) *protocol.ResponseMessage {
+		t.Helper()
+		mockConn.ClearSentMessages()
+		command := &protocol.CommandMessage{
+			Command:  protocol.CommandUploadChunk,
+			Filename: filename,
+			Data:     protocol.SerializeUploadRequest(&protocol.UploadRequest{Size: size}),
+		}
+		if err := cmdHandler.handle(command); err != nil {
+			t.Fatalf("Begin upload failed: %v", err)
+		}
+		respMsg, err := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload)
+		if err != nil {
+			t.Fatalf("Failed to deserialize response: %v", err)
+		}
+		return respMsg
+	}
+
+	// An existing file is refused and left untouched
+	createTestFiles(t, clientDir, []string{"kept.txt"})
+	respMsg := noClobber("kept.txt", 3)
+	if respMsg.Success || respMsg.Message != errFileExists.Error() {
+		t.Fatalf("Expected an existing file to be refused, got %+v", respMsg)
+	}
+	if content, _ := os.ReadFile(filepath.Join(clientDir, "kept.txt")); string(content) != "Test content for kept.txt" {
+		t.Errorf("Existing file changed to %q", content)
+	}
+
+	// A new name is written as usual
+	if respMsg := noClobber("fresh.txt", 3); !respMsg.Success {
+		t.Fatalf("Expected no-clobber upload of a new file to start, got %+v", respMsg)
+	}
+	sendChunkForTest(t, cmdHandler, 0, 1, []byte("new"))
+	respMsg, _ = protocol.DeserializeResponse(mockConn.sentMessages[1].Payload)
+	if !respMsg.Success {
+		t.Fatalf("Expected no-clobber upload to succeed, got %+v", respMsg)
+	}
+	if content, _ := os.ReadFile(filepath.Join(clientDir, "fresh.txt")); string(content) != "new" {
+		t.Errorf("Uploaded content = %q", content)
+	}
+
+	// The name is reserved while chunks arrive and released if the upload fails
+	noClobber("reserved.txt", 6)
+	if _, err := os.Stat(filepath.Join(clientDir, "reserved.txt")); err != nil {
+		t.Errorf("Expected the name to be reserved by the unfinished upload: %v", err)
+	}
+	sendChunkForTest(t, cmdHandler, 0, 2, []byte("abc"))
+	cmdHandler.abortUpload()
+	assertNoUploadLeftovers(t, cmdHandler, "reserved.txt")
+}
+
+func TestUploadStream_ValidateOnly(t *testing.T) {
+	tempDir := createTestTempDir(t)
+	defer cleanupTestTempDir(t, tempDir)
+
+	cmdHandler, mockConn := createTestCommandHandler(t, tempDir)
+	cmdHandler.config = &ServerConfig{DeniedPatterns: []string{"secret*"}, MaxUploadSize: 100}
+	clientDir, _ := cmdHandler.getClientDir()
+	validate := func(filename string, size uint64, overwrite bool) *protocol.ResponseMessage {
+		t.Helper()
+		mockConn.ClearSentMessages()
+		command := &protocol.CommandMessage{
+			Command:  protocol.CommandUploadChunk,
+			Filename: filename,
+			Data: protocol.SerializeUploadRequest(&protocol.UploadRequest{
+				Size: size, Overwrite: overwrite, ValidateOnly: true,
+			}),
+		}
+		if err := cmdHandler.handle(command); err != nil {
+			t.Fatalf("Validate upload failed: %v", err)
+		}
+		respMsg, err := protocol.DeserializeResponse(mockConn.sentMessages[0].Payload)
+		if err != nil {
+			t.Fatalf("Failed to deserialize response: %v", err)
+		}
+		return respMsg
+	}
+
+	// A forbidden name gets the refusal a real upload would, and nothing is created
+	respMsg := validate("secret.txt", 3, true)
+	if respMsg.Success || !strings.HasPrefix(respMsg.Message, errFilenameNotAllowed) {
+		t.Errorf("Expected a denied name to be refused, got %+v", respMsg)
+	}
+	assertNoUploadLeftovers(t, cmdHandler, "secret.txt")
+
+	if respMsg := validate("large.txt", 101, true); respMsg.Success || !strings.HasPrefix(respMsg.Message, "File too large") {
+		t.Errorf("Expected an oversized upload to be refused, got %+v", respMsg)
+	}
+
+	// An acceptable upload is answered with its stored name; no file or reservation appears
+	respMsg = validate("fine.txt", 3, false)
+	if !respMsg.Success || string(respMsg.Data) != "fine.txt" {
+		t.Errorf("Expected validation to succeed, got %+v", respMsg)
+	}
+	assertNoUploadLeftovers(t, cmdHandler, "fine.txt")
+	if cmdHandler.upload != nil {
+		t.Error("Validation should not leave an upload waiting for chunks")
+	}
+
+	createTestFiles(t, clientDir, []string{"kept.txt"})
+	if respMsg := validate("kept.txt", 3, false); respMsg.Success || respMsg.Message != errFileExists.Error() {
+		t.Errorf("Expected no-clobber validation of an existing file to be refused, got %+v", respMsg)
+	}
+	if respMsg := validate("kept.txt", 3, true); !respMsg.Success {
+		t.Errorf("Expected an overwriting upload to validate, got %+v", respMsg)
+	}
+}